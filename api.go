@@ -4,6 +4,7 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -47,6 +48,11 @@ var (
 	// because it's been deposed in the process.
 	ErrLeadershipLost = errors.New("leadership lost while committing log")
 
+	// ErrSnapshotInstallSuperseded is returned by a follower that stops
+	// receiving a snapshot because it's seen a newer term or leader than the
+	// one sending it.
+	ErrSnapshotInstallSuperseded = errors.New("snapshot install superseded by a newer leader")
+
 	// ErrAbortedByRestore is returned when a leader fails to commit a log
 	// entry because it's been superseded by a user snapshot restore.
 	ErrAbortedByRestore = errors.New("snapshot restored while committing log")
@@ -66,6 +72,21 @@ var (
 	// that's not supported by the current protocol version.
 	ErrUnsupportedProtocol = errors.New("operation not supported with current protocol version")
 
+	// ErrUnsupportedLogVersion is returned by a follower when it receives log
+	// entries written with a newer schema than it understands.
+	ErrUnsupportedLogVersion = errors.New("log entry version not supported")
+
+	// ErrJointConsensusUnsupported is returned by ChangeConfiguration when
+	// not every server in the configuration has reported that it supports
+	// joint consensus, such as during a rolling upgrade.
+	ErrJointConsensusUnsupported = errors.New("joint consensus not supported by every server")
+
+	// ErrLogFieldsUnsupported is returned when applying a command that uses
+	// fields, such as a TTL or a schedule, that not every server in the
+	// configuration has reported supporting, such as during a rolling
+	// upgrade.
+	ErrLogFieldsUnsupported = errors.New("log entry fields not supported by every server")
+
 	// ErrCantBootstrap is returned when attempt is made to bootstrap a
 	// cluster that already has state present.
 	ErrCantBootstrap = errors.New("bootstrap only works on new clusters")
@@ -73,6 +94,48 @@ var (
 	// ErrLeadershipTransferInProgress is returned when the leader is rejecting
 	// client requests because it is attempting to transfer leadership.
 	ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
+
+	// ErrLeaseExpired is returned by LeaseRead when the leader hasn't heard
+	// from a quorum recently enough to serve reads without checking in with
+	// them.
+	ErrLeaseExpired = errors.New("leader lease has expired")
+
+	// ErrLeadershipChanged is returned by BarrierAtTerm when this server
+	// isn't the leader for the given term.
+	ErrLeadershipChanged = errors.New("leadership changed since the given term")
+
+	// ErrTermRegression is returned when raft is asked to persist a term lower
+	// than the one it already has, which would indicate corrupted state.
+	ErrTermRegression = errors.New("refusing to persist a lower term")
+
+	// ErrLogCorrupt is matched by the LogCorruptionError returned when a log
+	// entry fails its checksum.
+	ErrLogCorrupt = errors.New("log entry is corrupt")
+
+	// ErrInvariantViolation is the fatal error raised when
+	// Config.CheckInvariants is set and Raft's state breaks one of its
+	// invariants, which indicates a bug.
+	ErrInvariantViolation = errors.New("raft invariant violated")
+
+	// ErrNotEligible is returned when a leadership transfer targets a server
+	// whose Config.CanBecomeLeader returns false.
+	ErrNotEligible = errors.New("node is not eligible to become leader")
+
+	// ErrFSMVersionUnsupported is returned by ApplyVersioned when not every
+	// server's FSM supported the command's version within its timeout.
+	ErrFSMVersionUnsupported = errors.New("FSM version not supported by every server")
+
+	// ErrJoinRefused is returned to a server asking to join the cluster
+	// when the leader won't add it, see Config.AuthorizeJoin.
+	ErrJoinRefused = errors.New("join refused")
+
+	// ErrLeaveRefused is returned when a server asks the leader to remove a
+	// server other than itself.
+	ErrLeaveRefused = errors.New("leave refused")
+
+	// ErrPeerBlocked is returned when communicating with a peer that has been
+	// blocked with BlockPeer.
+	ErrPeerBlocked = errors.New("peer is blocked")
 )
 
 // Raft implements a Raft node.
@@ -98,8 +161,17 @@ type Raft struct {
 	// for any other operation e.g. reading config using config().
 	confReloadMu sync.Mutex
 
-	// FSM is the client state machine to apply commands to
-	fsm FSM
+	// localConf is the configuration before any ClusterParameters are put in
+	// place, and clusterParameters are the ones last put in place. Both are
+	// protected by confReloadMu.
+	localConf         Config
+	clusterParameters *ClusterParameters
+
+	// FSM is the client state machine to apply commands to. It's only
+	// replaced by the FSM goroutine, see SwapFSM, which holds fsmLock to do
+	// so. Other goroutines must hold fsmLock to read it.
+	fsm     FSM
+	fsmLock sync.RWMutex
 
 	// fsmMutateCh is used to send state-changing updates to the FSM. This
 	// receives pointers to commitTuple structures when applying logs or
@@ -121,9 +193,15 @@ type Raft struct {
 	// leaderAddr is the current cluster leader Address
 	leaderAddr ServerAddress
 	// LeaderID is the current cluster leader ID
-	leaderID   ServerID
+	leaderID ServerID
+	// leaderTerm is the term in which the leader was learned
+	leaderTerm uint64
 	leaderLock sync.RWMutex
 
+	// voteLimiter enforces Config.RequestVoteRateLimit. It's only used from
+	// the main thread.
+	voteLimiter voteRateLimiter
+
 	// leaderCh is used to notify of leadership changes
 	leaderCh chan bool
 
@@ -136,6 +214,20 @@ type Raft struct {
 	// on.
 	candidateFromLeadershipTransfer atomic.Bool
 
+	// leadershipTransferTerm is the term this server was in when it was asked
+	// to start an election by a leadership transfer. AppendEntries in this term
+	// are from the leader handing over and must not stop the election.
+	leadershipTransferTerm atomic.Uint64
+
+	// inflatedTerm is the newest term reported by a follower with a stale log
+	// while Config.TermInflationGuard is set, or zero. See
+	// checkTermInflation.
+	inflatedTerm atomic.Uint64
+
+	// termLock serializes setCurrentTerm for StableStores that don't
+	// implement CompareAndSetStableStore.
+	termLock sync.Mutex
+
 	// Stores our local server ID, used to avoid sending RPCs to ourself
 	localID ServerID
 
@@ -155,9 +247,10 @@ type Raft struct {
 	// the log/snapshot.
 	configurations configurations
 
-	// Holds a copy of the latest configuration which can be read independently
-	// of the main loop.
-	latestConfiguration atomic.Value
+	// Holds a copy of the latest and committed configurations, along with
+	// their indexes, which can be read independently of the main loop.
+	latestConfiguration    atomic.Value
+	committedConfiguration atomic.Value
 
 	// RPC chan comes from the transport layer
 	rpcCh <-chan RPC
@@ -205,6 +298,31 @@ type Raft struct {
 	// the main thread.
 	leadershipTransferCh chan *leadershipTransferFuture
 
+	// replicationReportCh is used to build a ReplicationReport from outside of
+	// the main thread.
+	replicationReportCh chan *replicationReportFuture
+
+	// expiries tracks the applied entries with a TTL that haven't expired
+	// yet.
+	expiries *expiryTracker
+
+	// schedules tracks the committed LogSchedule entries whose command
+	// hasn't been committed yet.
+	schedules *scheduleTracker
+
+	// commitNotifyCh is closed, under commitNotifyLock, to wake the commit
+	// watchers when the commit index advances.
+	commitNotifyLock sync.Mutex
+	commitNotifyCh   chan struct{}
+
+	// elections counts the elections since this server was last a follower
+	// or leader, for Backoff. It's only used from the main thread.
+	elections uint64
+
+	// readIndexCh is used to get a read index from outside of the main
+	// thread.
+	readIndexCh chan *readIndexFuture
+
 	// leaderNotifyCh is used to tell leader that config has changed
 	leaderNotifyCh chan struct{}
 
@@ -213,6 +331,46 @@ type Raft struct {
 
 	// mainThreadSaturation measures the saturation of the main raft goroutine.
 	mainThreadSaturation *saturationMetric
+
+	// storeProbeInFlight is set while Live is checking the stores, so that
+	// probes against a hung store don't pile up.
+	storeProbeInFlight atomic.Bool
+
+	// applyWaiting counts the callers blocked handing a future to applyCh,
+	// which is part of the depth of the apply queue.
+	applyWaiting atomic.Int64
+
+	// configChanges holds the membership changes in progress, so identical
+	// requests can be coalesced. It's protected by configChangeLock.
+	configChangeLock sync.Mutex
+	configChanges    map[configChangeKey]*configurationChangeFuture
+
+	// draining is set by ShutdownGracefully to refuse new commands while the
+	// ones already submitted are finished.
+	draining atomic.Bool
+
+	// blockedPeers maps the peers blocked by BlockPeer to when their block
+	// expires. It's protected by blockedPeersLock.
+	blockedPeersLock sync.RWMutex
+	blockedPeers     map[ServerAddress]time.Time
+
+	// commitLatency collects commit latencies for the commit latency
+	// watchdog, if Config.CommitLatencySLO is set.
+	commitLatency *commitLatencyTracker
+
+	// snapshotIO runs the I/O of persisting snapshots, if configured.
+	snapshotIO *snapshotIOPool
+
+	// checkInvariants is set from Config.CheckInvariants, which can't be
+	// reloaded.
+	checkInvariants bool
+
+	// recorder is set from Config.Recorder, which can't be reloaded.
+	recorder *Recorder
+
+	// snapshotOutage tracks failures of the snapshot store. It's only used
+	// from the snapshot goroutine.
+	snapshotOutage snapshotOutage
 }
 
 // BootstrapCluster initializes a server's storage with the given cluster
@@ -254,17 +412,7 @@ func BootstrapCluster(conf *Config, logs LogStore, stable StableStore,
 	}
 
 	// Append configuration entry to log.
-	entry := &Log{
-		Index: 1,
-		Term:  1,
-	}
-	if conf.ProtocolVersion < 3 {
-		entry.Type = LogRemovePeerDeprecated
-		entry.Data = encodePeers(configuration, trans)
-	} else {
-		entry.Type = LogConfiguration
-		entry.Data = EncodeConfiguration(configuration)
-	}
+	entry := newConfigurationEntry(conf.ProtocolVersion, 1, 1, configuration, trans)
 	if err := logs.StoreLog(entry); err != nil {
 		return fmt.Errorf("failed to append configuration entry to log: %v", err)
 	}
@@ -335,6 +483,11 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 
 	logger := conf.getOrCreateLogger()
 
+	// Entries with a TTL that hadn't expired, and schedules that hadn't been
+	// reached, are carried over into the new snapshot, so they still take
+	// effect once the cluster is back.
+	expiries := newExpiryTracker()
+	schedules := newScheduleTracker()
 	for _, snapshot := range snapshots {
 		var source io.ReadCloser
 		_, source, err = snaps.Open(snapshot.ID)
@@ -356,7 +509,14 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 			"last-term", snapshot.Term,
 			"size-in-bytes", snapshot.Size,
 		)
-		crc := newCountingReadCloser(source)
+		var state snapshotState
+		var rest io.ReadCloser
+		state, rest, err = readSnapshotState(source, snapshot.Version)
+		if err != nil {
+			source.Close()
+			continue
+		}
+		crc := newCountingReadCloser(rest)
 		monitor := startSnapshotRestoreMonitor(snapLogger, crc, snapshot.Size, false)
 		err = fsm.Restore(crc)
 		// Close the source after the restore has completed
@@ -366,6 +526,8 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 			// Same here, skip and try the next one.
 			continue
 		}
+		expiries.restore(state.Expiries)
+		schedules.restore(state.Schedules)
 
 		snapshotIndex = snapshot.Index
 		snapshotTerm = snapshot.Term
@@ -390,8 +552,16 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 		if err = logs.GetLog(index, &entry); err != nil {
 			return fmt.Errorf("failed to get log at index %d: %v", index, err)
 		}
-		if entry.Type == LogCommand {
+		switch entry.Type {
+		case LogCommand:
 			_ = fsm.Apply(&entry)
+			expiries.track(&entry)
+		case LogExpiry:
+			_ = applyExpiry(fsm, &entry)
+			expiries.track(&entry)
+		}
+		if err = schedules.track(&entry); err != nil {
+			return err
 		}
 		lastIndex = entry.Index
 		lastTerm = entry.Term
@@ -403,7 +573,11 @@ func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
 	if err != nil {
 		return fmt.Errorf("failed to snapshot FSM: %v", err)
 	}
-	version := getSnapshotVersion(conf.ProtocolVersion)
+	snapshot = withSnapshotState(snapshot, snapshotState{
+		Expiries:  expiries.snapshot(),
+		Schedules: schedules.snapshot(),
+	})
+	version := snapshotVersion(conf.ProtocolVersion, snapshot)
 	sink, err := snaps.Create(version, lastIndex, lastTerm, configuration, 1, trans)
 	if err != nil {
 		return fmt.Errorf("failed to create snapshot: %v", err)
@@ -455,7 +629,7 @@ func HasExistingState(logs LogStore, stable StableStore, snaps SnapshotStore) (b
 			return true, nil
 		}
 	} else {
-		if err.Error() != "not found" {
+		if !isKeyNotFound(err) {
 			return false, fmt.Errorf("failed to read current term: %v", err)
 		}
 	}
@@ -494,9 +668,18 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 	// Ensure we have a LogOutput.
 	logger := conf.getOrCreateLogger()
 
+	// Record the state we start from before anything changes it.
+	if conf.Recorder != nil {
+		if err := conf.Recorder.recordStart(conf.LocalID, trans.LocalAddr(), logs, stable, snaps); err != nil {
+			return nil, fmt.Errorf("failed to start recording: %v", err)
+		}
+		logs = conf.Recorder.wrapLogStore(logs)
+		stable = conf.Recorder.wrapStableStore(stable)
+	}
+
 	// Try to restore the current term.
 	currentTerm, err := stable.GetUint64(keyCurrentTerm)
-	if err != nil && err.Error() != "not found" {
+	if err != nil && !isKeyNotFound(err) {
 		return nil, fmt.Errorf("failed to load current term: %v", err)
 	}
 
@@ -537,6 +720,8 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 		applyCh:               applyCh,
 		fsm:                   fsm,
 		fsmMutateCh:           make(chan interface{}, 128),
+		expiries:              newExpiryTracker(),
+		schedules:             newScheduleTracker(),
 		fsmSnapshotCh:         make(chan *reqSnapshotFuture),
 		leaderCh:              make(chan bool, 1),
 		localID:               localID,
@@ -557,18 +742,27 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 		bootstrapCh:           make(chan *bootstrapFuture),
 		observers:             make(map[uint64]*Observer),
 		leadershipTransferCh:  make(chan *leadershipTransferFuture, 1),
+		replicationReportCh:   make(chan *replicationReportFuture),
+		readIndexCh:           make(chan *readIndexFuture),
 		leaderNotifyCh:        make(chan struct{}, 1),
 		followerNotifyCh:      make(chan struct{}, 1),
 		mainThreadSaturation:  newSaturationMetric([]string{"raft", "thread", "main", "saturation"}, 1*time.Second),
+		checkInvariants:       conf.CheckInvariants,
+		recorder:              conf.Recorder,
+	}
+	if conf.CommitLatencySLO > 0 {
+		r.commitLatency = &commitLatencyTracker{}
 	}
 
 	r.conf.Store(*conf)
+	r.localConf = *conf
 
 	// Initialize as a follower.
 	r.setState(Follower)
 
-	// Restore the current term and the last log.
-	r.setCurrentTerm(currentTerm)
+	// Restore the current term and the last log. The term was just read from
+	// the stable store so there's no need to write it back.
+	r.raftState.setCurrentTerm(currentTerm)
 	r.setLastLog(lastLog.Index, lastLog.Term)
 
 	// Attempt to restore a snapshot if there are any.
@@ -588,6 +782,12 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 			return nil, err
 		}
 	}
+	// Read the configuration from a legacy peer store if there isn't one yet.
+	if r.configurations.latestIndex == 0 && conf.PeerStore != nil {
+		if err := r.loadPeerStore(conf.PeerStore); err != nil {
+			return nil, err
+		}
+	}
 	r.logger.Info("initial configuration",
 		"index", r.configurations.latestIndex,
 		"servers", hclog.Fmt("%+v", r.configurations.latest.Servers))
@@ -604,6 +804,20 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 	r.goFunc(r.run)
 	r.goFunc(r.runFSM)
 	r.goFunc(r.runSnapshots)
+	if r.snapshotIO = newSnapshotIOPool(conf, r.shutdownCh, r.logger); r.snapshotIO != nil {
+		for i := 0; i < r.snapshotIO.workers(conf); i++ {
+			r.goFunc(r.snapshotIO.run)
+		}
+	}
+	if conf.QueueSaturationPeriod > 0 {
+		r.goFunc(r.runQueueMonitor)
+	}
+	if conf.CommitLatencySLO > 0 {
+		r.goFunc(r.runCommitLatencyWatchdog)
+	}
+	if len(conf.RetryJoin) > 0 {
+		r.goFunc(r.runRetryJoin)
+	}
 	return r, nil
 }
 
@@ -623,12 +837,12 @@ func (r *Raft) restoreSnapshot() error {
 			continue
 		}
 
-		// Update the lastApplied so we don't replay old logs
-		r.setLastApplied(snapshot.Index)
-
 		// Update the last stable snapshot info
 		r.setLastSnapshot(snapshot.Index, snapshot.Term)
 
+		// Update the lastApplied so we don't replay old logs
+		r.setLastApplied(snapshot.Index)
+
 		// Update the configuration
 		var conf Configuration
 		var index uint64
@@ -637,13 +851,13 @@ func (r *Raft) restoreSnapshot() error {
 			index = snapshot.ConfigurationIndex
 		} else {
 			var err error
-			if conf, err = decodePeers(snapshot.Peers, r.trans); err != nil {
+			if conf, err = r.peerCodec().DecodePeers(snapshot.Peers, r.trans); err != nil {
 				return err
 			}
 			index = snapshot.Index
 		}
-		r.setCommittedConfiguration(conf, index)
 		r.setLatestConfiguration(conf, index)
+		r.setCommittedConfiguration(conf, index)
 
 		// Success!
 		return nil
@@ -676,7 +890,7 @@ func (r *Raft) tryRestoreSingleSnapshot(snapshot *SnapshotMeta) bool {
 		return false
 	}
 
-	if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, snapshot.Size); err != nil {
+	if err := r.restoreFSM(snapLogger, source, snapshot); err != nil {
 		source.Close()
 		snapLogger.Error("failed to restore snapshot", "error", err)
 		return false
@@ -704,13 +918,15 @@ func (r *Raft) ReloadConfig(rc ReloadableConfig) error {
 	// between this read and a later Store).
 	oldCfg := r.config()
 
-	// Set the reloadable fields
-	newCfg := rc.apply(oldCfg)
+	// Set the reloadable fields, keeping any cluster parameters in place
+	localCfg := rc.apply(r.localConf)
+	newCfg := r.clusterParameters.apply(localCfg)
 
 	if err := ValidateConfig(&newCfg); err != nil {
 		return err
 	}
 	r.conf.Store(newCfg)
+	r.localConf = localCfg
 
 	if rc.HeartbeatTimeout < oldCfg.HeartbeatTimeout {
 		// On leader, ensure replication loops running with a longer
@@ -727,9 +943,12 @@ func (r *Raft) ReloadConfig(rc ReloadableConfig) error {
 // reporting to users or tests. It is safe to call from any goroutine. It is
 // intended for reporting and testing purposes primarily; external
 // synchronization would be required to safely use this in a read-modify-write
-// pattern for reloadable configuration options.
+// pattern for reloadable configuration options. It reports this server's own
+// settings, which may be overridden by ClusterParameters.
 func (r *Raft) ReloadableConfig() ReloadableConfig {
-	cfg := r.config()
+	r.confReloadMu.Lock()
+	cfg := r.localConf
+	r.confReloadMu.Unlock()
 	var rc ReloadableConfig
 	rc.fromConfig(cfg)
 	return rc
@@ -783,6 +1002,27 @@ func (r *Raft) LeaderWithID() (ServerAddress, ServerID) {
 	return leaderAddr, leaderID
 }
 
+// LeaderWithTerm is like LeaderWithID but also returns the term in which the
+// leader was learned, from its AppendEntries or InstallSnapshot RPCs, so
+// clients caching the leader can tell which of two hints is newer. A leader
+// learned in an earlier term than this server's current term may have been
+// deposed, so it isn't returned: empty strings and the current term are
+// returned instead, as they are when no leader is known. The leader is also
+// forgotten when a follower loses contact with it.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) LeaderWithTerm() (ServerAddress, ServerID, uint64) {
+	r.leaderLock.RLock()
+	leaderAddr := r.leaderAddr
+	leaderID := r.leaderID
+	leaderTerm := r.leaderTerm
+	r.leaderLock.RUnlock()
+	if term := r.getCurrentTerm(); leaderAddr == "" || leaderTerm != term {
+		return "", "", term
+	}
+	return leaderAddr, leaderID, leaderTerm
+}
+
 // Apply is used to apply a command to the FSM in a highly consistent
 // manner. This returns a future that can be used to wait on the application.
 // An optional timeout can be provided to limit the amount of time we wait
@@ -802,11 +1042,85 @@ func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
 	return r.ApplyLog(Log{Data: cmd}, timeout)
 }
 
+// ApplyCtx is like Apply but takes a context in place of the timeout, so the
+// caller can cancel the command or give it a deadline. The context limits how
+// long the command waits to be enqueued, as Apply's timeout does. A command
+// that is cancelled while it's still queued on the leader is dropped rather
+// than appended to the log. Once appended it can't be withdrawn, but the
+// future's Error returns the context's error as soon as the context is done,
+// even though the command may still be committed and applied.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) ApplyCtx(ctx context.Context, cmd []byte) ApplyFuture {
+	metrics.IncrCounter([]string{"raft", "apply"}, 1)
+	// Raised before draining is checked, as in applyLog.
+	r.applyWaiting.Add(1)
+	defer r.applyWaiting.Add(-1)
+	if r.draining.Load() {
+		return errorFuture{ErrRaftShutdown}
+	}
+
+	// Create a log future, no index or term yet
+	logFuture := &logFuture{
+		log: Log{
+			Type: LogCommand,
+			Data: cmd,
+		},
+		enqueue: time.Now(),
+	}
+	logFuture.init()
+	logFuture.ctx = ctx
+
+	if err := ctx.Err(); err != nil {
+		return errorFuture{err}
+	}
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.applyCh <- logFuture:
+		return logFuture
+	}
+}
+
 // ApplyLog performs Apply but takes in a Log directly. The only values
-// currently taken from the submitted Log are Data and Extensions. See
-// Apply for details on error cases.
+// currently taken from the submitted Log are Data, Extensions and TTL. See
+// Apply for details on error cases. A TTL fails with ErrLogFieldsUnsupported
+// until every server in the configuration supports it.
 func (r *Raft) ApplyLog(log Log, timeout time.Duration) ApplyFuture {
+	return r.applyLog(log, 0, timeout)
+}
+
+// ApplyVersioned is like Apply for a command in a format that only FSMs
+// whose VersionedFSM.FSMVersion is at least version understand. The leader
+// holds the command until every server that applies commands, which is every
+// server but witnesses, has reported supporting that version, so that during
+// a rolling upgrade a command in a new format isn't committed until every
+// server that will apply it has been upgraded. Servers report their version
+// in reply to replication, so a newly elected leader holds versioned commands
+// until it has heard from them. Held commands are appended once they're
+// supported, after any commands submitted in the meantime. The timeout also
+// limits how long the command is held, after which it fails with
+// ErrFSMVersionUnsupported. A timeout of zero holds it until it's supported
+// or leadership is lost.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) ApplyVersioned(cmd []byte, version uint64, timeout time.Duration) ApplyFuture {
+	return r.applyLog(Log{Data: cmd}, version, timeout)
+}
+
+// applyLog hands a command to the leader, along with the FSM version it
+// requires, or zero if it doesn't require one.
+func (r *Raft) applyLog(log Log, fsmVersion uint64, timeout time.Duration) ApplyFuture {
 	metrics.IncrCounter([]string{"raft", "apply"}, 1)
+	// applyWaiting is raised before draining is checked, so that either
+	// ShutdownGracefully waits for this call or this call sees it's draining.
+	r.applyWaiting.Add(1)
+	defer r.applyWaiting.Add(-1)
+	if r.draining.Load() {
+		return errorFuture{ErrRaftShutdown}
+	}
 
 	var timer <-chan time.Time
 	if timeout > 0 {
@@ -819,7 +1133,13 @@ func (r *Raft) ApplyLog(log Log, timeout time.Duration) ApplyFuture {
 			Type:       LogCommand,
 			Data:       log.Data,
 			Extensions: log.Extensions,
+			TTL:        log.TTL,
 		},
+		enqueue:    time.Now(),
+		fsmVersion: fsmVersion,
+	}
+	if fsmVersion != 0 && timeout > 0 {
+		logFuture.holdUntil = logFuture.enqueue.Add(timeout)
 	}
 	logFuture.init()
 
@@ -846,9 +1166,43 @@ func (r *Raft) Barrier(timeout time.Duration) Future {
 	}
 
 	// Create a log future, no index or term yet
-	logFuture := &logFuture{log: Log{Type: LogBarrier}}
+	logFuture := &logFuture{log: Log{Type: LogBarrier}, enqueue: time.Now()}
 	logFuture.init()
 
+	r.applyWaiting.Add(1)
+	defer r.applyWaiting.Add(-1)
+	select {
+	case <-timer:
+		return errorFuture{ErrEnqueueTimeout}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.applyCh <- logFuture:
+		return logFuture
+	}
+}
+
+// BarrierAtTerm is like Barrier, but fails with ErrLeadershipChanged unless
+// this server has been the leader since the given term, for example as
+// returned by LeaderWithTerm when it became leader. A server is only ever
+// leader once in each term, so a caller that chains work across several
+// calls can use this to detect that leadership was lost and regained in
+// between, rather than carrying on as if nothing happened. If leadership is
+// lost before the barrier commits, it fails with ErrLeadershipLost as usual.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) BarrierAtTerm(term uint64, timeout time.Duration) Future {
+	metrics.IncrCounter([]string{"raft", "barrier"}, 1)
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	// Create a log future, no index yet
+	logFuture := &logFuture{log: Log{Type: LogBarrier}, enqueue: time.Now(), term: term}
+	logFuture.init()
+
+	r.applyWaiting.Add(1)
+	defer r.applyWaiting.Add(-1)
 	select {
 	case <-timer:
 		return errorFuture{ErrEnqueueTimeout}
@@ -879,11 +1233,23 @@ func (r *Raft) VerifyLeader() Future {
 func (r *Raft) GetConfiguration() ConfigurationFuture {
 	configReq := &configurationsFuture{}
 	configReq.init()
-	configReq.configurations = configurations{latest: r.getLatestConfiguration()}
+	configReq.configurations.latest, configReq.configurations.latestIndex = r.getLatestConfigurationWithIndex()
 	configReq.respond(nil)
 	return configReq
 }
 
+// LastConfiguration returns the latest configuration and its index, like
+// GetConfiguration, but without allocating a future. It reads an immutable copy
+// that the main loop swaps in atomically whenever the configuration changes, so
+// it's cheap enough to call on every request, for example when routing. The
+// returned Configuration is shared and must not be modified; use Clone first if
+// needed.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) LastConfiguration() (Configuration, uint64) {
+	return r.getLatestConfigurationWithIndex()
+}
+
 // AddPeer to the cluster configuration. Must be run on the leader, or it will fail.
 //
 // Deprecated: Use AddVoter/AddNonvoter instead.
@@ -956,6 +1322,26 @@ func (r *Raft) AddNonvoter(id ServerID, address ServerAddress, prevIndex uint64,
 	}, timeout)
 }
 
+// AddWitness will add the given server to the cluster as a witness. A witness
+// votes in elections and counts towards the commit quorum, but never stands for
+// election and is only sent log entry headers, which keeps its bandwidth and
+// storage needs minimal. This must be run on the leader or it will fail. For
+// prevIndex and timeout, see AddVoter.
+//
+// Experimental: witness support may change in a future minor release.
+func (r *Raft) AddWitness(id ServerID, address ServerAddress, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChange(configurationChangeRequest{
+		command:       AddWitness,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, timeout)
+}
+
 // RemoveServer will remove the given server from the cluster. If the current
 // leader is being removed, it will cause a new election to occur. This must be
 // run on the leader or it will fail. For prevIndex and timeout, see AddVoter.
@@ -988,6 +1374,33 @@ func (r *Raft) DemoteVoter(id ServerID, prevIndex uint64, timeout time.Duration)
 	}, timeout)
 }
 
+// ChangeConfiguration replaces the cluster's servers with the given ones in a
+// single step, so any number of servers can be added, removed or have their
+// suffrage changed at once. It uses joint consensus: the leader first commits
+// a configuration holding both the old and new servers, during which
+// elections and commitment need a majority of each, and then commits the new
+// servers on their own. The returned future completes once the joint
+// configuration is committed, after which the change can no longer be rolled
+// back. This must be run on the leader or it will fail. For prevIndex and
+// timeout, see AddVoter.
+//
+// Every server in the configuration must support joint consensus, or the
+// change fails with ErrJointConsensusUnsupported. A server that's just been
+// elected leader only knows this once it has heard from each server.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) ChangeConfiguration(servers []Server, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestConfigChange(configurationChangeRequest{
+		command:   enterJoint,
+		servers:   servers,
+		prevIndex: prevIndex,
+	}, timeout)
+}
+
 // Shutdown is used to stop the Raft background routines.
 // This is not a graceful operation. Provides a future that
 // can be used to block until all background routines have exited.
@@ -1006,12 +1419,80 @@ func (r *Raft) Shutdown() Future {
 	return &shutdownFuture{nil}
 }
 
+// ShutdownGracefully is like Shutdown, but first finishes the commands that
+// have already been submitted. New calls to Apply and its variants fail with
+// ErrRaftShutdown straight away, then, on the leader, it waits for the
+// commands already submitted to be committed and applied to the FSM, and on
+// other servers for the FSM to apply what has been committed, before
+// shutting down. If that takes longer than timeout, or leadership is lost,
+// it shuts down anyway. The returned future's Error waits until Raft has
+// shut down, and returns nil if everything was finished, or else why it
+// wasn't. A timeout of zero waits indefinitely.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) ShutdownGracefully(timeout time.Duration) Future {
+	r.draining.Store(true)
+	future := &deferError{}
+	future.init()
+	go func() {
+		err := r.drain(timeout)
+		r.Shutdown().Error()
+		future.respond(err)
+	}()
+	return future
+}
+
+// drain waits for the commands that have been submitted to be applied to the
+// FSM, giving up with ErrEnqueueTimeout after timeout, if it's nonzero.
+func (r *Raft) drain(timeout time.Duration) error {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	// Callers that were already handing commands over when draining started
+	// are let through, so that they're queued ahead of the barrier below.
+	for r.applyWaiting.Load() > 0 {
+		select {
+		case <-timer:
+			return ErrEnqueueTimeout
+		case <-r.shutdownCh:
+			return ErrRaftShutdown
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if r.State() != Leader {
+		return r.waitForFSM(timer)
+	}
+	// A barrier is applied after everything ahead of it in the queue and
+	// the log.
+	future := &logFuture{log: Log{Type: LogBarrier}, enqueue: time.Now()}
+	future.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case r.applyCh <- future:
+	}
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case err := <-future.errCh:
+		return err
+	}
+}
+
 // Snapshot is used to manually force Raft to take a snapshot. Returns a future
 // that can be used to block until complete, and that contains a function that
 // can be used to open the snapshot.
 func (r *Raft) Snapshot() SnapshotFuture {
 	future := &userSnapshotFuture{}
 	future.init()
+	r.newAuditor(AuditEvent{Operation: "Snapshot"}).watch(&future.deferError, nil)
 	select {
 	case r.userSnapshotCh <- future:
 		return future
@@ -1035,8 +1516,10 @@ func (r *Raft) Snapshot() SnapshotFuture {
 // install snapshot process. This involves a potentially dangerous period where
 // the leader commits ahead of its followers, so should only be used for disaster
 // recovery into a fresh cluster, and should not be used in normal operations.
-func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Duration) error {
+func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Duration) (err error) {
 	metrics.IncrCounter([]string{"raft", "restore"}, 1)
+	audit := r.newAuditor(AuditEvent{Operation: "Restore"})
+	defer func() { audit.record(err, 0) }()
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
@@ -1070,12 +1553,16 @@ func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Durati
 		},
 	}
 	noop.init()
+	r.applyWaiting.Add(1)
 	select {
 	case <-timer:
+		r.applyWaiting.Add(-1)
 		return ErrEnqueueTimeout
 	case <-r.shutdownCh:
+		r.applyWaiting.Add(-1)
 		return ErrRaftShutdown
 	case r.applyCh <- noop:
+		r.applyWaiting.Add(-1)
 		return noop.Error()
 	}
 }
@@ -1105,6 +1592,29 @@ func (r *Raft) String() string {
 	return fmt.Sprintf("Node at %s [%v]", r.localAddr, r.getState())
 }
 
+// VoteRecord describes the last vote cast by this server.
+type VoteRecord struct {
+	// Term is the term the vote was cast in.
+	Term uint64
+	// CandidateID is the ID of the server voted for. It is empty for votes
+	// cast by older versions of this library.
+	CandidateID ServerID
+	// CandidateAddress is the address of the server voted for.
+	CandidateAddress ServerAddress
+	// Time is when the vote was cast. It is zero for votes cast by older
+	// versions of this library.
+	Time time.Time
+}
+
+// LastVote returns the last vote this server cast, as persisted in the
+// StableStore, or a zero VoteRecord if it has never voted.
+//
+// Experimental: the contents of VoteRecord may change in a future minor
+// release.
+func (r *Raft) LastVote() (VoteRecord, error) {
+	return r.lastVote()
+}
+
 // LastContact returns the time of last contact by a leader.
 // This only makes sense if we are currently a follower.
 func (r *Raft) LastContact() time.Time {
@@ -1114,13 +1624,70 @@ func (r *Raft) LastContact() time.Time {
 	return last
 }
 
+// Status is a summary of a server's state intended for health checks, for
+// example so a load balancer can route client traffic to the leader or to
+// followers that are up to date. It is returned by Raft.Status and by the
+// Status RPC.
+type Status struct {
+	State RaftState
+
+	// LeaderAddr and LeaderID identify the leader this server knows of, and
+	// are empty if there is none.
+	LeaderAddr ServerAddress
+	LeaderID   ServerID
+
+	Term uint64
+
+	// LastContact is how long ago this server last heard from the leader. It
+	// is zero on the leader itself, and on a server that has never heard from
+	// a leader.
+	LastContact time.Duration
+
+	// AppliedIndex is the last index applied to the FSM.
+	AppliedIndex uint64
+}
+
+// IsFresh returns true if the server is the leader, or is a follower that
+// knows of a leader and heard from it within maxLastContact.
+func (s Status) IsFresh(maxLastContact time.Duration) bool {
+	switch s.State {
+	case Leader:
+		return true
+	case Follower:
+		return s.LeaderID != "" && s.LastContact <= maxLastContact
+	}
+	return false
+}
+
+// Status returns a summary of this server's state for health checks. It
+// doesn't need the main thread, so it is cheap to call frequently and still
+// answers while the server is busy.
+//
+// Experimental: see docs/api_stability.md.
+func (r *Raft) Status() Status {
+	leaderAddr, leaderID := r.LeaderWithID()
+	s := Status{
+		State:        r.getState(),
+		LeaderAddr:   leaderAddr,
+		LeaderID:     leaderID,
+		Term:         r.getCurrentTerm(),
+		AppliedIndex: r.getLastApplied(),
+	}
+	if last := r.LastContact(); s.State != Leader && !last.IsZero() {
+		s.LastContact = time.Since(last)
+	}
+	return s
+}
+
 // Stats is used to return a map of various internal stats. This
 // should only be used for informative purposes or debugging.
 //
 // Keys are: "state", "term", "last_log_index", "last_log_term",
 // "commit_index", "applied_index", "fsm_pending",
 // "last_snapshot_index", "last_snapshot_term",
-// "latest_configuration", "last_contact", and "num_peers".
+// "latest_configuration", "latest_configuration_index",
+// "committed_configuration", "committed_configuration_index",
+// "last_contact", and "num_peers".
 //
 // The value of "state" is a numeric constant representing one of
 // the possible leadership states the node is in at any given time.
@@ -1128,6 +1695,9 @@ func (r *Raft) LastContact() time.Time {
 //
 // The value of "latest_configuration" is a string which contains
 // the id of each server, its suffrage status, and its address.
+// "committed_configuration" is formatted the same way and is the most recent
+// configuration known to be committed, which lags the latest configuration
+// while a membership change is in flight.
 //
 // The value of "last_contact" is either "never" if there
 // has been no contact with a leader, "0" if the node is in the
@@ -1169,6 +1739,9 @@ func (r *Raft) Stats() map[string]string {
 		configuration := future.Configuration()
 		s["latest_configuration_index"] = toString(future.Index())
 		s["latest_configuration"] = fmt.Sprintf("%+v", configuration.Servers)
+		committed, committedIndex := r.getCommittedConfigurationWithIndex()
+		s["committed_configuration_index"] = toString(committedIndex)
+		s["committed_configuration"] = fmt.Sprintf("%+v", committed.Servers)
 
 		// This is a legacy metric that we've seen people use in the wild.
 		hasUs := false
@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import "time"
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// AuditSink receives a record of each administrative operation invoked on a
+// server, giving an audit trail of changes to the cluster. Set it with
+// Config.AuditSink.
+type AuditSink interface {
+	// Audit is called once for each operation, when it completes. It's called
+	// from Raft's own goroutines, including the main one, so it must not
+	// block and must be safe for concurrent use.
+	Audit(event AuditEvent)
+}
+
+// AuditEvent records an administrative operation.
+type AuditEvent struct {
+	// Operation is the operation invoked: AddVoter, AddNonvoter, AddWitness,
+	// DemoteVoter, RemoveServer, ChangeConfiguration, LeadershipTransfer,
+	// Snapshot or Restore. AddPeer and RemovePeer are recorded as AddVoter
+	// and RemoveServer.
+	Operation string
+
+	// Server is the ID of the server the operation was invoked on.
+	Server ServerID
+
+	// Requester is the ID of the server that asked for the operation over
+	// RPC, such as a server joining or leaving the cluster, or empty if it
+	// was invoked through this server's API.
+	Requester ServerID
+
+	// Target and TargetAddress identify the server the operation acts on, if
+	// any.
+	Target        ServerID
+	TargetAddress ServerAddress
+
+	// Time is when the operation was invoked, and Duration how long it took
+	// to complete.
+	Time     time.Time
+	Duration time.Duration
+
+	// Index is the index of the log entry holding a configuration change, if
+	// one was appended.
+	Index uint64
+
+	// Error is what the operation failed with, or nil if it succeeded.
+	Error error
+}
+
+// auditor records a single operation with the AuditSink. A nil auditor,
+// returned when there's no sink, records nothing.
+type auditor struct {
+	sink  AuditSink
+	event AuditEvent
+}
+
+// newAuditor starts recording event, which should have its operation and
+// target filled in.
+func (r *Raft) newAuditor(event AuditEvent) *auditor {
+	sink := r.config().AuditSink
+	if sink == nil {
+		return nil
+	}
+	event.Server = r.localID
+	event.Time = time.Now()
+	return &auditor{sink: sink, event: event}
+}
+
+// record sends the operation's outcome to the sink.
+func (a *auditor) record(err error, index uint64) {
+	if a == nil {
+		return
+	}
+	event := a.event
+	event.Duration = time.Since(event.Time)
+	event.Error = err
+	event.Index = index
+	a.sink.Audit(event)
+}
+
+// watch records the operation once d is responded to. If index isn't nil it
+// gives the log index to record.
+func (a *auditor) watch(d *deferError, index func() uint64) {
+	if a == nil {
+		return
+	}
+	d.onRespond = func(err error) {
+		var idx uint64
+		if index != nil {
+			idx = index()
+		}
+		a.record(err, idx)
+	}
+}
+
+// auditOperation returns the name recorded for a configuration change.
+func auditOperation(command ConfigurationChangeCommand) string {
+	if command == enterJoint {
+		return "ChangeConfiguration"
+	}
+	return command.String()
+}
@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingAuditSink keeps the events it's sent.
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *recordingAuditSink) Audit(event AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// last returns the latest event, after checking there's been one since
+// previously calling it.
+func (s *recordingAuditSink) last(t *testing.T, seen *int) AuditEvent {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Greater(t, len(s.events), *seen)
+	*seen = len(s.events)
+	return s.events[len(s.events)-1]
+}
+
+func TestRaft_AuditSink(t *testing.T) {
+	sink := &recordingAuditSink{}
+	conf := inmemConfig(t)
+	conf.AuditSink = sink
+	c := MakeCluster(4, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	var seen int
+
+	// A configuration change records its outcome and log index.
+	follower := c.Followers()[0]
+	future := leader.DemoteVoter(follower.localID, 0, 0)
+	require.NoError(t, future.Error())
+	event := sink.last(t, &seen)
+	require.Equal(t, "DemoteVoter", event.Operation)
+	require.Equal(t, leader.localID, event.Server)
+	require.Empty(t, event.Requester)
+	require.Equal(t, follower.localID, event.Target)
+	require.Equal(t, future.Index(), event.Index)
+	require.NoError(t, event.Error)
+	require.False(t, event.Time.IsZero())
+
+	// So does a failed one.
+	other := c.Followers()[1]
+	require.ErrorIs(t, other.RemoveServer(leader.localID, 0, 0).Error(), ErrNotLeader)
+	event = sink.last(t, &seen)
+	require.Equal(t, "RemoveServer", event.Operation)
+	require.Equal(t, other.localID, event.Server)
+	require.ErrorIs(t, event.Error, ErrNotLeader)
+
+	// A server leaving is recorded as the requester of its removal.
+	require.NoError(t, follower.Leave(c.propagateTimeout))
+	event = sink.last(t, &seen)
+	require.Equal(t, "RemoveServer", event.Operation)
+	require.Equal(t, leader.localID, event.Server)
+	require.Equal(t, follower.localID, event.Requester)
+
+	// Snapshots and restores.
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	snap := leader.Snapshot()
+	require.NoError(t, snap.Error())
+	event = sink.last(t, &seen)
+	require.Equal(t, "Snapshot", event.Operation)
+	require.NoError(t, event.Error)
+
+	meta, reader, err := snap.Open()
+	require.NoError(t, err)
+	defer reader.Close()
+	require.NoError(t, leader.Restore(meta, reader, 0))
+	event = sink.last(t, &seen)
+	require.Equal(t, "Restore", event.Operation)
+	require.NoError(t, event.Error)
+
+	// And leadership transfers.
+	require.NoError(t, leader.LeadershipTransferToServer(other.localID, other.localAddr).Error())
+	event = sink.last(t, &seen)
+	require.Equal(t, "LeadershipTransfer", event.Operation)
+	require.Equal(t, other.localID, event.Target)
+	require.Equal(t, other.localAddr, event.TargetAddress)
+	require.NoError(t, event.Error)
+}
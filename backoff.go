@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// BackoffKind identifies the operation being retried when a Backoff is
+// consulted.
+type BackoffKind uint8
+
+const (
+	// BackoffReplication is the wait before retrying AppendEntries or
+	// InstallSnapshot to a follower after a failure, which includes
+	// reconnecting to it.
+	BackoffReplication BackoffKind = iota
+
+	// BackoffHeartbeat is the wait before retrying a failed heartbeat.
+	BackoffHeartbeat
+
+	// BackoffElection is the election timeout of a candidate, after which it
+	// restarts the election. Failures counts the elections since the server
+	// was last a follower or leader. This wait must not be zero.
+	BackoffElection
+
+	// BackoffRetryJoin is the wait before another round of RetryJoin.
+	BackoffRetryJoin
+
+	// BackoffAccept is the wait before a NetworkTransport accepts
+	// connections again after failing to.
+	BackoffAccept
+
+	// BackoffSnapshot is the wait before the next automatic snapshot after
+	// the snapshot store failed to store one.
+	BackoffSnapshot
+)
+
+// String returns a human readable name for the kind.
+func (k BackoffKind) String() string {
+	switch k {
+	case BackoffReplication:
+		return "Replication"
+	case BackoffHeartbeat:
+		return "Heartbeat"
+	case BackoffElection:
+		return "Election"
+	case BackoffRetryJoin:
+		return "RetryJoin"
+	case BackoffAccept:
+		return "Accept"
+	case BackoffSnapshot:
+		return "Snapshot"
+	default:
+		return "Unknown"
+	}
+}
+
+// Backoff decides how long to wait before retrying an operation that failed,
+// letting operators standardize retry behavior and tests remove the waits.
+// Set it with Config.Backoff, or NetworkTransportConfig.Backoff for the
+// transport. It's called from Raft's own goroutines, so it must be safe for
+// concurrent use.
+type Backoff interface {
+	// Backoff returns how long to wait before the next attempt at an
+	// operation of the given kind after failures consecutive failures. base
+	// and max are the initial and longest waits DefaultBackoff would use,
+	// which are derived from the configuration.
+	Backoff(kind BackoffKind, failures uint64, base, max time.Duration) time.Duration
+}
+
+// DefaultBackoff returns the Backoff used when none is configured. It waits
+// base for the first two failures and doubles the wait for each one after,
+// up to max. Election timeouts are instead chosen at random between base and
+// twice base, so that candidates are unlikely to keep splitting the vote.
+func DefaultBackoff() Backoff {
+	return defaultBackoff{}
+}
+
+type defaultBackoff struct{}
+
+// Backoff implements the Backoff interface.
+func (defaultBackoff) Backoff(kind BackoffKind, failures uint64, base, max time.Duration) time.Duration {
+	if kind == BackoffElection {
+		if base <= 0 {
+			return base
+		}
+		return base + time.Duration(rand.Int63())%base
+	}
+	// The cap stops the doubling well before it could overflow.
+	return cappedExponentialBackoff(base, failures, 64, max)
+}
+
+// backoffWait returns how long to wait before retrying an operation of the
+// given kind, using the configured Backoff.
+func (r *Raft) backoffWait(kind BackoffKind, failures uint64, base, max time.Duration) time.Duration {
+	b := r.config().Backoff
+	if b == nil {
+		b = defaultBackoff{}
+	}
+	return b.Backoff(kind, failures, base, max)
+}
+
+// electionTimer returns a channel that fires when the current election should
+// be given up on and restarted.
+func (r *Raft) electionTimer(electionTimeout time.Duration) <-chan time.Time {
+	if electionTimeout == 0 {
+		return nil
+	}
+	return time.After(r.backoffWait(BackoffElection, r.elections, electionTimeout, 2*electionTimeout))
+}
@@ -0,0 +1,90 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultBackoff(t *testing.T) {
+	b := DefaultBackoff()
+	base, max := 10*time.Millisecond, 50*time.Millisecond
+	require.Equal(t, base, b.Backoff(BackoffReplication, 1, base, max))
+	require.Equal(t, base, b.Backoff(BackoffReplication, 2, base, max))
+	require.Equal(t, 2*base, b.Backoff(BackoffReplication, 3, base, max))
+	require.Equal(t, 4*base, b.Backoff(BackoffHeartbeat, 4, base, max))
+	require.Equal(t, max, b.Backoff(BackoffRetryJoin, 5, base, max))
+	require.Equal(t, max, b.Backoff(BackoffAccept, 1000, base, max))
+
+	for i := 0; i < 100; i++ {
+		wait := b.Backoff(BackoffElection, 1, base, 2*base)
+		require.GreaterOrEqual(t, wait, base)
+		require.Less(t, wait, 2*base)
+	}
+}
+
+// recordingBackoff doesn't wait, except for elections, and records the
+// kinds it's asked about.
+type recordingBackoff struct {
+	mu    sync.Mutex
+	kinds map[BackoffKind]uint64
+}
+
+func (b *recordingBackoff) Backoff(kind BackoffKind, failures uint64, base, max time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.kinds == nil {
+		b.kinds = make(map[BackoffKind]uint64)
+	}
+	if failures > b.kinds[kind] {
+		b.kinds[kind] = failures
+	}
+	if kind == BackoffElection {
+		return DefaultBackoff().Backoff(kind, failures, base, max)
+	}
+	return 0
+}
+
+func (b *recordingBackoff) failures(kind BackoffKind) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.kinds[kind]
+}
+
+func TestRaft_Backoff(t *testing.T) {
+	b := &recordingBackoff{}
+	conf := inmemConfig(t)
+	conf.Backoff = b
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	require.NotZero(t, b.failures(BackoffElection))
+
+	// Failures to reach a follower are retried without waiting.
+	follower := c.Followers()[0]
+	c.Disconnect(follower.localAddr)
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	retry(t, func() bool {
+		return b.failures(BackoffReplication) > 3 && b.failures(BackoffHeartbeat) > 3
+	})
+	c.FullyConnect()
+	c.WaitForReplication(1)
+}
+
+// retry polls fn until it returns true, failing the test if it takes too
+// long.
+func retry(t *testing.T, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
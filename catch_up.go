@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// catchUpSend is used by replicateTo once the follower's log matches ours but
+// it's more than a batch behind. It loads up to streams batches of batchSize
+// entries in parallel, since reading them from the LogStore is usually what
+// limits how fast a follower catches up, and sends each batch at the same
+// time, so the transport uses a connection per batch. The follower may get
+// them out of order, and rejects a batch whose previous entry it doesn't have
+// yet; that batch is sent again as soon as the one before it is in. Only one
+// window of batches is sent per call, so replicateTo can still react to being
+// stopped. It returns ok false if the window wasn't all appended, leaving
+// nextIndex after the last batch that was.
+func (r *Raft) catchUpSend(s *followerReplication, peer Server, lastIndex uint64, streams int, batchSize uint64) (shouldStop, ok bool) {
+	next := atomic.LoadUint64(&s.nextIndex)
+	var reqs []*AppendEntriesRequest
+	for start := next; start <= lastIndex && len(reqs) < streams; start += batchSize {
+		reqs = append(reqs, new(AppendEntriesRequest))
+	}
+
+	errs := make([]error, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		start := next + uint64(i)*batchSize
+		end := min(start+batchSize-1, lastIndex)
+		wg.Add(1)
+		go func(i int, req *AppendEntriesRequest) {
+			defer wg.Done()
+			errs[i] = r.setupAppendEntries(s, req, start, end)
+		}(i, req)
+	}
+	wg.Wait()
+
+	// Only send the batches before the first one that couldn't be loaded.
+	for i, err := range errs {
+		if err != nil {
+			reqs = reqs[:i]
+			break
+		}
+	}
+
+	resps := make([]AppendEntriesResponse, len(reqs))
+	starts := make([]time.Time, len(reqs))
+	done := make([]chan struct{}, len(reqs))
+	for i, req := range reqs {
+		done[i] = make(chan struct{})
+		wg.Add(1)
+		go func(i int, req *AppendEntriesRequest) {
+			defer wg.Done()
+			defer close(done[i])
+			starts[i] = time.Now()
+			errs[i] = r.trans.AppendEntries(peer.ID, peer.Address, req, &resps[i])
+			if i == 0 || errs[i] != nil || resps[i].Success || resps[i].Term > req.Term {
+				return
+			}
+
+			// The follower got this batch ahead of the one before it, so send
+			// it again once that one is in.
+			<-done[i-1]
+			if errs[i-1] != nil || !resps[i-1].Success {
+				return
+			}
+			metrics.IncrCounter([]string{"raft", "replication", "catchUp", "resent"}, 1)
+			starts[i] = time.Now()
+			resps[i] = AppendEntriesResponse{}
+			errs[i] = r.trans.AppendEntries(peer.ID, peer.Address, req, &resps[i])
+		}(i, req)
+	}
+	wg.Wait()
+
+	for i, req := range reqs {
+		resp := &resps[i]
+		if errs[i] != nil {
+			r.logger.Error("failed to appendEntries to", "peer", peer, "error", errs[i])
+			s.failures++
+			return false, false
+		}
+		appendStats(string(peer.ID), starts[i], float32(len(req.Entries)))
+		s.stats.recordAppend(starts[i], req)
+
+		// Check for a newer term, stop running
+		if resp.Term > req.Term {
+			r.checkTermInflation(resp)
+			r.handleStaleTerm(s)
+			return true, false
+		}
+
+		s.setLastContact()
+		s.fsmVersion.Store(resp.FSMVersion)
+		s.logVersion.Store(uint32(resp.LogVersion))
+
+		// Leave a rejection to replicateTo
+		if !resp.Success {
+			return false, false
+		}
+		s.setLastAckSent(starts[i])
+		updateLastAppended(s, req)
+	}
+	metrics.IncrCounter([]string{"raft", "replication", "catchUp", "batches"}, float32(len(reqs)))
+	return false, len(reqs) > 0
+}
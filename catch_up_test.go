@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_catchUpSend(t *testing.T) {
+	conf := inmemConfig(t)
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last ApplyFuture
+	for i := 0; i < 100; i++ {
+		last = leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, last.Error())
+	lastIndex := leader.getLastIndex()
+
+	// A server outside the configuration stands in for the follower.
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	follower := c1.rafts[0]
+	peer := Server{Suffrage: Voter, ID: follower.localID, Address: follower.localAddr}
+	s := &followerReplication{
+		peer:        peer,
+		currentTerm: leader.getCurrentTerm(),
+		commitment:  newCommitment(make(chan struct{}, 1), Configuration{Servers: []Server{peer}}, 1),
+		stats:       newReplicationStats(),
+	}
+
+	// A window the follower's log doesn't match is left to replicateTo.
+	s.nextIndex = 11
+	stop, ok := leader.catchUpSend(s, peer, lastIndex, 3, 10)
+	require.False(t, stop)
+	require.False(t, ok)
+	require.Equal(t, uint64(11), atomic.LoadUint64(&s.nextIndex))
+	require.Equal(t, uint64(0), follower.getLastIndex())
+
+	// Otherwise the whole window is appended, even if the follower gets the
+	// batches out of order.
+	s.nextIndex = 1
+	stop, ok = leader.catchUpSend(s, peer, lastIndex, 3, 10)
+	require.False(t, stop)
+	require.True(t, ok)
+	require.Equal(t, uint64(31), atomic.LoadUint64(&s.nextIndex))
+	require.Equal(t, uint64(30), atomic.LoadUint64(&s.matchIndex))
+	require.Equal(t, uint64(30), follower.getLastIndex())
+
+	// The rest is sent in later windows.
+	for atomic.LoadUint64(&s.nextIndex) <= lastIndex {
+		stop, ok = leader.catchUpSend(s, peer, lastIndex, 3, 10)
+		require.False(t, stop)
+		require.True(t, ok)
+	}
+	require.Equal(t, lastIndex+1, atomic.LoadUint64(&s.nextIndex))
+	require.Equal(t, lastIndex, follower.getLastIndex())
+}
+
+func TestRaft_CatchUpStreams(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.MaxAppendEntries = 16
+	conf.CatchUpStreams = 4
+	conf.TrailingLogs = 100
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	// The new server installs a snapshot and catches up on the rest of the
+	// log from there.
+	leader := c.Leader()
+	for i := 0; i < 300; i++ {
+		leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, leader.Snapshot().Error())
+	var last ApplyFuture
+	for i := 0; i < 700; i++ {
+		last = leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, last.Error())
+
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	require.NoError(t, leader.AddVoter(c1.rafts[0].localID, c1.rafts[0].localAddr, 0, 0).Error())
+
+	require.Eventually(t, func() bool {
+		return c1.rafts[0].AppliedIndex() >= last.Index()
+	}, c.longstopTimeout, 10*time.Millisecond)
+}
+
+func TestRaft_ReplicationStartConcurrency(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.ReplicationStartConcurrency = 1
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last ApplyFuture
+	for i := 0; i < 100; i++ {
+		last = leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, last.Error())
+
+	// Two new servers needing to catch up take turns.
+	c1 := MakeClusterNoBootstrap(2, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	for _, r := range c1.rafts {
+		require.NoError(t, leader.AddVoter(r.localID, r.localAddr, 0, 0).Error())
+	}
+	c.EnsureSame(t)
+
+	// So do all the followers after a leader change.
+	c.Disconnect(leader.localAddr)
+	c.Leader()
+	c.FullyConnect()
+	c.EnsureSame(t)
+}
+
+// delayTransport delays AppendEntries RPCs, standing in for a network with
+// some latency.
+type delayTransport struct {
+	Transport
+	delay time.Duration
+}
+
+func (d *delayTransport) AppendEntries(id ServerID, target ServerAddress, args *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	time.Sleep(d.delay)
+	return d.Transport.AppendEntries(id, target, args, resp)
+}
+
+func BenchmarkRaft_CatchUp(b *testing.B) {
+	for _, streams := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("streams=%d", streams), func(b *testing.B) {
+			newRaft := func(id string, trans Transport, bootstrap bool) *Raft {
+				conf := inmemConfig(b)
+				conf.LocalID = ServerID(id)
+				conf.Logger = hclog.NewNullLogger()
+				conf.MaxAppendEntries = 64
+				conf.CatchUpStreams = streams
+				store := NewInmemStore()
+				snaps := NewInmemSnapshotStore()
+				if bootstrap {
+					configuration := Configuration{Servers: []Server{{Suffrage: Voter, ID: conf.LocalID, Address: trans.LocalAddr()}}}
+					NoErr(BootstrapCluster(conf, store, store, snaps, trans, configuration), b)
+				}
+				r, err := NewRaft(conf, &MockFSM{}, store, store, snaps, trans)
+				NoErr(err, b)
+				return r
+			}
+
+			addr, trans := NewInmemTransport("")
+			leader := newRaft("leader", &delayTransport{Transport: trans, delay: time.Millisecond}, true)
+			defer leader.Shutdown()
+			for leader.State() != Leader {
+				time.Sleep(time.Millisecond)
+			}
+			var last ApplyFuture
+			for i := 0; i < 2000; i++ {
+				last = leader.Apply(logBytes(i, 1024), 0)
+			}
+			NoErr(last.Error(), b)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Time how long a new server takes to catch up on the log.
+				b.StopTimer()
+				followerAddr, followerTrans := NewInmemTransport("")
+				trans.Connect(followerAddr, followerTrans)
+				followerTrans.Connect(addr, trans)
+				follower := newRaft(fmt.Sprintf("follower-%d", i), followerTrans, false)
+				b.StartTimer()
+
+				NoErr(leader.AddNonvoter(follower.localID, followerAddr, 0, 0).Error(), b)
+				for follower.AppliedIndex() < last.Index() {
+					time.Sleep(time.Millisecond)
+				}
+
+				b.StopTimer()
+				NoErr(leader.RemoveServer(follower.localID, 0, 0).Error(), b)
+				NoErr(follower.Shutdown().Error(), b)
+				trans.Disconnect(followerAddr)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// ClusterParameters are operational settings replicated through the log as
+// part of the Configuration, so that every server converges on the same
+// tuning rather than relying on each server's Config matching. Once a
+// configuration holding them is committed, each server uses them in place of
+// its own settings. A zero field leaves that setting to each server's Config.
+type ClusterParameters struct {
+	// SnapshotThreshold overrides Config.SnapshotThreshold, taking precedence
+	// over ReloadConfig.
+	SnapshotThreshold uint64
+
+	// MaxAppendEntries overrides Config.MaxAppendEntries. It doesn't change
+	// the size of the apply buffer if Config.BatchApplyCh is set.
+	MaxAppendEntries int
+
+	// RequestVoteRateLimit overrides Config.RequestVoteRateLimit.
+	RequestVoteRateLimit float64
+}
+
+// validate checks the parameters are within the same bounds as the settings
+// they override.
+func (p *ClusterParameters) validate() error {
+	if p.MaxAppendEntries < 0 {
+		return fmt.Errorf("MaxAppendEntries must not be negative")
+	}
+	if p.MaxAppendEntries > 1024 {
+		return fmt.Errorf("MaxAppendEntries is too large")
+	}
+	if p.RequestVoteRateLimit < 0 {
+		return fmt.Errorf("RequestVoteRateLimit must not be negative")
+	}
+	return nil
+}
+
+// apply returns conf with the parameters that are set put in place. It's safe
+// to call on nil, which changes nothing.
+func (p *ClusterParameters) apply(conf Config) Config {
+	if p == nil {
+		return conf
+	}
+	if p.SnapshotThreshold != 0 {
+		conf.SnapshotThreshold = p.SnapshotThreshold
+	}
+	if p.MaxAppendEntries != 0 {
+		conf.MaxAppendEntries = p.MaxAppendEntries
+	}
+	if p.RequestVoteRateLimit != 0 {
+		conf.RequestVoteRateLimit = p.RequestVoteRateLimit
+	}
+	return conf
+}
+
+// clone returns a copy of the parameters, or nil if p is nil.
+func (p *ClusterParameters) clone() *ClusterParameters {
+	if p == nil {
+		return nil
+	}
+	copy := *p
+	return &copy
+}
+
+// equal returns true if both parameters are nil or the same.
+func (p *ClusterParameters) equal(o *ClusterParameters) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	return *p == *o
+}
+
+// SetClusterParameters replaces the parameters replicated to every server
+// with the given ones by appending a new configuration holding them. Setting
+// a zero ClusterParameters hands every setting back to each server's Config.
+// This must be run on the leader or it will fail. For prevIndex and timeout,
+// see AddVoter.
+func (r *Raft) SetClusterParameters(params ClusterParameters, prevIndex uint64, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+	if err := params.validate(); err != nil {
+		return errorFuture{err}
+	}
+
+	req := configurationChangeRequest{
+		command:   setParameters,
+		prevIndex: prevIndex,
+	}
+	if params != (ClusterParameters{}) {
+		req.parameters = &params
+	}
+	return r.requestConfigChange(req, timeout)
+}
+
+// applyClusterParameters puts the parameters from a newly committed
+// configuration in place of the server's own settings, if they've changed.
+func (r *Raft) applyClusterParameters(params *ClusterParameters) {
+	r.confReloadMu.Lock()
+	defer r.confReloadMu.Unlock()
+	if params.equal(r.clusterParameters) {
+		return
+	}
+
+	newCfg := params.apply(r.localConf)
+	if err := ValidateConfig(&newCfg); err != nil {
+		r.logger.Error("ignoring invalid cluster parameters", "parameters", fmt.Sprintf("%+v", params), "error", err)
+		return
+	}
+	r.clusterParameters = params.clone()
+	r.conf.Store(newCfg)
+	r.logger.Info("applied cluster parameters", "parameters", fmt.Sprintf("%+v", params))
+}
@@ -0,0 +1,129 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterParameters_Apply(t *testing.T) {
+	conf := *DefaultConfig()
+
+	var p *ClusterParameters
+	require.Equal(t, conf, p.apply(conf))
+	require.True(t, p.equal(nil))
+
+	p = &ClusterParameters{SnapshotThreshold: 7}
+	applied := p.apply(conf)
+	require.Equal(t, uint64(7), applied.SnapshotThreshold)
+	require.Equal(t, conf.MaxAppendEntries, applied.MaxAppendEntries)
+	require.Equal(t, conf.RequestVoteRateLimit, applied.RequestVoteRateLimit)
+	require.False(t, p.equal(nil))
+	require.True(t, p.equal(p.clone()))
+
+	require.Error(t, (&ClusterParameters{MaxAppendEntries: 2048}).validate())
+	require.Error(t, (&ClusterParameters{MaxAppendEntries: -1}).validate())
+	require.Error(t, (&ClusterParameters{RequestVoteRateLimit: -1}).validate())
+	require.NoError(t, (&ClusterParameters{MaxAppendEntries: 16, RequestVoteRateLimit: 5}).validate())
+}
+
+func TestConfiguration_nextConfiguration_setParameters(t *testing.T) {
+	params := &ClusterParameters{SnapshotThreshold: 7}
+	next, err := nextConfiguration(singleServer, 1, configurationChangeRequest{
+		command:    setParameters,
+		parameters: params,
+	})
+	require.NoError(t, err)
+	require.Equal(t, singleServer.Servers, next.Servers)
+	require.Equal(t, params, next.Parameters)
+
+	// The configuration has its own copy.
+	params.SnapshotThreshold = 8
+	require.Equal(t, uint64(7), next.Parameters.SnapshotThreshold)
+	clone := next.Clone()
+	clone.Parameters.SnapshotThreshold = 9
+	require.Equal(t, uint64(7), next.Parameters.SnapshotThreshold)
+
+	next, err = nextConfiguration(next, 2, configurationChangeRequest{command: setParameters})
+	require.NoError(t, err)
+	require.Nil(t, next.Parameters)
+
+	// They carry over other changes.
+	next.Parameters = &ClusterParameters{MaxAppendEntries: 16}
+	next, err = nextConfiguration(next, 3, configurationChangeRequest{
+		command:       AddVoter,
+		serverID:      ServerID("id2"),
+		serverAddress: ServerAddress("addr2"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 16, next.Parameters.MaxAppendEntries)
+}
+
+func TestRaft_ClusterParameters(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+
+	// A local reload doesn't stick while the parameters are set.
+	rc := follower.ReloadableConfig()
+	rc.SnapshotThreshold = 100
+	require.NoError(t, follower.ReloadConfig(rc))
+
+	params := ClusterParameters{SnapshotThreshold: 7, MaxAppendEntries: 16, RequestVoteRateLimit: 5}
+	require.NoError(t, leader.SetClusterParameters(params, 0, 0).Error())
+	retry(t, func() bool {
+		for _, r := range c.rafts {
+			conf := r.config()
+			if conf.SnapshotThreshold != 7 || conf.MaxAppendEntries != 16 || conf.RequestVoteRateLimit != 5 {
+				return false
+			}
+		}
+		return true
+	})
+	require.Equal(t, uint64(100), follower.ReloadableConfig().SnapshotThreshold)
+	rc.TrailingLogs = 20
+	require.NoError(t, follower.ReloadConfig(rc))
+	require.Equal(t, uint64(7), follower.config().SnapshotThreshold)
+	require.Equal(t, uint64(20), follower.config().TrailingLogs)
+
+	// A server joining after the entry has been compacted away gets the
+	// parameters from the snapshot.
+	for i := 0; i < 50; i++ {
+		leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, leader.Barrier(0).Error())
+	require.NoError(t, leader.Snapshot().Error())
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	joiner := c1.rafts[0]
+	require.NoError(t, leader.AddVoter(joiner.localID, joiner.localAddr, 0, 0).Error())
+	retry(t, func() bool { return joiner.config().SnapshotThreshold == 7 })
+
+	// Clearing them hands the settings back to each server.
+	require.NoError(t, leader.SetClusterParameters(ClusterParameters{}, 0, 0).Error())
+	retry(t, func() bool {
+		for _, r := range c.rafts {
+			want := conf.SnapshotThreshold
+			if r == follower {
+				want = 100
+			}
+			if r.config().SnapshotThreshold != want || r.config().MaxAppendEntries != conf.MaxAppendEntries {
+				return false
+			}
+		}
+		return true
+	})
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.Nil(t, future.Configuration().Parameters)
+
+	// Invalid parameters are refused.
+	require.Error(t, leader.SetClusterParameters(ClusterParameters{MaxAppendEntries: 4096}, 0, 0).Error())
+}
@@ -42,6 +42,10 @@ type AppendEntriesRequest struct {
 
 	// Commit index on the leader
 	LeaderCommitIndex uint64
+
+	// Timestamp is the leader's wall clock time in Unix milliseconds. It is
+	// only set on heartbeats and is only used to detect clock skew.
+	Timestamp int64
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -66,6 +70,18 @@ type AppendEntriesResponse struct {
 	// There are scenarios where this request didn't succeed
 	// but there's no need to wait/back-off the next attempt.
 	NoRetryBackoff bool
+
+	// Timestamp is the follower's wall clock time in Unix milliseconds, set
+	// in reply to a request carrying a Timestamp.
+	Timestamp int64
+
+	// FSMVersion is the version the follower's FSM reports with
+	// VersionedFSM, or zero if it doesn't implement it.
+	FSMVersion uint64
+
+	// LogVersion is the newest log entry version the follower accepts.
+	// Servers from before it was reported leave it as LogVersionMin.
+	LogVersion LogVersion
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -113,6 +129,70 @@ type RequestVoteResponse struct {
 
 	// Is the vote granted.
 	Granted bool
+
+	// Reason is why the vote wasn't granted. Servers running older versions
+	// don't set this, so a denied vote may have VoteDenialUnspecified.
+	Reason VoteDenialReason
+}
+
+// VoteDenialReason is a machine-readable reason a RequestVote was denied.
+type VoteDenialReason uint8
+
+const (
+	// VoteDenialUnspecified is used for granted votes and for denials from
+	// servers that don't send a reason.
+	VoteDenialUnspecified VoteDenialReason = iota
+	// VoteDenialOlderTerm means the candidate's term is behind the voter's.
+	VoteDenialOlderTerm
+	// VoteDenialStaleLogTerm means the voter's last log term is newer than
+	// the candidate's.
+	VoteDenialStaleLogTerm
+	// VoteDenialStaleLogIndex means the last log terms match but the voter
+	// has more entries than the candidate.
+	VoteDenialStaleLogIndex
+	// VoteDenialAlreadyVoted means the voter already voted for another
+	// candidate in this term.
+	VoteDenialAlreadyVoted
+	// VoteDenialHasLeader means the voter is still hearing from a leader.
+	VoteDenialHasLeader
+	// VoteDenialNotInConfiguration means the candidate isn't in the voter's
+	// configuration.
+	VoteDenialNotInConfiguration
+	// VoteDenialNotVoter means the candidate doesn't have a vote in the
+	// voter's configuration.
+	VoteDenialNotVoter
+	// VoteDenialInternalError means the voter failed to read or persist its
+	// vote.
+	VoteDenialInternalError
+	// VoteDenialRateLimited means the candidate exceeded the voter's
+	// RequestVoteRateLimit.
+	VoteDenialRateLimited
+)
+
+func (r VoteDenialReason) String() string {
+	switch r {
+	case VoteDenialUnspecified:
+		return "unspecified"
+	case VoteDenialOlderTerm:
+		return "older-term"
+	case VoteDenialStaleLogTerm:
+		return "stale-log-term"
+	case VoteDenialStaleLogIndex:
+		return "stale-log-index"
+	case VoteDenialAlreadyVoted:
+		return "already-voted"
+	case VoteDenialHasLeader:
+		return "has-leader"
+	case VoteDenialNotInConfiguration:
+		return "not-in-configuration"
+	case VoteDenialNotVoter:
+		return "not-voter"
+	case VoteDenialInternalError:
+		return "internal-error"
+	case VoteDenialRateLimited:
+		return "rate-limited"
+	}
+	return "VoteDenialReason"
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -120,6 +200,131 @@ func (r *RequestVoteResponse) GetRPCHeader() RPCHeader {
 	return r.RPCHeader
 }
 
+// RequestPreVoteRequest is the command used by a candidate to ask a Raft peer
+// whether it would vote in an election, before starting one. Answering it
+// doesn't change the peer's term or vote.
+type RequestPreVoteRequest struct {
+	RPCHeader
+
+	// Term is the term the candidate would use for the election.
+	Term uint64
+
+	// Used to ensure safety
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *RequestPreVoteRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// RequestPreVoteResponse is the response returned from a
+// RequestPreVoteRequest.
+type RequestPreVoteResponse struct {
+	RPCHeader
+
+	// Newer term if the candidate is out of date.
+	Term uint64
+
+	// Is the pre-vote granted.
+	Granted bool
+
+	// Reason is why the pre-vote wasn't granted.
+	Reason VoteDenialReason
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *RequestPreVoteResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// StatusRequest is the command used to ask a Raft peer for its Status, for
+// example by a load balancer health check. It may be sent by clients that
+// aren't part of the cluster, so its RPCHeader isn't checked. Transports with
+// a heartbeat fast-path, such as the NetworkTransport, answer it there, so it
+// doesn't wait behind other RPCs for the main thread.
+type StatusRequest struct {
+	RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *StatusRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// StatusResponse is the response returned from a StatusRequest.
+type StatusResponse struct {
+	RPCHeader
+	Status
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *StatusResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// JoinRequest is the command used by a server that isn't part of the cluster
+// yet to ask to be added as a voter, see Config.RetryJoin.
+type JoinRequest struct {
+	RPCHeader
+
+	// ID and Address identify the server to add.
+	ID      ServerID
+	Address ServerAddress
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *JoinRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// JoinResponse is the response returned from a JoinRequest.
+type JoinResponse struct {
+	RPCHeader
+
+	// Success is set once the server has been added to the configuration.
+	Success bool
+
+	// Leader is the address of the current leader, if known, when the
+	// request was sent to a server that isn't the leader.
+	Leader ServerAddress
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *JoinResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// LeaveRequest is the command used by a server to ask the leader to remove it
+// from the cluster, see Raft.Leave.
+type LeaveRequest struct {
+	RPCHeader
+
+	// ID identifies the server to remove.
+	ID ServerID
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *LeaveRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// LeaveResponse is the response returned from a LeaveRequest.
+type LeaveResponse struct {
+	RPCHeader
+
+	// Success is set once the server has been removed from the
+	// configuration. It isn't set if the request was sent to a server that
+	// isn't the leader.
+	Success bool
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *LeaveResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
 // InstallSnapshotRequest is the command sent to a Raft peer to bootstrap its
 // log (and state machine) from a snapshot on another peer.
 type InstallSnapshotRequest struct {
@@ -160,6 +365,11 @@ type InstallSnapshotResponse struct {
 
 	Term    uint64
 	Success bool
+
+	// ReceiveBytesPerSecond is the rate the follower wrote the snapshot to
+	// its disk at, if it measures it, which the leader paces later snapshots
+	// sent to it to.
+	ReceiveBytesPerSecond uint64
 }
 
 // GetRPCHeader - See WithRPCHeader.
@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// defaultCommitLatencySLOWindow is used when Config.CommitLatencySLOWindow
+// isn't set.
+const defaultCommitLatencySLOWindow = 30 * time.Second
+
+// CommitLatencyObservation is sent by the leader when its commit latency has
+// stayed above Config.CommitLatencySLO for Config.CommitLatencySLOWindow, and
+// again when it falls back below it.
+type CommitLatencyObservation struct {
+	// Latency is the commit latency measured when the observation was made.
+	Latency time.Duration
+	SLO     time.Duration
+	// Breached is true if the SLO has been breached, and false if the
+	// latency has recovered.
+	Breached bool
+	// Since is when the latency first went above the SLO.
+	Since time.Time
+	// TransferTo is the server leadership is being transferred to, if
+	// Config.CommitLatencySLOTransfer is set and a follower was found.
+	TransferTo ServerID
+}
+
+// commitLatencyTracker collects commit latencies from the leader loop for the
+// commit latency watchdog.
+type commitLatencyTracker struct {
+	mu sync.Mutex
+
+	// total and count sum up the latency of the entries committed since the
+	// last sample.
+	total time.Duration
+	count int
+
+	// oldest is when the oldest entry that hasn't committed yet was
+	// dispatched, or zero if there aren't any. It means a leader that can't
+	// commit anything at all is noticed.
+	oldest time.Time
+}
+
+// reset forgets everything, for a new leadership term.
+func (t *commitLatencyTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total, t.count, t.oldest = 0, 0, time.Time{}
+}
+
+// committed records the latency of a committed entry.
+func (t *commitLatencyTracker) committed(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total += latency
+	t.count++
+}
+
+// setOldest records when the oldest uncommitted entry was dispatched.
+func (t *commitLatencyTracker) setOldest(dispatch time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.oldest = dispatch
+}
+
+// dispatched records entries being dispatched at now, which are the oldest
+// uncommitted ones if there weren't any already.
+func (t *commitLatencyTracker) dispatched(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.oldest.IsZero() {
+		t.oldest = now
+	}
+}
+
+// sample returns the commit latency since the last sample: the mean latency
+// of the entries committed, or how long the oldest uncommitted entry has been
+// waiting if that's longer.
+func (t *commitLatencyTracker) sample(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var latency time.Duration
+	if t.count > 0 {
+		latency = t.total / time.Duration(t.count)
+	}
+	if !t.oldest.IsZero() && now.Sub(t.oldest) > latency {
+		latency = now.Sub(t.oldest)
+	}
+	t.total, t.count = 0, 0
+	return latency
+}
+
+// sloBreach tracks whether an SLO has been breached for long enough between
+// samples.
+type sloBreach struct {
+	since    time.Time
+	breached bool
+}
+
+// update records whether a sample taken at now was over the SLO, returning
+// whether the SLO became breached or recovered.
+func (b *sloBreach) update(over bool, window time.Duration, now time.Time) bool {
+	if !over {
+		b.since = time.Time{}
+		if b.breached {
+			b.breached = false
+			return true
+		}
+		return false
+	}
+	if b.since.IsZero() {
+		b.since = now
+	}
+	if !b.breached && now.Sub(b.since) >= window {
+		b.breached = true
+		return true
+	}
+	return false
+}
+
+// runCommitLatencyWatchdog is a long running goroutine that samples the
+// leader's commit latency, sending a CommitLatencyObservation when it breaches
+// Config.CommitLatencySLO for Config.CommitLatencySLOWindow or recovers, and
+// optionally handing leadership to the healthiest follower on a breach.
+func (r *Raft) runCommitLatencyWatchdog() {
+	window := r.config().CommitLatencySLOWindow
+	if window == 0 {
+		window = defaultCommitLatencySLOWindow
+	}
+	ticker := time.NewTicker(monitorInterval(window))
+	defer ticker.Stop()
+
+	var breach sloBreach
+	for {
+		var now time.Time
+		select {
+		case <-r.shutdownCh:
+			return
+		case now = <-ticker.C:
+		}
+
+		if r.getState() != Leader {
+			breach = sloBreach{}
+			continue
+		}
+		conf := r.config()
+		latency := r.commitLatency.sample(now)
+		since := breach.since
+		if !breach.update(latency > conf.CommitLatencySLO, window, now) {
+			continue
+		}
+
+		o := CommitLatencyObservation{
+			Latency:  latency,
+			SLO:      conf.CommitLatencySLO,
+			Breached: breach.breached,
+			Since:    since,
+		}
+		if !breach.breached {
+			r.logger.Info("commit latency back within SLO", "latency", latency, "slo", conf.CommitLatencySLO)
+			r.observe(o)
+			continue
+		}
+
+		o.Since = breach.since
+		metrics.IncrCounter([]string{"raft", "commitLatency", "sloBreached"}, 1)
+		r.logger.Error("commit latency SLO breached", "latency", latency, "slo", conf.CommitLatencySLO, "since", o.Since)
+		var target *PeerReplicationReport
+		if conf.CommitLatencySLOTransfer {
+			target = r.healthiestFollower()
+		}
+		if target != nil {
+			o.TransferTo = target.ID
+		}
+		r.observe(o)
+		if target != nil {
+			r.logger.Warn("transferring leadership to restore commit latency", "id", target.ID, "address", target.Address)
+			if err := r.LeadershipTransferToServer(target.ID, target.Address).Error(); err != nil {
+				r.logger.Error("failed to transfer leadership", "id", target.ID, "error", err)
+			}
+		}
+	}
+}
+
+// healthiestFollower returns the voter that is furthest along replicating,
+// preferring the one that acks fastest, or nil if there isn't one. Peers
+// blocked by BlockPeer aren't considered.
+func (r *Raft) healthiestFollower() *PeerReplicationReport {
+	report, err := r.ReplicationReport()
+	if err != nil {
+		return nil
+	}
+	var best *PeerReplicationReport
+	for i := range report.Peers {
+		p := &report.Peers[i]
+		if p.Suffrage != Voter || r.peerBlocked(p.Address) != nil {
+			continue
+		}
+		if best == nil || p.Lag < best.Lag || (p.Lag == best.Lag && p.AckLatency < best.AckLatency) {
+			best = p
+		}
+	}
+	return best
+}
@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitLatencyTracker(t *testing.T) {
+	var tr commitLatencyTracker
+	now := time.Now()
+
+	// Nothing going on is no latency.
+	require.Zero(t, tr.sample(now))
+
+	// The mean of the committed entries.
+	tr.committed(10 * time.Millisecond)
+	tr.committed(30 * time.Millisecond)
+	require.Equal(t, 20*time.Millisecond, tr.sample(now))
+	require.Zero(t, tr.sample(now))
+
+	// An entry stuck waiting counts for as long as it's been waiting.
+	tr.dispatched(now)
+	tr.dispatched(now.Add(time.Second))
+	tr.committed(time.Millisecond)
+	require.Equal(t, 2*time.Second, tr.sample(now.Add(2*time.Second)))
+	tr.setOldest(time.Time{})
+	require.Zero(t, tr.sample(now.Add(3*time.Second)))
+
+	tr.dispatched(now)
+	tr.reset()
+	require.Zero(t, tr.sample(now.Add(time.Second)))
+}
+
+func TestSLOBreach(t *testing.T) {
+	var b sloBreach
+	now := time.Now()
+
+	require.False(t, b.update(true, time.Second, now))
+	require.False(t, b.update(true, time.Second, now.Add(500*time.Millisecond)))
+
+	// Dipping below resets the window.
+	require.False(t, b.update(false, time.Second, now.Add(600*time.Millisecond)))
+	require.False(t, b.update(true, time.Second, now.Add(700*time.Millisecond)))
+	require.False(t, b.update(true, time.Second, now.Add(1500*time.Millisecond)))
+	require.True(t, b.update(true, time.Second, now.Add(1700*time.Millisecond)))
+	require.True(t, b.breached)
+	require.Equal(t, now.Add(700*time.Millisecond), b.since)
+
+	// Only reported once until it recovers.
+	require.False(t, b.update(true, time.Second, now.Add(2*time.Second)))
+	require.True(t, b.update(false, time.Second, now.Add(3*time.Second)))
+	require.False(t, b.breached)
+	require.False(t, b.update(false, time.Second, now.Add(4*time.Second)))
+}
+
+func TestRaft_CommitLatencySLO(t *testing.T) {
+	conf := inmemConfig(t)
+	// Every commit takes longer than this.
+	conf.CommitLatencySLO = time.Nanosecond
+	conf.CommitLatencySLOWindow = 50 * time.Millisecond
+	conf.CommitLatencySLOTransfer = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	sloCh := make(chan Observation, 16)
+	leader.RegisterObserver(NewObserver(sloCh, false, func(o *Observation) bool {
+		_, ok := o.Data.(CommitLatencyObservation)
+		return ok
+	}))
+
+	var o CommitLatencyObservation
+	deadline := time.After(c.longstopTimeout)
+WAIT:
+	for {
+		leader.Apply([]byte("test"), 0)
+		select {
+		case ob := <-sloCh:
+			o = ob.Data.(CommitLatencyObservation)
+			break WAIT
+		case <-deadline:
+			t.Fatalf("timed out waiting for SLO breach")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	require.True(t, o.Breached)
+	require.Equal(t, time.Nanosecond, o.SLO)
+	require.Greater(t, o.Latency, o.SLO)
+	require.False(t, o.Since.IsZero())
+	require.NotEmpty(t, o.TransferTo)
+	require.NotEqual(t, leader.localID, o.TransferTo)
+
+	// Leadership is handed over.
+	retry(t, func() bool { return leader.State() != Leader })
+}
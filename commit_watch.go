@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import "sync"
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// CommittedEntry describes a log entry that has been committed, as sent by
+// WatchCommits.
+type CommittedEntry struct {
+	Index uint64
+	Term  uint64
+	Type  LogType
+}
+
+// WatchCommits returns a channel that's sent every log entry committed on
+// this server, in order, starting with the entry at index from (or the first
+// entry if from is zero). Entries already committed are sent first, followed
+// by new ones as they commit, whichever server is leader. This is meant for
+// building secondary indexes and materialized views that must not miss any
+// entries. The entries are read from the LogStore, so a consumer that falls
+// behind doesn't hold up Raft.
+//
+// The channel is closed once the returned function is called, when Raft is
+// shut down, or when the next entry can no longer be read from the LogStore,
+// most likely because it was compacted into a snapshot. In the last case the
+// consumer must rebuild its state from a snapshot and watch again from the
+// entry after it.
+func (r *Raft) WatchCommits(from uint64) (<-chan CommittedEntry, func()) {
+	if from == 0 {
+		from = 1
+	}
+	ch := make(chan CommittedEntry)
+	stopCh := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(stopCh) })
+	}
+	go r.watchCommits(from, ch, stopCh)
+	return ch, cancel
+}
+
+// watchCommits sends each committed entry from index next onwards to ch,
+// until stopCh is closed.
+func (r *Raft) watchCommits(next uint64, ch chan<- CommittedEntry, stopCh <-chan struct{}) {
+	defer close(ch)
+	for {
+		// Take the notification channel before reading the commit index so
+		// we can't miss an update in between.
+		notifyCh := r.commitNotify()
+		commitIndex := r.getCommitIndex()
+		for ; next <= commitIndex; next++ {
+			var entry Log
+			if err := r.logs.GetLog(next, &entry); err != nil {
+				r.logger.Warn("stopping commit watch, failed to get log", "index", next, "error", err)
+				return
+			}
+			select {
+			case ch <- CommittedEntry{Index: entry.Index, Term: entry.Term, Type: entry.Type}:
+			case <-stopCh:
+				return
+			case <-r.shutdownCh:
+				return
+			}
+		}
+
+		select {
+		case <-notifyCh:
+		case <-stopCh:
+			return
+		case <-r.shutdownCh:
+			return
+		}
+	}
+}
+
+// commitNotify returns a channel that's closed the next time the commit index
+// advances.
+func (r *Raft) commitNotify() <-chan struct{} {
+	r.commitNotifyLock.Lock()
+	defer r.commitNotifyLock.Unlock()
+	if r.commitNotifyCh == nil {
+		r.commitNotifyCh = make(chan struct{})
+	}
+	return r.commitNotifyCh
+}
+
+// notifyCommit wakes the commit watchers after the commit index advances. The
+// channel is only made when there's a watcher, so this is cheap otherwise.
+func (r *Raft) notifyCommit() {
+	r.commitNotifyLock.Lock()
+	defer r.commitNotifyLock.Unlock()
+	if r.commitNotifyCh != nil {
+		close(r.commitNotifyCh)
+		r.commitNotifyCh = nil
+	}
+}
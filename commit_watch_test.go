@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_WatchCommits(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	c.WaitForReplication(5)
+
+	// Watch from the start on a follower, across a leadership change.
+	follower := c.Followers()[0]
+	ch, cancel := follower.WatchCommits(0)
+	defer cancel()
+
+	require.NoError(t, leader.LeadershipTransfer().Error())
+	leader = c.Leader()
+	var last uint64
+	for i := 0; i < 5; i++ {
+		future := leader.Apply([]byte("test"), 0)
+		require.NoError(t, future.Error())
+		last = future.Index()
+	}
+
+	var next uint64 = 1
+	var commands int
+	timeout := time.After(c.longstopTimeout)
+	for next <= last {
+		select {
+		case entry := <-ch:
+			require.Equal(t, next, entry.Index)
+			require.NotZero(t, entry.Term)
+			if entry.Type == LogCommand {
+				commands++
+			}
+			next++
+		case <-timeout:
+			t.Fatalf("timed out waiting for index %d", next)
+		}
+	}
+	require.Equal(t, 10, commands)
+
+	// Cancelling closes the channel.
+	cancel()
+	for range ch {
+	}
+}
+
+func TestRaft_WatchCommits_Compacted(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 1
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	require.NoError(t, leader.Snapshot().Error())
+
+	// The first entries are gone, so the watch ends straight away.
+	ch, cancel := leader.WatchCommits(1)
+	defer cancel()
+	select {
+	case _, ok := <-ch:
+		require.False(t, ok)
+	case <-time.After(c.longstopTimeout):
+		t.Fatalf("timed out")
+	}
+}
@@ -10,7 +10,9 @@ import (
 
 // Commitment is used to advance the leader's commit index. The leader and
 // replication goroutines report in newly written entries with match(), and
-// this notifies on commitCh when the commit index has advanced.
+// this notifies on commitCh when the commit index has advanced. Since commitCh
+// only buffers a single notification, acks that arrive before the leader gets
+// to it are coalesced into a single commit index advancement.
 type commitment struct {
 	// protects matchIndexes and commitIndex
 	sync.Mutex
@@ -18,12 +20,17 @@ type commitment struct {
 	commitCh chan struct{}
 	// voter ID to log index: the server stores up through this log entry
 	matchIndexes map[ServerID]uint64
+	// the voters that must each have a majority storing an entry for it to be
+	// committed, two sets during a joint consensus change
+	voterSets [][]ServerID
 	// a quorum stores up through this log entry. monotonically increases.
 	commitIndex uint64
 	// the first index of this leader's term: this needs to be replicated to a
 	// majority of the cluster before this leader may mark anything committed
 	// (per Raft's commitment rule)
 	startIndex uint64
+	// scratch space reused by recalculate to avoid allocating on every ack
+	matched []uint64
 }
 
 // newCommitment returns a commitment struct that notifies the provided
@@ -34,14 +41,13 @@ type commitment struct {
 // its description above).
 func newCommitment(commitCh chan struct{}, configuration Configuration, startIndex uint64) *commitment {
 	matchIndexes := make(map[ServerID]uint64)
-	for _, server := range configuration.Servers {
-		if server.Suffrage == Voter {
-			matchIndexes[server.ID] = 0
-		}
+	for _, server := range votingServers(configuration) {
+		matchIndexes[server.ID] = 0
 	}
 	return &commitment{
 		commitCh:     commitCh,
 		matchIndexes: matchIndexes,
+		voterSets:    voterSets(configuration),
 		commitIndex:  0,
 		startIndex:   startIndex,
 	}
@@ -55,11 +61,10 @@ func (c *commitment) setConfiguration(configuration Configuration) {
 	defer c.Unlock()
 	oldMatchIndexes := c.matchIndexes
 	c.matchIndexes = make(map[ServerID]uint64)
-	for _, server := range configuration.Servers {
-		if server.Suffrage == Voter {
-			c.matchIndexes[server.ID] = oldMatchIndexes[server.ID] // defaults to 0
-		}
+	for _, server := range votingServers(configuration) {
+		c.matchIndexes[server.ID] = oldMatchIndexes[server.ID] // defaults to 0
 	}
+	c.voterSets = voterSets(configuration)
 	c.recalculate()
 }
 
@@ -79,7 +84,12 @@ func (c *commitment) match(server ServerID, matchIndex uint64) {
 	defer c.Unlock()
 	if prev, hasVote := c.matchIndexes[server]; hasVote && matchIndex > prev {
 		c.matchIndexes[server] = matchIndex
-		c.recalculate()
+		// An ack at or below the commit index can't move it forward, which is
+		// the common case for followers acking behind a quorum, so skip the
+		// sort.
+		if matchIndex > c.commitIndex {
+			c.recalculate()
+		}
 	}
 }
 
@@ -90,12 +100,26 @@ func (c *commitment) recalculate() {
 		return
 	}
 
-	matched := make([]uint64, 0, len(c.matchIndexes))
-	for _, idx := range c.matchIndexes {
-		matched = append(matched, idx)
+	// During a joint consensus change an entry is only committed once it's
+	// stored by a majority of both configurations, so take the lower of the
+	// two.
+	var quorumMatchIndex uint64
+	found := false
+	for _, voters := range c.voterSets {
+		if len(voters) == 0 {
+			continue
+		}
+		matched := c.matched[:0]
+		for _, id := range voters {
+			matched = append(matched, c.matchIndexes[id])
+		}
+		c.matched = matched
+		sort.Sort(uint64Slice(matched))
+		if idx := matched[(len(matched)-1)/2]; !found || idx < quorumMatchIndex {
+			quorumMatchIndex = idx
+			found = true
+		}
 	}
-	sort.Sort(uint64Slice(matched))
-	quorumMatchIndex := matched[(len(matched)-1)/2]
 
 	if quorumMatchIndex > c.commitIndex && quorumMatchIndex >= c.startIndex {
 		c.commitIndex = quorumMatchIndex
@@ -152,6 +152,36 @@ func TestCommitment_recalculate(t *testing.T) {
 	}
 }
 
+// Tests that acks arriving before the leader reads the commit index result in
+// a single notification, and that acks behind the commit index don't notify.
+func TestCommitment_match_coalesced(t *testing.T) {
+	commitCh := make(chan struct{}, 1)
+	c := newCommitment(commitCh, voters(3), 0)
+
+	c.match("s1", 10)
+	c.match("s2", 10)
+	c.match("s1", 20)
+	c.match("s2", 20)
+	c.match("s3", 30)
+	if !drainNotifyCh(commitCh) {
+		t.Fatalf("expected commit notify")
+	}
+	if c.getCommitIndex() != 20 {
+		t.Fatalf("expected 20 entries committed, found %d", c.getCommitIndex())
+	}
+
+	// s3 was already past the commit index, so moving it further on its own
+	// can't advance it.
+	c.match("s3", 35)
+	if drainNotifyCh(commitCh) {
+		t.Fatalf("unexpected commit notify")
+	}
+	c.match("s2", 25)
+	if c.getCommitIndex() != 25 {
+		t.Fatalf("expected 25 entries committed, found %d", c.getCommitIndex())
+	}
+}
+
 // Tests recalculate() respecting startIndex.
 func TestCommitment_recalculate_startIndex(t *testing.T) {
 	commitCh := make(chan struct{}, 1)
@@ -242,3 +272,42 @@ func TestCommitment_singleVoter(t *testing.T) {
 		t.Fatalf("expected commit notify")
 	}
 }
+
+// Tests that a joint configuration needs a majority of both sets of voters.
+func TestCommitment_joint(t *testing.T) {
+	commitCh := make(chan struct{}, 1)
+	configuration := makeConfiguration([]string{"a", "d", "e"})
+	configuration.Outgoing = makeConfiguration([]string{"a", "b", "c"}).Servers
+	c := newCommitment(commitCh, configuration, 0)
+
+	// A majority of the new voters isn't enough.
+	c.match("a", 10)
+	c.match("d", 10)
+	if c.getCommitIndex() != 0 {
+		t.Fatalf("expected 0 entries committed, found %d", c.getCommitIndex())
+	}
+	if drainNotifyCh(commitCh) {
+		t.Fatalf("unexpected commit notify")
+	}
+
+	// Until the old voters catch up too.
+	c.match("b", 5)
+	if c.getCommitIndex() != 5 {
+		t.Fatalf("expected 5 entries committed, found %d", c.getCommitIndex())
+	}
+	c.match("c", 10)
+	if c.getCommitIndex() != 10 {
+		t.Fatalf("expected 10 entries committed, found %d", c.getCommitIndex())
+	}
+	if !drainNotifyCh(commitCh) {
+		t.Fatalf("expected commit notify")
+	}
+
+	// Leaving the joint configuration drops the old voters.
+	c.setConfiguration(makeConfiguration([]string{"a", "d", "e"}))
+	c.match("a", 20)
+	c.match("e", 20)
+	if c.getCommitIndex() != 20 {
+		t.Fatalf("expected 20 entries committed, found %d", c.getCommitIndex())
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// This package keeps the import path and the store interfaces of
+// hashicorp/raft, so LogStore, StableStore and SnapshotStore implementations
+// written for it, such as raft-boltdb, plug in as they are, and the stores
+// here can be used with it in turn. The one gap is that some log stores
+// encode a fixed set of Log fields rather than the whole struct, and so
+// silently drop the fields only this package has. CompatLogStore closes it.
+
+// compatLogMagic prefixes the Extensions of entries written by a
+// CompatLogStore, marking them as holding compatLogFields.
+var compatLogMagic = []byte("\x00raft-compat\x01")
+
+// compatLogFields holds the fields of a Log that hashicorp/raft doesn't have,
+// along with the entry's own Extensions.
+type compatLogFields struct {
+	Version        LogVersion
+	TTL            time.Duration
+	ExpiredIndex   uint64
+	ScheduledIndex uint64
+	Checksum       uint32
+	Extensions     []byte
+}
+
+// CompatLogStore wraps a LogStore written for hashicorp/raft that only keeps
+// the fields of a Log that hashicorp/raft has, such as one with its own
+// binary codec. The fields only this package has are packed into Extensions,
+// which such stores keep, on the way in and unpacked on the way out, so they
+// survive the round trip. Entries the store already holds without them are
+// read back as they are.
+type CompatLogStore struct {
+	store LogStore
+}
+
+// NewCompatLogStore returns a CompatLogStore wrapping store.
+func NewCompatLogStore(store LogStore) *CompatLogStore {
+	return &CompatLogStore{store: store}
+}
+
+// IsMonotonic implements the MonotonicLogStore interface. This is a shim to
+// expose the underlying store as monotonically indexed or not.
+func (c *CompatLogStore) IsMonotonic() bool {
+	if store, ok := c.store.(MonotonicLogStore); ok {
+		return store.IsMonotonic()
+	}
+	return false
+}
+
+// FirstIndex implements the LogStore interface.
+func (c *CompatLogStore) FirstIndex() (uint64, error) {
+	return c.store.FirstIndex()
+}
+
+// LastIndex implements the LogStore interface.
+func (c *CompatLogStore) LastIndex() (uint64, error) {
+	return c.store.LastIndex()
+}
+
+// GetLog implements the LogStore interface.
+func (c *CompatLogStore) GetLog(index uint64, log *Log) error {
+	if err := c.store.GetLog(index, log); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(log.Extensions, compatLogMagic) {
+		return nil
+	}
+	var fields compatLogFields
+	if err := decodeMsgPack(log.Extensions[len(compatLogMagic):], &fields); err != nil {
+		return fmt.Errorf("failed to decode log fields at index %d: %v", index, err)
+	}
+	log.Version = fields.Version
+	log.TTL = fields.TTL
+	log.ExpiredIndex = fields.ExpiredIndex
+	log.ScheduledIndex = fields.ScheduledIndex
+	log.Checksum = fields.Checksum
+	log.Extensions = fields.Extensions
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (c *CompatLogStore) StoreLog(log *Log) error {
+	packed, err := packCompatLog(log)
+	if err != nil {
+		return err
+	}
+	return c.store.StoreLog(packed)
+}
+
+// StoreLogs implements the LogStore interface.
+func (c *CompatLogStore) StoreLogs(logs []*Log) error {
+	packed := make([]*Log, len(logs))
+	for i, log := range logs {
+		var err error
+		if packed[i], err = packCompatLog(log); err != nil {
+			return err
+		}
+	}
+	return c.store.StoreLogs(packed)
+}
+
+// DeleteRange implements the LogStore interface.
+func (c *CompatLogStore) DeleteRange(min, max uint64) error {
+	return c.store.DeleteRange(min, max)
+}
+
+// packCompatLog returns a copy of log with the fields hashicorp/raft doesn't
+// have packed into its Extensions, or log itself if they're all unset.
+func packCompatLog(log *Log) (*Log, error) {
+	if log.Version == 0 && log.TTL == 0 && log.ExpiredIndex == 0 && log.ScheduledIndex == 0 && log.Checksum == 0 {
+		return log, nil
+	}
+	buf, err := encodeMsgPack(compatLogFields{
+		Version:        log.Version,
+		TTL:            log.TTL,
+		ExpiredIndex:   log.ExpiredIndex,
+		ScheduledIndex: log.ScheduledIndex,
+		Checksum:       log.Checksum,
+		Extensions:     log.Extensions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log fields at index %d: %v", log.Index, err)
+	}
+	packed := *log
+	packed.Version = 0
+	packed.TTL = 0
+	packed.ExpiredIndex = 0
+	packed.ScheduledIndex = 0
+	packed.Checksum = 0
+	packed.Extensions = append(append([]byte(nil), compatLogMagic...), buf.Bytes()...)
+	return &packed, nil
+}
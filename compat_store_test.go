@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamLogStore mimics a store with a codec that only keeps the fields
+// hashicorp/raft has.
+type upstreamLogStore struct {
+	*InmemStore
+}
+
+func (s upstreamLogStore) StoreLog(log *Log) error {
+	return s.StoreLogs([]*Log{log})
+}
+
+func (s upstreamLogStore) StoreLogs(logs []*Log) error {
+	for _, log := range logs {
+		if err := s.InmemStore.StoreLog(&Log{
+			Index:      log.Index,
+			Term:       log.Term,
+			Type:       log.Type,
+			Data:       log.Data,
+			Extensions: log.Extensions,
+			AppendedAt: log.AppendedAt,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompatLogStore(t *testing.T) {
+	inner := upstreamLogStore{NewInmemStore()}
+	store := NewCompatLogStore(inner)
+
+	entry := &Log{
+		Version:    LogVersionMax,
+		Index:      1,
+		Term:       2,
+		Type:       LogCommand,
+		Data:       []byte("data"),
+		Extensions: []byte("ext"),
+		TTL:        time.Minute,
+		AppendedAt: time.Now().Round(0),
+	}
+	entry.SetChecksum()
+	expiry := &Log{Version: LogVersionMax, Index: 2, Term: 2, Type: LogExpiry, ExpiredIndex: 1}
+	expiry.SetChecksum()
+	require.NoError(t, store.StoreLog(entry))
+	require.NoError(t, store.StoreLogs([]*Log{expiry}))
+
+	// The entries given to the store aren't changed.
+	require.Equal(t, []byte("ext"), entry.Extensions)
+
+	// Everything survives the round trip.
+	var out Log
+	require.NoError(t, store.GetLog(1, &out))
+	require.Equal(t, *entry, out)
+	require.NoError(t, out.VerifyChecksum())
+	require.NoError(t, store.GetLog(2, &out))
+	require.Equal(t, *expiry, out)
+
+	// Without the wrapper the extra fields are lost.
+	require.NoError(t, inner.GetLog(1, &out))
+	require.Zero(t, out.TTL)
+
+	// Entries written before the wrapper are read as they are.
+	require.NoError(t, inner.InmemStore.StoreLog(&Log{Index: 3, Term: 2, Extensions: []byte("old")}))
+	require.NoError(t, store.GetLog(3, &out))
+	require.Equal(t, Log{Index: 3, Term: 2, Extensions: []byte("old")}, out)
+
+	require.False(t, store.IsMonotonic())
+}
+
+func TestRaft_CompatLogStore(t *testing.T) {
+	conf := inmemConfig(t)
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     1,
+		Bootstrap: true,
+		Conf:      conf,
+	})
+	defer c.Close()
+	leader := c.Leader()
+	require.NoError(t, leader.Shutdown().Error())
+
+	// Restart on a store that would drop the fields only this package has.
+	inner := upstreamLogStore{NewInmemStore()}
+	store := NewCompatLogStore(inner)
+	first, err := leader.logs.FirstIndex()
+	require.NoError(t, err)
+	last, err := leader.logs.LastIndex()
+	require.NoError(t, err)
+	for i := first; i <= last; i++ {
+		var entry Log
+		require.NoError(t, leader.logs.GetLog(i, &entry))
+		require.NoError(t, store.StoreLog(&entry))
+	}
+	_, trans := NewInmemTransport(leader.localAddr)
+	lconf := leader.config()
+	r, err := NewRaft(&lconf, &MockFSM{}, NewChecksumLogStore(store), leader.stable, leader.snapshots, trans)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, r.Shutdown().Error()) }()
+	retry(t, func() bool { return r.State() == Leader })
+
+	future := r.ApplyLog(Log{Data: []byte("test"), TTL: time.Hour}, time.Second)
+	require.NoError(t, future.Error())
+	var entry Log
+	require.NoError(t, store.GetLog(future.Index(), &entry))
+	require.Equal(t, time.Hour, entry.TTL)
+	require.NoError(t, entry.VerifyChecksum())
+}
@@ -125,13 +125,20 @@ const (
 //	Since the original Raft library didn't enforce any versioning, we must
 //	include the legacy peers structure for this version, but we can deprecate
 //	it in the next snapshot version.
+//
+// 2: Raft's own state, such as entries with a TTL that haven't expired, may be
+//
+//	written ahead of the FSM's data. Only snapshots with such state are
+//	created with this version, so that servers that don't understand it
+//	refuse them rather than handing the state to the FSM. SnapshotStore
+//	implementations must accept it as well as version 1.
 type SnapshotVersion int
 
 const (
 	// SnapshotVersionMin is the minimum snapshot version
 	SnapshotVersionMin SnapshotVersion = 0
 	// SnapshotVersionMax is the maximum snapshot version
-	SnapshotVersionMax = 1
+	SnapshotVersionMax = 2
 )
 
 // Config provides any necessary configuration for the Raft server.
@@ -143,9 +150,23 @@ type Config struct {
 	// no auto-negotiation of versions so all servers must be manually
 	// configured with compatible versions. See ProtocolVersionMin and
 	// ProtocolVersionMax for the versions of the protocol that this server
-	// can _understand_.
+	// can _understand_, and MinProtocolVersion and MaxProtocolVersion for
+	// those it accepts.
 	ProtocolVersion ProtocolVersion
 
+	// MinProtocolVersion and MaxProtocolVersion bound the protocol versions
+	// of the RPCs this server accepts from other servers, which are refused
+	// with ErrUnsupportedProtocol outside of them. If zero, RPCs from one
+	// version below ProtocolVersion up to ProtocolVersionMax are accepted.
+	// During an upgrade, narrowing the range lets a server refuse peers that
+	// haven't been upgraded far enough, or widening it lets servers two
+	// versions apart interoperate where the protocols allow it. Both must
+	// include ProtocolVersion.
+	//
+	// Experimental: see docs/api_stability.md.
+	MinProtocolVersion ProtocolVersion
+	MaxProtocolVersion ProtocolVersion
+
 	// HeartbeatTimeout specifies the time in follower state without contact
 	// from a leader before we attempt an election.
 	HeartbeatTimeout time.Duration
@@ -198,6 +219,60 @@ type Config struct {
 	// setting used. This can be tuned during operation using ReloadConfig.
 	SnapshotThreshold uint64
 
+	// SnapshotCatchupGap controls how far behind a follower may be before the
+	// leader sends it the latest snapshot instead of replicating logs, even if
+	// the logs are still available. This only takes effect when the latest
+	// snapshot is past the follower's next index. A value of 0 disables this
+	// and the leader only falls back to a snapshot once the logs it needs have
+	// been compacted.
+	SnapshotCatchupGap uint64
+
+	// SnapshotCatchupRejections controls how many consecutive AppendEntries
+	// rejections the leader tolerates while searching backwards for a
+	// follower's matching log before sending it the latest snapshot instead.
+	// A value of 0 disables this.
+	SnapshotCatchupRejections uint64
+
+	// RequestVoteRateLimit limits how many RequestVote RPCs per second are
+	// processed from each sender, in bursts of up to that many, or of one if
+	// it's less than one. Senders are told apart by the host the transport
+	// received the request from, where it says. Only requests that would be
+	// denied anyway, because the candidate has no vote or its log is behind,
+	// are limited, and those beyond the limit are denied before they can
+	// change the term or read the StableStore, so a misbehaving server can't
+	// tie up this one with them. A value of 0 disables this.
+	RequestVoteRateLimit float64
+
+	// TermInflationGuard limits the disruption caused by a server rejoining
+	// with a much higher term than the cluster's, such as after a long
+	// partition when PreVote is disabled or not yet supported by every
+	// server. Normally the leader steps down when such a follower rejects
+	// its AppendEntries, and the cluster is leaderless until an election
+	// timeout passes. With this set, if the follower's log is behind the
+	// leader's, so it can't win an election itself, the leader instead stands
+	// for re-election in the follower's term straight away, then catches the
+	// follower up as usual.
+	TermInflationGuard bool
+
+	// CatchUpStreams controls how a follower that is behind, such as a new
+	// server or one that has just installed a snapshot, is caught up. If it
+	// is more than 1, once the follower's log matches, the leader loads up to
+	// this many batches of MaxAppendEntries entries from the LogStore in
+	// parallel and sends them all at once, each over its own connection.
+	// When the follower is within a batch, replication carries on as normal.
+	// Otherwise batches are loaded and sent one at a time until the follower
+	// has caught up. With the NetworkTransport, a MaxPool of at least this
+	// many keeps the connections open between batches.
+	CatchUpStreams int
+
+	// ReplicationStartConcurrency limits how many followers the leader probes
+	// and catches up at once when it starts replicating to them, such as
+	// after winning an election. The others wait their turn, though they're
+	// still sent heartbeats so they don't time out. This spreads the load on
+	// the LogStore and network when many followers need catching up at the
+	// same time. A value of 0 means no limit.
+	ReplicationStartConcurrency int
+
 	// LeaderLeaseTimeout is used to control how long the "lease" lasts
 	// for being the leader without being able to contact a quorum
 	// of nodes. If we reach this interval without contact, we will
@@ -214,6 +289,11 @@ type Config struct {
 	// buffered or aggressively consumed.
 	NotifyCh chan<- bool
 
+	// AuditSink, if set, is sent a record of each administrative operation
+	// invoked on this server, such as configuration changes, leadership
+	// transfers, snapshots and restores. See AuditSink.
+	AuditSink AuditSink
+
 	// LogOutput is used as a sink for logs, unless Logger is specified.
 	// Defaults to os.Stderr.
 	LogOutput io.Writer
@@ -232,10 +312,258 @@ type Config struct {
 	// raft's configuration and index values.
 	NoSnapshotRestoreOnStart bool
 
+	// StagingPromotionThreshold controls how new voters join the cluster. If
+	// zero, AddVoter gives a server a vote straight away, so adding a server
+	// that is far behind can cost availability until it catches up. Otherwise
+	// AddVoter adds the server as Staging, which receives logs but doesn't
+	// vote, and the leader promotes it to a Voter once its match index is
+	// within this many entries of the leader's last index.
+	StagingPromotionThreshold uint64
+
+	// ClockSkewThreshold is how far apart the leader's and a follower's wall
+	// clocks can be before the leader warns about it. The follower's clock is
+	// sampled from heartbeat responses, so skew smaller than the heartbeat
+	// round trip can't be detected. Lease based features and correlating
+	// logs across servers both suffer from skew. If zero, skew is still
+	// reported in metrics but never warned about.
+	ClockSkewThreshold time.Duration
+
+	// LeaseReadMaxClockSkew enables LeaseRead and bounds how much faster the
+	// leader's clock may run than a follower's over a heartbeat interval.
+	// The leader treats a quorum's acknowledgement of a heartbeat as a lease
+	// for the lesser of HeartbeatTimeout and ElectionTimeout, less this
+	// bound, since no follower campaigns before then. If zero, lease reads
+	// are disabled and LeaseRead always fails.
+	LeaseReadMaxClockSkew time.Duration
+
+	// PreVote controls if a candidate first asks the other voters whether
+	// they would vote for it before starting an election. The election, and
+	// the term increment that goes with it, only happens if a quorum agree.
+	// This stops a server that was partitioned away from disrupting a healthy
+	// leader when it rejoins. It requires a transport implementing
+	// WithPreVote and should only be enabled once every server supports it,
+	// since servers that don't will never grant a pre-vote.
+	PreVote bool
+
+	// PersistReplicationProgress controls if the leader periodically saves how
+	// far each follower has replicated in the StableStore. When this server
+	// next becomes leader it starts replicating to each follower from the
+	// saved position instead of from the end of its own log. The saved
+	// positions are only hints; a follower that has diverged is still found
+	// by the usual consistency check.
+	PersistReplicationProgress bool
+
+	// ReadyMaxLag is how many committed entries the FSM can be behind on
+	// before Ready reports that this server isn't ready. If zero, every
+	// committed entry must have been applied.
+	ReadyMaxLag uint64
+
+	// ProbeTimeout is how long Live waits for the main goroutine and each of
+	// the stores to respond before reporting that this server isn't live.
+	// If zero, 5 seconds is used.
+	ProbeTimeout time.Duration
+
+	// RetryJoin is a list of addresses of servers to ask to add this server
+	// to the cluster as a voter. A server that isn't part of a configuration
+	// yet asks each of them in turn, retrying with backoff, until one accepts.
+	// A server that isn't the leader redirects the request to the leader,
+	// which must have AuthorizeJoin set. It requires a transport implementing
+	// WithJoin, and should only be set on servers that aren't bootstrapped.
+	RetryJoin []string
+
+	// RetryJoinInterval is how long to wait after the first failed round of
+	// RetryJoin before trying again. The wait doubles after each round, up
+	// to 16 times this. If zero, 1 second is used.
+	RetryJoinInterval time.Duration
+
+	// RetryJoinMaxAttempts is how many rounds of RetryJoin are made before
+	// giving up. If zero, there is no limit.
+	RetryJoinMaxAttempts int
+
+	// AuthorizeJoin is called on the leader when a server asks to join the
+	// cluster with RetryJoin, and the server is only added as a voter if it
+	// returns nil. Requests to join are refused if it isn't set. The request
+	// isn't authenticated beyond what the transport does, so it should check
+	// the server is one that's expected to join. A server that's already in
+	// the configuration can't join under a different ID or address whatever
+	// this returns.
+	AuthorizeJoin func(id ServerID, address ServerAddress) error
+
+	// FatalErrorPolicy controls what happens when raft hits an error it can't
+	// recover from, such as the LogStore failing to return a committed log
+	// that needs to be applied. Defaults to FatalErrorPanic.
+	FatalErrorPolicy FatalErrorPolicy
+
+	// FaultCh is used to provide a channel that will be sent the error that
+	// caused raft to shut down when FatalErrorPolicy is FatalErrorShutdown.
+	// Raft will not block writing to this channel, so it should be buffered.
+	FaultCh chan<- error
+
+	// PeerCodec is used to encode the legacy peers format that is still
+	// written to RemovePeer log entries, snapshot RPCs and RequestVote
+	// responses for compatibility with older servers. Every codec decodes
+	// all known peers formats, so old log entries remain readable after a
+	// change. If nil, LegacyPeerCodec is used.
+	//
+	// Experimental: see docs/api_stability.md.
+	PeerCodec PeerCodec
+
+	// Backoff decides how long to wait before retrying replication,
+	// heartbeats, elections and RetryJoin after failures. If nil,
+	// DefaultBackoff is used.
+	//
+	// Experimental: see docs/api_stability.md.
+	Backoff Backoff
+
+	// LoopProfiler, if set, is told how long each iteration of the leader,
+	// FSM and replication loops spends working. See MetricsLoopProfiler.
+	//
+	// Experimental: see docs/api_stability.md.
+	LoopProfiler LoopProfiler
+
+	// QueueSaturationThreshold is the fraction of a queue's capacity its
+	// depth must stay above for QueueSaturationPeriod before it's considered
+	// saturated. See QueueName for the queues and their capacities.
+	//
+	// Experimental: see docs/api_stability.md.
+	QueueSaturationThreshold float64
+
+	// QueueSaturationPeriod is how long a queue must stay above
+	// QueueSaturationThreshold before a QueueSaturationObservation is sent
+	// and a warning logged, giving early warning of overload before
+	// operations start timing out. Queue depths are also reported in the
+	// raft.queue.depth gauge. If zero, the default, queue depths aren't
+	// tracked.
+	//
+	// Experimental: see docs/api_stability.md.
+	QueueSaturationPeriod time.Duration
+
+	// CommitLatencySLO, if positive, is the commit latency the leader is
+	// expected to stay within. If the latency stays above it for
+	// CommitLatencySLOWindow, a CommitLatencyObservation is sent and an error
+	// logged, and another observation is sent once it recovers. The latency
+	// is the mean time taken to commit entries, or how long the oldest
+	// uncommitted entry has been waiting if that's longer.
+	//
+	// Experimental: see docs/api_stability.md.
+	CommitLatencySLO time.Duration
+
+	// CommitLatencySLOWindow is how long the commit latency must stay above
+	// CommitLatencySLO to count as a breach. If zero, 30 seconds is used.
+	//
+	// Experimental: see docs/api_stability.md.
+	CommitLatencySLOWindow time.Duration
+
+	// CommitLatencySLOTransfer, if set, transfers leadership on a breach of
+	// CommitLatencySLO to the voter that is furthest along replicating, and
+	// acks fastest among those, as the cause is often the leader itself.
+	//
+	// Experimental: see docs/api_stability.md.
+	CommitLatencySLOTransfer bool
+
+	// SnapshotIOWorkers, if positive, runs the I/O of persisting snapshots
+	// on this many dedicated threads with their I/O priority lowered where
+	// the platform supports it, like ionice on Linux, so that background
+	// snapshots don't slow down writes to the log on a shared disk. Restores
+	// aren't affected, since the server can't make progress until they're
+	// done.
+	//
+	// Experimental: see docs/api_stability.md.
+	SnapshotIOWorkers int
+
+	// SnapshotIOBytesPerSecond, if positive, throttles the I/O of persisting
+	// snapshots to this rate where SnapshotIOWorkers can't lower its priority.
+	// If SnapshotIOWorkers isn't set, a single worker is used.
+	//
+	// Experimental: see docs/api_stability.md.
+	SnapshotIOBytesPerSecond int64
+
+	// SnapshotReceiveBufferSize, if positive, bounds how many bytes of a
+	// snapshot being received from the leader are read from the network
+	// ahead of writing them to the snapshot store, so that reading and
+	// writing overlap without memory growing when the disk is slower than
+	// the network. The rate the snapshot was written at is reported back to
+	// the leader, which paces later snapshots it sends to this server to it.
+	//
+	// Experimental: see docs/api_stability.md.
+	SnapshotReceiveBufferSize int
+
+	// SnapshotReceiveSyncBytes, if positive, syncs a snapshot being received
+	// from the leader each time this many bytes have been written, if the
+	// snapshot store's sink is a SyncableSnapshotSink, such as
+	// FileSnapshotStore's, rather than only once it's complete. This keeps
+	// the amount of unwritten data the OS holds for it bounded.
+	//
+	// Experimental: see docs/api_stability.md.
+	SnapshotReceiveSyncBytes int64
+
+	// SnapshotOutageLogBudget is how many bytes of log entries, counting
+	// their data and extensions, may be kept beyond TrailingLogs after the
+	// snapshot store has been failing. No snapshots are taken while it's
+	// failing, so the log isn't compacted, and followers that fall behind
+	// can't be sent one. The first compaction once it recovers keeps the
+	// entries written in that time, up to this budget, so those followers
+	// can catch up from the log. A value of 0 compacts to TrailingLogs as
+	// usual.
+	//
+	// Experimental: see docs/api_stability.md.
+	SnapshotOutageLogBudget uint64
+
+	// CheckInvariants checks that Raft's state stays consistent after every
+	// change to it, such as the commit index never being past the last log
+	// index, treating a violation as a fatal error matching
+	// ErrInvariantViolation. The checks add overhead, so they're meant for
+	// development and testing. This can't be changed by ReloadConfig.
+	//
+	// Experimental: see docs/api_stability.md.
+	CheckInvariants bool
+
+	// PeerStore is a legacy peer store to read the configuration from if
+	// none is found in the snapshots or the log. The first leader elected
+	// appends the configuration to the log, after which the PeerStore is
+	// ignored. See PeerStoreConfiguration.
+	//
+	// Experimental: see docs/api_stability.md.
+	PeerStore PeerStore
+
+	// CanBecomeLeader, if set, is called before this server starts an
+	// election, including one asked for by a leadership transfer. If it
+	// returns false the server stays a follower, still voting and
+	// replicating, so an embedder can keep an unhealthy server from seeking
+	// leadership without changing its suffrage. It's called from the main
+	// thread, so it must return quickly. This can't be changed by
+	// ReloadConfig.
+	//
+	// Experimental: see docs/api_stability.md.
+	CanBecomeLeader func() bool
+
+	// Recorder, if set, records a trace of the RPCs this server handles,
+	// the timer firings that change its state, and its writes to the log
+	// and stable store, which can be replayed with Replay. This can't be
+	// changed by ReloadConfig.
+	//
+	// Experimental: see docs/api_stability.md.
+	Recorder *Recorder
+
 	// skipStartup allows NewRaft() to bypass all background work goroutines
 	skipStartup bool
 }
 
+// FatalErrorPolicy is the action raft takes when it hits an error it can't
+// recover from.
+type FatalErrorPolicy uint8
+
+const (
+	// FatalErrorPanic panics, crashing the process raft is embedded in. This
+	// is the default and matches the historical behavior.
+	FatalErrorPanic FatalErrorPolicy = iota
+	// FatalErrorShutdown shuts raft down so that this server stops
+	// participating in the cluster, and reports the error on Config.FaultCh.
+	// The rest of the process is left running so that it can alert, drain
+	// or otherwise handle the failure.
+	FatalErrorShutdown
+)
+
 func (conf *Config) getOrCreateLogger() hclog.Logger {
 	if conf.Logger != nil {
 		return conf.Logger
@@ -307,20 +635,43 @@ func (rc *ReloadableConfig) fromConfig(from Config) {
 // DefaultConfig returns a Config with usable defaults.
 func DefaultConfig() *Config {
 	return &Config{
-		ProtocolVersion:    ProtocolVersionMax,
-		HeartbeatTimeout:   1000 * time.Millisecond,
-		ElectionTimeout:    1000 * time.Millisecond,
-		CommitTimeout:      50 * time.Millisecond,
-		MaxAppendEntries:   64,
-		ShutdownOnRemove:   true,
-		TrailingLogs:       10240,
-		SnapshotInterval:   120 * time.Second,
-		SnapshotThreshold:  8192,
-		LeaderLeaseTimeout: 500 * time.Millisecond,
-		LogLevel:           "DEBUG",
+		ProtocolVersion:          ProtocolVersionMax,
+		HeartbeatTimeout:         1000 * time.Millisecond,
+		ElectionTimeout:          1000 * time.Millisecond,
+		CommitTimeout:            50 * time.Millisecond,
+		MaxAppendEntries:         64,
+		ShutdownOnRemove:         true,
+		TrailingLogs:             10240,
+		SnapshotInterval:         120 * time.Second,
+		SnapshotThreshold:        8192,
+		LeaderLeaseTimeout:       500 * time.Millisecond,
+		ClockSkewThreshold:       1 * time.Second,
+		ReadyMaxLag:              1024,
+		ProbeTimeout:             5 * time.Second,
+		QueueSaturationThreshold: 0.9,
+		LogLevel:                 "DEBUG",
 	}
 }
 
+// supportedProtocolVersions returns the range of protocol versions this server
+// accepts RPCs for, applying the defaults for MinProtocolVersion and
+// MaxProtocolVersion.
+func (conf *Config) supportedProtocolVersions() (ProtocolVersion, ProtocolVersion) {
+	min, max := conf.MinProtocolVersion, conf.MaxProtocolVersion
+	if min == 0 {
+		// Support one version back, which drops support for protocol version
+		// 0 starting at protocol version 2.
+		min = conf.ProtocolVersion - 1
+		if min < ProtocolVersionMin {
+			min = ProtocolVersionMin
+		}
+	}
+	if max == 0 {
+		max = ProtocolVersionMax
+	}
+	return min, max
+}
+
 // ValidateConfig is used to validate a sane configuration
 func ValidateConfig(config *Config) error {
 	// We don't actually support running as 0 in the library any more, but
@@ -334,6 +685,11 @@ func ValidateConfig(config *Config) error {
 		return fmt.Errorf("ProtocolVersion %d must be >= %d and <= %d",
 			config.ProtocolVersion, protocolMin, ProtocolVersionMax)
 	}
+	if min, max := config.supportedProtocolVersions(); min > config.ProtocolVersion || max < config.ProtocolVersion ||
+		min < ProtocolVersionMin || max > ProtocolVersionMax {
+		return fmt.Errorf("supported protocol versions %d to %d must include ProtocolVersion %d and be within %d to %d",
+			min, max, config.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
+	}
 	if len(config.LocalID) == 0 {
 		return fmt.Errorf("LocalID cannot be empty")
 	}
@@ -355,6 +711,9 @@ func ValidateConfig(config *Config) error {
 	if config.SnapshotInterval < 5*time.Millisecond {
 		return fmt.Errorf("SnapshotInterval is too low")
 	}
+	if config.SnapshotThreshold == 0 {
+		return fmt.Errorf("SnapshotThreshold must be positive")
+	}
 	if config.LeaderLeaseTimeout < 5*time.Millisecond {
 		return fmt.Errorf("LeaderLeaseTimeout is too low")
 	}
@@ -364,5 +723,8 @@ func ValidateConfig(config *Config) error {
 	if config.ElectionTimeout < config.HeartbeatTimeout {
 		return fmt.Errorf("ElectionTimeout (%s) must be equal or greater than Heartbeat Timeout (%s)", config.ElectionTimeout, config.HeartbeatTimeout)
 	}
+	if config.QueueSaturationPeriod > 0 && config.QueueSaturationThreshold <= 0 {
+		return fmt.Errorf("QueueSaturationThreshold must be positive")
+	}
 	return nil
 }
@@ -0,0 +1,90 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// ConfigurationChangeFuture is implemented by the futures returned by
+// AddVoter, AddNonvoter, AddWitness, DemoteVoter and RemoveServer once the
+// request has been handed to Raft.
+type ConfigurationChangeFuture interface {
+	IndexFuture
+
+	// Coalesced returns true if the request was identical to one that was
+	// still in progress, so rather than making a change of its own, it
+	// resolves with that request's outcome and index.
+	Coalesced() bool
+}
+
+// configChangeKey identifies membership change requests that have the same
+// effect, so that duplicates can be coalesced.
+type configChangeKey struct {
+	command       ConfigurationChangeCommand
+	serverID      ServerID
+	serverAddress ServerAddress
+	prevIndex     uint64
+}
+
+// coalescable returns true if requests identical to req can share its
+// outcome.
+func coalescable(req configurationChangeRequest) bool {
+	switch req.command {
+	case AddVoter, AddNonvoter, AddWitness, DemoteVoter, RemoveServer:
+		return true
+	default:
+		return false
+	}
+}
+
+// coalesceConfigChange returns a future that resolves with the outcome of an
+// identical request that's still in progress, if there is one. Otherwise it
+// returns nil, and future is tracked so that later duplicates of it can be
+// coalesced until it resolves.
+func (r *Raft) coalesceConfigChange(future *configurationChangeFuture) *configurationChangeFuture {
+	if !coalescable(future.req) {
+		return nil
+	}
+	key := configChangeKey{
+		command:       future.req.command,
+		serverID:      future.req.serverID,
+		serverAddress: future.req.serverAddress,
+		prevIndex:     future.req.prevIndex,
+	}
+
+	r.configChangeLock.Lock()
+	defer r.configChangeLock.Unlock()
+	if pending, ok := r.configChanges[key]; ok {
+		dup := &configurationChangeFuture{req: future.req, coalesced: true}
+		dup.init()
+		pending.duplicates = append(pending.duplicates, dup)
+		metrics.IncrCounter([]string{"raft", "configurationChange", "coalesced"}, 1)
+		return dup
+	}
+	if r.configChanges == nil {
+		r.configChanges = make(map[configChangeKey]*configurationChangeFuture)
+	}
+	r.configChanges[key] = future
+
+	prev := future.onRespond
+	future.onRespond = func(err error) {
+		if prev != nil {
+			prev(err)
+		}
+		r.configChangeLock.Lock()
+		delete(r.configChanges, key)
+		duplicates := future.duplicates
+		future.duplicates = nil
+		r.configChangeLock.Unlock()
+		for _, dup := range duplicates {
+			dup.log.Index = future.log.Index
+			dup.respond(err)
+		}
+	}
+	return nil
+}
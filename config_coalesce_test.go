@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_CoalesceConfigChange(t *testing.T) {
+	r := &Raft{}
+	newFuture := func(req configurationChangeRequest) *configurationChangeFuture {
+		future := &configurationChangeFuture{req: req}
+		future.init()
+		return future
+	}
+	add := configurationChangeRequest{command: AddVoter, serverID: "a", serverAddress: "addr"}
+
+	first := newFuture(add)
+	require.Nil(t, r.coalesceConfigChange(first))
+	dup := r.coalesceConfigChange(newFuture(add))
+	require.NotNil(t, dup)
+	require.True(t, dup.Coalesced())
+	require.False(t, first.Coalesced())
+
+	// Different requests, and ones that can't be coalesced, aren't.
+	other := add
+	other.serverAddress = "other"
+	require.Nil(t, r.coalesceConfigChange(newFuture(other)))
+	require.Nil(t, r.coalesceConfigChange(newFuture(configurationChangeRequest{command: leaveJoint})))
+	require.Nil(t, r.coalesceConfigChange(newFuture(configurationChangeRequest{command: leaveJoint})))
+
+	// The duplicate resolves with the original's outcome.
+	first.log.Index = 7
+	first.respond(errors.New("failed"))
+	require.EqualError(t, dup.Error(), "failed")
+	require.Equal(t, uint64(7), dup.Index())
+
+	// Once the original has resolved, the same request starts afresh.
+	require.Nil(t, r.coalesceConfigChange(newFuture(add)))
+}
+
+func TestRaft_CoalesceConfigChange_Cluster(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+
+	var wg sync.WaitGroup
+	futures := make([]IndexFuture, 10)
+	for i := range futures {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			futures[i] = leader.DemoteVoter(follower.localID, 0, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	var coalesced int
+	indexes := make(map[uint64]bool)
+	for _, future := range futures {
+		require.NoError(t, future.Error())
+		if future.(ConfigurationChangeFuture).Coalesced() {
+			coalesced++
+		}
+		indexes[future.Index()] = true
+	}
+	// Each change made is either its own request or shared.
+	require.Equal(t, len(futures)-coalesced, len(indexes))
+}
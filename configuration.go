@@ -18,9 +18,16 @@ const (
 	Nonvoter
 	// Staging is a server that acts like a Nonvoter. A configuration change
 	// with a ConfigurationChangeCommand of Promote can change a Staging server
-	// into a Voter.
-	// Deprecated: use Nonvoter instead.
+	// into a Voter. When Config.StagingPromotionThreshold is set, AddVoter
+	// adds new servers as Staging and the leader promotes them once they have
+	// caught up.
 	Staging
+	// Witness is a server whose vote is counted in elections and whose match
+	// index is used in advancing the leader's commit index, but which never
+	// stands for election itself. Witnesses are only sent the headers of log
+	// entries (everything but Data and Extensions, except for configuration
+	// entries) so they can't serve as leader or apply commands to their FSM.
+	Witness
 )
 
 func (s ServerSuffrage) String() string {
@@ -31,10 +38,18 @@ func (s ServerSuffrage) String() string {
 		return "Nonvoter"
 	case Staging:
 		return "Staging"
+	case Witness:
+		return "Witness"
 	}
 	return "ServerSuffrage"
 }
 
+// isVoting returns true if a server with this suffrage counts towards election
+// and commitment quorums.
+func (s ServerSuffrage) isVoting() bool {
+	return s == Voter || s == Witness
+}
+
 // ConfigurationStore provides an interface that can optionally be implemented by FSMs
 // to store configuration updates made in the replicated log. In general this is only
 // necessary for FSMs that mutate durable state directly instead of applying changes
@@ -77,14 +92,45 @@ type Server struct {
 // These entries are appended to the log during membership changes.
 type Configuration struct {
 	Servers []Server
+
+	// Outgoing is set to the previous servers while a joint consensus change
+	// made with ChangeConfiguration is in progress. Elections and commitment
+	// then need a majority of the voters in Servers and a majority of the
+	// voters in Outgoing. It is nil otherwise.
+	//
+	// Experimental: see docs/api_stability.md.
+	Outgoing []Server
+
+	// Parameters are the ClusterParameters replicated to every server, set
+	// with SetClusterParameters. It is nil if none have been set.
+	//
+	// Experimental: see docs/api_stability.md.
+	Parameters *ClusterParameters
 }
 
 // Clone makes a deep copy of a Configuration.
 func (c *Configuration) Clone() (copy Configuration) {
 	copy.Servers = append(copy.Servers, c.Servers...)
+	copy.Outgoing = append(copy.Outgoing, c.Outgoing...)
+	copy.Parameters = c.Parameters.clone()
 	return
 }
 
+// String formats the configuration the same way as the %v verb, adding the
+// outgoing servers only during a joint consensus change.
+func (c Configuration) String() string {
+	if !c.isJoint() {
+		return fmt.Sprintf("{%v}", c.Servers)
+	}
+	return fmt.Sprintf("{%v outgoing:%v}", c.Servers, c.Outgoing)
+}
+
+// isJoint returns true if the configuration is part way through a joint
+// consensus change.
+func (c *Configuration) isJoint() bool {
+	return len(c.Outgoing) > 0
+}
+
 // ConfigurationChangeCommand is the different ways to change the cluster
 // configuration.
 type ConfigurationChangeCommand uint8
@@ -105,6 +151,18 @@ const (
 	// AddStaging makes a server a Voter.
 	// Deprecated: AddStaging was actually AddVoter. Use AddVoter instead.
 	AddStaging = 0 // explicit 0 to preserve the old value.
+	// AddWitness adds a server with Suffrage of Witness.
+	AddWitness ConfigurationChangeCommand = iota
+	// addStaging makes a server Staging unless it's a Voter. AddVoter is
+	// translated into this when Config.StagingPromotionThreshold is set.
+	addStaging
+	// enterJoint starts a joint consensus change to the requested servers.
+	enterJoint
+	// leaveJoint finishes a joint consensus change by dropping the outgoing
+	// servers.
+	leaveJoint
+	// setParameters replaces the cluster parameters.
+	setParameters
 )
 
 func (c ConfigurationChangeCommand) String() string {
@@ -119,6 +177,16 @@ func (c ConfigurationChangeCommand) String() string {
 		return "RemoveServer"
 	case Promote:
 		return "Promote"
+	case AddWitness:
+		return "AddWitness"
+	case addStaging:
+		return "AddStaging"
+	case enterJoint:
+		return "EnterJoint"
+	case leaveJoint:
+		return "LeaveJoint"
+	case setParameters:
+		return "SetParameters"
 	}
 	return "ConfigurationChangeCommand"
 }
@@ -129,11 +197,17 @@ func (c ConfigurationChangeCommand) String() string {
 type configurationChangeRequest struct {
 	command       ConfigurationChangeCommand
 	serverID      ServerID
-	serverAddress ServerAddress // only present for AddVoter, AddNonvoter
+	serverAddress ServerAddress // only present for AddVoter, AddNonvoter, AddWitness
+	servers       []Server      // only present for enterJoint
+	// parameters are only present for setParameters, and nil to clear them.
+	parameters *ClusterParameters
 	// prevIndex, if nonzero, is the index of the only configuration upon which
 	// this change may be applied; if another configuration entry has been
 	// added in the meantime, this request will fail.
 	prevIndex uint64
+	// requester is the server that asked for this change over RPC, or empty
+	// if it was asked for through this server's API.
+	requester ServerID
 }
 
 // configurations is state tracked on every server about its Configurations.
@@ -170,9 +244,14 @@ func (c *configurations) Clone() (copy configurations) {
 }
 
 // hasVote returns true if the server identified by 'id' is a Voter in the
-// provided Configuration.
+// provided Configuration, or in its outgoing servers during a joint consensus
+// change.
 func hasVote(configuration Configuration, id ServerID) bool {
-	for _, server := range configuration.Servers {
+	return serversHaveVote(configuration.Servers, id) || serversHaveVote(configuration.Outgoing, id)
+}
+
+func serversHaveVote(servers []Server, id ServerID) bool {
+	for _, server := range servers {
 		if server.ID == id {
 			return server.Suffrage == Voter
 		}
@@ -180,10 +259,64 @@ func hasVote(configuration Configuration, id ServerID) bool {
 	return false
 }
 
-// inConfiguration returns true if the server identified by 'id' is in in the
+// isWitness returns true if the server identified by 'id' is a Witness in the
 // provided Configuration.
+func isWitness(configuration Configuration, id ServerID) bool {
+	for _, server := range configuration.Servers {
+		if server.ID == id {
+			return server.Suffrage == Witness
+		}
+	}
+	return false
+}
+
+// inConfiguration returns true if the server identified by 'id' is in in the
+// provided Configuration, or in its outgoing servers during a joint consensus
+// change.
 func inConfiguration(configuration Configuration, id ServerID) bool {
+	for _, server := range allServers(configuration) {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// allServers returns the servers in the configuration followed by any
+// outgoing servers that aren't also in it. Outside of a joint consensus change
+// this is just configuration.Servers.
+func allServers(configuration Configuration) []Server {
+	if !configuration.isJoint() {
+		return configuration.Servers
+	}
+	servers := append([]Server(nil), configuration.Servers...)
+	for _, server := range configuration.Outgoing {
+		if !serversContain(configuration.Servers, server.ID) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// votingServers returns each server whose vote counts in either half of the
+// configuration.
+func votingServers(configuration Configuration) []Server {
+	var servers []Server
 	for _, server := range configuration.Servers {
+		if server.Suffrage.isVoting() {
+			servers = append(servers, server)
+		}
+	}
+	for _, server := range configuration.Outgoing {
+		if server.Suffrage.isVoting() && !serversContain(servers, server.ID) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func serversContain(servers []Server, id ServerID) bool {
+	for _, server := range servers {
 		if server.ID == id {
 			return true
 		}
@@ -191,6 +324,44 @@ func inConfiguration(configuration Configuration, id ServerID) bool {
 	return false
 }
 
+// voterSets returns the IDs of the voting servers in the configuration and,
+// during a joint consensus change, of the outgoing servers. A decision needs a
+// majority of each set.
+func voterSets(configuration Configuration) [][]ServerID {
+	sets := [][]ServerID{votingIDs(configuration.Servers)}
+	if configuration.isJoint() {
+		sets = append(sets, votingIDs(configuration.Outgoing))
+	}
+	return sets
+}
+
+func votingIDs(servers []Server) []ServerID {
+	var ids []ServerID
+	for _, server := range servers {
+		if server.Suffrage.isVoting() {
+			ids = append(ids, server.ID)
+		}
+	}
+	return ids
+}
+
+// quorumReached returns true if the given servers make up a majority of every
+// voter set in the configuration.
+func quorumReached(configuration Configuration, servers map[ServerID]bool) bool {
+	for _, voters := range voterSets(configuration) {
+		n := 0
+		for _, id := range voters {
+			if servers[id] {
+				n++
+			}
+		}
+		if n < len(voters)/2+1 {
+			return false
+		}
+	}
+	return true
+}
+
 // checkConfiguration tests a cluster membership configuration for common
 // errors.
 func checkConfiguration(configuration Configuration) error {
@@ -229,6 +400,28 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 	if change.prevIndex > 0 && change.prevIndex != currentIndex {
 		return Configuration{}, fmt.Errorf("configuration changed since %v (latest is %v)", change.prevIndex, currentIndex)
 	}
+	if current.isJoint() != (change.command == leaveJoint) {
+		if current.isJoint() {
+			return Configuration{}, fmt.Errorf("a joint consensus change is in progress")
+		}
+		return Configuration{}, fmt.Errorf("no joint consensus change is in progress")
+	}
+
+	// Witnesses only hold entry headers, so letting one become a Voter (or a
+	// Nonvoter that could later be promoted) would create a server that could
+	// win an election without the data to back it.
+	switch change.command {
+	case AddVoter, AddNonvoter, DemoteVoter, Promote, addStaging:
+		if isWitness(current, change.serverID) {
+			return Configuration{}, fmt.Errorf("server %v is a witness and must be removed before being re-added with a different suffrage", change.serverID)
+		}
+	case enterJoint:
+		for _, server := range change.servers {
+			if server.Suffrage != Witness && isWitness(current, server.ID) {
+				return Configuration{}, fmt.Errorf("server %v is a witness and must be removed before being re-added with a different suffrage", server.ID)
+			}
+		}
+	}
 
 	configuration := current.Clone()
 	switch change.command {
@@ -274,6 +467,34 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 		if !found {
 			configuration.Servers = append(configuration.Servers, newServer)
 		}
+	case addStaging:
+		newServer := Server{
+			Suffrage: Staging,
+			ID:       change.serverID,
+			Address:  change.serverAddress,
+		}
+		found := false
+		for i, server := range configuration.Servers {
+			if server.ID == change.serverID {
+				if server.Suffrage == Voter {
+					configuration.Servers[i].Address = change.serverAddress
+				} else {
+					configuration.Servers[i] = newServer
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			configuration.Servers = append(configuration.Servers, newServer)
+		}
+	case enterJoint:
+		configuration.Outgoing = configuration.Servers
+		configuration.Servers = append([]Server(nil), change.servers...)
+	case leaveJoint:
+		configuration.Outgoing = nil
+	case setParameters:
+		configuration.Parameters = change.parameters.clone()
 	case DemoteVoter:
 		for i, server := range configuration.Servers {
 			if server.ID == change.serverID {
@@ -295,6 +516,27 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 				break
 			}
 		}
+	case AddWitness:
+		newServer := Server{
+			Suffrage: Witness,
+			ID:       change.serverID,
+			Address:  change.serverAddress,
+		}
+		found := false
+		for i, server := range configuration.Servers {
+			if server.ID == change.serverID {
+				if server.Suffrage == Witness {
+					configuration.Servers[i].Address = change.serverAddress
+				} else {
+					configuration.Servers[i] = newServer
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			configuration.Servers = append(configuration.Servers, newServer)
+		}
 	}
 
 	// Make sure we didn't do something bad like remove the last voter
@@ -309,46 +551,37 @@ func nextConfiguration(current Configuration, currentIndex uint64, change config
 // This is here for backwards compatibility when operating with a mix of old
 // servers and should be removed once we deprecate support for protocol version 1.
 func encodePeers(configuration Configuration, trans Transport) []byte {
-	// Gather up all the voters, other suffrage types are not supported by
-	// this data format.
-	var encPeers [][]byte
-	for _, server := range configuration.Servers {
-		if server.Suffrage == Voter {
-			encPeers = append(encPeers, trans.EncodePeer(server.ID, server.Address))
-		}
-	}
-
-	// Encode the entire array.
-	buf, err := encodeMsgPack(encPeers)
+	buf, err := LegacyPeerCodec{}.EncodePeers(configuration, trans)
 	if err != nil {
-		panic(fmt.Errorf("failed to encode peers: %v", err))
+		panic(err)
 	}
-
-	return buf.Bytes()
+	return buf
 }
 
 // decodePeers is used to deserialize an old list of peers into a Configuration.
 // This is here for backwards compatibility with old log entries and snapshots;
 // it should be removed eventually.
 func decodePeers(buf []byte, trans Transport) (Configuration, error) {
-	// Decode the buffer first.
-	var encPeers [][]byte
-	if err := decodeMsgPack(buf, &encPeers); err != nil {
-		return Configuration{}, fmt.Errorf("failed to decode peers: %v", err)
-	}
+	return LegacyPeerCodec{}.DecodePeers(buf, trans)
+}
 
-	// Deserialize each peer.
-	var servers []Server
-	for _, enc := range encPeers {
-		p := trans.DecodePeer(enc)
-		servers = append(servers, Server{
-			Suffrage: Voter,
-			ID:       ServerID(p),
-			Address:  p,
-		})
+// newConfigurationEntry returns a log entry holding the configuration, in the
+// format servers of the given protocol version expect.
+func newConfigurationEntry(protocolVersion ProtocolVersion, index, term uint64,
+	configuration Configuration, trans Transport) *Log {
+	entry := &Log{
+		Index: index,
+		Term:  term,
 	}
-
-	return Configuration{Servers: servers}, nil
+	if protocolVersion < 3 {
+		entry.Type = LogRemovePeerDeprecated
+		entry.Data = encodePeers(configuration, trans)
+	} else {
+		entry.Type = LogConfiguration
+		entry.Data = EncodeConfiguration(configuration)
+	}
+	entry.SetChecksum()
+	return entry
 }
 
 // EncodeConfiguration serializes a Configuration using MsgPack, or panics on
@@ -166,6 +166,21 @@ var voterPair = Configuration{
 	},
 }
 
+var voterAndWitness = Configuration{
+	Servers: []Server{
+		{
+			Suffrage: Voter,
+			ID:       ServerID("id1"),
+			Address:  ServerAddress("addr1x"),
+		},
+		{
+			Suffrage: Witness,
+			ID:       ServerID("id2"),
+			Address:  ServerAddress("addr2x"),
+		},
+	},
+}
+
 var nextConfigurationTests = []struct {
 	current  Configuration
 	command  ConfigurationChangeCommand
@@ -227,6 +242,27 @@ var nextConfigurationTests = []struct {
 	{oneOfEach, Promote, 2, "{[{Voter id1 addr1x} {Voter id2 addr2x} {Nonvoter id3 addr3x}]}"},
 	// Promote: was Nonvoter.
 	{oneOfEach, Promote, 3, "{[{Voter id1 addr1x} {Staging id2 addr2x} {Nonvoter id3 addr3x}]}"},
+
+	// AddWitness: was missing.
+	{singleServer, AddWitness, 2, "{[{Voter id1 addr1x} {Witness id2 addr2}]}"},
+	// AddWitness: was Voter.
+	{voterPair, AddWitness, 2, "{[{Voter id1 addr1x} {Witness id2 addr2}]}"},
+	// AddWitness: was Nonvoter.
+	{oneOfEach, AddWitness, 3, "{[{Voter id1 addr1x} {Staging id2 addr2x} {Witness id3 addr3}]}"},
+	// AddWitness: was Witness.
+	{voterAndWitness, AddWitness, 2, "{[{Voter id1 addr1x} {Witness id2 addr2}]}"},
+
+	// RemoveServer: was Witness.
+	{voterAndWitness, RemoveServer, 2, "{[{Voter id1 addr1x}]}"},
+
+	// addStaging: was missing.
+	{singleServer, addStaging, 2, "{[{Voter id1 addr1x} {Staging id2 addr2}]}"},
+	// addStaging: was Voter.
+	{singleServer, addStaging, 1, "{[{Voter id1 addr1}]}"},
+	// addStaging: was Staging.
+	{oneOfEach, addStaging, 2, "{[{Voter id1 addr1x} {Staging id2 addr2} {Nonvoter id3 addr3x}]}"},
+	// addStaging: was Nonvoter.
+	{oneOfEach, addStaging, 3, "{[{Voter id1 addr1x} {Staging id2 addr2x} {Staging id3 addr3}]}"},
 }
 
 func TestConfiguration_nextConfiguration_table(t *testing.T) {
@@ -298,6 +334,102 @@ func TestConfiguration_nextConfiguration_checkConfiguration(t *testing.T) {
 	}
 }
 
+func TestConfiguration_nextConfiguration_witness(t *testing.T) {
+	for _, command := range []ConfigurationChangeCommand{AddVoter, AddNonvoter, DemoteVoter, Promote} {
+		req := configurationChangeRequest{
+			command:       command,
+			serverID:      ServerID("id2"),
+			serverAddress: ServerAddress("addr2"),
+		}
+		_, err := nextConfiguration(voterAndWitness, 1, req)
+		if err == nil || !strings.Contains(err.Error(), "witness") {
+			t.Fatalf("nextConfiguration should have failed for %v on a witness, got %v", command, err)
+		}
+	}
+}
+
+func TestConfiguration_nextConfiguration_joint(t *testing.T) {
+	req := configurationChangeRequest{
+		command: enterJoint,
+		servers: []Server{
+			{Suffrage: Voter, ID: "id1", Address: "addr1x"},
+			{Suffrage: Voter, ID: "id3", Address: "addr3"},
+			{Suffrage: Nonvoter, ID: "id4", Address: "addr4"},
+		},
+	}
+	joint, err := nextConfiguration(voterPair, 1, req)
+	if err != nil {
+		t.Fatalf("nextConfiguration should have succeeded, got %v", err)
+	}
+	expected := "{[{Voter id1 addr1x} {Voter id3 addr3} {Nonvoter id4 addr4}] outgoing:[{Voter id1 addr1x} {Voter id2 addr2x}]}"
+	if joint.String() != expected {
+		t.Fatalf("nextConfiguration returned %v, expected %s", joint, expected)
+	}
+	if !hasVote(joint, "id2") || !inConfiguration(joint, "id2") {
+		t.Fatalf("outgoing voter should keep its vote during the change")
+	}
+
+	// No other changes are allowed until the joint configuration is left.
+	for _, command := range []ConfigurationChangeCommand{AddVoter, RemoveServer, enterJoint} {
+		req := configurationChangeRequest{
+			command:       command,
+			serverID:      ServerID("id5"),
+			serverAddress: ServerAddress("addr5"),
+			servers:       voterPair.Servers,
+		}
+		_, err := nextConfiguration(joint, 1, req)
+		if err == nil || !strings.Contains(err.Error(), "joint consensus change is in progress") {
+			t.Fatalf("nextConfiguration should have failed for %v during a joint change, got %v", command, err)
+		}
+	}
+
+	next, err := nextConfiguration(joint, 2, configurationChangeRequest{command: leaveJoint})
+	if err != nil {
+		t.Fatalf("nextConfiguration should have succeeded, got %v", err)
+	}
+	expected = "{[{Voter id1 addr1x} {Voter id3 addr3} {Nonvoter id4 addr4}]}"
+	if next.String() != expected || next.isJoint() {
+		t.Fatalf("nextConfiguration returned %v, expected %s", next, expected)
+	}
+	if hasVote(next, "id2") {
+		t.Fatalf("id2 should not have vote")
+	}
+
+	_, err = nextConfiguration(next, 3, configurationChangeRequest{command: leaveJoint})
+	if err == nil || !strings.Contains(err.Error(), "no joint consensus change") {
+		t.Fatalf("nextConfiguration should have failed to leave a non-joint configuration, got %v", err)
+	}
+}
+
+func TestConfiguration_quorumReached(t *testing.T) {
+	joint := Configuration{
+		Servers:  voters(3).Servers,
+		Outgoing: makeConfiguration([]string{"s1", "s4", "s5"}).Servers,
+	}
+	cases := []struct {
+		configuration Configuration
+		servers       []ServerID
+		reached       bool
+	}{
+		{voters(3), []ServerID{"s1"}, false},
+		{voters(3), []ServerID{"s1", "s2"}, true},
+		{voters(3), []ServerID{"s4", "s5"}, false},
+		{joint, []ServerID{"s1", "s2"}, false},
+		{joint, []ServerID{"s1", "s4"}, false},
+		{joint, []ServerID{"s2", "s3", "s4", "s5"}, true},
+		{joint, []ServerID{"s1", "s2", "s4"}, true},
+	}
+	for i, tc := range cases {
+		servers := make(map[ServerID]bool)
+		for _, id := range tc.servers {
+			servers[id] = true
+		}
+		if reached := quorumReached(tc.configuration, servers); reached != tc.reached {
+			t.Errorf("case %d: quorumReached returned %v, expected %v", i, reached, tc.reached)
+		}
+	}
+}
+
 func TestConfiguration_encodeDecodePeers(t *testing.T) {
 	// Set up configuration.
 	var configuration Configuration
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// DiscoveryProvider finds the addresses of servers that may belong to the
+// cluster, for example so a new server knows who to ask to join. Addresses
+// are hints: they may include servers that are down or not yet members, and
+// the local server itself.
+type DiscoveryProvider interface {
+	// Discover returns the addresses found. It should honour cancellation of
+	// the context.
+	Discover(ctx context.Context) ([]ServerAddress, error)
+}
+
+// StaticDiscovery is a DiscoveryProvider that always returns the same
+// addresses.
+type StaticDiscovery []ServerAddress
+
+// Discover implements the DiscoveryProvider interface.
+func (s StaticDiscovery) Discover(context.Context) ([]ServerAddress, error) {
+	return append([]ServerAddress(nil), s...), nil
+}
+
+// Instance is a virtual machine returned by an InstanceLister.
+type Instance struct {
+	// ID is the cloud provider's identifier for the instance.
+	ID string
+
+	// Address is the instance's private IP address.
+	Address string
+
+	// Tags are the instance's tags, or labels in GCE terms.
+	Tags map[string]string
+}
+
+// InstanceLister lists the running instances visible to a cloud account.
+// EC2InstanceLister and GCEInstanceLister talk to the AWS and GCP APIs over
+// plain HTTP, and other providers only need to implement this one method.
+type InstanceLister interface {
+	ListInstances(ctx context.Context) ([]Instance, error)
+}
+
+// TagDiscovery is a DiscoveryProvider that finds every instance carrying a
+// tag, so servers started by an autoscaling group can find each other.
+type TagDiscovery struct {
+	// Lister lists the candidate instances.
+	Lister InstanceLister
+
+	// TagKey and TagValue select the instances that run servers.
+	TagKey   string
+	TagValue string
+
+	// Port is the port the transport listens on, which is appended to each
+	// instance's address.
+	Port int
+}
+
+// Discover implements the DiscoveryProvider interface. Addresses are sorted
+// so repeated calls return them in the same order.
+func (d *TagDiscovery) Discover(ctx context.Context) ([]ServerAddress, error) {
+	instances, err := d.Lister.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []ServerAddress
+	for _, instance := range instances {
+		if instance.Address == "" {
+			continue
+		}
+		if value, ok := instance.Tags[d.TagKey]; !ok || value != d.TagValue {
+			continue
+		}
+		addrs = append(addrs, ServerAddress(net.JoinHostPort(instance.Address, strconv.Itoa(d.Port))))
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs, nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// EC2InstanceLister lists running instances with the EC2 DescribeInstances
+// API.
+type EC2InstanceLister struct {
+	// Client makes the requests. AWS requires requests to be signed, so its
+	// transport is expected to add the Signature Version 4 headers, for
+	// example using the AWS SDK's signer. This keeps the SDK out of this
+	// module.
+	Client *http.Client
+
+	// Endpoint is the EC2 API endpoint, for example
+	// "https://ec2.us-east-1.amazonaws.com".
+	Endpoint string
+}
+
+// ec2DescribeInstancesResponse is the subset of the DescribeInstances
+// response that is needed to discover servers.
+type ec2DescribeInstancesResponse struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceID       string `xml:"instanceId"`
+			PrivateIPAddress string `xml:"privateIpAddress"`
+			Tags             []struct {
+				Key   string `xml:"key"`
+				Value string `xml:"value"`
+			} `xml:"tagSet>item"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// ListInstances implements the InstanceLister interface.
+func (l *EC2InstanceLister) ListInstances(ctx context.Context) ([]Instance, error) {
+	var instances []Instance
+	var nextToken string
+	for {
+		query := url.Values{}
+		query.Set("Action", "DescribeInstances")
+		query.Set("Version", "2016-11-15")
+		query.Set("Filter.1.Name", "instance-state-name")
+		query.Set("Filter.1.Value.1", "running")
+		if nextToken != "" {
+			query.Set("NextToken", nextToken)
+		}
+
+		var resp ec2DescribeInstancesResponse
+		if err := discoveryGet(ctx, l.Client, l.Endpoint+"/?"+query.Encode(), func(r io.Reader) error {
+			return xml.NewDecoder(r).Decode(&resp)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to describe EC2 instances: %v", err)
+		}
+
+		for _, reservation := range resp.Reservations {
+			for _, inst := range reservation.Instances {
+				instance := Instance{
+					ID:      inst.InstanceID,
+					Address: inst.PrivateIPAddress,
+					Tags:    make(map[string]string, len(inst.Tags)),
+				}
+				for _, tag := range inst.Tags {
+					instance.Tags[tag.Key] = tag.Value
+				}
+				instances = append(instances, instance)
+			}
+		}
+		if resp.NextToken == "" {
+			return instances, nil
+		}
+		nextToken = resp.NextToken
+	}
+}
+
+// GCEInstanceLister lists running instances in a zone with the Compute
+// Engine instances.list API.
+type GCEInstanceLister struct {
+	// Client makes the requests. Its transport is expected to add an OAuth2
+	// bearer token, for example using golang.org/x/oauth2/google.
+	Client *http.Client
+
+	// Project and Zone select the instances to list.
+	Project string
+	Zone    string
+
+	// Endpoint is the Compute Engine API endpoint. If empty,
+	// "https://compute.googleapis.com" is used.
+	Endpoint string
+}
+
+// gceInstancesResponse is the subset of the instances.list response that is
+// needed to discover servers.
+type gceInstancesResponse struct {
+	Items []struct {
+		ID                string            `json:"id"`
+		Status            string            `json:"status"`
+		Labels            map[string]string `json:"labels"`
+		NetworkInterfaces []struct {
+			NetworkIP string `json:"networkIP"`
+		} `json:"networkInterfaces"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// ListInstances implements the InstanceLister interface.
+func (l *GCEInstanceLister) ListInstances(ctx context.Context) ([]Instance, error) {
+	endpoint := l.Endpoint
+	if endpoint == "" {
+		endpoint = "https://compute.googleapis.com"
+	}
+	base := fmt.Sprintf("%s/compute/v1/projects/%s/zones/%s/instances",
+		endpoint, url.PathEscape(l.Project), url.PathEscape(l.Zone))
+
+	var instances []Instance
+	var pageToken string
+	for {
+		query := url.Values{}
+		query.Set("filter", `status = "RUNNING"`)
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var resp gceInstancesResponse
+		if err := discoveryGet(ctx, l.Client, base+"?"+query.Encode(), func(r io.Reader) error {
+			return json.NewDecoder(r).Decode(&resp)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list GCE instances: %v", err)
+		}
+
+		for _, item := range resp.Items {
+			instance := Instance{
+				ID:   item.ID,
+				Tags: item.Labels,
+			}
+			if len(item.NetworkInterfaces) > 0 {
+				instance.Address = item.NetworkInterfaces[0].NetworkIP
+			}
+			instances = append(instances, instance)
+		}
+		if resp.NextPageToken == "" {
+			return instances, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// discoveryGet makes a GET request and decodes a successful response.
+func discoveryGet(ctx context.Context, client *http.Client, u string, decode func(io.Reader) error) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	return decode(resp.Body)
+}
@@ -0,0 +1,337 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+const (
+	// defaultMDNSService is the DNS-SD service type used when none is given.
+	defaultMDNSService = "_raft._tcp"
+
+	// defaultMDNSTimeout is how long Discover listens for answers when no
+	// timeout is given.
+	defaultMDNSTimeout = time.Second
+
+	// mdnsTTL is the TTL of advertised records, in seconds.
+	mdnsTTL = 120
+)
+
+// mdnsGroup is the IPv4 mDNS multicast group.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSDiscovery is a DiscoveryProvider that finds servers on the local
+// network with multicast DNS service discovery (RFC 6762 and 6763), so a
+// small cluster can assemble itself without any static configuration. Every
+// server should call Advertise so the others can find it.
+type MDNSDiscovery struct {
+	// Service is the DNS-SD service type, "_raft._tcp" if empty. Use a
+	// different one for each cluster sharing a network.
+	Service string
+
+	// Name identifies this server in its advertisement, and must be unique
+	// on the network. It's only needed to Advertise.
+	Name string
+
+	// IP and Port are the address this server advertises. If IP is nil the
+	// first IPv4 address of Interface, or of the host, is used.
+	IP   net.IP
+	Port int
+
+	// Interface is the network interface to use, both to answer queries
+	// and to send them. If nil, the system picks one.
+	Interface *net.Interface
+
+	// Timeout is how long Discover listens for answers, one second if zero.
+	Timeout time.Duration
+
+	// group is the address queries are sent to, overridden by tests.
+	group *net.UDPAddr
+}
+
+// Discover implements the DiscoveryProvider interface. It sends a query and
+// returns the addresses of every server that answers before the timeout,
+// including this server if it is advertising.
+func (d *MDNSDiscovery) Discover(ctx context.Context) ([]ServerAddress, error) {
+	conn, err := d.listenQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Answers come straight back to our port since the query isn't sent
+	// from port 5353 (RFC 6762 section 6.7).
+	// mDNS queries carry an ID of zero and don't ask for recursion (RFC 6762
+	// section 18).
+	msg := new(dns.Msg).SetQuestion(d.serviceName(), dns.TypePTR)
+	msg.Id = 0
+	msg.RecursionDesired = false
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode mDNS query: %v", err)
+	}
+	if _, err := conn.WriteToUDP(query, d.groupAddr()); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultMDNSTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetReadDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	found := make(map[ServerAddress]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("failed to read mDNS answer: %v", err)
+		}
+		var answer dns.Msg
+		if err := answer.Unpack(buf[:n]); err != nil || !answer.Response {
+			continue
+		}
+		records := append(append(answer.Answer, answer.Ns...), answer.Extra...)
+		for _, addr := range serviceAddresses(records, d.serviceName()) {
+			found[addr] = true
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]ServerAddress, 0, len(found))
+	for addr := range found {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs, nil
+}
+
+// listenQuery opens the socket Discover sends its query from and reads the
+// answers on. If an Interface is set the socket is bound to its address, and
+// the query is sent out of it.
+func (d *MDNSDiscovery) listenQuery() (*net.UDPConn, error) {
+	laddr := &net.UDPAddr{IP: net.IPv4zero}
+	if d.Interface != nil {
+		ip, err := interfaceIPv4(d.Interface)
+		if err != nil {
+			return nil, err
+		}
+		laddr.IP = ip
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	if d.Interface != nil {
+		if err := setMulticastInterface(conn, laddr.IP); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send mDNS queries on %s: %v", d.Interface.Name, err)
+		}
+	}
+	return conn, nil
+}
+
+// Advertise answers mDNS queries for the service with this server's address
+// until the returned function is called.
+func (d *MDNSDiscovery) Advertise() (stop func(), err error) {
+	if d.Name == "" || d.Port == 0 {
+		return nil, fmt.Errorf("a name and port are needed to advertise")
+	}
+	ip := d.IP.To4()
+	if ip == nil {
+		if ip, err = localIPv4(d.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn *net.UDPConn
+	if d.group != nil {
+		conn, err = net.ListenUDP("udp4", d.group)
+	} else {
+		conn, err = net.ListenMulticastUDP("udp4", d.Interface, mdnsGroup)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+
+	service := d.serviceName()
+	instance := d.Name + "." + service
+	host := d.Name + ".local."
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dns.Msg
+			if err := query.Unpack(buf[:n]); err != nil || query.Response || len(query.Question) == 0 {
+				continue
+			}
+			question := query.Question[0]
+			if !strings.EqualFold(question.Name, service) ||
+				(question.Qtype != dns.TypePTR && question.Qtype != dns.TypeANY) {
+				continue
+			}
+			answer, err := mdnsAnswer(&query, service, instance, host, ip, uint16(d.Port)).Pack()
+			if err != nil {
+				continue
+			}
+			dest := from
+			if from.Port == mdnsGroup.Port {
+				dest = d.groupAddr()
+			}
+			conn.WriteToUDP(answer, dest)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			conn.Close()
+			wg.Wait()
+		})
+	}, nil
+}
+
+func (d *MDNSDiscovery) serviceName() string {
+	service := d.Service
+	if service == "" {
+		service = defaultMDNSService
+	}
+	return strings.TrimSuffix(service, ".") + ".local."
+}
+
+func (d *MDNSDiscovery) groupAddr() *net.UDPAddr {
+	if d.group != nil {
+		return d.group
+	}
+	return mdnsGroup
+}
+
+// localIPv4 returns the first non-loopback IPv4 address of the interface, or
+// of any interface if it is nil.
+func localIPv4(iface *net.Interface) (net.IP, error) {
+	var addrs []net.Addr
+	var err error
+	if iface != nil {
+		addrs, err = iface.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if ip := ipNet.IP.To4(); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address to advertise")
+}
+
+// interfaceIPv4 returns the first IPv4 address of the interface, which may be
+// a loopback one.
+func interfaceIPv4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip := ipNet.IP.To4(); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", iface.Name)
+}
+
+// serviceAddresses follows the PTR, SRV and A records in an answer to the
+// addresses of the service's instances.
+func serviceAddresses(records []dns.RR, service string) []ServerAddress {
+	srv := make(map[string]*dns.SRV)
+	ips := make(map[string]net.IP)
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			srv[strings.ToLower(rr.Hdr.Name)] = rr
+		case *dns.A:
+			ips[strings.ToLower(rr.Hdr.Name)] = rr.A
+		}
+	}
+	var addrs []ServerAddress
+	for _, rr := range records {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok || !strings.EqualFold(ptr.Hdr.Name, service) {
+			continue
+		}
+		s, ok := srv[strings.ToLower(ptr.Ptr)]
+		if !ok {
+			continue
+		}
+		ip, ok := ips[strings.ToLower(s.Target)]
+		if !ok {
+			continue
+		}
+		addrs = append(addrs, ServerAddress(net.JoinHostPort(ip.String(), strconv.Itoa(int(s.Port)))))
+	}
+	return addrs
+}
+
+// mdnsAnswer builds an authoritative answer to query with the PTR, SRV and A
+// records for an instance of the service.
+func mdnsAnswer(query *dns.Msg, service, instance, host string, ip net.IP, port uint16) *dns.Msg {
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: mdnsTTL}
+	}
+	answer := new(dns.Msg)
+	answer.Id = query.Id
+	answer.Response = true
+	answer.Authoritative = true
+	answer.Answer = []dns.RR{
+		&dns.PTR{Hdr: header(service, dns.TypePTR), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV), Port: port, Target: host},
+		&dns.A{Hdr: header(host, dns.TypeA), A: ip.To4()},
+	}
+	return answer
+}
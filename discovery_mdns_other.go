@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package raft
+
+import "net"
+
+// setMulticastInterface isn't supported on this platform, so multicast is
+// sent wherever the platform routes it from the address the socket is bound
+// to.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	return nil
+}
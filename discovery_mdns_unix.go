@@ -0,0 +1,30 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package raft
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface makes multicast sent on conn go out of the interface
+// with the given IPv4 address.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
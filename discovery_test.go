@@ -0,0 +1,166 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticDiscovery(t *testing.T) {
+	d := StaticDiscovery{"a:8300", "b:8300"}
+	addrs, err := d.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{"a:8300", "b:8300"}, addrs)
+}
+
+func TestTagDiscovery_EC2(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "DescribeInstances", r.URL.Query().Get("Action"))
+		if r.URL.Query().Get("NextToken") == "" {
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><instanceId>i-1</instanceId><privateIpAddress>10.0.0.2</privateIpAddress><tagSet><item><key>role</key><value>raft</value></item></tagSet></item>
+<item><instanceId>i-2</instanceId><privateIpAddress>10.0.0.3</privateIpAddress><tagSet><item><key>role</key><value>web</value></item></tagSet></item>
+</instancesSet></item></reservationSet><nextToken>page2</nextToken></DescribeInstancesResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><instanceId>i-3</instanceId><privateIpAddress>10.0.0.1</privateIpAddress><tagSet><item><key>role</key><value>raft</value></item></tagSet></item>
+</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+	}))
+	defer srv.Close()
+
+	d := &TagDiscovery{
+		Lister:   &EC2InstanceLister{Client: srv.Client(), Endpoint: srv.URL},
+		TagKey:   "role",
+		TagValue: "raft",
+		Port:     8300,
+	}
+	addrs, err := d.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{"10.0.0.1:8300", "10.0.0.2:8300"}, addrs)
+}
+
+func TestTagDiscovery_GCE(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/compute/v1/projects/proj/zones/us-east1-b/instances", r.URL.Path)
+		fmt.Fprint(w, `{"items": [
+			{"id": "1", "labels": {"role": "raft"}, "networkInterfaces": [{"networkIP": "10.1.0.1"}]},
+			{"id": "2", "labels": {"role": "web"}, "networkInterfaces": [{"networkIP": "10.1.0.2"}]},
+			{"id": "3", "labels": {"role": "raft"}}
+		]}`)
+	}))
+	defer srv.Close()
+
+	d := &TagDiscovery{
+		Lister:   &GCEInstanceLister{Client: srv.Client(), Project: "proj", Zone: "us-east1-b", Endpoint: srv.URL},
+		TagKey:   "role",
+		TagValue: "raft",
+		Port:     8300,
+	}
+	addrs, err := d.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{"10.1.0.1:8300"}, addrs)
+}
+
+func TestTagDiscovery_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	d := &TagDiscovery{Lister: &EC2InstanceLister{Client: srv.Client(), Endpoint: srv.URL}}
+	_, err := d.Discover(context.Background())
+	require.ErrorContains(t, err, "403")
+}
+
+func TestMDNSDiscovery(t *testing.T) {
+	// Use a unicast address in place of the multicast group, which isn't
+	// available everywhere tests run.
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	group := l.LocalAddr().(*net.UDPAddr)
+	require.NoError(t, l.Close())
+
+	server := &MDNSDiscovery{
+		Service: "_test._tcp",
+		Name:    "node1",
+		IP:      net.IPv4(10, 0, 0, 1),
+		Port:    8300,
+		group:   group,
+	}
+	stop, err := server.Advertise()
+	require.NoError(t, err)
+	defer stop()
+
+	client := &MDNSDiscovery{Service: "_test._tcp", Timeout: 200 * time.Millisecond, group: group}
+	addrs, err := client.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{"10.0.0.1:8300"}, addrs)
+
+	// Queries are sent from the configured interface.
+	client.Interface = loopbackInterface(t)
+	conn, err := client.listenQuery()
+	require.NoError(t, err)
+	require.True(t, conn.LocalAddr().(*net.UDPAddr).IP.IsLoopback())
+	require.NoError(t, conn.Close())
+	addrs, err = client.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []ServerAddress{"10.0.0.1:8300"}, addrs)
+	client.Interface = nil
+
+	// Other services are ignored.
+	client.Service = "_other._tcp"
+	addrs, err = client.Discover(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, addrs)
+}
+
+// loopbackInterface returns the host's IPv4 loopback interface.
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		if _, err := interfaceIPv4(&ifaces[i]); err == nil {
+			return &ifaces[i]
+		}
+	}
+	t.Skip("no IPv4 loopback interface")
+	return nil
+}
+
+func TestServiceAddresses_Compressed(t *testing.T) {
+	// An answer as a typical responder would send it, with names compressed
+	// against the first one.
+	msg := []byte{
+		0, 0, 0x84, 0, 0, 0, 0, 3, 0, 0, 0, 0,
+		// PTR _raft._tcp.local. -> node1._raft._tcp.local.
+		5, '_', 'r', 'a', 'f', 't', 4, '_', 't', 'c', 'p', 5, 'l', 'o', 'c', 'a', 'l', 0,
+		0, 12, 0, 1, 0, 0, 0, 120, 0, 8,
+		5, 'n', 'o', 'd', 'e', '1', 0xC0, 12,
+		// SRV node1._raft._tcp.local. -> node1.local.:8300
+		0xC0, 40,
+		0, 33, 0, 1, 0, 0, 0, 120, 0, 14,
+		0, 0, 0, 0, 0x20, 0x6C, 5, 'n', 'o', 'd', 'e', '1', 0xC0, 23,
+		// A node1.local. -> 10.0.0.1
+		0xC0, 66,
+		0, 1, 0, 1, 0, 0, 0, 120, 0, 4,
+		10, 0, 0, 1,
+	}
+	var answer dns.Msg
+	require.NoError(t, answer.Unpack(msg))
+	require.Len(t, answer.Answer, 3)
+	require.Equal(t, []ServerAddress{"10.0.0.1:8300"}, serviceAddresses(answer.Answer, "_raft._tcp.local."))
+}
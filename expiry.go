@@ -0,0 +1,189 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// expiryTracker records the applied LogCommand entries with a TTL that haven't
+// expired yet. It is updated by the FSM goroutine as entries are applied, so
+// every server tracks the same entries and any of them can take over
+// appending LogExpiry entries when it becomes leader. Deadlines are counted
+// from when the leader appended the entry rather than from when a server
+// applied it, so they're the same everywhere and don't move when a server
+// restarts and applies the entry again. An entry isn't expired while a
+// server that can't apply LogExpiry entries is in the configuration. The
+// entries that are still pending are kept in snapshots, see snapshotState, so
+// a server that restores one still expires them.
+type expiryTracker struct {
+	lock    sync.Mutex
+	pending map[uint64]pendingExpiry
+
+	// notifyCh is notified when an entry is added, so the leader can
+	// schedule it.
+	notifyCh chan struct{}
+}
+
+// pendingExpiry is an entry that will expire at deadline.
+type pendingExpiry struct {
+	data       []byte
+	extensions []byte
+	deadline   time.Time
+}
+
+// expiryState is a pendingExpiry as it's kept in a snapshot.
+type expiryState struct {
+	Index      uint64
+	Data       []byte
+	Extensions []byte
+
+	// Deadline is in Unix nanoseconds.
+	Deadline int64
+}
+
+func newExpiryTracker() *expiryTracker {
+	return &expiryTracker{
+		pending:  make(map[uint64]pendingExpiry),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// track updates the tracker for an entry that is being applied.
+func (t *expiryTracker) track(l *Log) {
+	switch {
+	case l.Type == LogCommand && l.TTL > 0:
+		t.lock.Lock()
+		t.pending[l.Index] = pendingExpiry{
+			data:       l.Data,
+			extensions: l.Extensions,
+			deadline:   expiryDeadline(l),
+		}
+		t.lock.Unlock()
+		asyncNotifyCh(t.notifyCh)
+	case l.Type == LogExpiry:
+		t.lock.Lock()
+		delete(t.pending, l.ExpiredIndex)
+		t.lock.Unlock()
+	}
+}
+
+// expiryDeadline returns when an entry with a TTL expires. Entries from
+// leaders that didn't set AppendedAt are counted from now.
+func expiryDeadline(l *Log) time.Time {
+	if l.AppendedAt.IsZero() {
+		return time.Now().Add(l.TTL)
+	}
+	return l.AppendedAt.Add(l.TTL)
+}
+
+// snapshot returns the pending entries, in index order, to be kept in a
+// snapshot.
+func (t *expiryTracker) snapshot() []expiryState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	states := make([]expiryState, 0, len(t.pending))
+	for index, p := range t.pending {
+		states = append(states, expiryState{
+			Index:      index,
+			Data:       p.data,
+			Extensions: p.extensions,
+			Deadline:   p.deadline.UnixNano(),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Index < states[j].Index })
+	return states
+}
+
+// restore replaces the pending entries with those kept in a snapshot.
+func (t *expiryTracker) restore(states []expiryState) {
+	t.lock.Lock()
+	t.pending = make(map[uint64]pendingExpiry, len(states))
+	for _, s := range states {
+		t.pending[s.Index] = pendingExpiry{
+			data:       s.Data,
+			extensions: s.Extensions,
+			deadline:   time.Unix(0, s.Deadline),
+		}
+	}
+	t.lock.Unlock()
+	asyncNotifyCh(t.notifyCh)
+}
+
+// due returns the indexes of the entries whose deadline has passed at now,
+// other than those in skip, and the earliest deadline of the rest, which is
+// zero if there are none. Indexes in skip that are no longer pending are
+// removed from it.
+func (t *expiryTracker) due(now time.Time, skip map[uint64]struct{}) ([]uint64, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for index := range skip {
+		if _, ok := t.pending[index]; !ok {
+			delete(skip, index)
+		}
+	}
+
+	var due []uint64
+	var next time.Time
+	for index, p := range t.pending {
+		if _, ok := skip[index]; ok {
+			continue
+		}
+		if !p.deadline.After(now) {
+			due = append(due, index)
+		} else if next.IsZero() || p.deadline.Before(next) {
+			next = p.deadline
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	return due, next
+}
+
+// get returns a pending entry.
+func (t *expiryTracker) get(index uint64) pendingExpiry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.pending[index]
+}
+
+// expireEntries appends a LogExpiry entry for each entry whose TTL has run out
+// and returns a channel that fires when the next one is due, or nil if there
+// are none. This must only be called from the main thread.
+func (r *Raft) expireEntries() <-chan time.Time {
+	now := time.Now()
+	due, next := r.expiries.due(now, r.leaderState.expiring)
+	if len(due) > 0 && r.clusterLogVersion() < (&Log{Type: LogExpiry}).requiredVersion() {
+		// A server has joined that can't apply LogExpiry entries, so hold
+		// them until it's upgraded or removed.
+		return time.After(r.config().CommitTimeout)
+	}
+	if len(due) > 0 {
+		futures := make([]*logFuture, 0, len(due))
+		for _, index := range due {
+			// Nobody waits on these, they're applied like any other entry.
+			// The Extensions are copied too, so an FSM that routes commands
+			// by them, such as NamespaceFSM, routes the expiry the same way.
+			p := r.expiries.get(index)
+			future := &logFuture{log: Log{
+				Type:         LogExpiry,
+				Data:         p.data,
+				Extensions:   p.extensions,
+				ExpiredIndex: index,
+			}}
+			future.init()
+			futures = append(futures, future)
+			r.leaderState.expiring[index] = struct{}{}
+		}
+		metrics.IncrCounter([]string{"raft", "leader", "expired"}, float32(len(futures)))
+		r.dispatchLogs(futures)
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(next.Sub(now))
+}
@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryTracker(t *testing.T) {
+	tracker := newExpiryTracker()
+	tracker.track(&Log{Index: 1, Type: LogCommand, Data: []byte("a")})
+	tracker.track(&Log{Index: 2, Type: LogCommand, Data: []byte("b"), TTL: time.Second})
+	tracker.track(&Log{Index: 3, Type: LogCommand, Data: []byte("c"), TTL: time.Minute})
+	tracker.track(&Log{Index: 4, Type: LogCommand, Data: []byte("d"), TTL: time.Second})
+
+	// Entries without a TTL aren't tracked, and skipped ones aren't due.
+	now := time.Now()
+	skip := map[uint64]struct{}{4: {}, 7: {}}
+	due, next := tracker.due(now, skip)
+	require.Empty(t, due)
+	require.WithinDuration(t, now.Add(time.Second), next, 100*time.Millisecond)
+	require.Equal(t, map[uint64]struct{}{4: {}}, skip)
+
+	due, next = tracker.due(now.Add(2*time.Second), skip)
+	require.Equal(t, []uint64{2}, due)
+	require.Equal(t, []byte("b"), tracker.get(2).data)
+	require.WithinDuration(t, now.Add(time.Minute), next, 100*time.Millisecond)
+
+	// Applying the expiry stops tracking the entry.
+	tracker.track(&Log{Index: 5, Type: LogExpiry, ExpiredIndex: 2})
+	tracker.track(&Log{Index: 6, Type: LogExpiry, ExpiredIndex: 4})
+	due, _ = tracker.due(now.Add(2*time.Second), skip)
+	require.Empty(t, due)
+	require.Empty(t, skip)
+}
+
+func TestExpiryTracker_Snapshot(t *testing.T) {
+	appended := time.Now().Add(-time.Hour)
+	tracker := newExpiryTracker()
+	tracker.track(&Log{Index: 1, Type: LogCommand, Data: []byte("a"), Extensions: []byte("ext"), TTL: time.Minute, AppendedAt: appended})
+	tracker.track(&Log{Index: 2, Type: LogCommand, Data: []byte("b"), TTL: 2 * time.Hour, AppendedAt: appended})
+
+	// Deadlines count from when the leader appended the entry, so an entry
+	// applied long after that can be due straight away.
+	due, next := tracker.due(time.Now(), nil)
+	require.Equal(t, []uint64{1}, due)
+	require.Equal(t, appended.Add(2*time.Hour).UnixNano(), next.UnixNano())
+
+	// The pending entries survive a round trip through a snapshot, and
+	// restoring one replaces what was there.
+	var buf bytes.Buffer
+	require.NoError(t, writeSnapshotState(&buf, snapshotState{Expiries: tracker.snapshot()}))
+	buf.WriteString("fsm")
+	state, rest, err := readSnapshotState(io.NopCloser(bytes.NewReader(buf.Bytes())), snapshotStateVersion)
+	require.NoError(t, err)
+	fsmData, err := io.ReadAll(rest)
+	require.NoError(t, err)
+	require.Equal(t, "fsm", string(fsmData))
+
+	restored := newExpiryTracker()
+	restored.track(&Log{Index: 3, Type: LogCommand, TTL: time.Minute})
+	restored.restore(state.Expiries)
+	require.Equal(t, tracker.snapshot(), restored.snapshot())
+	require.Equal(t, []byte("ext"), restored.get(1).extensions)
+
+	// Snapshots without the state are passed through untouched.
+	state, rest, err = readSnapshotState(io.NopCloser(strings.NewReader("fsm")), snapshotStateVersion)
+	require.NoError(t, err)
+	require.True(t, state.empty())
+	fsmData, err = io.ReadAll(rest)
+	require.NoError(t, err)
+	require.Equal(t, "fsm", string(fsmData))
+
+	// Nor is anything taken off snapshots from before the state was kept,
+	// whatever they start with.
+	state, rest, err = readSnapshotState(io.NopCloser(bytes.NewReader(buf.Bytes())), 1)
+	require.NoError(t, err)
+	require.True(t, state.empty())
+	fsmData, err = io.ReadAll(rest)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), fsmData)
+}
+
+// expiringFSM is a MockFSM that records the expiries it's passed.
+type expiringFSM struct {
+	*MockFSM
+
+	lock    sync.Mutex
+	expired []*Log
+}
+
+func (f *expiringFSM) Expire(l *Log) interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expired = append(f.expired, l)
+	return nil
+}
+
+func (f *expiringFSM) Expired() []*Log {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*Log(nil), f.expired...)
+}
+
+func (f *expiringFSM) Underlying() FSM {
+	return f.MockFSM
+}
+
+func TestRaft_ApplyLog_TTL(t *testing.T) {
+	// The first server's FSM is told about expiries, the others' aren't.
+	var made int
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     3,
+		Bootstrap: true,
+		Conf:      inmemConfig(t),
+		MakeFSMFunc: func() FSM {
+			made++
+			if made == 1 {
+				return &expiringFSM{MockFSM: &MockFSM{}}
+			}
+			return &MockFSM{}
+		},
+	})
+	defer c.Close()
+
+	leader := c.Leader()
+	future := leader.ApplyLog(Log{Data: []byte("lock"), Extensions: []byte("ext"), TTL: 50 * time.Millisecond}, 0)
+	require.NoError(t, future.Error())
+
+	// The expiry carries the same Extensions, so it's routed the same way.
+	fsm := c.fsms[0].(*expiringFSM)
+	retry(t, func() bool { return len(fsm.Expired()) == 1 })
+	index := leader.getLastIndex()
+	var expiry Log
+	require.NoError(t, leader.logs.GetLog(index, &expiry))
+	require.Equal(t, LogExpiry, expiry.Type)
+	require.Equal(t, future.Index(), expiry.ExpiredIndex)
+	require.Equal(t, []byte("lock"), expiry.Data)
+	require.Equal(t, []byte("ext"), expiry.Extensions)
+	require.Equal(t, expiry.ExpiredIndex, fsm.Expired()[0].ExpiredIndex)
+	require.Equal(t, []byte("lock"), fsm.Expired()[0].Data)
+
+	// No FSM is passed the expiry to apply as a command.
+	c.WaitForReplication(1)
+	for _, fsm := range c.fsms {
+		require.Equal(t, [][]byte{[]byte("lock")}, getMockFSM(fsm).Logs())
+	}
+
+	// Only one expiry is appended.
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, index, leader.getLastIndex())
+}
+
+func TestRaft_ApplyLog_TTL_Snapshot(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 0
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	// An entry that's compacted into a snapshot before it expires is kept
+	// in the snapshot, along with its Extensions.
+	leader := c.Leader()
+	future := leader.ApplyLog(Log{Data: []byte("lock"), Extensions: []byte("ext"), TTL: time.Hour}, 0)
+	require.NoError(t, future.Error())
+	require.NoError(t, leader.Snapshot().Error())
+	pending := leader.expiries.get(future.Index())
+	require.Equal(t, []byte("lock"), pending.data)
+
+	// The snapshot is marked as holding the state, so older servers refuse
+	// it rather than passing the state to the FSM.
+	snaps, err := leader.snapshots.List()
+	require.NoError(t, err)
+	require.Equal(t, snapshotStateVersion, snaps[0].Version)
+
+	// A server that joins and is sent the snapshot tracks it too, with the
+	// same deadline.
+	c1 := MakeClusterNoBootstrap(1, t, inmemConfig(t))
+	c.Merge(c1)
+	c.FullyConnect()
+	joined := c1.rafts[0]
+	require.NoError(t, leader.AddNonvoter(joined.localID, joined.localAddr, 0, 0).Error())
+	retry(t, func() bool { return !joined.expiries.get(future.Index()).deadline.IsZero() })
+	got := joined.expiries.get(future.Index())
+	require.Equal(t, pending.deadline.UnixNano(), got.deadline.UnixNano())
+	require.Equal(t, []byte("ext"), got.extensions)
+}
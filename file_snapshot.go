@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +40,9 @@ type FileSnapshotStore struct {
 	// noSync, if true, skips crash-safe file fsync api calls.
 	// It's a private field, only used in testing
 	noSync bool
+
+	// compressor, if set, compresses new snapshots.
+	compressor SnapshotCompressor
 }
 
 type snapMetaSlice []*fileSnapshotMeta
@@ -57,6 +61,11 @@ type FileSnapshotSink struct {
 	stateHash hash.Hash64
 	buffered  *bufio.Writer
 
+	// compressed, if set, compresses what's written before it's buffered,
+	// and written counts the bytes before compression.
+	compressed io.WriteCloser
+	written    int64
+
 	closed bool
 }
 
@@ -65,6 +74,10 @@ type FileSnapshotSink struct {
 type fileSnapshotMeta struct {
 	SnapshotMeta
 	CRC []byte
+
+	// Compression names the SnapshotCompressor used for the state file, or
+	// is empty if it isn't compressed. Size is the size before compression.
+	Compression string `json:",omitempty"`
 }
 
 // bufferedFile is returned when we open a snapshot. This way
@@ -131,6 +144,16 @@ func NewFileSnapshotStore(base string, retain int, logOutput io.Writer) (*FileSn
 	}))
 }
 
+// SetCompressor sets the compressor used for new snapshots, or turns
+// compression off if c is nil. Existing snapshots can still be opened if
+// they were compressed with c or gzip. It must be called before the store is
+// used.
+//
+// Experimental: see docs/api_stability.md.
+func (f *FileSnapshotStore) SetCompressor(c SnapshotCompressor) {
+	f.compressor = c
+}
+
 // testPermissions tries to touch a file in our path to see if it works.
 func (f *FileSnapshotStore) testPermissions() error {
 	path := filepath.Join(f.path, testPath)
@@ -156,11 +179,25 @@ func snapshotName(term, index uint64) string {
 	return fmt.Sprintf("%d-%d-%d", term, index, msec)
 }
 
+// snapshotNameTime returns the time a name from snapshotName was made at, or
+// the zero time if it isn't one.
+func snapshotNameTime(name string) time.Time {
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return time.Time{}
+	}
+	msec, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(msec)
+}
+
 // Create is used to start a new snapshot
 func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
-	// We only support version 1 snapshots at this time.
-	if version != 1 {
+	// We only support version 1 snapshots and later at this time.
+	if version < 1 || version > SnapshotVersionMax {
 		return nil, fmt.Errorf("unsupported snapshot version %d", version)
 	}
 
@@ -191,6 +228,7 @@ func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 				Peers:              encodePeers(configuration, trans),
 				Configuration:      configuration,
 				ConfigurationIndex: configurationIndex,
+				CreatedAt:          time.Now(),
 			},
 			CRC: nil,
 		},
@@ -218,6 +256,19 @@ func (f *FileSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 	multi := io.MultiWriter(sink.stateFile, sink.stateHash)
 	sink.buffered = bufio.NewWriter(multi)
 
+	// Compress ahead of the buffer if configured
+	if f.compressor != nil {
+		compressed, err := f.compressor.NewWriter(sink.buffered)
+		if err != nil {
+			f.logger.Error("failed to create compressor", "error", err)
+			sink.stateFile.Close()
+			os.RemoveAll(path)
+			return nil, err
+		}
+		sink.compressed = compressed
+		sink.meta.Compression = f.compressor.Name()
+	}
+
 	// Done
 	return sink, nil
 }
@@ -307,6 +358,12 @@ func (f *FileSnapshotStore) readMeta(name string) (*fileSnapshotMeta, error) {
 	if err := dec.Decode(meta); err != nil {
 		return nil, err
 	}
+
+	// Snapshots written before CreatedAt was recorded have the time in
+	// their name.
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = snapshotNameTime(name)
+	}
 	return meta, nil
 }
 
@@ -353,6 +410,22 @@ func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error
 		return nil, nil, err
 	}
 
+	// Decompress if needed
+	if meta.Compression != "" {
+		c, ok := f.snapshotCompressor(meta.Compression)
+		if !ok {
+			fh.Close()
+			return nil, nil, fmt.Errorf("unknown snapshot compression %q", meta.Compression)
+		}
+		decompressed, err := c.NewReader(bufio.NewReader(fh))
+		if err != nil {
+			f.logger.Error("failed to decompress state file", "error", err)
+			fh.Close()
+			return nil, nil, err
+		}
+		return &meta.SnapshotMeta, &compressedFile{ReadCloser: decompressed, fh: fh}, nil
+	}
+
 	// Return a buffered file
 	buffered := &bufferedFile{
 		bh: bufio.NewReader(fh),
@@ -390,9 +463,27 @@ func (s *FileSnapshotSink) ID() string {
 // Write is used to append to the state file. We write to the
 // buffered IO object to reduce the amount of context switches.
 func (s *FileSnapshotSink) Write(b []byte) (int, error) {
+	if s.compressed != nil {
+		n, err := s.compressed.Write(b)
+		s.written += int64(n)
+		return n, err
+	}
 	return s.buffered.Write(b)
 }
 
+// Sync implements the SyncableSnapshotSink interface. It flushes what's been
+// buffered to the state file and syncs it, unless syncing is disabled. Data
+// still held by the compressor, if any, is left there.
+func (s *FileSnapshotSink) Sync() error {
+	if err := s.buffered.Flush(); err != nil {
+		return err
+	}
+	if s.noSync {
+		return nil
+	}
+	return s.stateFile.Sync()
+}
+
 // Close is used to indicate a successful end.
 func (s *FileSnapshotSink) Close() error {
 	// Make sure close is idempotent
@@ -466,6 +557,13 @@ func (s *FileSnapshotSink) Cancel() error {
 
 // finalize is used to close all of our resources.
 func (s *FileSnapshotSink) finalize() error {
+	// Flush the compressor into the buffer
+	if s.compressed != nil {
+		if err := s.compressed.Close(); err != nil {
+			return err
+		}
+	}
+
 	// Flush any remaining data
 	if err := s.buffered.Flush(); err != nil {
 		return err
@@ -491,6 +589,9 @@ func (s *FileSnapshotSink) finalize() error {
 		return statErr
 	}
 	s.meta.Size = stat.Size()
+	if s.compressed != nil {
+		s.meta.Size = s.written
+	}
 
 	// Set the CRC
 	s.meta.CRC = s.stateHash.Sum(nil)
@@ -5,11 +5,14 @@ package raft
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestFileSnapshotStoreImpl(t *testing.T) {
@@ -195,6 +198,109 @@ func TestFileSS_CancelSnapshot(t *testing.T) {
 	}
 }
 
+func TestFileSS_Sync(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	snap, err := NewFileSnapshotStoreWithLogger(dir, 3, newTestLogger(t))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, trans := NewInmemTransport(NewInmemAddr())
+	sink, err := snap.Create(SnapshotVersionMax, 10, 3, Configuration{}, 0, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sink.Cancel()
+
+	// Buffered writes reach the state file once synced.
+	if _, err := sink.Write([]byte("first\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	syncer, ok := sink.(SyncableSnapshotSink)
+	if !ok {
+		t.Fatalf("expected a SyncableSnapshotSink")
+	}
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state, err := os.ReadFile(sink.(*FileSnapshotSink).stateFile.Name())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(state, []byte("first\n")) {
+		t.Fatalf("unexpected state file contents: %q", state)
+	}
+}
+
+func TestFileSS_Meta(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	snap, err := NewFileSnapshotStoreWithLogger(dir, 3, newTestLogger(t))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, trans := NewInmemTransport(NewInmemAddr())
+	before := time.Now()
+	sink, err := snap.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := sink.Write([]byte("state")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	after := time.Now()
+
+	// List reports the metadata without opening the snapshot.
+	snaps, err := snap.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := snaps[0]
+	if meta.Size != 5 || meta.Version != SnapshotVersionMax || meta.ConfigurationIndex != 2 {
+		t.Fatalf("bad meta: %#v", meta)
+	}
+	if meta.CreatedAt.Before(before) || meta.CreatedAt.After(after) {
+		t.Fatalf("bad created time %v, expected between %v and %v", meta.CreatedAt, before, after)
+	}
+
+	// Snapshots written before the time was recorded get it from their
+	// name.
+	metaPath := filepath.Join(dir, snapPath, meta.ID, metaFilePath)
+	buf, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	delete(raw, "CreatedAt")
+	if buf, err = json.Marshal(raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(metaPath, buf, 0o644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snaps, err = snap.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := snaps[0].CreatedAt; got.Before(before.Truncate(time.Millisecond)) || got.After(after) {
+		t.Fatalf("bad created time %v, expected between %v and %v", got, before, after)
+	}
+}
+
 func TestFileSS_Retention(t *testing.T) {
 	var err error
 	// Create a test dir
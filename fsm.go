@@ -13,12 +13,18 @@ import (
 )
 
 // FSM is implemented by clients to make use of the replicated log.
+//
+// FSMV2 is the shape this is expected to take in the next major version.
+// NewFSMV2 and FSMFromV2 convert between the two.
 type FSM interface {
 	// Apply is called once a log entry is committed by a majority of the cluster.
 	//
 	// Apply should apply the log to the FSM. Apply must be deterministic and
 	// produce the same result on all peers in the cluster.
 	//
+	// Apply is passed LogCommand entries. An FSM that needs to know when
+	// commands applied with a TTL expire implements ExpiringFSM.
+	//
 	// The returned value is returned to the client as the ApplyFuture.Response.
 	Apply(*Log) interface{}
 
@@ -62,6 +68,48 @@ type BatchingFSM interface {
 	FSM
 }
 
+// VersionedFSM can optionally be implemented by an FSM to report the newest
+// version of the command format it understands. Each server reports its
+// version to the leader, which holds back commands submitted with
+// ApplyVersioned until every server that applies commands supports their
+// version, so that a new command format can be rolled out safely one server
+// at a time.
+//
+// Experimental: see docs/api_stability.md.
+type VersionedFSM interface {
+	// FSMVersion returns the newest command format version the FSM
+	// understands. It's called from Raft's main goroutine, so it must not
+	// block.
+	FSMVersion() uint64
+
+	FSM
+}
+
+// ExpiringFSM can optionally be implemented by an FSM to be told when a
+// command applied with a TTL expires. Other FSMs aren't passed LogExpiry
+// entries at all, so one that doesn't check the type of the entries it's
+// given won't apply an expired command a second time.
+//
+// Experimental: see docs/api_stability.md.
+type ExpiringFSM interface {
+	// Expire is passed the LogExpiry entry for a command whose TTL has run
+	// out, at the same point in the log on every server. It carries the
+	// command's index in ExpiredIndex and a copy of its Data and Extensions.
+	// It's called from the same goroutine as Apply, in log order, and its
+	// return value is treated like Apply's.
+	Expire(*Log) interface{}
+
+	FSM
+}
+
+// applyExpiry passes a LogExpiry entry to fsm if it implements ExpiringFSM.
+func applyExpiry(fsm FSM, l *Log) interface{} {
+	if e, ok := fsm.(ExpiringFSM); ok {
+		return e.Expire(l)
+	}
+	return nil
+}
+
 // FSMSnapshot is returned by an FSM in response to a Snapshot
 // It must be safe to invoke FSMSnapshot methods with concurrent
 // calls to Apply.
@@ -90,18 +138,24 @@ func (r *Raft) runFSM() {
 		defer func() {
 			// Invoke the future if given
 			if req.future != nil {
+				req.future.measureApplied()
 				req.future.response = resp
 				req.future.respond(nil)
 			}
 		}()
 
+		r.expiries.track(req.log)
 		switch req.log.Type {
 		case LogCommand:
 			start := time.Now()
 			resp = r.fsm.Apply(req.log)
 			metrics.MeasureSince([]string{"raft", "fsm", "apply"}, start)
 
+		case LogExpiry:
+			resp = applyExpiry(r.fsm, req.log)
+
 		case LogConfiguration:
+			r.observeConfigurationApplied(req.log)
 			if !configStoreEnabled {
 				// Return early to avoid incrementing the index and term for
 				// an unimplemented operation.
@@ -118,16 +172,9 @@ func (r *Raft) runFSM() {
 		lastTerm = req.log.Term
 	}
 
-	applyBatch := func(reqs []*commitTuple) {
-		if !batchingEnabled {
-			for _, ct := range reqs {
-				applySingle(ct)
-			}
-			return
-		}
-
-		// Only send LogCommand and LogConfiguration log types. LogBarrier types
-		// will not be sent to the FSM.
+	sendBatch := func(reqs []*commitTuple) {
+		// Only send LogCommand and LogConfiguration log types. LogBarrier
+		// types will not be sent to the FSM.
 		shouldSend := func(l *Log) bool {
 			switch l.Type {
 			case LogCommand, LogConfiguration:
@@ -139,6 +186,7 @@ func (r *Raft) runFSM() {
 		var lastBatchIndex, lastBatchTerm uint64
 		sendLogs := make([]*Log, 0, len(reqs))
 		for _, req := range reqs {
+			r.expiries.track(req.log)
 			if shouldSend(req.log) {
 				sendLogs = append(sendLogs, req.log)
 			}
@@ -165,6 +213,10 @@ func (r *Raft) runFSM() {
 
 		var i int
 		for _, req := range reqs {
+			if req.log.Type == LogConfiguration {
+				r.observeConfigurationApplied(req.log)
+			}
+
 			var resp interface{}
 			// If the log was sent to the FSM, retrieve the response.
 			if shouldSend(req.log) {
@@ -173,12 +225,38 @@ func (r *Raft) runFSM() {
 			}
 
 			if req.future != nil {
+				req.future.measureApplied()
 				req.future.response = resp
 				req.future.respond(nil)
 			}
 		}
 	}
 
+	applyBatch := func(reqs []*commitTuple) {
+		if !batchingEnabled {
+			for _, ct := range reqs {
+				applySingle(ct)
+			}
+			return
+		}
+
+		// LogExpiry entries are passed to Expire rather than ApplyBatch, so
+		// split the batch around them to keep the entries in order.
+		for len(reqs) > 0 {
+			n := 0
+			for n < len(reqs) && reqs[n].log.Type != LogExpiry {
+				n++
+			}
+			if n == 0 {
+				applySingle(reqs[0])
+				n = 1
+			} else {
+				sendBatch(reqs[:n])
+			}
+			reqs = reqs[n:]
+		}
+	}
+
 	restore := func(req *restoreFuture) {
 		// Open the snapshot
 		meta, source, err := r.snapshots.Open(req.ID)
@@ -196,7 +274,7 @@ func (r *Raft) runFSM() {
 		)
 
 		// Attempt to restore
-		if err := fsmRestoreAndMeasure(snapLogger, r.fsm, source, meta.Size); err != nil {
+		if err := r.restoreFSM(snapLogger, source, meta); err != nil {
 			req.respond(fmt.Errorf("failed to restore snapshot %v: %v", req.ID, err))
 			return
 		}
@@ -204,6 +282,12 @@ func (r *Raft) runFSM() {
 		// Update the last index and term
 		lastIndex = meta.Index
 		lastTerm = meta.Term
+		if meta.ConfigurationIndex > 0 {
+			r.observe(ConfigurationAppliedObservation{
+				Index:         meta.ConfigurationIndex,
+				Configuration: meta.Configuration.Clone(),
+			})
+		}
 		req.respond(nil)
 	}
 
@@ -222,11 +306,29 @@ func (r *Raft) runFSM() {
 		// Respond to the request
 		req.index = lastIndex
 		req.term = lastTerm
-		req.snapshot = snap
+		req.snapshot = withSnapshotState(snap, r.snapshotState())
 		req.respond(err)
 	}
 
+	swap := func(req *swapFSMFuture) {
+		// The current FSM is always copied over, even if nothing has been
+		// applied here yet, since it may hold a snapshot restored when Raft
+		// started.
+		if err := r.copyFSM(r.fsm, req.fsm); err != nil {
+			req.respond(err)
+			return
+		}
+		r.fsmLock.Lock()
+		r.fsm = req.fsm
+		r.fsmLock.Unlock()
+		batchingFSM, batchingEnabled = r.fsm.(BatchingFSM)
+		configStore, configStoreEnabled = r.fsm.(ConfigurationStore)
+		r.logger.Info("swapped FSM", "index", r.getLastApplied())
+		req.respond(nil)
+	}
+
 	saturation := newSaturationMetric([]string{"raft", "thread", "fsm", "saturation"}, 1*time.Second)
+	saturation.iterationFn = func(d time.Duration) { r.profileLoop(HotLoopFSM, d) }
 
 	for {
 		saturation.sleeping()
@@ -238,10 +340,17 @@ func (r *Raft) runFSM() {
 			switch req := ptr.(type) {
 			case []*commitTuple:
 				applyBatch(req)
+				releaseCommitTuples(req)
 
 			case *restoreFuture:
 				restore(req)
 
+			case *fsmBarrierFuture:
+				req.respond(nil)
+
+			case *swapFSMFuture:
+				swap(req)
+
 			default:
 				panic(fmt.Errorf("bad type passed to fsmMutateCh: %#v", ptr))
 			}
@@ -277,3 +386,12 @@ func fsmRestoreAndMeasure(logger hclog.Logger, fsm FSM, source io.ReadCloser, sn
 
 	return nil
 }
+
+// observeConfigurationApplied sends a ConfigurationAppliedObservation for a
+// configuration entry.
+func (r *Raft) observeConfigurationApplied(l *Log) {
+	r.observe(ConfigurationAppliedObservation{
+		Index:         l.Index,
+		Configuration: DecodeConfiguration(l.Data),
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// swapFSMFuture is used to replace the FSM from the FSM goroutine.
+type swapFSMFuture struct {
+	deferError
+	fsm FSM
+}
+
+// SwapFSM replaces the FSM while Raft is running, for example to move to a
+// new storage engine or code path without restarting the server. The swap is
+// queued behind the entries that have been committed so far, and while it's
+// made no entries are applied: the current FSM's state is copied into the
+// new one by persisting a snapshot of it straight into the new FSM's
+// Restore, then the new FSM takes over and applying carries on from where
+// the old one left off. Both FSMs must therefore use the same snapshot
+// format. If the copy fails, the current FSM is kept. The old FSM isn't used
+// once the future returns without an error, and it's up to the caller to
+// release anything it holds.
+//
+// This only affects this server, so each server in the cluster needs to swap
+// its own. An optional timeout limits how long to wait for the swap to be
+// started.
+func (r *Raft) SwapFSM(fsm FSM, timeout time.Duration) Future {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	future := &swapFSMFuture{fsm: fsm}
+	future.init()
+	select {
+	case <-timer:
+		return errorFuture{ErrEnqueueTimeout}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.fsmMutateCh <- future:
+		return future
+	}
+}
+
+// currentFSM returns the FSM in use. The FSM goroutine, which is the only
+// one that swaps it, can read r.fsm directly instead.
+func (r *Raft) currentFSM() FSM {
+	r.fsmLock.RLock()
+	defer r.fsmLock.RUnlock()
+	return r.fsm
+}
+
+// copyFSM copies the state of from into to, by persisting a snapshot of from
+// straight into to's Restore. This must only be called from the FSM
+// goroutine.
+func (r *Raft) copyFSM(from, to FSM) error {
+	defer metrics.MeasureSince([]string{"raft", "fsm", "swap"}, time.Now())
+	snap, err := from.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot the current FSM: %v", err)
+	}
+	defer snap.Release()
+
+	pr, pw := io.Pipe()
+	persistErr := make(chan error, 1)
+	go func() {
+		persistErr <- snap.Persist(&pipeSnapshotSink{pw})
+	}()
+	err = to.Restore(pr)
+	// Unblock Persist if Restore stopped reading early, in which case it
+	// fails because of that, so Restore's error is the one to report.
+	pr.CloseWithError(errors.New("restore finished"))
+	perr := <-persistErr
+	if err != nil {
+		return fmt.Errorf("failed to restore the new FSM: %v", err)
+	}
+	if perr != nil {
+		return fmt.Errorf("failed to persist the current FSM: %v", perr)
+	}
+	return nil
+}
+
+// pipeSnapshotSink is a SnapshotSink that writes to a pipe.
+type pipeSnapshotSink struct {
+	*io.PipeWriter
+}
+
+// ID implements the SnapshotSink interface.
+func (p *pipeSnapshotSink) ID() string {
+	return ""
+}
+
+// Cancel implements the SnapshotSink interface.
+func (p *pipeSnapshotSink) Cancel() error {
+	return p.CloseWithError(errors.New("snapshot cancelled"))
+}
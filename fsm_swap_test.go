@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingRestoreFSM is a MockFSM that can't be restored.
+type failingRestoreFSM struct {
+	*MockFSM
+}
+
+func (f *failingRestoreFSM) Restore(io.ReadCloser) error {
+	return errors.New("restore failed")
+}
+
+func TestRaft_SwapFSM(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	old := getMockFSM(c.fsms[c.IndexOf(leader)])
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte("before"), 0).Error())
+	}
+
+	// A failed copy keeps the current FSM.
+	require.ErrorContains(t, leader.SwapFSM(&failingRestoreFSM{&MockFSM{}}, 0).Error(), "restore failed")
+
+	// The new FSM picks up from where the old one left off.
+	swapped := &MockFSM{}
+	require.NoError(t, leader.SwapFSM(swapped, 0).Error())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte("after"), 0).Error())
+	}
+	require.Len(t, old.Logs(), 10)
+	require.Len(t, swapped.Logs(), 20)
+	require.Equal(t, old.Logs(), swapped.Logs()[:10])
+
+	// Snapshots are taken from the new FSM.
+	require.NoError(t, leader.Snapshot().Error())
+	_, source, err := leader.snapshots.Open(mustLatestSnapshotID(t, leader))
+	require.NoError(t, err)
+	restored := &MockFSM{}
+	require.NoError(t, restored.Restore(source))
+	require.Len(t, restored.Logs(), 20)
+}
+
+func TestRaft_SwapFSM_AfterRestart(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte("before"), 0).Error())
+	}
+	c.WaitForReplication(10)
+
+	// Restart a follower from a snapshot. Its new transport isn't connected
+	// to the others, so nothing is applied after the restore.
+	follower := c.Followers()[0]
+	require.NoError(t, follower.Snapshot().Error())
+	require.NoError(t, follower.Shutdown().Error())
+	_, trans := NewInmemTransport(follower.localAddr)
+	conf := follower.config()
+	r, err := NewRaft(&conf, &MockFSM{}, follower.logs, follower.stable, follower.snapshots, trans)
+	require.NoError(t, err)
+	c.rafts[c.IndexOf(follower)] = r
+
+	// The restored state is carried over to the new FSM.
+	swapped := &MockFSM{}
+	require.NoError(t, r.SwapFSM(swapped, 0).Error())
+	require.Len(t, swapped.Logs(), 10)
+}
+
+// mustLatestSnapshotID returns the ID of the latest snapshot r's store holds.
+func mustLatestSnapshotID(t *testing.T, r *Raft) string {
+	snaps, err := r.snapshots.List()
+	require.NoError(t, err)
+	require.NotEmpty(t, snaps)
+	return snaps[0].ID
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import "time"
+
+// localFSMVersion returns the version this server's FSM reports, or zero if
+// it doesn't implement VersionedFSM.
+func (r *Raft) localFSMVersion() uint64 {
+	if fsm, ok := r.currentFSM().(VersionedFSM); ok {
+		return fsm.FSMVersion()
+	}
+	return 0
+}
+
+// clusterFSMVersion returns the newest FSM version every server in the
+// latest configuration that applies commands has reported supporting. That's
+// every server but witnesses, including those on their way out of a joint
+// configuration. Servers that haven't reported one yet count as zero. This
+// must only be called from the main thread while leader.
+func (r *Raft) clusterFSMVersion() uint64 {
+	var version uint64
+	first := true
+	for _, server := range allServers(r.configurations.latest) {
+		if server.Suffrage == Witness {
+			continue
+		}
+		var v uint64
+		if server.ID == r.localID {
+			v = r.localFSMVersion()
+		} else if repl, ok := r.leaderState.replState[server.ID]; ok {
+			v = repl.fsmVersion.Load()
+		}
+		if first || v < version {
+			version, first = v, false
+		}
+	}
+	return version
+}
+
+// releaseHeld dispatches the commands held for their FSM version that every
+// server now supports, and fails those that have been held for too long.
+// This must only be called from the main thread while leader.
+func (r *Raft) releaseHeld() {
+	version := r.clusterFSMVersion()
+	now := time.Now()
+	var ready []*logFuture
+	held := r.leaderState.held[:0]
+	for _, l := range r.leaderState.held {
+		switch {
+		case l.fsmVersion <= version:
+			ready = append(ready, l)
+		case !l.holdUntil.IsZero() && now.After(l.holdUntil):
+			l.respond(ErrFSMVersionUnsupported)
+		default:
+			held = append(held, l)
+		}
+	}
+	for i := len(held); i < len(r.leaderState.held); i++ {
+		r.leaderState.held[i] = nil
+	}
+	r.leaderState.held = held
+	if len(ready) > 0 {
+		r.dispatchLogs(ready)
+	}
+}
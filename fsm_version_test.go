@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// versionedFSM is a MockFSM reporting a version that can be changed, as
+// though the server was upgraded.
+type versionedFSM struct {
+	*MockFSM
+	version atomic.Uint64
+}
+
+func (v *versionedFSM) FSMVersion() uint64 {
+	return v.version.Load()
+}
+
+func (v *versionedFSM) Underlying() FSM {
+	return v.MockFSM
+}
+
+func TestRaft_ApplyVersioned(t *testing.T) {
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     3,
+		Bootstrap: true,
+		Conf:      inmemConfig(t),
+		MakeFSMFunc: func() FSM {
+			fsm := &versionedFSM{MockFSM: &MockFSM{}}
+			fsm.version.Store(1)
+			return fsm
+		},
+	})
+	defer c.Close()
+	leader := c.Leader()
+	version := func(r *Raft) *atomic.Uint64 {
+		return &c.fsms[c.IndexOf(r)].(*versionedFSM).version
+	}
+
+	// Commands every server supports are applied.
+	require.NoError(t, leader.ApplyVersioned([]byte("v1"), 1, 0).Error())
+	require.NoError(t, leader.Apply([]byte("plain"), 0).Error())
+
+	// Nonvoters apply commands too, so newer commands are held until
+	// they've been upgraded as well as the voters, and fail if that takes
+	// too long.
+	old := c.Followers()[0]
+	require.NoError(t, leader.DemoteVoter(old.localID, 0, 0).Error())
+	for _, r := range c.rafts {
+		if r != old {
+			version(r).Store(2)
+		}
+	}
+	require.ErrorIs(t, leader.ApplyVersioned([]byte("v2"), 2, 100*time.Millisecond).Error(), ErrFSMVersionUnsupported)
+
+	held := leader.ApplyVersioned([]byte("v2"), 2, 0)
+	require.NoError(t, leader.Apply([]byte("plain"), 0).Error())
+	select {
+	case <-held.(*logFuture).errCh:
+		t.Fatalf("versioned command wasn't held")
+	default:
+	}
+	version(old).Store(2)
+	require.NoError(t, held.Error())
+	c.WaitForReplication(4)
+	for _, fsm := range c.fsms {
+		require.Equal(t, 1, countCommand(fsm, []byte("v2")))
+	}
+}
@@ -4,10 +4,13 @@
 package raft
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
 	"time"
+
+	metrics "github.com/armon/go-metrics"
 )
 
 // Future is used to represent an action that may occur in the future.
@@ -94,6 +97,12 @@ type deferError struct {
 	errCh      chan error
 	responded  bool
 	ShutdownCh chan struct{}
+
+	// ctx, if set, stops Error waiting once it's done.
+	ctx context.Context
+
+	// onRespond, if set, is called with the outcome before it's delivered.
+	onRespond func(error)
 }
 
 func (d *deferError) init() {
@@ -110,10 +119,21 @@ func (d *deferError) Error() error {
 	if d.errCh == nil {
 		panic("waiting for response on nil channel")
 	}
+	var done <-chan struct{}
+	if d.ctx != nil {
+		done = d.ctx.Done()
+	}
 	select {
 	case d.err = <-d.errCh:
 	case <-d.ShutdownCh:
 		d.err = ErrRaftShutdown
+	case <-done:
+		// Prefer the outcome if it arrived at the same time.
+		select {
+		case d.err = <-d.errCh:
+		default:
+			d.err = d.ctx.Err()
+		}
 	}
 	return d.err
 }
@@ -125,6 +145,9 @@ func (d *deferError) respond(err error) {
 	if d.responded {
 		return
 	}
+	if d.onRespond != nil {
+		d.onRespond(err)
+	}
 	d.errCh <- err
 	close(d.errCh)
 	d.responded = true
@@ -136,6 +159,17 @@ func (d *deferError) respond(err error) {
 type configurationChangeFuture struct {
 	logFuture
 	req configurationChangeRequest
+
+	// coalesced is set if this request resolves with the outcome of an
+	// identical one, which holds it in duplicates until then. duplicates is
+	// protected by Raft's configChangeLock.
+	coalesced  bool
+	duplicates []*configurationChangeFuture
+}
+
+// Coalesced implements the ConfigurationChangeFuture interface.
+func (c *configurationChangeFuture) Coalesced() bool {
+	return c.coalesced
 }
 
 // bootstrapFuture is used to attempt a live bootstrap of the cluster. See the
@@ -153,7 +187,27 @@ type logFuture struct {
 	deferError
 	log      Log
 	response interface{}
+
+	// enqueue, dispatch and commit record when the entry was submitted,
+	// written to the leader's log and committed. They carry the monotonic
+	// clock reading and are only used to measure latency on the leader, they
+	// are never replicated.
+	enqueue  time.Time
 	dispatch time.Time
+	commit   time.Time
+
+	// term, if nonzero, is the term the leader must still be in when the
+	// entry is dispatched. See BarrierAtTerm.
+	term uint64
+
+	// fsmVersion, if nonzero, is the FSM version every server that applies
+	// commands must support before the entry is dispatched. See
+	// ApplyVersioned.
+	fsmVersion uint64
+
+	// holdUntil, if nonzero, is when the leader gives up holding an entry
+	// waiting for its fsmVersion.
+	holdUntil time.Time
 }
 
 func (l *logFuture) Response() interface{} {
@@ -164,6 +218,17 @@ func (l *logFuture) Index() uint64 {
 	return l.log.Index
 }
 
+// measureApplied records how long the entry took to be applied to the FSM
+// after it was committed, and end to end since it was submitted.
+func (l *logFuture) measureApplied() {
+	if !l.commit.IsZero() {
+		metrics.MeasureSince([]string{"raft", "fsm", "commitToApply"}, l.commit)
+	}
+	if !l.enqueue.IsZero() {
+		metrics.MeasureSince([]string{"raft", "apply", "latency"}, l.enqueue)
+	}
+}
+
 type shutdownFuture struct {
 	raft *Raft
 }
@@ -237,10 +302,11 @@ type restoreFuture struct {
 // the leader. This is to prevent a stale read.
 type verifyFuture struct {
 	deferError
-	notifyCh   chan *verifyFuture
-	quorumSize int
-	votes      int
-	voteLock   sync.Mutex
+	notifyCh      chan *verifyFuture
+	quorumSize    int
+	configuration Configuration
+	granted       map[ServerID]bool
+	voteLock      sync.Mutex
 }
 
 // leadershipTransferFuture is used to track the progress of a leadership
@@ -271,7 +337,7 @@ func (c *configurationsFuture) Index() uint64 {
 
 // vote is used to respond to a verifyFuture.
 // This may block when responding on the notifyCh.
-func (v *verifyFuture) vote(leader bool) {
+func (v *verifyFuture) vote(id ServerID, leader bool) {
 	v.voteLock.Lock()
 	defer v.voteLock.Unlock()
 
@@ -281,8 +347,8 @@ func (v *verifyFuture) vote(leader bool) {
 	}
 
 	if leader {
-		v.votes++
-		if v.votes >= v.quorumSize {
+		v.granted[id] = true
+		if quorumReached(v.configuration, v.granted) {
 			v.notifyCh <- v
 			v.notifyCh = nil
 		}
@@ -292,6 +358,14 @@ func (v *verifyFuture) vote(leader bool) {
 	}
 }
 
+// quorumReached returns true if enough servers have confirmed we're still the
+// leader.
+func (v *verifyFuture) quorumReached() bool {
+	v.voteLock.Lock()
+	defer v.voteLock.Unlock()
+	return quorumReached(v.configuration, v.granted)
+}
+
 // appendFuture is used for waiting on a pipelined append
 // entries RPC.
 type appendFuture struct {
@@ -299,6 +373,7 @@ type appendFuture struct {
 	start time.Time
 	args  *AppendEntriesRequest
 	resp  *AppendEntriesResponse
+	size  int64
 }
 
 func (a *appendFuture) Start() time.Time {
@@ -0,0 +1,223 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// idempotentCommandMagic prefixes commands built by IdempotentCommand.
+var idempotentCommandMagic = []byte{0xff, 'i', 'd', 'k'}
+
+// IdempotentCommand wraps a command with a client supplied token, for use with
+// IdempotentFSM. A client that retries an Apply, for example after it timed
+// out without knowing whether the command was committed, should reuse the
+// token so that the command is only applied once.
+func IdempotentCommand(token string, cmd []byte) []byte {
+	buf := make([]byte, 0, len(idempotentCommandMagic)+binary.MaxVarintLen64+len(token)+len(cmd))
+	buf = appendPrefixed(buf, idempotentCommandMagic, []byte(token))
+	return append(buf, cmd...)
+}
+
+// decodeIdempotentCommand splits a command built by IdempotentCommand. It
+// returns false for other commands.
+func decodeIdempotentCommand(data []byte) (string, []byte, bool) {
+	token, cmd, ok := splitPrefixed(data, idempotentCommandMagic)
+	return string(token), cmd, ok
+}
+
+// DuplicateResponse is returned by IdempotentFSM.Apply, and so from the
+// ApplyFuture, when a command's token has already been applied. The command
+// isn't passed to the wrapped FSM.
+type DuplicateResponse struct {
+	// Index is the index of the log entry where the token was first applied.
+	Index uint64
+
+	// Response is what the wrapped FSM returned then. It isn't kept in
+	// snapshots, so it's nil if the first command was applied before this
+	// server last restored one.
+	Response interface{}
+}
+
+// idempotencyToken is an entry in the registry. Its fields are exported so it
+// can be encoded in snapshots.
+type idempotencyToken struct {
+	Token string
+	Index uint64
+	// LastSeen is the AppendedAt time, in Unix nanoseconds, of the latest
+	// entry carrying the token.
+	LastSeen int64
+
+	response interface{}
+}
+
+// IdempotentFSM wraps an FSM with a registry of the tokens of commands built
+// by IdempotentCommand that have been applied, so that a command that is
+// retried with the same token is only applied once. Other commands are passed
+// straight through. The registry is kept in snapshots along with the wrapped
+// FSM's state.
+//
+// The registry is bounded by the number of tokens and how long they're kept.
+// To stay deterministic, tokens are aged using the time the leader appended
+// each entry rather than the local clock. A retry that arrives after its
+// token has been dropped is applied again.
+//
+// IdempotentFSM doesn't implement BatchingFSM or ConfigurationStore, so
+// wrapping an FSM that does disables them.
+type IdempotentFSM struct {
+	fsm       FSM
+	maxTokens int
+	ttl       time.Duration
+
+	// tokens holds *idempotencyToken in order of when they were last seen,
+	// oldest first.
+	tokens *list.List
+	byName map[string]*list.Element
+}
+
+// NewIdempotentFSM wraps fsm. maxTokens bounds how many tokens are kept, and
+// ttl how long after its last use a token is kept. Either may be zero for no
+// limit.
+func NewIdempotentFSM(fsm FSM, maxTokens int, ttl time.Duration) *IdempotentFSM {
+	return &IdempotentFSM{
+		fsm:       fsm,
+		maxTokens: maxTokens,
+		ttl:       ttl,
+		tokens:    list.New(),
+		byName:    make(map[string]*list.Element),
+	}
+}
+
+// Apply implements the FSM interface.
+func (f *IdempotentFSM) Apply(l *Log) interface{} {
+	if l.Type != LogCommand {
+		return f.fsm.Apply(l)
+	}
+	token, cmd, ok := decodeIdempotentCommand(l.Data)
+	if !ok {
+		return f.fsm.Apply(l)
+	}
+
+	now := l.AppendedAt.UnixNano()
+	f.expire(l.AppendedAt)
+	if e, ok := f.byName[token]; ok {
+		t := e.Value.(*idempotencyToken)
+		t.LastSeen = now
+		f.tokens.MoveToBack(e)
+		return DuplicateResponse{Index: t.Index, Response: t.response}
+	}
+
+	unwrapped := *l
+	unwrapped.Data = cmd
+	resp := f.fsm.Apply(&unwrapped)
+	f.byName[token] = f.tokens.PushBack(&idempotencyToken{
+		Token:    token,
+		Index:    l.Index,
+		LastSeen: now,
+		response: resp,
+	})
+	if f.maxTokens > 0 && f.tokens.Len() > f.maxTokens {
+		f.remove(f.tokens.Front())
+	}
+	return resp
+}
+
+// Expire implements the ExpiringFSM interface, passing the entry to the
+// wrapped FSM if it implements ExpiringFSM too, with the token taken off the
+// expired command.
+func (f *IdempotentFSM) Expire(l *Log) interface{} {
+	if _, cmd, ok := decodeIdempotentCommand(l.Data); ok {
+		unwrapped := *l
+		unwrapped.Data = cmd
+		l = &unwrapped
+	}
+	return applyExpiry(f.fsm, l)
+}
+
+// expire drops the tokens that haven't been seen for longer than the TTL.
+func (f *IdempotentFSM) expire(now time.Time) {
+	if f.ttl <= 0 || now.IsZero() {
+		return
+	}
+	cutoff := now.Add(-f.ttl).UnixNano()
+	for e := f.tokens.Front(); e != nil && e.Value.(*idempotencyToken).LastSeen < cutoff; e = f.tokens.Front() {
+		f.remove(e)
+	}
+}
+
+func (f *IdempotentFSM) remove(e *list.Element) {
+	delete(f.byName, e.Value.(*idempotencyToken).Token)
+	f.tokens.Remove(e)
+}
+
+// Snapshot implements the FSM interface.
+func (f *IdempotentFSM) Snapshot() (FSMSnapshot, error) {
+	tokens := make([]idempotencyToken, 0, f.tokens.Len())
+	for e := f.tokens.Front(); e != nil; e = e.Next() {
+		tokens = append(tokens, *e.Value.(*idempotencyToken))
+	}
+	snap, err := f.fsm.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &idempotentSnapshot{tokens: tokens, snap: snap}, nil
+}
+
+// Restore implements the FSM interface.
+func (f *IdempotentFSM) Restore(snapshot io.ReadCloser) error {
+	r := bufio.NewReader(snapshot)
+	buf, err := readPrefixed(r)
+	if err != nil {
+		snapshot.Close()
+		return fmt.Errorf("failed to read idempotency tokens: %v", err)
+	}
+	var tokens []idempotencyToken
+	if err := decodeMsgPack(buf, &tokens); err != nil {
+		snapshot.Close()
+		return fmt.Errorf("failed to decode idempotency tokens: %v", err)
+	}
+
+	f.tokens.Init()
+	f.byName = make(map[string]*list.Element, len(tokens))
+	for i := range tokens {
+		f.byName[tokens[i].Token] = f.tokens.PushBack(&tokens[i])
+	}
+	return f.fsm.Restore(struct {
+		io.Reader
+		io.Closer
+	}{r, snapshot})
+}
+
+// idempotentSnapshot writes the registry ahead of the wrapped FSM's snapshot.
+type idempotentSnapshot struct {
+	tokens []idempotencyToken
+	snap   FSMSnapshot
+}
+
+// Persist implements the FSMSnapshot interface.
+func (s *idempotentSnapshot) Persist(sink SnapshotSink) error {
+	buf, err := encodeMsgPack(s.tokens)
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to encode idempotency tokens: %v", err)
+	}
+	if _, err := sink.Write(appendPrefixed(nil, nil, buf.Bytes())); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write idempotency tokens: %v", err)
+	}
+	return s.snap.Persist(sink)
+}
+
+// Release implements the FSMSnapshot interface.
+func (s *idempotentSnapshot) Release() {
+	s.snap.Release()
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentCommand(t *testing.T) {
+	token, cmd, ok := decodeIdempotentCommand(IdempotentCommand("abc", []byte("cmd")))
+	require.True(t, ok)
+	require.Equal(t, "abc", token)
+	require.Equal(t, []byte("cmd"), cmd)
+
+	_, _, ok = decodeIdempotentCommand([]byte("cmd"))
+	require.False(t, ok)
+	_, _, ok = decodeIdempotentCommand(append(idempotentCommandMagic, 10, 'a'))
+	require.False(t, ok)
+}
+
+func TestIdempotentFSM(t *testing.T) {
+	mock := &MockFSM{}
+	fsm := NewIdempotentFSM(mock, 2, time.Minute)
+	start := time.Now()
+	apply := func(index uint64, data []byte, at time.Duration) interface{} {
+		return fsm.Apply(&Log{Index: index, Type: LogCommand, Data: data, AppendedAt: start.Add(at)})
+	}
+
+	// A retried command is only applied once.
+	require.Equal(t, 1, apply(1, IdempotentCommand("a", []byte("one")), 0))
+	require.Equal(t, DuplicateResponse{Index: 1, Response: 1}, apply(2, IdempotentCommand("a", []byte("one")), 0))
+	require.Equal(t, 2, apply(3, []byte("plain"), 0))
+	require.Equal(t, 3, apply(4, IdempotentCommand("b", []byte("two")), 0))
+	require.Equal(t, [][]byte{[]byte("one"), []byte("plain"), []byte("two")}, mock.Logs())
+
+	// Expiries are passed on without the token, to FSMs that take them.
+	require.Nil(t, fsm.Expire(&Log{Type: LogExpiry, Data: IdempotentCommand("a", []byte("one"))}))
+	expiring := &expiringFSM{MockFSM: &MockFSM{}}
+	fsm.fsm = expiring
+	require.Nil(t, fsm.Expire(&Log{Type: LogExpiry, Data: IdempotentCommand("a", []byte("one"))}))
+	require.Equal(t, []byte("one"), expiring.Expired()[0].Data)
+	fsm.fsm = mock
+
+	// The registry survives a snapshot.
+	store := NewInmemSnapshotStore()
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	sink, err := store.Create(SnapshotVersionMax, 4, 1, Configuration{}, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+	_, source, err := store.Open(sink.ID())
+	require.NoError(t, err)
+
+	mock = &MockFSM{}
+	fsm = NewIdempotentFSM(mock, 2, time.Minute)
+	require.NoError(t, fsm.Restore(source))
+	require.Len(t, mock.Logs(), 3)
+	require.Equal(t, DuplicateResponse{Index: 4}, apply(5, IdempotentCommand("b", []byte("two")), 0))
+
+	// A corrupt registry length is refused rather than allocated.
+	corrupt := io.NopCloser(bytes.NewReader(binary.AppendUvarint(nil, 1<<62)))
+	require.Error(t, NewIdempotentFSM(&MockFSM{}, 2, time.Minute).Restore(corrupt))
+
+	// The least recently seen token is dropped once there are too many.
+	require.Equal(t, 4, apply(6, IdempotentCommand("c", []byte("three")), 0))
+	require.Equal(t, 5, apply(7, IdempotentCommand("a", []byte("one")), 0))
+
+	// Tokens are dropped once they haven't been seen for the TTL, measured
+	// by the entries' AppendedAt times.
+	require.Equal(t, DuplicateResponse{Index: 6, Response: 4}, apply(8, IdempotentCommand("c", []byte("three")), 30*time.Second))
+	require.Equal(t, 6, apply(9, IdempotentCommand("a", []byte("one")), 90*time.Second))
+	require.Equal(t, 7, apply(10, IdempotentCommand("c", []byte("three")), 2*time.Minute))
+}
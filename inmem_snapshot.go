@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 )
 
 // InmemSnapshotStore implements the SnapshotStore interface and
@@ -36,8 +37,8 @@ func NewInmemSnapshotStore() *InmemSnapshotStore {
 // Create replaces the stored snapshot with a new one using the given args
 func (m *InmemSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
-	// We only support version 1 snapshots at this time.
-	if version != 1 {
+	// We only support version 1 snapshots and later at this time.
+	if version < 1 || version > SnapshotVersionMax {
 		return nil, fmt.Errorf("unsupported snapshot version %d", version)
 	}
 
@@ -55,6 +56,7 @@ func (m *InmemSnapshotStore) Create(version SnapshotVersion, index, term uint64,
 			Peers:              encodePeers(configuration, trans),
 			Configuration:      configuration,
 			ConfigurationIndex: configurationIndex,
+			CreatedAt:          time.Now(),
 		},
 		contents: &bytes.Buffer{},
 	}
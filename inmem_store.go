@@ -4,7 +4,6 @@
 package raft
 
 import (
-	"errors"
 	"sync"
 )
 
@@ -112,7 +111,7 @@ func (i *InmemStore) Get(key []byte) ([]byte, error) {
 	defer i.l.RUnlock()
 	val := i.kv[string(key)]
 	if val == nil {
-		return nil, errors.New("not found")
+		return nil, ErrKeyNotFound
 	}
 	return val, nil
 }
@@ -125,6 +124,17 @@ func (i *InmemStore) SetUint64(key []byte, val uint64) error {
 	return nil
 }
 
+// CompareAndSetUint64 implements the CompareAndSetStableStore interface.
+func (i *InmemStore) CompareAndSetUint64(key []byte, old, val uint64) (bool, error) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.kvInt[string(key)] != old {
+		return false, nil
+	}
+	i.kvInt[string(key)] = val
+	return true, nil
+}
+
 // GetUint64 implements the StableStore interface.
 func (i *InmemStore) GetUint64(key []byte) (uint64, error) {
 	i.l.RLock()
@@ -125,6 +125,58 @@ func (i *InmemTransport) RequestVote(id ServerID, target ServerAddress, args *Re
 	return nil
 }
 
+// RequestPreVote implements the WithPreVote interface.
+func (i *InmemTransport) RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*RequestPreVoteResponse)
+	*resp = *out
+	return nil
+}
+
+// Status implements the WithStatus interface.
+func (i *InmemTransport) Status(id ServerID, target ServerAddress, args *StatusRequest, resp *StatusResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*StatusResponse)
+	*resp = *out
+	return nil
+}
+
+// Join implements the WithJoin interface.
+func (i *InmemTransport) Join(id ServerID, target ServerAddress, args *JoinRequest, resp *JoinResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*JoinResponse)
+	*resp = *out
+	return nil
+}
+
+// Leave implements the WithLeave interface.
+func (i *InmemTransport) Leave(id ServerID, target ServerAddress, args *LeaveRequest, resp *LeaveResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*LeaveResponse)
+	*resp = *out
+	return nil
+}
+
 // InstallSnapshot implements the Transport interface.
 func (i *InmemTransport) InstallSnapshot(id ServerID, target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error {
 	rpcResp, err := i.makeRPC(target, args, data, 10*i.timeout)
@@ -167,6 +219,7 @@ func (i *InmemTransport) makeRPC(target ServerAddress, args interface{}, r io.Re
 		Command:  args,
 		Reader:   r,
 		RespChan: respCh,
+		From:     i.localAddr,
 	}
 	select {
 	case peer.consumerCh <- req:
@@ -316,6 +369,7 @@ func (i *inmemPipeline) AppendEntries(args *AppendEntriesRequest, resp *AppendEn
 	rpc := RPC{
 		Command:  args,
 		RespChan: respCh,
+		From:     i.trans.localAddr,
 	}
 
 	// Check if we have been already shutdown, otherwise the random choose
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+)
+
+// The setters below shadow those of raftState so that, when
+// Config.CheckInvariants is set, the invariants are checked after every
+// change. The term is covered by setCurrentTerm, which always refuses to go
+// backwards.
+
+func (r *Raft) setCommitIndex(index uint64) {
+	old := r.getCommitIndex()
+	r.raftState.setCommitIndex(index)
+	if r.checkInvariants {
+		if index < old {
+			r.invariantViolated("commit index went backwards from %d to %d", old, index)
+		}
+		r.checkIndexInvariants()
+	}
+}
+
+func (r *Raft) setLastApplied(index uint64) {
+	old := r.getLastApplied()
+	r.raftState.setLastApplied(index)
+	if r.checkInvariants {
+		if index < old {
+			r.invariantViolated("last applied index went backwards from %d to %d", old, index)
+		}
+		r.checkIndexInvariants()
+	}
+}
+
+func (r *Raft) setLastLog(index, term uint64) {
+	r.raftState.setLastLog(index, term)
+	if r.checkInvariants {
+		r.checkIndexInvariants()
+	}
+}
+
+func (r *Raft) setLastSnapshot(index, term uint64) {
+	r.raftState.setLastSnapshot(index, term)
+	if r.checkInvariants {
+		r.checkIndexInvariants()
+	}
+}
+
+// checkIndexInvariants checks how the indexes and terms relate to each other.
+// It can be called from any goroutine, so each value on the smaller side of a
+// comparison is read before the value it must not exceed, which only grows,
+// or only shrinks by less than the smaller side has grown since.
+func (r *Raft) checkIndexInvariants() {
+	lastApplied := r.getLastApplied()
+	commitIndex := r.getCommitIndex()
+	lastSnapIndex, lastSnapTerm := r.getLastSnapshot()
+	lastLogIndex, lastLogTerm := r.getLastLog()
+	term := r.getCurrentTerm()
+
+	lastIndex := lastLogIndex
+	if lastSnapIndex > lastIndex {
+		lastIndex = lastSnapIndex
+	}
+	switch {
+	case commitIndex > lastIndex:
+		r.invariantViolated("commit index %d is past the last index %d", commitIndex, lastIndex)
+	case lastApplied > commitIndex && lastApplied > lastSnapIndex:
+		// Entries covered by a snapshot count as committed, as a snapshot
+		// can be installed ahead of learning the commit index.
+		r.invariantViolated("last applied index %d is past the commit index %d and the last snapshot %d",
+			lastApplied, commitIndex, lastSnapIndex)
+	case lastLogTerm > term:
+		r.invariantViolated("last log term %d is past the current term %d", lastLogTerm, term)
+	case lastSnapTerm > term:
+		r.invariantViolated("last snapshot term %d is past the current term %d", lastSnapTerm, term)
+	}
+}
+
+// checkConfigurationInvariants checks the latest and committed configurations
+// are valid and consistent. It must only be called from the main thread.
+func (r *Raft) checkConfigurationInvariants() {
+	c := r.configurations
+	if c.committedIndex > c.latestIndex {
+		r.invariantViolated("committed configuration index %d is past the latest configuration index %d",
+			c.committedIndex, c.latestIndex)
+		return
+	}
+	if c.latestIndex > 0 {
+		if err := checkConfiguration(c.latest); err != nil {
+			r.invariantViolated("latest configuration at index %d is invalid: %v", c.latestIndex, err)
+			return
+		}
+	}
+	if c.committedIndex > 0 {
+		if err := checkConfiguration(c.committed); err != nil {
+			r.invariantViolated("committed configuration at index %d is invalid: %v", c.committedIndex, err)
+		}
+	}
+}
+
+// invariantViolated handles a broken invariant as a fatal error.
+func (r *Raft) invariantViolated(format string, args ...interface{}) {
+	r.fatal(fmt.Errorf("%w: %s", ErrInvariantViolation, fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_CheckInvariants(t *testing.T) {
+	cases := map[string]func(r *Raft){
+		"commit past last index": func(r *Raft) {
+			r.setCommitIndex(5)
+		},
+		"commit goes backwards": func(r *Raft) {
+			r.setLastLog(5, 1)
+			r.setCommitIndex(5)
+			r.setCommitIndex(4)
+		},
+		"applied past commit": func(r *Raft) {
+			r.setLastLog(5, 1)
+			r.setCommitIndex(3)
+			r.setLastApplied(4)
+		},
+		"log term past current term": func(r *Raft) {
+			r.setLastLog(5, 2)
+		},
+		"committed configuration past latest": func(r *Raft) {
+			r.setCommittedConfiguration(Configuration{Servers: []Server{{ID: "first", Address: "first"}}}, 1)
+		},
+		"invalid configuration": func(r *Raft) {
+			r.setLatestConfiguration(Configuration{Servers: []Server{{ID: "first"}}}, 1)
+		},
+	}
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) {
+			faultCh := make(chan error, 1)
+			conf := inmemConfig(t)
+			conf.LocalID = ServerID("first")
+			conf.skipStartup = true
+			conf.CheckInvariants = true
+			conf.FatalErrorPolicy = FatalErrorShutdown
+			conf.FaultCh = faultCh
+			env := MakeRaft(t, conf, false)
+			defer env.Release()
+			r := env.raft
+			r.setCurrentTerm(1)
+
+			fn(r)
+			select {
+			case err := <-faultCh:
+				require.ErrorIs(t, err, ErrInvariantViolation)
+			default:
+				t.Fatalf("expected invariant violation")
+			}
+		})
+	}
+
+	t.Run("consistent", func(t *testing.T) {
+		conf := inmemConfig(t)
+		conf.LocalID = ServerID("first")
+		conf.skipStartup = true
+		conf.CheckInvariants = true
+		env := MakeRaft(t, conf, false)
+		defer env.Release()
+		r := env.raft
+		r.setCurrentTerm(2)
+
+		r.setLastLog(5, 2)
+		r.setCommitIndex(4)
+		r.setLastApplied(4)
+		r.setLatestConfiguration(Configuration{Servers: []Server{{ID: "first", Address: "first"}}}, 2)
+		r.setCommittedConfiguration(Configuration{Servers: []Server{{ID: "first", Address: "first"}}}, 2)
+
+		// A snapshot can be installed ahead of the commit index.
+		r.setLastSnapshot(10, 2)
+		r.setLastApplied(10)
+		require.NotEqual(t, Shutdown, r.getState())
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// leaveRetryInterval is how long Leave waits before asking again when there's
+// no leader or the leader couldn't be reached.
+const leaveRetryInterval = 50 * time.Millisecond
+
+// Leave removes this server from the cluster. A leader first transfers
+// leadership to another voter. The server then asks the leader to remove it,
+// retrying while there's no leader or the leader can't be reached, and
+// returns once the removal has been committed. This requires a transport
+// implementing WithLeave. An optional timeout limits how long it waits, after
+// which ErrEnqueueTimeout is returned; the removal may still go ahead. The
+// server keeps running afterwards, so it's up to the caller to shut it down.
+func (r *Raft) Leave(timeout time.Duration) error {
+	defer metrics.MeasureSince([]string{"raft", "leave"}, time.Now())
+	if r.protocolVersion < 3 {
+		return ErrUnsupportedProtocol
+	}
+	trans, ok := r.trans.(WithLeave)
+	if !ok {
+		return fmt.Errorf("transport doesn't support leaving")
+	}
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	if r.State() == Leader {
+		future := r.LeadershipTransfer()
+		errCh := make(chan error, 1)
+		go func() { errCh <- future.Error() }()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				return fmt.Errorf("failed to transfer leadership before leaving: %w", err)
+			}
+		case <-timer:
+			return ErrEnqueueTimeout
+		}
+	}
+
+	for {
+		if !inConfiguration(r.getLatestConfiguration(), r.localID) {
+			return nil
+		}
+
+		var err error
+		leader, _ := r.LeaderWithID()
+		if leader == "" {
+			err = fmt.Errorf("no known leader")
+		} else if leader != r.localAddr {
+			var done bool
+			if done, err = r.sendLeave(trans, leader); done {
+				return nil
+			}
+		}
+		if err != nil {
+			r.logger.Debug("failed to leave, will retry", "leader", leader, "error", err)
+		}
+
+		select {
+		case <-time.After(leaveRetryInterval):
+		case <-timer:
+			return ErrEnqueueTimeout
+		case <-r.shutdownCh:
+			return ErrRaftShutdown
+		}
+	}
+}
+
+// sendLeave asks the leader to remove this server, reporting whether it has
+// been.
+func (r *Raft) sendLeave(trans WithLeave, leader ServerAddress) (bool, error) {
+	req := &LeaveRequest{
+		RPCHeader: r.getRPCHeader(),
+		ID:        r.localID,
+	}
+	var resp LeaveResponse
+	if err := trans.Leave("", leader, req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Success, nil
+}
+
+// leave is invoked when we get a Leave RPC call. This must only be called
+// from the main thread.
+func (r *Raft) leave(rpc RPC, req *LeaveRequest) {
+	defer metrics.MeasureSince([]string{"raft", "rpc", "leave"}, time.Now())
+	resp := &LeaveResponse{RPCHeader: r.getRPCHeader()}
+	if r.getState() != Leader {
+		rpc.Respond(resp, nil)
+		return
+	}
+	if string(req.RPCHeader.ID) != string(req.ID) {
+		rpc.Respond(resp, fmt.Errorf("%w: servers can only ask to remove themselves", ErrLeaveRefused))
+		return
+	}
+	var found bool
+	for _, server := range allServers(r.configurations.latest) {
+		if server.ID != req.ID {
+			continue
+		}
+		if server.Address != r.trans.DecodePeer(req.RPCHeader.Addr) {
+			rpc.Respond(resp, fmt.Errorf("%w: %s isn't at the address it asked from", ErrLeaveRefused, req.ID))
+			return
+		}
+		found = true
+	}
+	if !found {
+		resp.Success = true
+		rpc.Respond(resp, nil)
+		return
+	}
+
+	// The change is made by the main thread, which is busy handling this RPC,
+	// so wait for it elsewhere.
+	r.logger.Info("removing server that asked to leave", "id", req.ID)
+	r.goFunc(func() {
+		err := r.requestConfigChange(configurationChangeRequest{
+			command:   RemoveServer,
+			serverID:  req.ID,
+			requester: req.ID,
+		}, 0).Error()
+		resp.Success = err == nil
+		rpc.Respond(resp, err)
+	})
+}
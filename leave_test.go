@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_Leave(t *testing.T) {
+	c := MakeCluster(4, t, nil)
+	defer c.Close()
+
+	// A follower asks the leader to remove it.
+	leader := c.Leader()
+	follower := c.Followers()[0]
+	require.NoError(t, follower.Leave(c.propagateTimeout))
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.False(t, inConfiguration(future.Configuration(), follower.localID))
+
+	// The leader hands over leadership before doing the same.
+	require.NoError(t, leader.Leave(c.propagateTimeout))
+	require.NotEqual(t, Leader, leader.State())
+	newLeader := c.Leader()
+	require.NotEqual(t, leader, newLeader)
+	future = newLeader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.False(t, inConfiguration(future.Configuration(), leader.localID))
+	require.Len(t, future.Configuration().Servers, 2)
+}
+
+func TestRaft_LeaveRefused(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	followers := c.Followers()
+	trans := c.trans[c.IndexOf(followers[0])]
+
+	// A server can't ask for another to be removed, whether it says so or
+	// claims to be it.
+	for _, header := range []RPCHeader{
+		followers[0].getRPCHeader(),
+		{
+			ProtocolVersion: ProtocolVersionMax,
+			ID:              []byte(followers[1].localID),
+			Addr:            trans.EncodePeer(followers[1].localID, followers[0].localAddr),
+		},
+	} {
+		var resp LeaveResponse
+		err := trans.(WithLeave).Leave(leader.localID, leader.localAddr,
+			&LeaveRequest{RPCHeader: header, ID: followers[1].localID}, &resp)
+		require.ErrorContains(t, err, ErrLeaveRefused.Error())
+		require.False(t, resp.Success)
+	}
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.Len(t, future.Configuration().Servers, 3)
+}
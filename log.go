@@ -41,6 +41,21 @@ const (
 	// created when a server is added, removed, promoted, etc. Only used
 	// when protocol version 1 or greater is in use.
 	LogConfiguration
+
+	// LogExpiry marks that the TTL of an earlier LogCommand entry has run
+	// out. It is appended by the leader and passed to FSMs that implement
+	// ExpiringFSM, carrying the expired entry's index in ExpiredIndex and a
+	// copy of its Data and Extensions. It may occasionally be repeated for
+	// the same entry, for example when leadership changes while one is in
+	// flight, so FSMs should ignore ones for entries that have already
+	// expired.
+	LogExpiry
+
+	// LogSchedule holds a command to be applied once the commit index or the
+	// leader's clock reaches a target, as requested with ApplyAt. It isn't
+	// applied to the FSM itself. The leader appends the command as a
+	// LogCommand entry with ScheduledIndex set once the target is reached.
+	LogSchedule
 )
 
 // String returns LogType as a human readable string.
@@ -58,14 +73,65 @@ func (lt LogType) String() string {
 		return "LogBarrier"
 	case LogConfiguration:
 		return "LogConfiguration"
+	case LogExpiry:
+		return "LogExpiry"
+	case LogSchedule:
+		return "LogSchedule"
 	default:
 		return fmt.Sprintf("%d", lt)
 	}
 }
 
+// LogVersion is the version of the Log entry schema. Entries are encoded by
+// field name, so a decoder simply leaves fields it doesn't know about, or that
+// an older writer didn't set, at their zero value. The version lets readers
+// tell an entry that predates a field apart from one where it is empty.
+//
+// # Version History
+//
+// 0: Original entries written before the schema was versioned. Extensions and
+// AppendedAt may or may not be present depending on the writer.
+//
+// 1: Adds the Version field itself. The leader always sets AppendedAt, which
+// serves as the entry's creation time.
+//
+// 2: Adds the TTL and ExpiredIndex fields, and the LogExpiry type.
+//
+// 3: Adds the Checksum field, which is verified from this version on.
+//
+// 4: Adds the ScheduledIndex field, which the checksum covers from this
+// version on, and the LogSchedule type.
+//
+// 5: Adds joint consensus, where LogConfiguration entries carry the Outgoing
+// servers of the encoded Configuration. The leader doesn't start a joint
+// change until every server accepts this version, and a server being added
+// by one refuses the joint configuration if it doesn't.
+//
+// New fields must be optional, so servers can keep replicating entries from
+// a mix of versions during a rolling upgrade. Followers report the newest
+// version they accept, and the leader stamps each entry with the newest
+// version every server in the configuration accepts. Commands that use newer
+// fields, such as a TTL, are refused with ErrLogFieldsUnsupported until every
+// server accepts the version that added them, since an older server couldn't
+// apply them. A follower will refuse entries with a version newer than
+// LogVersionMax, rather than storing them with fields silently dropped, so
+// servers can be upgraded in any order.
+type LogVersion uint8
+
+const (
+	// LogVersionMin is the minimum log entry version
+	LogVersionMin LogVersion = 0
+	// LogVersionMax is the maximum log entry version
+	LogVersionMax LogVersion = 5
+)
+
 // Log entries are replicated to all members of the Raft cluster
 // and form the heart of the replicated state machine.
 type Log struct {
+	// Version holds the schema version the entry was written with. See
+	// LogVersion for details.
+	Version LogVersion
+
 	// Index holds the index of the log entry.
 	Index uint64
 
@@ -93,6 +159,23 @@ type Log struct {
 	// program is also a good idea.
 	Extensions []byte
 
+	// TTL may be set on a LogCommand entry to have it expire. Once this long
+	// has passed since the leader appended the entry, per its AppendedAt, the
+	// leader appends a LogExpiry entry for it, so the FSM learns of the expiry
+	// at the same point in the log on every server rather than each server
+	// running its own timer. Entries that haven't expired are kept in
+	// snapshots, ahead of the FSM's own data, so they aren't forgotten when
+	// the log is compacted.
+	TTL time.Duration
+
+	// ExpiredIndex holds the index of the entry that expired on LogExpiry
+	// entries.
+	ExpiredIndex uint64
+
+	// ScheduledIndex holds the index of the LogSchedule entry a LogCommand
+	// entry was scheduled by, or zero if it wasn't.
+	ScheduledIndex uint64
+
 	// AppendedAt stores the time the leader first appended this log to it's
 	// LogStore. Followers will observe the leader's time. It is not used for
 	// coordination or as part of the replication protocol at all. It exists only
@@ -105,10 +188,17 @@ type Log struct {
 	// delivering to followers although the current implementation happens to do
 	// this.
 	AppendedAt time.Time
+
+	// Checksum holds a CRC32 of the entry's contents, set from version 3 on.
+	// See VerifyChecksum.
+	Checksum uint32
 }
 
 // LogStore is used to provide an interface for storing
 // and retrieving logs in a durable fashion.
+//
+// LogStoreV2 is the shape this is expected to take in the next major
+// version. NewLogStoreV2 and LogStoreFromV2 convert between the two.
 type LogStore interface {
 	// FirstIndex returns the first index written. 0 for no entries.
 	FirstIndex() (uint64, error)
@@ -116,7 +206,9 @@ type LogStore interface {
 	// LastIndex returns the last index written. 0 for no entries.
 	LastIndex() (uint64, error)
 
-	// GetLog gets a log entry at a given index.
+	// GetLog gets a log entry at a given index. If the entry is found but
+	// has been corrupted, it should return an error matching ErrLogCorrupt,
+	// such as a LogCorruptionError. See ChecksumLogStore.
 	GetLog(index uint64, log *Log) error
 
 	// StoreLog stores a log entry.
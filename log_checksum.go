@@ -0,0 +1,137 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// castagnoliTable is the CRC32 table used for log entry checksums, which
+// most CPUs can compute in hardware.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LogCorruptionError is returned when a log entry doesn't match its checksum.
+// It matches ErrLogCorrupt with errors.Is.
+type LogCorruptionError struct {
+	Index    uint64
+	Checksum uint32
+	Expected uint32
+}
+
+// Error implements the error interface.
+func (e *LogCorruptionError) Error() string {
+	return fmt.Sprintf("%v: index %d has checksum %08x, expected %08x", ErrLogCorrupt, e.Index, e.Checksum, e.Expected)
+}
+
+// Is lets errors.Is match the error with ErrLogCorrupt.
+func (e *LogCorruptionError) Is(target error) bool {
+	return target == ErrLogCorrupt
+}
+
+// computeChecksum returns the checksum of the entry's contents. AppendedAt is
+// left out as it's only informational, and stores may not keep it exactly.
+func (l *Log) computeChecksum() uint32 {
+	var buf [8]byte
+	h := crc32.New(castagnoliTable)
+	for _, v := range []uint64{
+		uint64(l.Version), l.Index, l.Term, uint64(l.Type),
+		uint64(l.TTL), l.ExpiredIndex,
+		uint64(len(l.Data)), uint64(len(l.Extensions)),
+	} {
+		binary.BigEndian.PutUint64(buf[:], v)
+		h.Write(buf[:])
+	}
+	if l.Version >= 4 {
+		binary.BigEndian.PutUint64(buf[:], l.ScheduledIndex)
+		h.Write(buf[:])
+	}
+	h.Write(l.Data)
+	h.Write(l.Extensions)
+	return h.Sum32()
+}
+
+// SetChecksum sets the entry's Checksum from its contents. Raft sets it on
+// every entry it creates, so this is only needed for entries modified outside
+// of Raft.
+func (l *Log) SetChecksum() {
+	l.Checksum = l.computeChecksum()
+}
+
+// VerifyChecksum returns a LogCorruptionError if the entry doesn't match its
+// Checksum. Entries older than version 3 have no checksum, so they always
+// pass.
+func (l *Log) VerifyChecksum() error {
+	if l.Version < 3 {
+		return nil
+	}
+	if sum := l.computeChecksum(); sum != l.Checksum {
+		return &LogCorruptionError{Index: l.Index, Checksum: sum, Expected: l.Checksum}
+	}
+	return nil
+}
+
+// ChecksumLogStore wraps any LogStore implementation to verify the checksum
+// of each entry it reads, so that corruption at rest is reported with an
+// error matching ErrLogCorrupt rather than the entry being replayed.
+type ChecksumLogStore struct {
+	store LogStore
+}
+
+// NewChecksumLogStore returns a ChecksumLogStore wrapping store.
+func NewChecksumLogStore(store LogStore) *ChecksumLogStore {
+	return &ChecksumLogStore{store: store}
+}
+
+// IsMonotonic implements the MonotonicLogStore interface. This is a shim to
+// expose the underlying store as monotonically indexed or not.
+func (c *ChecksumLogStore) IsMonotonic() bool {
+	if store, ok := c.store.(MonotonicLogStore); ok {
+		return store.IsMonotonic()
+	}
+	return false
+}
+
+// FirstIndex implements the LogStore interface.
+func (c *ChecksumLogStore) FirstIndex() (uint64, error) {
+	return c.store.FirstIndex()
+}
+
+// LastIndex implements the LogStore interface.
+func (c *ChecksumLogStore) LastIndex() (uint64, error) {
+	return c.store.LastIndex()
+}
+
+// GetLog implements the LogStore interface.
+func (c *ChecksumLogStore) GetLog(index uint64, log *Log) error {
+	if err := c.store.GetLog(index, log); err != nil {
+		return err
+	}
+	if err := log.VerifyChecksum(); err != nil {
+		metrics.IncrCounter([]string{"raft", "logstore", "corrupt"}, 1)
+		return err
+	}
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (c *ChecksumLogStore) StoreLog(log *Log) error {
+	return c.store.StoreLog(log)
+}
+
+// StoreLogs implements the LogStore interface.
+func (c *ChecksumLogStore) StoreLogs(logs []*Log) error {
+	return c.store.StoreLogs(logs)
+}
+
+// DeleteRange implements the LogStore interface.
+func (c *ChecksumLogStore) DeleteRange(min, max uint64) error {
+	return c.store.DeleteRange(min, max)
+}
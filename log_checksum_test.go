@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Checksum(t *testing.T) {
+	l := &Log{Version: LogVersionMax, Index: 5, Term: 2, Type: LogCommand, Data: []byte("hello")}
+	l.SetChecksum()
+	require.NotZero(t, l.Checksum)
+	require.NoError(t, l.VerifyChecksum())
+
+	l.Data[0] = 'j'
+	err := l.VerifyChecksum()
+	require.ErrorIs(t, err, ErrLogCorrupt)
+	var corrupt *LogCorruptionError
+	require.True(t, errors.As(err, &corrupt))
+	require.Equal(t, uint64(5), corrupt.Index)
+	require.NotEqual(t, corrupt.Expected, corrupt.Checksum)
+
+	// Moving data between fields is caught too.
+	l = &Log{Version: LogVersionMax, Data: []byte("ab"), Extensions: []byte("c")}
+	l.SetChecksum()
+	l.Data, l.Extensions = []byte("a"), []byte("bc")
+	require.ErrorIs(t, l.VerifyChecksum(), ErrLogCorrupt)
+
+	// Older entries have no checksum to check.
+	l = &Log{Version: 2, Index: 5, Data: []byte("hello")}
+	require.NoError(t, l.VerifyChecksum())
+}
+
+func TestChecksumLogStore(t *testing.T) {
+	inmem := NewInmemStore()
+	store := NewChecksumLogStore(inmem)
+
+	entry := &Log{Version: LogVersionMax, Index: 1, Term: 1, Data: []byte("test")}
+	entry.SetChecksum()
+	require.NoError(t, store.StoreLog(entry))
+
+	var out Log
+	require.NoError(t, store.GetLog(1, &out))
+	require.Equal(t, []byte("test"), out.Data)
+
+	// The in-memory store keeps the entry it was given, so this corrupts it.
+	entry.Data[0] = 'b'
+	require.ErrorIs(t, store.GetLog(1, &out), ErrLogCorrupt)
+	require.ErrorIs(t, store.GetLog(2, &out), ErrLogNotFound)
+}
+
+func TestRaft_appendEntries_Checksum(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+	r.logs = NewChecksumLogStore(env.store)
+	r.setCurrentTerm(1)
+
+	entry := func(index uint64, data string) *Log {
+		l := &Log{Version: LogVersionMax, Index: index, Term: 1, Type: LogCommand, Data: []byte(data)}
+		l.SetChecksum()
+		return l
+	}
+	send := func(prev uint64, entries ...*Log) RPCResponse {
+		respCh := make(chan RPCResponse, 1)
+		r.appendEntries(RPC{RespChan: respCh}, &AppendEntriesRequest{
+			RPCHeader:    RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")},
+			Term:         1,
+			PrevLogEntry: prev,
+			PrevLogTerm:  1,
+			Entries:      entries,
+		})
+		return <-respCh
+	}
+
+	first, second := entry(1, "a"), entry(2, "b")
+	resp := send(0, first, second)
+	require.NoError(t, resp.Error)
+	require.True(t, resp.Response.(*AppendEntriesResponse).Success)
+
+	// An entry corrupted on the way is refused.
+	bad := entry(3, "c")
+	bad.Data[0] = 'd'
+	resp = send(2, bad)
+	require.ErrorIs(t, resp.Error, ErrLogCorrupt)
+	require.Equal(t, uint64(2), r.getLastIndex())
+
+	// A corrupt entry in our own log is replaced with the leader's copy.
+	second.Data[0] = 'x'
+	var out Log
+	require.ErrorIs(t, r.logs.GetLog(2, &out), ErrLogCorrupt)
+	resp = send(1, entry(2, "b"), entry(3, "c"))
+	require.NoError(t, resp.Error)
+	require.True(t, resp.Response.(*AppendEntriesResponse).Success)
+	require.NoError(t, r.logs.GetLog(2, &out))
+	require.Equal(t, []byte("b"), out.Data)
+	require.NoError(t, r.logs.GetLog(3, &out))
+	require.Equal(t, []byte("c"), out.Data)
+}
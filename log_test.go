@@ -156,3 +156,26 @@ func getCurrentGaugeValue(t *testing.T, sink *metrics.InmemSink, name string) fl
 	t.Fatalf("didn't find gauge %q", name)
 	return 0
 }
+
+func TestLog_DecodeUnversioned(t *testing.T) {
+	// An entry encoded before the Version field existed.
+	type unversionedLog struct {
+		Index uint64
+		Term  uint64
+		Type  LogType
+		Data  []byte
+	}
+	buf, err := encodeMsgPack(unversionedLog{Index: 1, Term: 2, Type: LogCommand, Data: []byte("foo")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var l Log
+	if err := decodeMsgPack(buf.Bytes(), &l); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.Version != LogVersionMin || l.Index != 1 || l.Term != 2 ||
+		l.Type != LogCommand || !bytes.Equal(l.Data, []byte("foo")) {
+		t.Fatalf("bad log: %#v", l)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+// requiredVersion returns the oldest log entry version that has all the
+// fields the entry uses.
+func (l *Log) requiredVersion() LogVersion {
+	switch {
+	case l.ScheduledIndex != 0 || l.Type == LogSchedule:
+		return 4
+	case l.TTL != 0 || l.ExpiredIndex != 0 || l.Type == LogExpiry:
+		return 2
+	}
+	return LogVersionMin
+}
+
+// clusterLogVersion returns the newest log entry version every server in the
+// latest configuration, including nonvoters, has reported accepting. Servers
+// that haven't reported one yet, including ones running versions from before
+// it was reported, count as LogVersionMin. This must only be called from the
+// main thread while leader.
+func (r *Raft) clusterLogVersion() LogVersion {
+	version := LogVersionMax
+	servers := r.configurations.latest.Servers
+	servers = append(servers[:len(servers):len(servers)], r.configurations.latest.Outgoing...)
+	for _, server := range servers {
+		if server.ID == r.localID {
+			continue
+		}
+		v := LogVersionMin
+		if repl, ok := r.leaderState.replState[server.ID]; ok {
+			v = LogVersion(repl.logVersion.Load())
+		}
+		if v < version {
+			version = v
+		}
+	}
+	return version
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_requiredVersion(t *testing.T) {
+	command := &Log{Type: LogCommand, Data: []byte("test")}
+	require.Equal(t, LogVersionMin, command.requiredVersion())
+
+	ttl := &Log{Type: LogCommand, TTL: time.Minute}
+	require.Equal(t, LogVersion(2), ttl.requiredVersion())
+	require.Equal(t, LogVersion(2), (&Log{Type: LogExpiry}).requiredVersion())
+
+	scheduled := &Log{Type: LogCommand, ScheduledIndex: 5}
+	require.Equal(t, LogVersion(4), scheduled.requiredVersion())
+	require.Equal(t, LogVersion(4), (&Log{Type: LogSchedule}).requiredVersion())
+}
+
+func TestRaft_LogVersionRollingUpgrade(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	lastVersion := func() LogVersion {
+		var entry Log
+		require.NoError(t, leader.logs.GetLog(leader.getLastIndex(), &entry))
+		return entry.Version
+	}
+
+	// Once every server has reported the version it accepts, entries are
+	// stamped with the newest one.
+	retry(t, func() bool {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+		return lastVersion() == LogVersionMax
+	})
+
+	// A server that hasn't reported one, as an old one wouldn't, holds
+	// entries back to the oldest version, and commands that need newer
+	// fields are refused.
+	require.NoError(t, leader.AddNonvoter("old", "old-addr", 0, 0).Error())
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	require.Equal(t, LogVersionMin, lastVersion())
+	last := leader.getLastIndex()
+	err := leader.ApplyLog(Log{Data: []byte("test"), TTL: time.Hour}, 0).Error()
+	require.ErrorIs(t, err, ErrLogFieldsUnsupported)
+	err = leader.ApplyAt([]byte("test"), Schedule{Index: 1}, 0).Error()
+	require.ErrorIs(t, err, ErrLogFieldsUnsupported)
+	require.Equal(t, last, leader.getLastIndex())
+
+	// Nor can a joint consensus change start, since the server might drop the
+	// outgoing servers from the configuration.
+	servers := []Server{{Suffrage: Voter, ID: leader.localID, Address: leader.localAddr}}
+	require.ErrorIs(t, leader.ChangeConfiguration(servers, 0, 0).Error(), ErrJointConsensusUnsupported)
+
+	require.NoError(t, leader.RemoveServer("old", 0, 0).Error())
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	require.Equal(t, LogVersionMax, lastVersion())
+	require.NoError(t, leader.ApplyLog(Log{Data: []byte("test"), TTL: time.Hour}, 0).Error())
+}
+
+func TestRaft_LogVersionHoldsLeaderEntries(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	retry(t, func() bool { return leader.clusterLogVersion() == LogVersionMax })
+
+	// appended returns whether the leader has appended an entry matching fn.
+	appended := func(fn func(*Log) bool) bool {
+		first, err := leader.logs.FirstIndex()
+		require.NoError(t, err)
+		for i := first; i <= leader.getLastIndex(); i++ {
+			var entry Log
+			require.NoError(t, leader.logs.GetLog(i, &entry))
+			if fn(&entry) {
+				return true
+			}
+		}
+		return false
+	}
+	expired := func(l *Log) bool { return l.Type == LogExpiry }
+	var future ApplyFuture
+	scheduled := func(l *Log) bool { return l.ScheduledIndex == future.Index() }
+
+	// Commit an entry with a TTL and a schedule while every server can,
+	// then add one that can't before they're due.
+	future = leader.ApplyAt([]byte("scheduled"), Schedule{Time: time.Now().Add(200 * time.Millisecond)}, 0)
+	require.NoError(t, future.Error())
+	require.NoError(t, leader.ApplyLog(Log{Data: []byte("test"), TTL: 200 * time.Millisecond}, 0).Error())
+	require.NoError(t, leader.AddNonvoter("old", "old-addr", 0, 0).Error())
+
+	// Neither the expiry nor the scheduled command is appended while it's
+	// in the configuration.
+	time.Sleep(500 * time.Millisecond)
+	require.False(t, appended(expired))
+	require.False(t, appended(scheduled))
+
+	require.NoError(t, leader.RemoveServer("old", 0, 0).Error())
+	retry(t, func() bool { return appended(expired) && appended(scheduled) })
+}
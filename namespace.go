@@ -0,0 +1,242 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// namespaceHeaderMagic prefixes the Extensions of entries built by
+// NamespacedLog.
+var namespaceHeaderMagic = []byte{0xff, 'n', 's'}
+
+// NamespacedLog returns a log entry carrying cmd for the given namespace, such
+// as a tenant ID, to submit with ApplyLog. The namespace is recorded in the
+// entry's Extensions, which NamespaceFSM uses to route the command, so it
+// can't be combined with other middleware using Extensions.
+func NamespacedLog(namespace string, cmd []byte) Log {
+	return Log{Data: cmd, Extensions: appendPrefixed(nil, namespaceHeaderMagic, []byte(namespace))}
+}
+
+// LogNamespace returns the namespace of an entry built by NamespacedLog. It
+// returns false for other entries.
+func LogNamespace(l *Log) (string, bool) {
+	namespace, _, ok := splitPrefixed(l.Extensions, namespaceHeaderMagic)
+	return string(namespace), ok
+}
+
+// UnknownNamespaceError is returned by NamespaceFSM.Apply, and so from the
+// ApplyFuture, for a command in a namespace with no FSM registered.
+type UnknownNamespaceError struct {
+	Namespace string
+}
+
+func (e *UnknownNamespaceError) Error() string {
+	return fmt.Sprintf("no FSM registered for namespace %q", e.Namespace)
+}
+
+// NamespaceFSM dispatches commands to an FSM per namespace, letting a single
+// Raft group carry the commands of many small tenants. Commands built by
+// NamespacedLog go to the FSM registered for their namespace, and other
+// entries go to the default FSM. The time taken to apply each command is
+// reported in the raft.fsm.namespace.apply metric, labelled with the
+// namespace.
+//
+// Snapshots hold the state of every namespace. Each namespace's snapshot is
+// buffered in memory while it's persisted, so this suits many small
+// namespaces rather than a few large ones.
+//
+// NamespaceFSM doesn't implement BatchingFSM or ConfigurationStore, so
+// wrapping FSMs that do disables them.
+type NamespaceFSM struct {
+	fsms map[string]FSM
+}
+
+// NewNamespaceFSM returns a NamespaceFSM passing entries without a namespace
+// to defaultFSM, which may be nil if all commands are namespaced.
+func NewNamespaceFSM(defaultFSM FSM) *NamespaceFSM {
+	f := &NamespaceFSM{fsms: make(map[string]FSM)}
+	if defaultFSM != nil {
+		f.fsms[""] = defaultFSM
+	}
+	return f
+}
+
+// Register routes the commands for namespace to fsm. It must be called before
+// the NamespaceFSM is passed to NewRaft, on every server.
+func (f *NamespaceFSM) Register(namespace string, fsm FSM) {
+	f.fsms[namespace] = fsm
+}
+
+// Apply implements the FSM interface.
+func (f *NamespaceFSM) Apply(l *Log) interface{} {
+	namespace, _ := LogNamespace(l)
+	fsm, ok := f.fsms[namespace]
+	if !ok {
+		if l.Type != LogCommand {
+			// Only the default FSM sees other entry types.
+			return nil
+		}
+		return &UnknownNamespaceError{Namespace: namespace}
+	}
+	start := time.Now()
+	defer metrics.MeasureSinceWithLabels([]string{"raft", "fsm", "namespace", "apply"}, start,
+		[]metrics.Label{{Name: "namespace", Value: namespace}})
+	return fsm.Apply(l)
+}
+
+// Expire implements the ExpiringFSM interface, passing the entry to the FSM
+// registered for the expired command's namespace if it implements
+// ExpiringFSM too.
+func (f *NamespaceFSM) Expire(l *Log) interface{} {
+	namespace, _ := LogNamespace(l)
+	fsm, ok := f.fsms[namespace]
+	if !ok {
+		return nil
+	}
+	return applyExpiry(fsm, l)
+}
+
+// Snapshot implements the FSM interface.
+func (f *NamespaceFSM) Snapshot() (FSMSnapshot, error) {
+	snap := &namespaceSnapshot{snaps: make(map[string]FSMSnapshot, len(f.fsms))}
+	for namespace, fsm := range f.fsms {
+		s, err := fsm.Snapshot()
+		if err != nil {
+			snap.Release()
+			return nil, fmt.Errorf("failed to snapshot namespace %q: %w", namespace, err)
+		}
+		snap.snaps[namespace] = s
+	}
+	return snap, nil
+}
+
+// Restore implements the FSM interface. Registered namespaces missing from
+// the snapshot, such as ones registered since it was taken, are restored from
+// an empty snapshot, so that no state from before the restore survives it.
+// Their FSMs must take an empty snapshot to mean no state.
+func (f *NamespaceFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	r := bufio.NewReader(snapshot)
+	restored := make(map[string]struct{}, len(f.fsms))
+	for {
+		name, err := readPrefixed(r)
+		if err == io.EOF {
+			return f.resetMissing(restored)
+		} else if err != nil {
+			return fmt.Errorf("failed to read namespace: %v", err)
+		}
+		namespace := string(name)
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("failed to read namespace %q: %v", namespace, err)
+		}
+		fsm, ok := f.fsms[namespace]
+		if !ok {
+			return &UnknownNamespaceError{Namespace: namespace}
+		}
+		state := io.LimitReader(r, int64(size))
+		if err := fsm.Restore(io.NopCloser(state)); err != nil {
+			return fmt.Errorf("failed to restore namespace %q: %w", namespace, err)
+		}
+		restored[namespace] = struct{}{}
+		// Skip whatever the FSM didn't read.
+		if _, err := io.Copy(io.Discard, state); err != nil {
+			return fmt.Errorf("failed to read namespace %q: %v", namespace, err)
+		}
+	}
+}
+
+// resetMissing restores the registered namespaces that aren't in restored
+// from an empty snapshot.
+func (f *NamespaceFSM) resetMissing(restored map[string]struct{}) error {
+	for namespace, fsm := range f.fsms {
+		if _, ok := restored[namespace]; ok {
+			continue
+		}
+		if err := fsm.Restore(io.NopCloser(bytes.NewReader(nil))); err != nil {
+			return fmt.Errorf("failed to reset namespace %q: %w", namespace, err)
+		}
+	}
+	return nil
+}
+
+// namespaceSnapshot writes the snapshot of each namespace in turn, prefixed
+// by its name and length.
+type namespaceSnapshot struct {
+	snaps map[string]FSMSnapshot
+}
+
+// Persist implements the FSMSnapshot interface.
+func (s *namespaceSnapshot) Persist(sink SnapshotSink) error {
+	namespaces := make([]string, 0, len(s.snaps))
+	for namespace := range s.snaps {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		buf := &namespaceSnapshotBuffer{id: sink.ID()}
+		if err := s.snaps[namespace].Persist(buf); err != nil {
+			sink.Cancel()
+			return fmt.Errorf("failed to persist namespace %q: %w", namespace, err)
+		}
+		if buf.cancelled {
+			sink.Cancel()
+			return fmt.Errorf("failed to persist namespace %q: cancelled", namespace)
+		}
+		header := appendPrefixed(nil, nil, []byte(namespace))
+		header = binary.AppendUvarint(header, uint64(buf.Len()))
+		if _, err := sink.Write(header); err != nil {
+			sink.Cancel()
+			return err
+		}
+		if _, err := buf.WriteTo(sink); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+// Release implements the FSMSnapshot interface.
+func (s *namespaceSnapshot) Release() {
+	for _, snap := range s.snaps {
+		snap.Release()
+	}
+}
+
+// namespaceSnapshotBuffer collects the snapshot of a single namespace.
+type namespaceSnapshotBuffer struct {
+	bytes.Buffer
+	id        string
+	cancelled bool
+}
+
+// Close implements the SnapshotSink interface.
+func (b *namespaceSnapshotBuffer) Close() error {
+	return nil
+}
+
+// ID implements the SnapshotSink interface.
+func (b *namespaceSnapshotBuffer) ID() string {
+	return b.id
+}
+
+// Cancel implements the SnapshotSink interface.
+func (b *namespaceSnapshotBuffer) Cancel() error {
+	b.cancelled = true
+	return nil
+}
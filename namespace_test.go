@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedLog(t *testing.T) {
+	l := NamespacedLog("tenant-1", []byte("cmd"))
+	namespace, ok := LogNamespace(&l)
+	require.True(t, ok)
+	require.Equal(t, "tenant-1", namespace)
+	require.Equal(t, []byte("cmd"), l.Data)
+
+	_, ok = LogNamespace(&Log{Data: []byte("cmd")})
+	require.False(t, ok)
+	_, ok = LogNamespace(&Log{Extensions: append(namespaceHeaderMagic, 10, 'a')})
+	require.False(t, ok)
+}
+
+func TestNamespaceFSM(t *testing.T) {
+	defaultFSM, tenant1, tenant2 := &MockFSM{}, &MockFSM{}, &MockFSM{}
+	fsm := NewNamespaceFSM(defaultFSM)
+	fsm.Register("tenant-1", tenant1)
+	fsm.Register("tenant-2", tenant2)
+	apply := func(index uint64, namespace string, data string) interface{} {
+		l := NamespacedLog(namespace, []byte(data))
+		l.Index = index
+		l.Type = LogCommand
+		return fsm.Apply(&l)
+	}
+
+	// Commands are routed by namespace.
+	require.Equal(t, 1, apply(1, "tenant-1", "one"))
+	require.Equal(t, 1, apply(2, "tenant-2", "two"))
+	require.Equal(t, 2, apply(3, "tenant-1", "three"))
+	require.Equal(t, 1, fsm.Apply(&Log{Index: 4, Type: LogCommand, Data: []byte("plain")}))
+	require.Equal(t, &UnknownNamespaceError{Namespace: "tenant-3"}, apply(5, "tenant-3", "four"))
+	require.Equal(t, [][]byte{[]byte("one"), []byte("three")}, tenant1.Logs())
+	require.Equal(t, [][]byte{[]byte("two")}, tenant2.Logs())
+	require.Equal(t, [][]byte{[]byte("plain")}, defaultFSM.Logs())
+
+	// Expiries are routed the same way, to FSMs that take them.
+	expiring := &expiringFSM{MockFSM: &MockFSM{}}
+	fsm.Register("tenant-4", expiring)
+	expiry := NamespacedLog("tenant-4", []byte("lock"))
+	expiry.Type = LogExpiry
+	require.Nil(t, fsm.Expire(&expiry))
+	require.Equal(t, []*Log{&expiry}, expiring.Expired())
+	expiry = NamespacedLog("tenant-1", []byte("one"))
+	expiry.Type = LogExpiry
+	require.Nil(t, fsm.Expire(&expiry))
+	require.Len(t, tenant1.Logs(), 2)
+
+	// Every namespace survives a snapshot.
+	store := NewInmemSnapshotStore()
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	sink, err := store.Create(SnapshotVersionMax, 5, 1, Configuration{}, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	_, source, err := store.Open(sink.ID())
+	require.NoError(t, err)
+
+	// Namespaces missing from the snapshot are reset rather than keeping
+	// their state.
+	defaultFSM, tenant1, tenant2 = &MockFSM{}, &MockFSM{}, &MockFSM{}
+	tenant4 := &MockFSM{}
+	fsm = NewNamespaceFSM(defaultFSM)
+	fsm.Register("tenant-1", tenant1)
+	fsm.Register("tenant-2", tenant2)
+	fsm.Register("tenant-4", tenant4)
+	l := NamespacedLog("tenant-4", []byte("stale"))
+	l.Type = LogCommand
+	fsm.Apply(&l)
+	require.NoError(t, fsm.Restore(source))
+	require.Equal(t, [][]byte{[]byte("one"), []byte("three")}, tenant1.Logs())
+	require.Equal(t, [][]byte{[]byte("two")}, tenant2.Logs())
+	require.Equal(t, [][]byte{[]byte("plain")}, defaultFSM.Logs())
+	require.Empty(t, tenant4.Logs())
+
+	// A snapshot holding a namespace that isn't registered can't be restored.
+	_, source, err = store.Open(sink.ID())
+	require.NoError(t, err)
+	fsm = NewNamespaceFSM(&MockFSM{})
+	fsm.Register("tenant-1", &MockFSM{})
+	require.Equal(t, &UnknownNamespaceError{Namespace: "tenant-2"}, fsm.Restore(source))
+}
+
+func TestRaft_NamespaceFSM(t *testing.T) {
+	tenant := &MockFSM{}
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     1,
+		Bootstrap: true,
+		MakeFSMFunc: func() FSM {
+			fsm := NewNamespaceFSM(&MockFSM{})
+			fsm.Register("tenant", tenant)
+			return fsm
+		},
+	})
+	defer c.Close()
+
+	future := c.Leader().ApplyLog(NamespacedLog("tenant", []byte("cmd")), 0)
+	require.NoError(t, future.Error())
+	require.Equal(t, 1, future.Response())
+	require.Equal(t, [][]byte{[]byte("cmd")}, tenant.Logs())
+
+	future = c.Leader().ApplyLog(NamespacedLog("other", []byte("cmd")), 0)
+	require.NoError(t, future.Error())
+	require.Equal(t, &UnknownNamespaceError{Namespace: "other"}, future.Response())
+}
@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+const (
+	// defaultCompressionThreshold is used when
+	// NetworkTransportConfig.CompressionThreshold is zero.
+	defaultCompressionThreshold = 512
+
+	// compressionRetryInterval is how long a NetworkTransport waits before
+	// offering compression again to a peer that didn't understand the offer.
+	compressionRetryInterval = time.Minute
+)
+
+// WireCompressor compresses the data of the log entries a NetworkTransport
+// sends in AppendEntries RPCs. Compression is negotiated for each connection:
+// the dialing side offers the compressors it's configured with and the other
+// side picks the first one it has too. Peers that don't support compression,
+// or have no compressor in common, are sent uncompressed entries.
+type WireCompressor interface {
+	// Name identifies the algorithm to peers, so it must be the same on every
+	// server using it.
+	Name() string
+
+	// Compress returns data compressed.
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress reverses Compress.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// NewFlateCompressor returns a WireCompressor using the DEFLATE algorithm from
+// the standard library at the given level, such as flate.BestSpeed. Faster
+// algorithms like snappy or zstd can be used by implementing WireCompressor
+// with a library providing them.
+func NewFlateCompressor(level int) (WireCompressor, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	c := &flateCompressor{}
+	c.writers.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	return c, nil
+}
+
+type flateCompressor struct {
+	writers sync.Pool
+}
+
+// Name implements the WireCompressor interface.
+func (c *flateCompressor) Name() string {
+	return "deflate"
+}
+
+// Compress implements the WireCompressor interface.
+func (c *flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements the WireCompressor interface.
+func (c *flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// compressionRequest offers the names of the compressors the dialing side of
+// a connection has, in order of preference.
+type compressionRequest struct {
+	Algorithms []string
+}
+
+// compressionResponse names the compressor picked, or is empty if there's
+// none in common.
+type compressionResponse struct {
+	Algorithm string
+}
+
+// negotiateCompression offers the transport's compressors to the other side
+// of a new connection, and records the one it picks on the connection.
+func (n *NetworkTransport) negotiateCompression(conn *netConn) error {
+	req := compressionRequest{Algorithms: make([]string, 0, len(n.compressors))}
+	for _, c := range n.compressors {
+		req.Algorithms = append(req.Algorithms, c.Name())
+	}
+	if n.timeout > 0 {
+		conn.conn.SetDeadline(time.Now().Add(n.timeout))
+	}
+	if err := sendRPC(conn, rpcNegotiateCompression, &req); err != nil {
+		return err
+	}
+	var resp compressionResponse
+	if _, err := decodeResponse(conn, &resp); err != nil {
+		return err
+	}
+	conn.conn.SetDeadline(time.Time{})
+	conn.compressor = n.compressor(resp.Algorithm)
+	conn.compressionThreshold = n.compressionThreshold
+	return nil
+}
+
+// compressor returns the compressor with the given name, or nil if there's
+// none.
+func (n *NetworkTransport) compressor(name string) WireCompressor {
+	for _, c := range n.compressors {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// pickCompressor returns the first of the offered compressors that this
+// transport has, or nil if there's none.
+func (n *NetworkTransport) pickCompressor(offered []string) WireCompressor {
+	for _, name := range offered {
+		if c := n.compressor(name); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// shouldOfferCompression reports whether to offer compression to target on a
+// new connection.
+func (n *NetworkTransport) shouldOfferCompression(target ServerAddress) bool {
+	if len(n.compressors) == 0 {
+		return false
+	}
+	n.compressionLock.Lock()
+	defer n.compressionLock.Unlock()
+	failed, ok := n.compressionFailed[target]
+	return !ok || time.Since(failed) > compressionRetryInterval
+}
+
+// compressionUnsupported records that target didn't understand an offer of
+// compression, most likely because it's running an older version.
+func (n *NetworkTransport) compressionUnsupported(target ServerAddress) {
+	n.compressionLock.Lock()
+	defer n.compressionLock.Unlock()
+	n.compressionFailed[target] = time.Now()
+}
+
+// compressEntries returns a copy of req with the data of entries of at least
+// threshold bytes compressed, along with the positions of those entries. The
+// entries in req are left alone since they may be shared with the log cache.
+func compressEntries(c WireCompressor, threshold int, req *AppendEntriesRequest) (*AppendEntriesRequest, []int, error) {
+	var compressed []int
+	var entries []*Log
+	for i, entry := range req.Entries {
+		if len(entry.Data) < threshold {
+			continue
+		}
+		data, err := c.Compress(entry.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to compress entry %d: %w", entry.Index, err)
+		}
+		if len(data) >= len(entry.Data) {
+			continue
+		}
+		if entries == nil {
+			entries = make([]*Log, len(req.Entries))
+			copy(entries, req.Entries)
+		}
+		copied := *entry
+		copied.Data = data
+		entries[i] = &copied
+		compressed = append(compressed, i)
+	}
+	if len(compressed) == 0 {
+		return req, nil, nil
+	}
+	out := *req
+	out.Entries = entries
+	return &out, compressed, nil
+}
+
+// decompressEntries reverses compressEntries.
+func decompressEntries(c WireCompressor, req *AppendEntriesRequest, compressed []int) error {
+	for _, i := range compressed {
+		if i < 0 || i >= len(req.Entries) {
+			return fmt.Errorf("compressed entry %d out of range", i)
+		}
+		data, err := c.Decompress(req.Entries[i].Data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress entry %d: %w", req.Entries[i].Index, err)
+		}
+		req.Entries[i].Data = data
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -24,6 +25,12 @@ const (
 	rpcRequestVote
 	rpcInstallSnapshot
 	rpcTimeoutNow
+	rpcRequestPreVote
+	rpcStatus
+	rpcJoin
+	rpcLeave
+	rpcNegotiateCompression
+	rpcAppendEntriesCompressed
 
 	// DefaultTimeoutScale is the default TimeoutScale in a NetworkTransport.
 	DefaultTimeoutScale = 256 * 1024 // 256KB
@@ -81,6 +88,11 @@ type NetworkTransport struct {
 	connPool     map[ServerAddress][]*netConn
 	connPoolLock sync.Mutex
 
+	// heartbeatConns holds the connection to each peer kept for heartbeats,
+	// or is nil if heartbeats share the pool. It's protected by
+	// connPoolLock.
+	heartbeatConns map[ServerAddress]*netConn
+
 	consumeCh chan RPC
 
 	heartbeatFn     func(RPC)
@@ -109,6 +121,16 @@ type NetworkTransport struct {
 	TimeoutScale int
 
 	msgpackUseNewTimeFormat bool
+
+	wireTap           WireTap
+	wireTapSampleRate float64
+
+	compressors          []WireCompressor
+	compressionThreshold int
+	compressionFailed    map[ServerAddress]time.Time
+	compressionLock      sync.Mutex
+
+	backoff Backoff
 }
 
 // NetworkTransportConfig encapsulates configuration for the network transport layer.
@@ -166,8 +188,73 @@ type NetworkTransportConfig struct {
 	// go-msgpack v1.1.5 by default). Decoding is not affected, as all
 	// go-msgpack v2.1.0+ decoders know how to decode both formats.
 	MsgpackUseNewTimeFormat bool
+
+	// WireTap, if set, is invoked for every inbound and outbound RPC handled
+	// by the transport. It is intended for debugging and is called
+	// synchronously on the RPC path, so it must return quickly.
+	WireTap WireTap
+
+	// WireTapSampleRate is the fraction of RPCs, between 0 and 1, that are
+	// passed to WireTap. Zero (or any value >= 1) passes every RPC. Lower
+	// values keep the overhead down when the tap is left on in production.
+	WireTapSampleRate float64
+
+	// Compressors, if set, are offered in order of preference to compress
+	// the data of log entries sent in AppendEntries RPCs over each new
+	// connection. See WireCompressor.
+	Compressors []WireCompressor
+
+	// CompressionThreshold is the size in bytes below which entries aren't
+	// compressed. Zero means 512 bytes.
+	CompressionThreshold int
+
+	// Backoff decides how long to wait before accepting connections again
+	// after failing to. If nil, DefaultBackoff is used.
+	//
+	// Experimental: see docs/api_stability.md.
+	Backoff Backoff
+
+	// HeartbeatConnections keeps a connection to each peer that's only used
+	// for heartbeats, apart from the pool used for replication and
+	// snapshots. Heartbeats then never wait for a connection to be dialed,
+	// and are read by a handler on the peer that isn't busy decoding a large
+	// request, so a slow transfer can't hold up the signal that the leader
+	// is alive.
+	//
+	// Experimental: see docs/api_stability.md.
+	HeartbeatConnections bool
+}
+
+// WireTapEvent describes a single RPC observed by a WireTap.
+type WireTapEvent struct {
+	// Inbound is true for RPCs received from a peer, and false for RPCs this
+	// transport sent.
+	Inbound bool
+
+	// Type is the RPC type, e.g. "AppendEntries", "Heartbeat", "RequestVote",
+	// "InstallSnapshot" or "TimeoutNow".
+	Type string
+
+	// Peer is the target address for outbound RPCs, and the remote address of
+	// the connection for inbound RPCs.
+	Peer ServerAddress
+
+	// Size is the number of bytes this side wrote for the RPC: the encoded
+	// request plus any snapshot data for outbound RPCs, and the encoded
+	// response for inbound RPCs.
+	Size int64
+
+	// Latency is the round trip time for outbound RPCs, and the time from
+	// decoding the request to encoding the response for inbound RPCs.
+	Latency time.Duration
+
+	// Error is the error the RPC failed with, if any.
+	Error error
 }
 
+// WireTap receives a WireTapEvent for each RPC sampled by the transport.
+type WireTap func(WireTapEvent)
+
 // ServerAddressProvider is a target address to which we invoke an RPC when establishing a connection
 type ServerAddressProvider interface {
 	ServerAddr(id ServerID) (ServerAddress, error)
@@ -186,8 +273,27 @@ type netConn struct {
 	target ServerAddress
 	conn   net.Conn
 	w      *bufio.Writer
+	cw     *countingWriter
 	dec    *codec.Decoder
 	enc    *codec.Encoder
+
+	// compressor compresses entries sent over this connection, if the other
+	// side agreed to it.
+	compressor           WireCompressor
+	compressionThreshold int
+}
+
+// countingWriter tracks how many bytes have been written through it. It is
+// only used from the goroutine that owns the connection so it isn't locked.
+type countingWriter struct {
+	w     io.Writer
+	bytes int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bytes += int64(n)
+	return n, err
 }
 
 func (n *netConn) Release() error {
@@ -234,6 +340,18 @@ func NewNetworkTransportWithConfig(
 		TimeoutScale:            DefaultTimeoutScale,
 		serverAddressProvider:   config.ServerAddressProvider,
 		msgpackUseNewTimeFormat: config.MsgpackUseNewTimeFormat,
+		wireTap:                 config.WireTap,
+		wireTapSampleRate:       config.WireTapSampleRate,
+		compressors:             config.Compressors,
+		compressionThreshold:    config.CompressionThreshold,
+		compressionFailed:       make(map[ServerAddress]time.Time),
+		backoff:                 config.Backoff,
+	}
+	if trans.compressionThreshold == 0 {
+		trans.compressionThreshold = defaultCompressionThreshold
+	}
+	if config.HeartbeatConnections {
+		trans.heartbeatConns = make(map[ServerAddress]*netConn)
 	}
 
 	// Create the connection context and then start our listener.
@@ -317,6 +435,10 @@ func (n *NetworkTransport) CloseStreams() {
 
 		delete(n.connPool, k)
 	}
+	for k, conn := range n.heartbeatConns {
+		conn.Release()
+		delete(n.heartbeatConns, k)
+	}
 
 	// Cancel the existing connections and create a new context. Both these
 	// operations must always be done with the lock held otherwise we can create
@@ -404,8 +526,36 @@ func (n *NetworkTransport) getConn(target ServerAddress) (*netConn, error) {
 	if conn := n.getPooledConn(target); conn != nil {
 		return conn, nil
 	}
+	return n.dialConn(target)
+}
+
+// getHeartbeatConn returns the connection kept for heartbeats to a peer,
+// dialing it if there isn't one.
+func (n *NetworkTransport) getHeartbeatConn(id ServerID, target ServerAddress) (*netConn, error) {
+	address := n.getProviderAddressOrFallback(id, target)
+	n.connPoolLock.Lock()
+	conn := n.heartbeatConns[address]
+	delete(n.heartbeatConns, address)
+	n.connPoolLock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	return n.dialConn(address)
+}
 
-	// Dial a new connection
+// returnHeartbeatConn keeps a connection for the next heartbeat to its peer.
+func (n *NetworkTransport) returnHeartbeatConn(conn *netConn) {
+	n.connPoolLock.Lock()
+	defer n.connPoolLock.Unlock()
+	if _, ok := n.heartbeatConns[conn.target]; ok || n.IsShutdown() {
+		conn.Release()
+		return
+	}
+	n.heartbeatConns[conn.target] = conn
+}
+
+// dialConn is used to make a new connection.
+func (n *NetworkTransport) dialConn(target ServerAddress) (*netConn, error) {
 	conn, err := n.stream.Dial(target, n.timeout)
 	if err != nil {
 		return nil, err
@@ -418,13 +568,24 @@ func (n *NetworkTransport) getConn(target ServerAddress) (*netConn, error) {
 		dec:    codec.NewDecoder(bufio.NewReader(conn), &codec.MsgpackHandle{}),
 		w:      bufio.NewWriterSize(conn, connSendBufferSize),
 	}
+	netConn.cw = &countingWriter{w: netConn.w}
 
-	netConn.enc = codec.NewEncoder(netConn.w, &codec.MsgpackHandle{
+	netConn.enc = codec.NewEncoder(netConn.cw, &codec.MsgpackHandle{
 		BasicHandle: codec.BasicHandle{
 			TimeNotBuiltin: !n.msgpackUseNewTimeFormat,
 		},
 	})
 
+	// Offer compression. Older servers close the connection on RPCs they
+	// don't know, so dial again without it.
+	if n.shouldOfferCompression(target) {
+		if err := n.negotiateCompression(netConn); err != nil {
+			n.logger.Debug("failed to negotiate compression", "peer", target, "error", err)
+			n.compressionUnsupported(target)
+			return n.dialConn(target)
+		}
+	}
+
 	// Done
 	return netConn, nil
 }
@@ -473,14 +634,66 @@ func (n *NetworkTransport) RequestVote(id ServerID, target ServerAddress, args *
 	return n.genericRPC(id, target, rpcRequestVote, args, resp)
 }
 
+// RequestPreVote implements the WithPreVote interface.
+func (n *NetworkTransport) RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error {
+	return n.genericRPC(id, target, rpcRequestPreVote, args, resp)
+}
+
+// Status implements the WithStatus interface.
+func (n *NetworkTransport) Status(id ServerID, target ServerAddress, args *StatusRequest, resp *StatusResponse) error {
+	return n.genericRPC(id, target, rpcStatus, args, resp)
+}
+
+// Join implements the WithJoin interface.
+func (n *NetworkTransport) Join(id ServerID, target ServerAddress, args *JoinRequest, resp *JoinResponse) error {
+	return n.genericRPC(id, target, rpcJoin, args, resp)
+}
+
+// Leave implements the WithLeave interface.
+func (n *NetworkTransport) Leave(id ServerID, target ServerAddress, args *LeaveRequest, resp *LeaveResponse) error {
+	return n.genericRPC(id, target, rpcLeave, args, resp)
+}
+
 // genericRPC handles a simple request/response RPC.
-func (n *NetworkTransport) genericRPC(id ServerID, target ServerAddress, rpcType uint8, args interface{}, resp interface{}) error {
+func (n *NetworkTransport) genericRPC(id ServerID, target ServerAddress, rpcType uint8, args interface{}, resp interface{}) (err error) {
 	// Get a conn
-	conn, err := n.getConnFromAddressProvider(id, target)
+	var conn *netConn
+	heartbeat := n.heartbeatConns != nil && isHeartbeatRequest(args)
+	if heartbeat {
+		conn, err = n.getHeartbeatConn(id, target)
+	} else {
+		conn, err = n.getConnFromAddressProvider(id, target)
+	}
 	if err != nil {
 		return err
 	}
 
+	// The conn is returned to the pool last, after it's been tapped, as
+	// another RPC may use it as soon as it's back.
+	var canReturn bool
+	defer func() {
+		if !canReturn {
+			return
+		}
+		if heartbeat {
+			n.returnHeartbeatConn(conn)
+		} else {
+			n.returnConn(conn)
+		}
+	}()
+	if n.shouldTap() {
+		start, written := time.Now(), conn.cw.bytes
+		defer func() {
+			n.tap(WireTapEvent{
+				Type:    rpcTypeName(rpcType, args),
+				Peer:    conn.target,
+				Size:    conn.cw.bytes - written,
+				Latency: time.Since(start),
+				Error:   err,
+			})
+		}()
+	}
+
 	// Set a deadline
 	if n.timeout > 0 {
 		conn.conn.SetDeadline(time.Now().Add(n.timeout))
@@ -492,15 +705,20 @@ func (n *NetworkTransport) genericRPC(id ServerID, target ServerAddress, rpcType
 	}
 
 	// Decode the response
-	canReturn, err := decodeResponse(conn, resp)
-	if canReturn {
-		n.returnConn(conn)
-	}
+	canReturn, err = decodeResponse(conn, resp)
 	return err
 }
 
+// isHeartbeatRequest returns true if args is an AppendEntries request of the
+// form sent as a heartbeat.
+func isHeartbeatRequest(args interface{}) bool {
+	req, ok := args.(*AppendEntriesRequest)
+	return ok && req.Term != 0 && req.PrevLogEntry == 0 && req.PrevLogTerm == 0 &&
+		len(req.Entries) == 0 && req.LeaderCommitIndex == 0
+}
+
 // InstallSnapshot implements the Transport interface.
-func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error {
+func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) (err error) {
 	// Get a conn, always close for InstallSnapshot
 	conn, err := n.getConnFromAddressProvider(id, target)
 	if err != nil {
@@ -508,6 +726,21 @@ func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, ar
 	}
 	defer conn.Release()
 
+	// The conn is released after it's been tapped.
+	var streamed int64
+	if n.shouldTap() {
+		start, written := time.Now(), conn.cw.bytes
+		defer func() {
+			n.tap(WireTapEvent{
+				Type:    "InstallSnapshot",
+				Peer:    conn.target,
+				Size:    conn.cw.bytes - written + streamed,
+				Latency: time.Since(start),
+				Error:   err,
+			})
+		}()
+	}
+
 	// Set a deadline, scaled by request size
 	if n.timeout > 0 {
 		timeout := n.timeout * time.Duration(args.Size/int64(n.TimeoutScale))
@@ -523,7 +756,7 @@ func (n *NetworkTransport) InstallSnapshot(id ServerID, target ServerAddress, ar
 	}
 
 	// Stream the state
-	if _, err = io.Copy(conn.w, data); err != nil {
+	if streamed, err = io.Copy(conn.w, data); err != nil {
 		return err
 	}
 
@@ -558,20 +791,17 @@ func (n *NetworkTransport) listen() {
 	const baseDelay = 5 * time.Millisecond
 	const maxDelay = 1 * time.Second
 
-	var loopDelay time.Duration
+	b := n.backoff
+	if b == nil {
+		b = DefaultBackoff()
+	}
+	var failures uint64
 	for {
 		// Accept incoming connections
 		conn, err := n.stream.Accept()
 		if err != nil {
-			if loopDelay == 0 {
-				loopDelay = baseDelay
-			} else {
-				loopDelay *= 2
-			}
-
-			if loopDelay > maxDelay {
-				loopDelay = maxDelay
-			}
+			failures++
+			loopDelay := b.Backoff(BackoffAccept, failures, baseDelay, maxDelay)
 
 			if !n.IsShutdown() {
 				n.logger.Error("failed to accept connection", "error", err)
@@ -584,8 +814,8 @@ func (n *NetworkTransport) listen() {
 				continue
 			}
 		}
-		// No error, reset loop delay
-		loopDelay = 0
+		// No error, reset the failures
+		failures = 0
 
 		n.logger.Debug("accepted connection", "local-address", n.LocalAddr(), "remote-address", conn.RemoteAddr().String())
 
@@ -601,13 +831,17 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 	defer conn.Close()
 	r := bufio.NewReaderSize(conn, connReceiveBufferSize)
 	w := bufio.NewWriter(conn)
+	cw := &countingWriter{w: w}
 	dec := codec.NewDecoder(r, &codec.MsgpackHandle{})
-	enc := codec.NewEncoder(w, &codec.MsgpackHandle{
+	enc := codec.NewEncoder(cw, &codec.MsgpackHandle{
 		BasicHandle: codec.BasicHandle{
 			TimeNotBuiltin: !n.msgpackUseNewTimeFormat,
 		},
 	})
 
+	// compressor is the compressor negotiated for this connection, if any.
+	var compressor WireCompressor
+
 	for {
 		select {
 		case <-connCtx.Done():
@@ -616,7 +850,7 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 		default:
 		}
 
-		if err := n.handleCommand(r, dec, enc); err != nil {
+		if err := n.handleCommand(r, dec, enc, cw, &compressor, ServerAddress(conn.RemoteAddr().String())); err != nil {
 			if err != io.EOF {
 				n.logger.Error("failed to decode incoming command", "error", err)
 			}
@@ -630,7 +864,7 @@ func (n *NetworkTransport) handleConn(connCtx context.Context, conn net.Conn) {
 }
 
 // handleCommand is used to decode and dispatch a single command.
-func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, enc *codec.Encoder) error {
+func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, enc *codec.Encoder, cw *countingWriter, compressor *WireCompressor, peer ServerAddress) error {
 	getTypeStart := time.Now()
 
 	// Get the rpc type
@@ -648,6 +882,7 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 	respCh := make(chan RPCResponse, 1)
 	rpc := RPC{
 		RespChan: respCh,
+		From:     peer,
 	}
 
 	// Decode the command
@@ -678,6 +913,38 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 		} else {
 			labels = []metrics.Label{{Name: "rpcType", Value: "AppendEntries"}}
 		}
+	case rpcAppendEntriesCompressed:
+		if *compressor == nil {
+			return fmt.Errorf("compressed AppendEntries without negotiating compression")
+		}
+		var req AppendEntriesRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		var compressed []int
+		if err := dec.Decode(&compressed); err != nil {
+			return err
+		}
+		if err := decompressEntries(*compressor, &req, compressed); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "AppendEntries"}}
+	case rpcNegotiateCompression:
+		// This is answered by the transport itself.
+		var req compressionRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		*compressor = n.pickCompressor(req.Algorithms)
+		var resp compressionResponse
+		if *compressor != nil {
+			resp.Algorithm = (*compressor).Name()
+		}
+		if err := enc.Encode(""); err != nil {
+			return err
+		}
+		return enc.Encode(&resp)
 	case rpcRequestVote:
 		var req RequestVoteRequest
 		if err := dec.Decode(&req); err != nil {
@@ -700,6 +967,38 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 		}
 		rpc.Command = &req
 		labels = []metrics.Label{{Name: "rpcType", Value: "TimeoutNow"}}
+	case rpcRequestPreVote:
+		var req RequestPreVoteRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "RequestPreVote"}}
+	case rpcStatus:
+		var req StatusRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "Status"}}
+
+		// Status is answered without the main thread, so it can take the
+		// heartbeat fast-path too.
+		isHeartbeat = true
+	case rpcJoin:
+		var req JoinRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "Join"}}
+	case rpcLeave:
+		var req LeaveRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+		labels = []metrics.Label{{Name: "rpcType", Value: "Leave"}}
 	default:
 		return fmt.Errorf("unknown rpc type %d", rpcType)
 	}
@@ -734,6 +1033,19 @@ RESP:
 	select {
 	case resp := <-respCh:
 		defer metrics.MeasureSinceWithLabels([]string{"raft", "net", "rpcRespond"}, respWaitStart, labels)
+		if n.shouldTap() {
+			written := cw.bytes
+			defer func() {
+				n.tap(WireTapEvent{
+					Inbound: true,
+					Type:    labels[0].Value,
+					Peer:    peer,
+					Size:    cw.bytes - written,
+					Latency: time.Since(decodeStart),
+					Error:   resp.Error,
+				})
+			}()
+		}
 		// Send the error first
 		respErr := ""
 		if resp.Error != nil {
@@ -776,8 +1088,72 @@ func decodeResponse(conn *netConn, resp interface{}) (bool, error) {
 	return true, nil
 }
 
+// shouldTap reports whether the next RPC should be passed to the wire tap,
+// applying the configured sample rate.
+func (n *NetworkTransport) shouldTap() bool {
+	if n.wireTap == nil {
+		return false
+	}
+	if n.wireTapSampleRate <= 0 || n.wireTapSampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < n.wireTapSampleRate
+}
+
+// tap hands an event to the wire tap, recovering from any panic so a buggy
+// debugging hook can't take down the transport.
+func (n *NetworkTransport) tap(ev WireTapEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.logger.Error("wire tap panicked", "error", r)
+		}
+	}()
+	n.wireTap(ev)
+}
+
+// rpcTypeName returns the name used for an outbound RPC in wire tap events.
+func rpcTypeName(rpcType uint8, args interface{}) string {
+	switch rpcType {
+	case rpcAppendEntries:
+		if req, ok := args.(*AppendEntriesRequest); ok && len(req.Entries) == 0 &&
+			req.PrevLogEntry == 0 && req.LeaderCommitIndex == 0 {
+			return "Heartbeat"
+		}
+		return "AppendEntries"
+	case rpcRequestVote:
+		return "RequestVote"
+	case rpcInstallSnapshot:
+		return "InstallSnapshot"
+	case rpcTimeoutNow:
+		return "TimeoutNow"
+	case rpcRequestPreVote:
+		return "RequestPreVote"
+	case rpcStatus:
+		return "Status"
+	case rpcJoin:
+		return "Join"
+	case rpcLeave:
+		return "Leave"
+	default:
+		return fmt.Sprintf("%d", rpcType)
+	}
+}
+
 // sendRPC is used to encode and send the RPC.
 func sendRPC(conn *netConn, rpcType uint8, args interface{}) error {
+	// Compress the entries if we can, sending which ones after the request
+	var compressed []int
+	if req, ok := args.(*AppendEntriesRequest); ok && rpcType == rpcAppendEntries && conn.compressor != nil {
+		out, positions, err := compressEntries(conn.compressor, conn.compressionThreshold, req)
+		if err != nil {
+			conn.Release()
+			return err
+		}
+		if len(positions) > 0 {
+			rpcType, args, compressed = rpcAppendEntriesCompressed, out, positions
+		}
+	}
+
 	// Write the request type
 	if err := conn.w.WriteByte(rpcType); err != nil {
 		conn.Release()
@@ -789,6 +1165,12 @@ func sendRPC(conn *netConn, rpcType uint8, args interface{}) error {
 		conn.Release()
 		return err
 	}
+	if compressed != nil {
+		if err := conn.enc.Encode(compressed); err != nil {
+			conn.Release()
+			return err
+		}
+	}
 
 	// Flush
 	if err := conn.w.Flush(); err != nil {
@@ -836,6 +1218,15 @@ func (n *netPipeline) decodeResponses() {
 
 			_, err := decodeResponse(n.conn, future.resp)
 			future.respond(err)
+			if n.trans.shouldTap() {
+				n.trans.tap(WireTapEvent{
+					Type:    "AppendEntries",
+					Peer:    n.conn.target,
+					Size:    future.size,
+					Latency: time.Since(future.start),
+					Error:   err,
+				})
+			}
 			select {
 			case n.doneCh <- future:
 			case <-n.shutdownCh:
@@ -863,9 +1254,11 @@ func (n *netPipeline) AppendEntries(args *AppendEntriesRequest, resp *AppendEntr
 	}
 
 	// Send the RPC
+	written := n.conn.cw.bytes
 	if err := sendRPC(n.conn, rpcAppendEntries, future.args); err != nil {
 		return nil, err
 	}
+	future.size = n.conn.cw.bytes - written
 
 	// Hand-off for decoding, this can also cause back-pressure
 	// to prevent too many inflight requests
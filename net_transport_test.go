@@ -5,6 +5,7 @@ package raft
 
 import (
 	"bytes"
+	"compress/flate"
 	"context"
 	"fmt"
 	"net"
@@ -200,6 +201,70 @@ func TestNetworkTransport_Heartbeat_FastPath(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_HeartbeatConnections(t *testing.T) {
+	trans1, err := NewTCPTransportWithLogger("localhost:0", nil, 2, time.Second, newTestLogger(t))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer trans1.Close()
+	resp := AppendEntriesResponse{Term: 10, Success: true}
+	trans1.SetHeartbeatHandler(func(rpc RPC) {
+		rpc.Respond(&resp, nil)
+	})
+	go func() {
+		for rpc := range trans1.Consumer() {
+			rpc.Respond(&resp, nil)
+		}
+	}()
+
+	trans2, err := NewTCPTransportWithConfig("localhost:0", nil, &NetworkTransportConfig{
+		MaxPool:              2,
+		Timeout:              time.Second,
+		Logger:               newTestLogger(t),
+		HeartbeatConnections: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer trans2.Close()
+	target := trans1.LocalAddr()
+	heartbeat := AppendEntriesRequest{
+		Term:      10,
+		RPCHeader: RPCHeader{ProtocolVersion: ProtocolVersionMax, Addr: []byte("cartman")},
+	}
+	appendReq := makeAppendRPC()
+	conns := func() (*netConn, int) {
+		trans2.connPoolLock.Lock()
+		defer trans2.connPoolLock.Unlock()
+		return trans2.heartbeatConns[target], len(trans2.connPool[target])
+	}
+
+	// Heartbeats keep their own connection, apart from the pool.
+	var out AppendEntriesResponse
+	if err := trans2.AppendEntries("id1", target, &heartbeat, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, pooled := conns()
+	if first == nil || pooled != 0 {
+		t.Fatalf("expected only a heartbeat connection, got %v and %d pooled", first, pooled)
+	}
+	if err := trans2.AppendEntries("id1", target, &appendReq, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := trans2.AppendEntries("id1", target, &heartbeat, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second, pooled := conns()
+	if second != first || pooled != 1 {
+		t.Fatalf("expected the heartbeat connection to be reused and one pooled, got %v and %d pooled", second, pooled)
+	}
+
+	trans2.CloseStreams()
+	if conn, pooled := conns(); conn != nil || pooled != 0 {
+		t.Fatalf("expected connections to be closed")
+	}
+}
+
 func makeAppendRPC() AppendEntriesRequest {
 	return AppendEntriesRequest{
 		Term:         10,
@@ -597,6 +662,358 @@ func TestNetworkTransport_RequestVote(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_RequestPreVote(t *testing.T) {
+	for _, useAddrProvider := range []bool{true, false} {
+		// Transport 1 is consumer
+		trans1, err := makeTransport(t, useAddrProvider, "localhost:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer trans1.Close()
+		rpcCh := trans1.Consumer()
+
+		// Make the RPC request
+		args := RequestPreVoteRequest{
+			Term:         20,
+			LastLogIndex: 100,
+			LastLogTerm:  19,
+			RPCHeader:    RPCHeader{Addr: []byte("butters")},
+		}
+
+		resp := RequestPreVoteResponse{
+			Term:    100,
+			Granted: false,
+			Reason:  VoteDenialHasLeader,
+		}
+
+		// Listen for a request
+		go func() {
+			select {
+			case rpc := <-rpcCh:
+				// Verify the command
+				req := rpc.Command.(*RequestPreVoteRequest)
+				if !reflect.DeepEqual(req, &args) {
+					t.Errorf("command mismatch: %#v %#v", *req, args)
+					return
+				}
+
+				rpc.Respond(&resp, nil)
+
+			case <-time.After(200 * time.Millisecond):
+				t.Errorf("timeout")
+				return
+			}
+		}()
+
+		// Transport 2 makes outbound request
+		trans2, err := makeTransport(t, useAddrProvider, string(trans1.LocalAddr()))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer trans2.Close()
+		var out RequestPreVoteResponse
+		if err := trans2.RequestPreVote("id1", trans1.LocalAddr(), &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Verify the response
+		if !reflect.DeepEqual(resp, out) {
+			t.Fatalf("command mismatch: %#v %#v", resp, out)
+		}
+	}
+}
+
+func TestNetworkTransport_Status(t *testing.T) {
+	trans1, err := makeTransport(t, false, "localhost:0")
+	require.NoError(t, err)
+	defer trans1.Close()
+	rpcCh := trans1.Consumer()
+
+	resp := StatusResponse{
+		Status: Status{
+			State:        Follower,
+			LeaderAddr:   "127.0.0.1:1234",
+			LeaderID:     "leader",
+			Term:         5,
+			LastContact:  250 * time.Millisecond,
+			AppliedIndex: 100,
+		},
+	}
+
+	// Listen for a request
+	go func() {
+		select {
+		case rpc := <-rpcCh:
+			if _, ok := rpc.Command.(*StatusRequest); !ok {
+				t.Errorf("unexpected command: %#v", rpc.Command)
+				return
+			}
+			rpc.Respond(&resp, nil)
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("timeout")
+		}
+	}()
+
+	// Transport 2 makes outbound request
+	trans2, err := makeTransport(t, false, string(trans1.LocalAddr()))
+	require.NoError(t, err)
+	defer trans2.Close()
+	var out StatusResponse
+	require.NoError(t, trans2.Status("id1", trans1.LocalAddr(), &StatusRequest{}, &out))
+	require.Equal(t, resp, out)
+
+	// With a heartbeat handler it's answered there instead of by the
+	// consumer.
+	trans1.SetHeartbeatHandler(func(rpc RPC) {
+		if _, ok := rpc.Command.(*StatusRequest); !ok {
+			t.Errorf("unexpected command: %#v", rpc.Command)
+		}
+		rpc.Respond(&resp, nil)
+	})
+	out = StatusResponse{}
+	require.NoError(t, trans2.Status("id1", trans1.LocalAddr(), &StatusRequest{}, &out))
+	require.Equal(t, resp, out)
+	require.Empty(t, rpcCh)
+}
+
+func TestNetworkTransport_Join(t *testing.T) {
+	trans1, err := makeTransport(t, false, "localhost:0")
+	require.NoError(t, err)
+	defer trans1.Close()
+	rpcCh := trans1.Consumer()
+
+	args := JoinRequest{ID: "node2", Address: "127.0.0.1:1235"}
+	resp := JoinResponse{Leader: "127.0.0.1:1234"}
+
+	// Listen for a request
+	go func() {
+		select {
+		case rpc := <-rpcCh:
+			if req, ok := rpc.Command.(*JoinRequest); !ok || req.ID != args.ID || req.Address != args.Address {
+				t.Errorf("unexpected command: %#v", rpc.Command)
+				return
+			}
+			rpc.Respond(&resp, nil)
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("timeout")
+		}
+	}()
+
+	// Transport 2 makes outbound request
+	trans2, err := makeTransport(t, false, string(trans1.LocalAddr()))
+	require.NoError(t, err)
+	defer trans2.Close()
+	var out JoinResponse
+	require.NoError(t, trans2.Join("", trans1.LocalAddr(), &args, &out))
+	require.Equal(t, resp, out)
+}
+
+func TestNetworkTransport_Leave(t *testing.T) {
+	trans1, err := makeTransport(t, false, "localhost:0")
+	require.NoError(t, err)
+	defer trans1.Close()
+	rpcCh := trans1.Consumer()
+
+	resp := LeaveResponse{Success: true}
+
+	// Listen for a request
+	go func() {
+		select {
+		case rpc := <-rpcCh:
+			if req, ok := rpc.Command.(*LeaveRequest); !ok || req.ID != "node2" {
+				t.Errorf("unexpected command: %#v", rpc.Command)
+				return
+			}
+			rpc.Respond(&resp, nil)
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("timeout")
+		}
+	}()
+
+	// Transport 2 makes outbound request
+	trans2, err := makeTransport(t, false, string(trans1.LocalAddr()))
+	require.NoError(t, err)
+	defer trans2.Close()
+	var out LeaveResponse
+	require.NoError(t, trans2.Leave("", trans1.LocalAddr(), &LeaveRequest{ID: "node2"}, &out))
+	require.Equal(t, resp, out)
+}
+
+func TestNetworkTransport_Compression(t *testing.T) {
+	deflate, err := NewFlateCompressor(flate.BestSpeed)
+	require.NoError(t, err)
+
+	// sendAppend sends an AppendEntries with a large and a small entry from a
+	// transport with clientCompressors to one with serverCompressors. It
+	// returns the request received and the bytes written to send it.
+	sendAppend := func(serverCompressors, clientCompressors []WireCompressor) (*AppendEntriesRequest, int64) {
+		config := &NetworkTransportConfig{MaxPool: 2, Timeout: time.Second, Logger: newTestLogger(t), Compressors: serverCompressors}
+		trans1, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+		require.NoError(t, err)
+		defer trans1.Close()
+
+		var size int64
+		config = &NetworkTransportConfig{
+			MaxPool:     2,
+			Timeout:     time.Second,
+			Logger:      newTestLogger(t),
+			Compressors: clientCompressors,
+			WireTap:     func(ev WireTapEvent) { size = ev.Size },
+		}
+		trans2, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+		require.NoError(t, err)
+		defer trans2.Close()
+
+		received := make(chan *AppendEntriesRequest, 1)
+		go func() {
+			select {
+			case rpc := <-trans1.Consumer():
+				received <- rpc.Command.(*AppendEntriesRequest)
+				rpc.Respond(&AppendEntriesResponse{Success: true}, nil)
+			case <-time.After(time.Second):
+				t.Errorf("timeout")
+			}
+		}()
+
+		args := makeAppendRPC()
+		large := &Log{Index: 102, Term: 4, Type: LogCommand, Data: bytes.Repeat([]byte("compressible "), 1000)}
+		args.Entries = append(args.Entries, large)
+		var out AppendEntriesResponse
+		require.NoError(t, trans2.AppendEntries("id1", trans1.LocalAddr(), &args, &out))
+		require.True(t, out.Success)
+
+		// The sender's entries are left alone.
+		require.Equal(t, bytes.Repeat([]byte("compressible "), 1000), large.Data)
+		return <-received, size
+	}
+
+	want := makeAppendRPC()
+	checkEntries := func(req *AppendEntriesRequest) {
+		require.Len(t, req.Entries, 2)
+		require.Equal(t, want.Entries[0].Data, req.Entries[0].Data)
+		require.Equal(t, bytes.Repeat([]byte("compressible "), 1000), req.Entries[1].Data)
+	}
+
+	// Both sides support compression.
+	req, compressedSize := sendAppend([]WireCompressor{deflate}, []WireCompressor{deflate})
+	checkEntries(req)
+
+	// The receiver doesn't, so the entries go uncompressed.
+	req, plainSize := sendAppend(nil, []WireCompressor{deflate})
+	checkEntries(req)
+	require.Less(t, compressedSize, plainSize/4)
+}
+
+func TestNetworkTransport_WireTap(t *testing.T) {
+	var lock sync.Mutex
+	var events []WireTapEvent
+	newTap := func() WireTap {
+		return func(ev WireTapEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, ev)
+		}
+	}
+
+	config := &NetworkTransportConfig{MaxPool: 2, Timeout: time.Second, Logger: newTestLogger(t), WireTap: newTap()}
+	trans1, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+	require.NoError(t, err)
+	defer trans1.Close()
+	rpcCh := trans1.Consumer()
+
+	go func() {
+		select {
+		case rpc := <-rpcCh:
+			rpc.Respond(&RequestVoteResponse{Term: 100}, nil)
+		case <-time.After(200 * time.Millisecond):
+			t.Errorf("timeout")
+		}
+	}()
+
+	config = &NetworkTransportConfig{MaxPool: 2, Timeout: time.Second, Logger: newTestLogger(t), WireTap: newTap()}
+	trans2, err := NewTCPTransportWithConfig("localhost:0", nil, config)
+	require.NoError(t, err)
+	defer trans2.Close()
+
+	args := RequestVoteRequest{Term: 20, RPCHeader: RPCHeader{Addr: []byte("butters")}}
+	var out RequestVoteResponse
+	require.NoError(t, trans2.RequestVote("id1", trans1.LocalAddr(), &args, &out))
+
+	// The inbound event is emitted before the response is flushed, so by now
+	// both sides must have reported.
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, events, 2)
+	for _, ev := range events {
+		require.Equal(t, "RequestVote", ev.Type)
+		require.NoError(t, ev.Error)
+		require.Greater(t, ev.Size, int64(0))
+		if ev.Inbound {
+			require.NotEmpty(t, ev.Peer)
+		} else {
+			require.Equal(t, trans1.LocalAddr(), ev.Peer)
+		}
+	}
+	require.NotEqual(t, events[0].Inbound, events[1].Inbound)
+}
+
+func TestNetworkTransport_WireTap_Concurrent(t *testing.T) {
+	trans1, err := NewTCPTransportWithConfig("localhost:0", nil,
+		&NetworkTransportConfig{MaxPool: 1, Timeout: time.Second, Logger: newTestLogger(t)})
+	require.NoError(t, err)
+	defer trans1.Close()
+	go func() {
+		for rpc := range trans1.Consumer() {
+			rpc.Respond(&RequestVoteResponse{Term: 100}, nil)
+		}
+	}()
+
+	// Pooled conns are reused by other RPCs as soon as they're returned,
+	// which mustn't race with tapping the RPC that returned them.
+	var sizes atomic.Int64
+	trans2, err := NewTCPTransportWithConfig("localhost:0", nil, &NetworkTransportConfig{
+		MaxPool: 1, Timeout: time.Second, Logger: newTestLogger(t),
+		WireTap: func(ev WireTapEvent) { sizes.Add(ev.Size) },
+	})
+	require.NoError(t, err)
+	defer trans2.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				args := RequestVoteRequest{Term: 20, RPCHeader: RPCHeader{Addr: []byte("butters")}}
+				var out RequestVoteResponse
+				if err := trans2.RequestVote("id1", trans1.LocalAddr(), &args, &out); err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Greater(t, sizes.Load(), int64(0))
+}
+
+func TestNetworkTransport_WireTap_Sampling(t *testing.T) {
+	n := &NetworkTransport{}
+	require.False(t, n.shouldTap())
+
+	n.wireTap = func(WireTapEvent) {}
+	require.True(t, n.shouldTap())
+
+	n.wireTapSampleRate = 0.000001
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if n.shouldTap() {
+			sampled++
+		}
+	}
+	require.Less(t, sampled, 10)
+}
+
 func TestNetworkTransport_InstallSnapshot(t *testing.T) {
 	for _, useAddrProvider := range []bool{true, false} {
 		// Transport 1 is consumer
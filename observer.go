@@ -14,9 +14,17 @@ type Observation struct {
 	Raft *Raft
 	// Data holds observation-specific data. Possible types are
 	// RequestVoteRequest
+	// RequestPreVoteRequest
 	// RaftState
 	// PeerObservation
 	// LeaderObservation
+	// SnapshotDecisionObservation
+	// ElectionObservation
+	// ClockSkewObservation
+	// QueueSaturationObservation
+	// CommitLatencyObservation
+	// ConfigurationAppliedObservation
+	// SnapshotStoreObservation
 	Data interface{}
 }
 
@@ -34,6 +42,15 @@ type PeerObservation struct {
 	Peer    Server
 }
 
+// ConfigurationAppliedObservation is sent by the FSM goroutine when it reaches a
+// configuration entry, in order with the commands applied around it, so
+// anything that tracks membership can follow the FSM exactly. It's also sent
+// after a snapshot is restored, with the configuration the snapshot holds.
+type ConfigurationAppliedObservation struct {
+	Index         uint64
+	Configuration Configuration
+}
+
 // FailedHeartbeatObservation is sent when a node fails to heartbeat with the leader
 type FailedHeartbeatObservation struct {
 	PeerID      ServerID
@@ -45,6 +62,84 @@ type ResumedHeartbeatObservation struct {
 	PeerID ServerID
 }
 
+// ClockSkewObservation is sent when the apparent clock skew between the
+// leader and a follower first exceeds Config.ClockSkewThreshold, and again
+// when it falls back within it.
+type ClockSkewObservation struct {
+	PeerID ServerID
+	// Skew is how far the follower's clock is ahead of the leader's. It is
+	// negative if the follower is behind.
+	Skew time.Duration
+	// Exceeded is true if Skew is beyond the threshold.
+	Exceeded bool
+}
+
+// SnapshotDecisionReason describes why the leader chose to send a snapshot to a
+// follower instead of replicating logs.
+type SnapshotDecisionReason string
+
+const (
+	// SnapshotLogNotFound means the logs the follower needs have already been
+	// compacted away.
+	SnapshotLogNotFound SnapshotDecisionReason = "log-not-found"
+	// SnapshotCatchupGap means the follower was further behind than
+	// Config.SnapshotCatchupGap.
+	SnapshotCatchupGap SnapshotDecisionReason = "catchup-gap"
+	// SnapshotCatchupRejections means the follower rejected more than
+	// Config.SnapshotCatchupRejections consecutive AppendEntries.
+	SnapshotCatchupRejections SnapshotDecisionReason = "catchup-rejections"
+)
+
+// SnapshotDecisionObservation is sent when the leader decides to send a
+// snapshot to a follower instead of replicating logs.
+type SnapshotDecisionObservation struct {
+	Peer      Server
+	Reason    SnapshotDecisionReason
+	NextIndex uint64
+	LastIndex uint64
+}
+
+// ElectionResult describes how an election attempt ended.
+type ElectionResult string
+
+const (
+	// ElectionWon means this server received a quorum of votes.
+	ElectionWon ElectionResult = "won"
+	// ElectionNewerTerm means a voter replied with a newer term, so this
+	// server reverted to follower.
+	ElectionNewerTerm ElectionResult = "newer-term"
+	// ElectionTimedOut means a quorum wasn't reached before the election
+	// timeout, so a new election will be started.
+	ElectionTimedOut ElectionResult = "timed-out"
+	// ElectionAborted means the candidate stopped for another reason, such
+	// as hearing from a leader or shutting down.
+	ElectionAborted ElectionResult = "aborted"
+	// ElectionPreVoteFailed means a quorum didn't grant a pre-vote before the
+	// election timeout, so the election was never started and the term was
+	// not incremented. Votes holds the pre-vote replies.
+	ElectionPreVoteFailed ElectionResult = "pre-vote-failed"
+)
+
+// ElectionVote describes the vote a single server gave in an election.
+type ElectionVote struct {
+	Granted bool
+	// Reason explains why the vote wasn't granted. It is empty for granted
+	// votes.
+	Reason string
+}
+
+// ElectionObservation is sent at the end of each election attempt with the
+// votes that were received.
+type ElectionObservation struct {
+	Term        uint64
+	Result      ElectionResult
+	VotesNeeded int
+	// Votes holds an entry for every voting server in the configuration.
+	// Servers that didn't reply in time are included with a Reason of "no
+	// response".
+	Votes map[ServerID]ElectionVote
+}
+
 // nextObserverId is used to provide a unique ID for each observer to aid in
 // deregistration.
 var nextObserverID uint64
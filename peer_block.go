@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// BlockPeer makes this server ignore the peer at addr for the given duration,
+// without changing the cluster's membership. RPCs from the peer are answered
+// with ErrPeerBlocked instead of being acted on, and this server doesn't send
+// it any, so it neither replicates to the peer nor asks it for votes. Nor does
+// it transfer leadership to the peer, whether asked to directly or picking a
+// server itself, as LeadershipTransfer and the commit latency watchdog do. This is
+// meant for isolating a misbehaving server while it's investigated. Blocking
+// a peer again replaces its expiry, and a duration of zero or less lifts the
+// block.
+//
+// The block is local to this server and isn't persisted, so to isolate a
+// server from the whole cluster every other server must block it.
+func (r *Raft) BlockPeer(addr ServerAddress, duration time.Duration) {
+	r.blockedPeersLock.Lock()
+	defer r.blockedPeersLock.Unlock()
+
+	now := time.Now()
+	for peer, until := range r.blockedPeers {
+		if !now.Before(until) {
+			delete(r.blockedPeers, peer)
+		}
+	}
+	if duration <= 0 {
+		if _, ok := r.blockedPeers[addr]; ok {
+			r.logger.Info("unblocking peer", "peer", addr)
+		}
+		delete(r.blockedPeers, addr)
+		return
+	}
+	if r.blockedPeers == nil {
+		r.blockedPeers = make(map[ServerAddress]time.Time)
+	}
+	r.blockedPeers[addr] = now.Add(duration)
+	r.logger.Warn("blocking peer", "peer", addr, "duration", duration)
+}
+
+// peerBlocked returns ErrPeerBlocked if addr has been blocked by BlockPeer
+// and the block hasn't expired.
+func (r *Raft) peerBlocked(addr ServerAddress) error {
+	if addr == "" {
+		return nil
+	}
+	r.blockedPeersLock.RLock()
+	until, ok := r.blockedPeers[addr]
+	r.blockedPeersLock.RUnlock()
+	if ok && time.Now().Before(until) {
+		return ErrPeerBlocked
+	}
+	return nil
+}
+
+// rejectBlockedRPC answers rpc with ErrPeerBlocked and returns true if it was
+// sent by a blocked peer.
+func (r *Raft) rejectBlockedRPC(rpc RPC) bool {
+	wh, ok := rpc.Command.(WithRPCHeader)
+	if !ok {
+		return false
+	}
+	header := wh.GetRPCHeader()
+	if len(header.Addr) == 0 {
+		return false
+	}
+	addr := r.trans.DecodePeer(header.Addr)
+	if err := r.peerBlocked(addr); err != nil {
+		metrics.IncrCounter([]string{"raft", "rpc", "blocked"}, 1)
+		r.logger.Debug("ignoring RPC from blocked peer", "peer", addr)
+		rpc.Respond(nil, err)
+		return true
+	}
+	return false
+}
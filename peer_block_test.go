@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_BlockPeer(t *testing.T) {
+	// Catch-up streams are used too, and don't get around the block.
+	conf := inmemConfig(t)
+	conf.CatchUpStreams = 4
+	conf.MaxAppendEntries = 2
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	followers := c.Followers()
+	blocked, other := followers[0], followers[1]
+	blockedFSM := getMockFSM(c.fsms[c.IndexOf(blocked)])
+	otherFSM := getMockFSM(c.fsms[c.IndexOf(other)])
+
+	// The leader stops replicating to a blocked peer, but the rest of the
+	// cluster carries on.
+	leader.BlockPeer(blocked.localAddr, time.Hour)
+	futures := make([]ApplyFuture, 0, 10)
+	for i := 0; i < 10; i++ {
+		futures = append(futures, leader.Apply([]byte("test"), 0))
+	}
+	for _, future := range futures {
+		require.NoError(t, future.Error())
+	}
+	retry(t, func() bool { return len(otherFSM.Logs()) == 10 })
+	require.Empty(t, blockedFSM.Logs())
+
+	// RPCs from a blocked peer are refused.
+	var resp RequestVoteResponse
+	req := RequestVoteRequest{
+		RPCHeader:    blocked.getRPCHeader(),
+		Term:         blocked.getCurrentTerm(),
+		LastLogIndex: blocked.LastIndex(),
+		LastLogTerm:  blocked.getCurrentTerm(),
+	}
+	err := c.trans[c.IndexOf(blocked)].RequestVote(leader.localID, leader.localAddr, &req, &resp)
+	require.EqualError(t, err, ErrPeerBlocked.Error())
+
+	// Leadership isn't handed to a blocked peer.
+	err = leader.LeadershipTransferToServer(blocked.localID, blocked.localAddr).Error()
+	require.ErrorIs(t, err, ErrPeerBlocked)
+
+	// Lifting the block lets the peer catch up.
+	leader.BlockPeer(blocked.localAddr, 0)
+	require.NoError(t, leader.peerBlocked(blocked.localAddr))
+	retry(t, func() bool { return len(blockedFSM.Logs()) == 10 })
+
+	// Blocks expire on their own.
+	leader.BlockPeer(blocked.localAddr, 10*time.Millisecond)
+	require.ErrorIs(t, leader.peerBlocked(blocked.localAddr), ErrPeerBlocked)
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, leader.peerBlocked(blocked.localAddr))
+
+	// Nor is a blocked peer picked when the leader chooses who to hand
+	// leadership to.
+	leader.BlockPeer(blocked.localAddr, time.Hour)
+	require.NoError(t, leader.LeadershipTransfer().Error())
+	retry(t, func() bool { return other.State() == Leader })
+}
@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+)
+
+// PeerCodec serializes a Configuration into the "peers" format used by log
+// entries, snapshots and RPCs from before protocol version 3. Decoders must
+// accept every format a previous codec may have written, since old log entries
+// and snapshots are read back long after they were created.
+type PeerCodec interface {
+	// EncodePeers serializes the given configuration.
+	EncodePeers(configuration Configuration, trans Transport) ([]byte, error)
+
+	// DecodePeers deserializes a configuration written by EncodePeers.
+	DecodePeers(buf []byte, trans Transport) (Configuration, error)
+}
+
+// peersFormatVersion1 is the leading byte of peers encoded by
+// VersionedPeerCodec. The legacy format is a MsgPack array, which never
+// starts with this byte, so the two can be told apart.
+const peersFormatVersion1 byte = 0x01
+
+// LegacyPeerCodec is the original peers format: a MsgPack array of peers
+// encoded by the transport. Only voters can be represented, and each server's
+// ID is taken to be its address. This is the default since it is the only
+// format older servers understand. It decodes the versioned format as well.
+type LegacyPeerCodec struct{}
+
+// EncodePeers implements the PeerCodec interface.
+func (LegacyPeerCodec) EncodePeers(configuration Configuration, trans Transport) ([]byte, error) {
+	// Gather up all the voters, other suffrage types are not supported by
+	// this data format.
+	var encPeers [][]byte
+	for _, server := range configuration.Servers {
+		if server.Suffrage == Voter {
+			encPeers = append(encPeers, trans.EncodePeer(server.ID, server.Address))
+		}
+	}
+
+	// Encode the entire array.
+	buf, err := encodeMsgPack(encPeers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode peers: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodePeers implements the PeerCodec interface.
+func (LegacyPeerCodec) DecodePeers(buf []byte, trans Transport) (Configuration, error) {
+	return decodePeersAnyVersion(buf, trans)
+}
+
+// VersionedPeerCodec writes a version byte followed by the full
+// configuration, so server IDs and suffrage survive the round trip. Only use
+// this once every server in the cluster can decode it.
+type VersionedPeerCodec struct{}
+
+// EncodePeers implements the PeerCodec interface.
+func (VersionedPeerCodec) EncodePeers(configuration Configuration, trans Transport) ([]byte, error) {
+	buf, err := encodeMsgPack(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode peers: %v", err)
+	}
+	return append([]byte{peersFormatVersion1}, buf.Bytes()...), nil
+}
+
+// DecodePeers implements the PeerCodec interface.
+func (VersionedPeerCodec) DecodePeers(buf []byte, trans Transport) (Configuration, error) {
+	return decodePeersAnyVersion(buf, trans)
+}
+
+// decodePeersAnyVersion decodes peers in any of the formats written by the
+// codecs above.
+func decodePeersAnyVersion(buf []byte, trans Transport) (Configuration, error) {
+	if len(buf) > 0 && buf[0] == peersFormatVersion1 {
+		var configuration Configuration
+		if err := decodeMsgPack(buf[1:], &configuration); err != nil {
+			return Configuration{}, fmt.Errorf("failed to decode peers: %v", err)
+		}
+		return configuration, nil
+	}
+
+	// Decode the buffer first.
+	var encPeers [][]byte
+	if err := decodeMsgPack(buf, &encPeers); err != nil {
+		return Configuration{}, fmt.Errorf("failed to decode peers: %v", err)
+	}
+
+	// Deserialize each peer.
+	var servers []Server
+	for _, enc := range encPeers {
+		p := trans.DecodePeer(enc)
+		servers = append(servers, Server{
+			Suffrage: Voter,
+			ID:       ServerID(p),
+			Address:  p,
+		})
+	}
+
+	return Configuration{Servers: servers}, nil
+}
+
+// peerCodec returns the configured PeerCodec, or LegacyPeerCodec if none was
+// given or the configuration hasn't been set yet.
+func (r *Raft) peerCodec() PeerCodec {
+	if conf, ok := r.conf.Load().(Config); ok && conf.PeerCodec != nil {
+		return conf.PeerCodec
+	}
+	return LegacyPeerCodec{}
+}
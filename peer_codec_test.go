@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCodec_Versioned(t *testing.T) {
+	_, trans := NewInmemTransport("")
+
+	buf, err := VersionedPeerCodec{}.EncodePeers(sampleConfiguration, trans)
+	require.NoError(t, err)
+	require.Equal(t, peersFormatVersion1, buf[0])
+
+	// IDs and suffrage survive the round trip, with either codec.
+	for _, codec := range []PeerCodec{LegacyPeerCodec{}, VersionedPeerCodec{}} {
+		decoded, err := codec.DecodePeers(buf, trans)
+		require.NoError(t, err)
+		require.Equal(t, sampleConfiguration, decoded)
+	}
+}
+
+func TestPeerCodec_DecodesLegacy(t *testing.T) {
+	_, trans := NewInmemTransport("")
+	address := NewInmemAddr()
+	configuration := Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: ServerID(address), Address: ServerAddress(address)},
+	}}
+
+	// An entry written in the old format must still be readable after
+	// switching to the versioned codec.
+	buf := encodePeers(configuration, trans)
+	decoded, err := VersionedPeerCodec{}.DecodePeers(buf, trans)
+	require.NoError(t, err)
+	require.Equal(t, configuration, decoded)
+
+	// The legacy format only carries voters, with the address as the ID.
+	buf, err = LegacyPeerCodec{}.EncodePeers(sampleConfiguration, trans)
+	require.NoError(t, err)
+	decoded, err = LegacyPeerCodec{}.DecodePeers(buf, trans)
+	require.NoError(t, err)
+	require.Equal(t, Configuration{Servers: []Server{
+		{Suffrage: Voter, ID: "addr1", Address: "addr1"},
+	}}, decoded)
+}
+
+func TestPeerCodec_DecodeInvalid(t *testing.T) {
+	_, trans := NewInmemTransport("")
+	_, err := LegacyPeerCodec{}.DecodePeers([]byte{peersFormatVersion1, 0xc1}, trans)
+	require.Error(t, err)
+}
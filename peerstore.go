@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// PeerStore is the part of the interface of the peer stores used by older
+// versions of this library, before the configuration was kept in the log,
+// needed to read the peers out of them for migration. Old implementations
+// satisfy it as they are.
+type PeerStore interface {
+	// Peers returns the addresses of the servers in the cluster.
+	Peers() ([]string, error)
+}
+
+// StaticPeers is a PeerStore holding a fixed list of peers.
+type StaticPeers struct {
+	StaticPeers []string
+}
+
+// Peers implements the PeerStore interface.
+func (s *StaticPeers) Peers() ([]string, error) {
+	return s.StaticPeers, nil
+}
+
+// JSONPeers is a PeerStore reading the peers.json file written by the old
+// JSON peer store.
+type JSONPeers struct {
+	path string
+}
+
+// NewJSONPeers returns a JSONPeers reading the peers.json file in the base
+// directory.
+func NewJSONPeers(base string) *JSONPeers {
+	return &JSONPeers{path: filepath.Join(base, "peers.json")}
+}
+
+// Peers implements the PeerStore interface. A missing file has no peers.
+func (j *JSONPeers) Peers() ([]string, error) {
+	buf, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(buf)) == 0 {
+		return nil, nil
+	}
+	var peers []string
+	if err := json.Unmarshal(buf, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// PeerStoreConfiguration returns the configuration a server will start with
+// when Config.PeerStore is set to peers. Nothing is written to the stores. If
+// the server's snapshots and log already hold a configuration, that's
+// returned and the PeerStore is ignored. Otherwise the configuration is made
+// from the peers, as voters identified by their addresses, plus the local
+// server, and is only kept in memory until a leader is elected, which then
+// appends its own to the log. Running this on each server before upgrading
+// them is a way to check they agree on the membership.
+//
+// As with GetConfiguration, the FSM is only used to restore snapshots and
+// should be discarded afterwards.
+func PeerStoreConfiguration(conf *Config, fsm FSM, logs LogStore, stable StableStore,
+	snaps SnapshotStore, trans Transport, peers PeerStore) (Configuration, error) {
+	migrateConf := *conf
+	migrateConf.PeerStore = peers
+	return GetConfiguration(&migrateConf, fsm, logs, stable, snaps, trans)
+}
+
+// loadPeerStore makes the configuration from the peers in the PeerStore the
+// latest and committed one, if there are any peers. It's only called from
+// NewRaft when no configuration was found.
+//
+// The configuration isn't written to the log, since servers may have
+// different peers and logs of different lengths, and appending to their own
+// logs outside of a leader's term would break the Log Matching property.
+// Instead it's held in memory at index 0 until the first leader appends it,
+// see runLeader, after which it's replicated like any other configuration.
+func (r *Raft) loadPeerStore(store PeerStore) error {
+	peers, err := store.Peers()
+	if err != nil {
+		return fmt.Errorf("failed to read legacy peers: %v", err)
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	// Legacy servers were identified by their address, and the old stores
+	// didn't always include the local server.
+	var configuration Configuration
+	var hasLocal bool
+	for _, peer := range peers {
+		server := Server{
+			Suffrage: Voter,
+			ID:       ServerID(peer),
+			Address:  ServerAddress(peer),
+		}
+		if server.Address == r.localAddr {
+			server.ID = r.localID
+			hasLocal = true
+		}
+		configuration.Servers = append(configuration.Servers, server)
+	}
+	if !hasLocal {
+		configuration.Servers = append(configuration.Servers, Server{
+			Suffrage: Voter,
+			ID:       r.localID,
+			Address:  r.localAddr,
+		})
+	}
+	sort.Slice(configuration.Servers, func(i, j int) bool {
+		return configuration.Servers[i].Address < configuration.Servers[j].Address
+	})
+	if err := checkConfiguration(configuration); err != nil {
+		return fmt.Errorf("invalid legacy peers: %v", err)
+	}
+
+	r.setCommittedConfiguration(configuration, 0)
+	r.setLatestConfiguration(configuration, 0)
+	r.logger.Info("read configuration from legacy peer store",
+		"servers", hclog.Fmt("%+v", configuration.Servers))
+	return nil
+}
+
+// hasLegacyConfiguration returns true if the latest configuration was read
+// from a PeerStore and hasn't been written to the log yet.
+func (r *Raft) hasLegacyConfiguration() bool {
+	return r.configurations.latestIndex == 0 && len(r.configurations.latest.Servers) > 0
+}
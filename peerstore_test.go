@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONPeers(t *testing.T) {
+	dir := t.TempDir()
+	store := NewJSONPeers(dir)
+
+	peers, err := store.Peers()
+	require.NoError(t, err)
+	require.Empty(t, peers)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "peers.json"), []byte(`["127.0.0.1:8300", "127.0.0.2:8300"]`), 0o600))
+	peers, err = store.Peers()
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:8300", "127.0.0.2:8300"}, peers)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "peers.json"), []byte(`{`), 0o600))
+	_, err = store.Peers()
+	require.Error(t, err)
+}
+
+// legacyStores returns stores holding a log with n commands but no
+// configuration, as left behind by a server that kept its peers elsewhere.
+func legacyStores(t *testing.T, n uint64) *InmemStore {
+	store := NewInmemStore()
+	require.NoError(t, store.SetUint64(keyCurrentTerm, 2))
+	for i := uint64(1); i <= n; i++ {
+		entry := &Log{Index: i, Term: 2, Type: LogCommand, Data: []byte(fmt.Sprintf("legacy%d", i))}
+		require.NoError(t, store.StoreLog(entry))
+	}
+	return store
+}
+
+func TestPeerStoreConfiguration(t *testing.T) {
+	conf := inmemConfig(t)
+	addr, trans := NewInmemTransport("127.0.0.4:8300")
+	conf.LocalID = "local"
+	store := legacyStores(t, 3)
+	snaps := NewInmemSnapshotStore()
+	peers := &StaticPeers{StaticPeers: []string{"127.0.0.3:8300", string(addr), "127.0.0.2:8300"}}
+
+	// The local server keeps its ID, and nothing is written to the log.
+	configuration, err := PeerStoreConfiguration(conf, &MockFSM{}, store, store, snaps, trans, peers)
+	require.NoError(t, err)
+	require.Equal(t, []Server{
+		{Suffrage: Voter, ID: "127.0.0.2:8300", Address: "127.0.0.2:8300"},
+		{Suffrage: Voter, ID: "127.0.0.3:8300", Address: "127.0.0.3:8300"},
+		{Suffrage: Voter, ID: "local", Address: addr},
+	}, configuration.Servers)
+	lastIndex, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lastIndex)
+
+	// A configuration in the log takes precedence.
+	entry := &Log{Index: 4, Term: 2, Type: LogConfiguration, Data: EncodeConfiguration(Configuration{
+		Servers: []Server{{Suffrage: Voter, ID: "local", Address: addr}},
+	})}
+	require.NoError(t, store.StoreLog(entry))
+	configuration, err = PeerStoreConfiguration(conf, &MockFSM{}, store, store, snaps, trans, peers)
+	require.NoError(t, err)
+	require.Len(t, configuration.Servers, 1)
+
+	// An empty peer store leaves the server without a configuration.
+	empty := NewInmemStore()
+	configuration, err = PeerStoreConfiguration(conf, &MockFSM{}, empty, empty, snaps, trans, &StaticPeers{})
+	require.NoError(t, err)
+	require.Empty(t, configuration.Servers)
+}
+
+func TestRaft_PeerStoreUpgrade(t *testing.T) {
+	var addrs []string
+	var transports []*InmemTransport
+	for i := 0; i < 3; i++ {
+		addr, trans := NewInmemTransport("")
+		addrs = append(addrs, string(addr))
+		transports = append(transports, trans)
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	// The servers' peer stores and logs differ: the second server's peers
+	// leave it out and its log is shorter.
+	peers := [][]string{
+		addrs,
+		{addrs[0], addrs[2]},
+		{addrs[2], addrs[1], addrs[0]},
+	}
+	legacy := []uint64{3, 2, 3}
+
+	var rafts []*Raft
+	var fsms []*MockFSM
+	var stores []*InmemStore
+	for i, trans := range transports {
+		conf := inmemConfig(t)
+		conf.LocalID = ServerID(addrs[i])
+		conf.PeerStore = &StaticPeers{StaticPeers: peers[i]}
+		store := legacyStores(t, legacy[i])
+		fsm := &MockFSM{}
+		r, err := NewRaft(conf, fsm, store, store, NewInmemSnapshotStore(), trans)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Shutdown().Error()) }()
+		rafts = append(rafts, r)
+		fsms = append(fsms, fsm)
+		stores = append(stores, store)
+	}
+
+	// The servers elect a leader from the configuration in the peer stores
+	// and carry on from the legacy log.
+	var leader *Raft
+	retry(t, func() bool {
+		for _, r := range rafts {
+			if r.State() == Leader {
+				leader = r
+				return true
+			}
+		}
+		return false
+	})
+	require.NoError(t, leader.Apply([]byte("upgraded"), time.Second).Error())
+	retry(t, func() bool {
+		for _, fsm := range fsms {
+			if len(fsm.Logs()) != 4 {
+				return false
+			}
+		}
+		return true
+	})
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.Len(t, future.Configuration().Servers, 3)
+
+	// Every server ends up with the same log, holding the leader's
+	// configuration.
+	lastIndex, err := stores[0].LastIndex()
+	require.NoError(t, err)
+	var configurations int
+	for index := uint64(1); index <= lastIndex; index++ {
+		var want Log
+		require.NoError(t, stores[0].GetLog(index, &want))
+		if want.Type == LogConfiguration {
+			configurations++
+		}
+		for _, store := range stores[1:] {
+			var got Log
+			require.NoError(t, store.GetLog(index, &got))
+			require.Equal(t, want.Term, got.Term)
+			require.Equal(t, want.Type, got.Type)
+			require.Equal(t, want.Data, got.Data)
+		}
+	}
+	require.Equal(t, 1, configurations)
+	for _, store := range stores[1:] {
+		last, err := store.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, lastIndex, last)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// defaultProbeTimeout is used by Live when Config.ProbeTimeout is zero.
+const defaultProbeTimeout = 5 * time.Second
+
+// Ready returns nil if this server is fit to serve reads, for use as a
+// readiness probe. A server is ready when it knows of a leader (or is the
+// leader) and its FSM is within Config.ReadyMaxLag entries of the commit
+// index. Otherwise the error says why it isn't ready.
+func (r *Raft) Ready() error {
+	state := r.getState()
+	if state == Shutdown {
+		return ErrRaftShutdown
+	}
+	if state != Leader {
+		if _, id := r.LeaderWithID(); id == "" {
+			return fmt.Errorf("no known leader")
+		}
+	}
+
+	commitIndex, appliedIndex := r.getCommitIndex(), r.getLastApplied()
+	if commitIndex > appliedIndex && commitIndex-appliedIndex > r.config().ReadyMaxLag {
+		return fmt.Errorf("applied index %d is %d entries behind commit index %d",
+			appliedIndex, commitIndex-appliedIndex, commitIndex)
+	}
+	return nil
+}
+
+// Live returns nil if this server's main goroutine and stores are responsive,
+// for use as a liveness probe. Each must respond within Config.ProbeTimeout.
+// The time taken by the log and stable stores is also recorded as metrics, so
+// a slow disk can be spotted before it fails the probe. Otherwise the error
+// says what didn't respond.
+func (r *Raft) Live() error {
+	if r.getState() == Shutdown {
+		return ErrRaftShutdown
+	}
+	timeout := r.config().ProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	if err := r.probeMainThread(timeout); err != nil {
+		return err
+	}
+	return r.probeStores(timeout)
+}
+
+// probeMainThread checks the main goroutine picks up and answers a request
+// within the timeout.
+func (r *Raft) probeMainThread(timeout time.Duration) error {
+	defer metrics.MeasureSince([]string{"raft", "probe", "mainThread"}, time.Now())
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	future := &configurationsFuture{}
+	future.init()
+	select {
+	case r.configurationsCh <- future:
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case <-timer.C:
+		return fmt.Errorf("main goroutine did not respond within %v", timeout)
+	}
+	select {
+	case err := <-future.errCh:
+		return err
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case <-timer.C:
+		return fmt.Errorf("main goroutine did not respond within %v", timeout)
+	}
+}
+
+// probeStores reads from the log and stable stores and checks they answer
+// within the timeout. A store that hangs is left with the read outstanding,
+// and later probes fail straight away until it returns.
+func (r *Raft) probeStores(timeout time.Duration) error {
+	if !r.storeProbeInFlight.CompareAndSwap(false, true) {
+		return fmt.Errorf("previous store check has not finished")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer r.storeProbeInFlight.Store(false)
+		start := time.Now()
+		if _, err := r.logs.LastIndex(); err != nil {
+			errCh <- fmt.Errorf("log store failed: %w", err)
+			return
+		}
+		metrics.MeasureSince([]string{"raft", "probe", "logStore"}, start)
+
+		start = time.Now()
+		if _, err := r.stable.GetUint64(keyCurrentTerm); err != nil && !isKeyNotFound(err) {
+			errCh <- fmt.Errorf("stable store failed: %w", err)
+			return
+		}
+		metrics.MeasureSince([]string{"raft", "probe", "stableStore"}, start)
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stores did not respond within %v", timeout)
+	}
+}
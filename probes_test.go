@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_ReadyLive(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	c.WaitForReplication(1)
+	for _, r := range c.rafts {
+		require.NoError(t, r.Ready())
+		require.NoError(t, r.Live())
+	}
+
+	// A follower that lost its leader isn't ready, but is still live.
+	follower := c.Followers()[0]
+	c.Disconnect(follower.localAddr)
+	require.Eventually(t, func() bool {
+		return follower.Ready() != nil
+	}, c.propagateTimeout*5, 10*time.Millisecond)
+	require.NoError(t, follower.Live())
+
+	require.NoError(t, follower.Shutdown().Error())
+	require.ErrorIs(t, follower.Ready(), ErrRaftShutdown)
+	require.ErrorIs(t, follower.Live(), ErrRaftShutdown)
+}
+
+func TestRaft_Ready_Lag(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = "first"
+	conf.ReadyMaxLag = 10
+	conf.skipStartup = true
+	// The test sets indexes without any log to back them.
+	conf.CheckInvariants = false
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	require.ErrorContains(t, r.Ready(), "no known leader")
+
+	r.setLeader("leader", "leader")
+	r.setCommitIndex(20)
+	r.setLastApplied(10)
+	require.NoError(t, r.Ready())
+	r.setLastApplied(9)
+	require.ErrorContains(t, r.Ready(), "11 entries behind")
+}
+
+// blockingLogStore is a LogStore whose LastIndex blocks until unblocked.
+type blockingLogStore struct {
+	LogStore
+	unblockCh chan struct{}
+}
+
+func (s *blockingLogStore) LastIndex() (uint64, error) {
+	<-s.unblockCh
+	return s.LogStore.LastIndex()
+}
+
+func TestRaft_Live_Unresponsive(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = "first"
+	conf.ProbeTimeout = 50 * time.Millisecond
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	// Nothing is running the main loop.
+	require.ErrorContains(t, r.Live(), "main goroutine did not respond")
+
+	go r.runFollower()
+	require.NoError(t, r.Live())
+
+	store := &blockingLogStore{LogStore: r.logs, unblockCh: make(chan struct{})}
+	r.logs = store
+	require.ErrorContains(t, r.Live(), "stores did not respond")
+	require.ErrorContains(t, r.Live(), "previous store check")
+
+	close(store.unblockCh)
+	require.Eventually(t, func() bool {
+		return r.Live() == nil
+	}, time.Second, 10*time.Millisecond)
+}
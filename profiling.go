@@ -0,0 +1,58 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// HotLoop identifies one of Raft's busiest loops, whose iterations are timed
+// when a LoopProfiler is configured.
+type HotLoop string
+
+const (
+	// HotLoopLeader is the main loop while this server is the leader.
+	HotLoopLeader HotLoop = "leader"
+
+	// HotLoopFSM is the loop applying commands and taking snapshots of the
+	// FSM.
+	HotLoopFSM HotLoop = "fsm"
+
+	// HotLoopReplicate is the loop replicating to each follower.
+	HotLoopReplicate HotLoop = "replicate"
+)
+
+// LoopProfiler is told how long each iteration of Raft's busiest loops spent
+// working, not counting the time waiting for work, making a saturated loop
+// directly observable. Set it with Config.LoopProfiler.
+type LoopProfiler interface {
+	// LoopIteration is called at the end of each iteration of loop. It's
+	// called from the loop itself, so it must return quickly, and from
+	// several goroutines at once.
+	LoopIteration(loop HotLoop, d time.Duration)
+}
+
+// MetricsLoopProfiler is a LoopProfiler that records each iteration as a
+// raft.loop.iteration timer labelled with the loop, which metrics sinks
+// aggregate into histograms or summaries.
+type MetricsLoopProfiler struct{}
+
+// LoopIteration implements the LoopProfiler interface.
+func (MetricsLoopProfiler) LoopIteration(loop HotLoop, d time.Duration) {
+	metrics.AddSampleWithLabels([]string{"raft", "loop", "iteration"}, float32(d)/float32(time.Millisecond),
+		[]metrics.Label{{Name: "loop", Value: string(loop)}})
+}
+
+// profileLoop reports an iteration of loop that spent d working, if a
+// LoopProfiler is configured.
+func (r *Raft) profileLoop(loop HotLoop, d time.Duration) {
+	if p := r.config().LoopProfiler; p != nil {
+		p.LoopIteration(loop, d)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingLoopProfiler counts the iterations of each loop.
+type countingLoopProfiler struct {
+	mu         sync.Mutex
+	iterations map[HotLoop]int
+}
+
+func (p *countingLoopProfiler) LoopIteration(loop HotLoop, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.iterations[loop]++
+}
+
+func (p *countingLoopProfiler) count(loop HotLoop) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.iterations[loop]
+}
+
+func TestRaft_LoopProfiler(t *testing.T) {
+	profiler := &countingLoopProfiler{iterations: make(map[HotLoop]int)}
+	conf := inmemConfig(t)
+	conf.LoopProfiler = profiler
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	c.WaitForReplication(10)
+
+	require.NotZero(t, profiler.count(HotLoopLeader))
+	require.NotZero(t, profiler.count(HotLoopFSM))
+	require.NotZero(t, profiler.count(HotLoopReplicate))
+}
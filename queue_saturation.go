@@ -0,0 +1,161 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// QueueName identifies one of the queues commands pass through on their way
+// to the FSM, whose depths are tracked when Config.QueueSaturationPeriod is
+// set.
+type QueueName string
+
+const (
+	// QueueApply holds Apply, Barrier and similar calls waiting for the leader
+	// to pick them up. Its capacity is MaxAppendEntries, the most the leader
+	// takes at once, or the size of the buffer if BatchApplyCh is set.
+	QueueApply QueueName = "apply"
+
+	// QueueCommit holds entries that have been committed but not yet handed
+	// to the FSM goroutine. Its capacity is MaxAppendEntries.
+	QueueCommit QueueName = "commit"
+
+	// QueueFSM holds batches of entries handed to the FSM goroutine but not
+	// yet applied.
+	QueueFSM QueueName = "fsm"
+)
+
+// QueueSaturationObservation is sent when the depth of a queue has stayed
+// above Config.QueueSaturationThreshold of its capacity for
+// Config.QueueSaturationPeriod, and again when it falls back below it. A
+// saturated queue means commands are arriving faster than they can be
+// handled, which leads to timeouts if it carries on.
+type QueueSaturationObservation struct {
+	Queue    QueueName
+	Depth    int
+	Capacity int
+	// Saturated is true if the queue has become saturated, and false if it
+	// has recovered.
+	Saturated bool
+	// Since is when the depth first went above the threshold.
+	Since time.Time
+}
+
+// queueSaturation tracks whether a queue is saturated between samples.
+type queueSaturation struct {
+	since     time.Time
+	saturated bool
+}
+
+// update records a sample of a queue's depth taken at now, returning whether
+// the queue became saturated or recovered.
+func (q *queueSaturation) update(depth, capacity int, threshold float64, period time.Duration, now time.Time) bool {
+	if float64(depth) <= threshold*float64(capacity) {
+		q.since = time.Time{}
+		if q.saturated {
+			q.saturated = false
+			return true
+		}
+		return false
+	}
+	if q.since.IsZero() {
+		q.since = now
+	}
+	if !q.saturated && now.Sub(q.since) >= period {
+		q.saturated = true
+		return true
+	}
+	return false
+}
+
+// queueDepth is a sample of a queue's depth.
+type queueDepth struct {
+	name     QueueName
+	depth    int
+	capacity int
+}
+
+// queueDepths returns the current depth and capacity of each queue.
+func (r *Raft) queueDepths(conf Config) []queueDepth {
+	applyCap := cap(r.applyCh)
+	if applyCap < conf.MaxAppendEntries {
+		applyCap = conf.MaxAppendEntries
+	}
+	var commit uint64
+	if commitIndex, lastApplied := r.getCommitIndex(), r.getLastApplied(); commitIndex > lastApplied {
+		commit = commitIndex - lastApplied
+	}
+	return []queueDepth{
+		{QueueApply, len(r.applyCh) + int(r.applyWaiting.Load()), applyCap},
+		{QueueCommit, int(commit), conf.MaxAppendEntries},
+		{QueueFSM, len(r.fsmMutateCh), cap(r.fsmMutateCh)},
+	}
+}
+
+// monitorInterval returns how often to sample something that must stay over
+// a limit for period to count: often enough to see whether it stayed there
+// for the whole period, without adding load to a busy server.
+func monitorInterval(period time.Duration) time.Duration {
+	interval := period / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	} else if interval > time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// runQueueMonitor is a long running goroutine that samples the depth of each
+// queue, reporting them in metrics and sending a QueueSaturationObservation
+// when one becomes saturated or recovers.
+func (r *Raft) runQueueMonitor() {
+	ticker := time.NewTicker(monitorInterval(r.config().QueueSaturationPeriod))
+	defer ticker.Stop()
+
+	queues := make(map[QueueName]*queueSaturation)
+	for {
+		var now time.Time
+		select {
+		case <-r.shutdownCh:
+			return
+		case now = <-ticker.C:
+		}
+
+		conf := r.config()
+		for _, d := range r.queueDepths(conf) {
+			name, depth, capacity := d.name, d.depth, d.capacity
+			labels := []metrics.Label{{Name: "queue", Value: string(name)}}
+			metrics.SetGaugeWithLabels([]string{"raft", "queue", "depth"}, float32(depth), labels)
+
+			q, ok := queues[name]
+			if !ok {
+				q = &queueSaturation{}
+				queues[name] = q
+			}
+			since := q.since
+			if !q.update(depth, capacity, conf.QueueSaturationThreshold, conf.QueueSaturationPeriod, now) {
+				continue
+			}
+			if q.saturated {
+				since = q.since
+				r.logger.Warn("queue saturated", "queue", name, "depth", depth, "capacity", capacity, "since", since)
+			} else {
+				r.logger.Info("queue no longer saturated", "queue", name, "depth", depth, "capacity", capacity)
+			}
+			r.observe(QueueSaturationObservation{
+				Queue:     name,
+				Depth:     depth,
+				Capacity:  capacity,
+				Saturated: q.saturated,
+				Since:     since,
+			})
+		}
+	}
+}
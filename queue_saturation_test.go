@@ -0,0 +1,103 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueSaturation_Update(t *testing.T) {
+	var q queueSaturation
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// Below the threshold.
+	require.False(t, q.update(8, 10, 0.8, time.Second, at(0)))
+	require.True(t, q.since.IsZero())
+
+	// Above it, but not for long enough.
+	require.False(t, q.update(9, 10, 0.8, time.Second, at(0)))
+	require.False(t, q.update(9, 10, 0.8, time.Second, at(500*time.Millisecond)))
+	require.False(t, q.saturated)
+
+	// Dipping below restarts the period.
+	require.False(t, q.update(1, 10, 0.8, time.Second, at(600*time.Millisecond)))
+	require.False(t, q.update(10, 10, 0.8, time.Second, at(time.Second)))
+	require.False(t, q.update(10, 10, 0.8, time.Second, at(1500*time.Millisecond)))
+	require.True(t, q.update(10, 10, 0.8, time.Second, at(2*time.Second)))
+	require.True(t, q.saturated)
+	require.Equal(t, at(time.Second), q.since)
+
+	// Only the change is reported.
+	require.False(t, q.update(10, 10, 0.8, time.Second, at(3*time.Second)))
+	require.True(t, q.update(0, 10, 0.8, time.Second, at(4*time.Second)))
+	require.False(t, q.saturated)
+	require.False(t, q.update(0, 10, 0.8, time.Second, at(5*time.Second)))
+}
+
+// blockingFSM is a MockFSM whose Apply waits until unblock is closed.
+type blockingFSM struct {
+	*MockFSM
+	unblock chan struct{}
+}
+
+func (m *blockingFSM) Apply(log *Log) interface{} {
+	<-m.unblock
+	return m.MockFSM.Apply(log)
+}
+
+func TestRaft_QueueSaturation(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.QueueSaturationThreshold = 0.01
+	conf.QueueSaturationPeriod = 50 * time.Millisecond
+	fsm := &blockingFSM{MockFSM: &MockFSM{}, unblock: make(chan struct{})}
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     1,
+		Bootstrap: true,
+		Conf:      conf,
+		MakeFSMFunc: func() FSM {
+			return fsm
+		},
+	})
+	defer c.Close()
+	leader := c.Leader()
+
+	saturationCh := make(chan Observation, 16)
+	leader.RegisterObserver(NewObserver(saturationCh, false, func(o *Observation) bool {
+		s, ok := o.Data.(QueueSaturationObservation)
+		return ok && s.Queue == QueueFSM
+	}))
+
+	// With the FSM stuck, each commit leaves another batch queued for it.
+	var futures []ApplyFuture
+	for i := 0; i < 5; i++ {
+		futures = append(futures, leader.Apply([]byte("test"), 0))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case o := <-saturationCh:
+		s := o.Data.(QueueSaturationObservation)
+		require.True(t, s.Saturated)
+		require.Greater(t, s.Depth, 1)
+		require.Equal(t, cap(leader.fsmMutateCh), s.Capacity)
+		require.False(t, s.Since.IsZero())
+	case <-time.After(c.longstopTimeout):
+		t.Fatalf("timed out waiting for saturation")
+	}
+
+	close(fsm.unblock)
+	for _, f := range futures {
+		require.NoError(t, f.Error())
+	}
+	select {
+	case o := <-saturationCh:
+		require.False(t, o.Data.(QueueSaturationObservation).Saturated)
+	case <-time.After(c.longstopTimeout):
+		t.Fatalf("timed out waiting for recovery")
+	}
+}
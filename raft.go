@@ -6,8 +6,10 @@ package raft
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,12 +21,19 @@ import (
 const (
 	minCheckInterval       = 10 * time.Millisecond
 	oldestLogGaugeInterval = 10 * time.Second
+
+	// replicationProgressInterval is how often the leader persists follower
+	// replication progress when Config.PersistReplicationProgress is set.
+	replicationProgressInterval = 10 * time.Second
 )
 
 var (
 	keyCurrentTerm  = []byte("CurrentTerm")
 	keyLastVoteTerm = []byte("LastVoteTerm")
 	keyLastVoteCand = []byte("LastVoteCand")
+	keyLastVote     = []byte("LastVote")
+
+	keyReplicationProgress = []byte("ReplicationProgress")
 )
 
 // getRPCHeader returns an initialized RPCHeader struct for the given
@@ -48,20 +57,14 @@ func (r *Raft) checkRPCHeader(rpc RPC) error {
 	}
 	header := wh.GetRPCHeader()
 
-	// First check is to just make sure the code can understand the
-	// protocol at all.
-	if header.ProtocolVersion < ProtocolVersionMin ||
-		header.ProtocolVersion > ProtocolVersionMax {
-		return ErrUnsupportedProtocol
-	}
-
-	// Second check is whether we should support this message, given the
-	// current protocol we are configured to run. This will drop support
-	// for protocol version 0 starting at protocol version 2, which is
-	// currently what we want, and in general support one version back. We
-	// may need to revisit this policy depending on how future protocol
-	// changes evolve.
-	if header.ProtocolVersion < r.config().ProtocolVersion-1 {
+	// Check whether we should support this message, given the range of
+	// protocols we are configured to accept, which is never more than the
+	// code can understand. By default we support one version back from the
+	// protocol we are configured to run. We may need to revisit this policy
+	// depending on how future protocol changes evolve.
+	conf := r.config()
+	min, max := conf.supportedProtocolVersions()
+	if header.ProtocolVersion < min || header.ProtocolVersion > max {
 		return ErrUnsupportedProtocol
 	}
 
@@ -83,6 +86,37 @@ type commitTuple struct {
 	future *logFuture
 }
 
+// commitTuplePool recycles commitTuples since a busy leader creates one for
+// every committed command. Tuples are owned by the FSM goroutine once sent on
+// fsmMutateCh and are released after they have been applied. logFutures aren't
+// pooled because they're handed back to callers of Apply, who may hold on to
+// them indefinitely.
+var commitTuplePool = sync.Pool{
+	New: func() interface{} {
+		metrics.IncrCounter([]string{"raft", "fsm", "commitTuple", "alloc"}, 1)
+		return new(commitTuple)
+	},
+}
+
+// newCommitTuple returns a commitTuple from the pool.
+func newCommitTuple(l *Log, future *logFuture) *commitTuple {
+	ct := commitTuplePool.Get().(*commitTuple)
+	ct.log = l
+	ct.future = future
+	return ct
+}
+
+// releaseCommitTuples returns the given commitTuples to the pool. They must
+// not be used afterwards.
+func releaseCommitTuples(batch []*commitTuple) {
+	for _, ct := range batch {
+		ct.log = nil
+		ct.future = nil
+		commitTuplePool.Put(ct)
+	}
+	metrics.IncrCounter([]string{"raft", "fsm", "commitTuple", "released"}, float32(len(batch)))
+}
+
 // leaderState is state that is used while we are a leader.
 type leaderState struct {
 	leadershipTransferInProgress int32 // indicates that a leadership transfer is in progress.
@@ -92,15 +126,23 @@ type leaderState struct {
 	replState                    map[ServerID]*followerReplication
 	notify                       map[*verifyFuture]struct{}
 	stepDown                     chan struct{}
+	leadershipLostCh             chan struct{} // closed when we step down
+	progressHints                map[ServerID]uint64
+	expiring                     map[uint64]struct{} // indexes this leader has appended LogExpiry entries for
+	scheduling                   map[uint64]struct{} // LogSchedule indexes this leader has appended commands for
+	startLimit                   chan struct{}       // bounds concurrent initial catch-ups, nil if unlimited
+	held                         []*logFuture        // versioned commands waiting for every server to support them
 }
 
-// setLeader is used to modify the current leader Address and ID of the cluster
+// setLeader is used to modify the current leader Address and ID of the cluster.
+// The leader is recorded as belonging to the current term.
 func (r *Raft) setLeader(leaderAddr ServerAddress, leaderID ServerID) {
 	r.leaderLock.Lock()
 	oldLeaderAddr := r.leaderAddr
 	r.leaderAddr = leaderAddr
 	oldLeaderID := r.leaderID
 	r.leaderID = leaderID
+	r.leaderTerm = r.getCurrentTerm()
 	r.leaderLock.Unlock()
 	if oldLeaderAddr != leaderAddr || oldLeaderID != leaderID {
 		r.observe(LeaderObservation{Leader: leaderAddr, LeaderAddr: leaderAddr, LeaderID: leaderID})
@@ -119,12 +161,25 @@ func (r *Raft) requestConfigChange(req configurationChangeRequest, timeout time.
 		req: req,
 	}
 	future.init()
+	audit := r.newAuditor(AuditEvent{
+		Operation:     auditOperation(req.command),
+		Requester:     req.requester,
+		Target:        req.serverID,
+		TargetAddress: req.serverAddress,
+	})
+	audit.watch(&future.deferError, future.Index)
+	if dup := r.coalesceConfigChange(future); dup != nil {
+		audit.watch(&dup.deferError, dup.Index)
+		return dup
+	}
 	select {
 	case <-timer:
+		future.respond(ErrEnqueueTimeout)
 		return errorFuture{ErrEnqueueTimeout}
 	case r.configurationChangeCh <- future:
 		return future
 	case <-r.shutdownCh:
+		future.respond(ErrRaftShutdown)
 		return errorFuture{ErrRaftShutdown}
 	}
 }
@@ -159,6 +214,7 @@ func (r *Raft) runFollower() {
 	r.logger.Info("entering follower state", "follower", r, "leader-address", leaderAddr, "leader-id", leaderID)
 	metrics.IncrCounter([]string{"raft", "state", "follower"}, 1)
 	heartbeatTimer := randomTimeout(r.config().HeartbeatTimeout)
+	r.elections = 0
 
 	for r.getState() == Follower {
 		r.mainThreadSaturation.sleeping()
@@ -193,6 +249,16 @@ func (r *Raft) runFollower() {
 			// Reject any operations since we are not the leader
 			l.respond(ErrNotLeader)
 
+		case rr := <-r.replicationReportCh:
+			r.mainThreadSaturation.working()
+			// Reject any operations since we are not the leader
+			rr.respond(ErrNotLeader)
+
+		case ri := <-r.readIndexCh:
+			r.mainThreadSaturation.working()
+			// Reject any operations since we are not the leader
+			ri.respond(ErrNotLeader)
+
 		case c := <-r.configurationsCh:
 			r.mainThreadSaturation.working()
 			c.configurations = r.configurations.Clone()
@@ -224,7 +290,7 @@ func (r *Raft) runFollower() {
 			lastLeaderAddr, lastLeaderID := r.LeaderWithID()
 			r.setLeader("", "")
 
-			if r.configurations.latestIndex == 0 {
+			if r.configurations.latestIndex == 0 && !r.hasLegacyConfiguration() {
 				if !didWarn {
 					r.logger.Warn("no known peers, aborting election")
 					didWarn = true
@@ -237,8 +303,14 @@ func (r *Raft) runFollower() {
 				}
 			} else {
 				metrics.IncrCounter([]string{"raft", "transition", "heartbeat_timeout"}, 1)
-				if hasVote(r.configurations.latest, r.localID) {
+				if !r.canBecomeLeader() {
+					if !didWarn {
+						r.logger.Warn("heartbeat timeout reached, not eligible to become leader, not triggering a leader election")
+						didWarn = true
+					}
+				} else if hasVote(r.configurations.latest, r.localID) {
 					r.logger.Warn("heartbeat timeout reached, starting election", "last-leader-addr", lastLeaderAddr, "last-leader-id", lastLeaderID)
+					r.recorder.recordTimer("heartbeat")
 					r.setState(Candidate)
 					return
 				} else if !didWarn {
@@ -284,9 +356,7 @@ func (r *Raft) runCandidate() {
 	term := r.getCurrentTerm() + 1
 	r.logger.Info("entering candidate state", "node", r, "term", term)
 	metrics.IncrCounter([]string{"raft", "state", "candidate"}, 1)
-
-	// Start vote for us, and set a timeout
-	voteCh := r.electSelf()
+	r.elections++
 
 	// Make sure the leadership transfer flag is reset after each run. Having this
 	// flag will set the field LeadershipTransfer in a RequestVoteRequst to true,
@@ -295,14 +365,32 @@ func (r *Raft) runCandidate() {
 	// otherwise.
 	defer func() { r.candidateFromLeadershipTransfer.Store(false) }()
 
+	// Start vote for us, and set a timeout. If pre-vote is enabled we first
+	// check a quorum would vote for us, unless the leader is handing over to
+	// us, in which case the other servers have already agreed.
+	var voteCh <-chan *voteResult
+	var preVoteCh <-chan *preVoteResult
+	if r.preVoteEnabled() && !r.candidateFromLeadershipTransfer.Load() {
+		preVoteCh = r.preElectSelf(term)
+	} else {
+		voteCh = r.electSelf()
+	}
+
 	electionTimeout := r.config().ElectionTimeout
-	electionTimer := randomTimeout(electionTimeout)
+	electionTimer := r.electionTimer(electionTimeout)
 
-	// Tally the votes, need a simple majority
-	grantedVotes := 0
+	// Tally the votes, need a simple majority (of both the old and new
+	// servers during a joint consensus change)
+	grantedVotes := make(map[ServerID]bool)
+	preVoteGrantedVotes := make(map[ServerID]bool)
 	votesNeeded := r.quorumSize()
 	r.logger.Debug("calculated votes needed", "needed", votesNeeded, "term", term)
 
+	// Record each vote so observers can see why an election failed
+	votes := make(map[ServerID]ElectionVote)
+	result := ElectionAborted
+	defer func() { r.observeElection(term, result, votesNeeded, votes) }()
+
 	for r.getState() == Candidate {
 		r.mainThreadSaturation.sleeping()
 
@@ -311,25 +399,63 @@ func (r *Raft) runCandidate() {
 			r.mainThreadSaturation.working()
 			r.processRPC(rpc)
 
+		case preVote := <-preVoteCh:
+			r.mainThreadSaturation.working()
+			votes[preVote.voterID] = preVote.electionVote(term)
+
+			// Check if the term is greater than ours, bail
+			if preVote.Term > term {
+				r.logger.Debug("newer term discovered during pre-vote, fallback to follower", "term", preVote.Term)
+				r.setState(Follower)
+				r.setCurrentTerm(preVote.Term)
+				result = ElectionNewerTerm
+				return
+			}
+
+			// Check if the pre-vote is granted
+			if preVote.Granted {
+				preVoteGrantedVotes[preVote.voterID] = true
+				r.logger.Debug("pre-vote granted", "from", preVote.voterID, "term", term, "tally", len(preVoteGrantedVotes))
+			} else if preVote.err == nil {
+				r.logger.Debug("pre-vote denied", "from", preVote.voterID, "term", term, "reason", preVote.Reason)
+			}
+
+			// Start the real election once a quorum would vote for us
+			if quorumReached(r.configurations.latest, preVoteGrantedVotes) {
+				r.logger.Info("pre-vote won, starting election", "term", term, "tally", len(preVoteGrantedVotes))
+				preVoteCh = nil
+				votes = make(map[ServerID]ElectionVote)
+				voteCh = r.electSelf()
+				electionTimer = r.electionTimer(electionTimeout)
+			}
+
 		case vote := <-voteCh:
 			r.mainThreadSaturation.working()
+			votes[vote.voterID] = vote.electionVote(term)
+
 			// Check if the term is greater than ours, bail
 			if vote.Term > r.getCurrentTerm() {
 				r.logger.Debug("newer term discovered, fallback to follower", "term", vote.Term)
 				r.setState(Follower)
 				r.setCurrentTerm(vote.Term)
+				result = ElectionNewerTerm
 				return
 			}
 
 			// Check if the vote is granted
 			if vote.Granted {
-				grantedVotes++
-				r.logger.Debug("vote granted", "from", vote.voterID, "term", vote.Term, "tally", grantedVotes)
+				grantedVotes[vote.voterID] = true
+				r.logger.Debug("vote granted", "from", vote.voterID, "term", vote.Term, "tally", len(grantedVotes))
+			} else if vote.err == nil {
+				r.logger.Debug("vote denied", "from", vote.voterID, "term", vote.Term, "reason", vote.Reason)
+				metrics.IncrCounterWithLabels([]string{"raft", "candidate", "voteDenied"}, 1,
+					[]metrics.Label{{Name: "reason", Value: vote.Reason.String()}})
 			}
 
 			// Check if we've become the leader
-			if grantedVotes >= votesNeeded {
-				r.logger.Info("election won", "term", vote.Term, "tally", grantedVotes)
+			if quorumReached(r.configurations.latest, grantedVotes) {
+				r.logger.Info("election won", "term", vote.Term, "tally", len(grantedVotes))
+				result = ElectionWon
 				r.setState(Leader)
 				r.setLeader(r.localAddr, r.localID)
 				return
@@ -360,6 +486,16 @@ func (r *Raft) runCandidate() {
 			// Reject any operations since we are not the leader
 			l.respond(ErrNotLeader)
 
+		case rr := <-r.replicationReportCh:
+			r.mainThreadSaturation.working()
+			// Reject any operations since we are not the leader
+			rr.respond(ErrNotLeader)
+
+		case ri := <-r.readIndexCh:
+			r.mainThreadSaturation.working()
+			// Reject any operations since we are not the leader
+			ri.respond(ErrNotLeader)
+
 		case c := <-r.configurationsCh:
 			r.mainThreadSaturation.working()
 			c.configurations = r.configurations.Clone()
@@ -375,14 +511,26 @@ func (r *Raft) runCandidate() {
 		case <-r.followerNotifyCh:
 			if electionTimeout != r.config().ElectionTimeout {
 				electionTimeout = r.config().ElectionTimeout
-				electionTimer = randomTimeout(electionTimeout)
+				electionTimer = r.electionTimer(electionTimeout)
 			}
 
 		case <-electionTimer:
 			r.mainThreadSaturation.working()
+			r.recorder.recordTimer("election")
+			if !r.canBecomeLeader() {
+				r.logger.Warn("election timeout reached, no longer eligible to become leader, reverting to follower", "term", term)
+				r.setState(Follower)
+				return
+			}
 			// Election failed! Restart the election. We simply return,
 			// which will kick us back into runCandidate
+			if preVoteCh != nil {
+				r.logger.Warn("pre-vote timeout reached, restarting pre-vote", "term", term, "tally", preVoteGrantedVotes)
+				result = ElectionPreVoteFailed
+				return
+			}
 			r.logger.Warn("Election timeout reached, restarting election")
+			result = ElectionTimedOut
 			return
 
 		case <-r.shutdownCh:
@@ -413,6 +561,12 @@ func (r *Raft) setupLeaderState() {
 	r.leaderState.replState = make(map[ServerID]*followerReplication)
 	r.leaderState.notify = make(map[*verifyFuture]struct{})
 	r.leaderState.stepDown = make(chan struct{}, 1)
+	r.leaderState.leadershipLostCh = make(chan struct{})
+	r.leaderState.expiring = make(map[uint64]struct{})
+	r.leaderState.scheduling = make(map[uint64]struct{})
+	if r.commitLatency != nil {
+		r.commitLatency.reset()
+	}
 }
 
 // runLeader runs the main loop while in leader state. Do the setup here and drop into
@@ -420,6 +574,11 @@ func (r *Raft) setupLeaderState() {
 func (r *Raft) runLeader() {
 	r.logger.Info("entering leader state", "leader", r)
 	metrics.IncrCounter([]string{"raft", "state", "leader"}, 1)
+	r.elections = 0
+
+	// Profile the leader loop's iterations if configured
+	r.mainThreadSaturation.iterationFn = func(d time.Duration) { r.profileLoop(HotLoopLeader, d) }
+	defer func() { r.mainThreadSaturation.iterationFn = nil }()
 
 	// Notify that we are the leader
 	overrideNotifyBool(r.leaderCh, true)
@@ -446,6 +605,19 @@ func (r *Raft) runLeader() {
 	// leaderloop.
 	r.setupLeaderState()
 
+	// Load any replication progress saved the last time we were leader
+	if r.config().PersistReplicationProgress {
+		r.leaderState.progressHints = r.loadReplicationProgress()
+	}
+
+	// Forget any newer term reported while we were last leader
+	r.inflatedTerm.Store(0)
+
+	// Limit how many followers we catch up at once, if configured
+	if n := r.config().ReplicationStartConcurrency; n > 0 {
+		r.leaderState.startLimit = make(chan struct{}, n)
+	}
+
 	// Run a background go-routine to emit metrics on log age
 	stopCh := make(chan struct{})
 	go emitLogStoreMetrics(r.logs, []string{"raft", "leader"}, oldestLogGaugeInterval, stopCh)
@@ -461,6 +633,14 @@ func (r *Raft) runLeader() {
 		// is extremely stale.
 		r.setLastContact()
 
+		// Save how far each follower got for the next time we're leader
+		if r.config().PersistReplicationProgress {
+			r.persistReplicationProgress()
+		}
+
+		// Abort any snapshots still being streamed to followers
+		close(r.leaderState.leadershipLostCh)
+
 		// Stop replication
 		for _, p := range r.leaderState.replState {
 			close(p.stopCh)
@@ -476,6 +656,11 @@ func (r *Raft) runLeader() {
 			future.respond(ErrLeadershipLost)
 		}
 
+		// Respond to the commands held for their FSM version
+		for _, future := range r.leaderState.held {
+			future.respond(ErrLeadershipLost)
+		}
+
 		// Clear all the state
 		r.leaderState.commitCh = nil
 		r.leaderState.commitment = nil
@@ -483,6 +668,11 @@ func (r *Raft) runLeader() {
 		r.leaderState.replState = nil
 		r.leaderState.notify = nil
 		r.leaderState.stepDown = nil
+		r.leaderState.progressHints = nil
+		r.leaderState.expiring = nil
+		r.leaderState.scheduling = nil
+		r.leaderState.startLimit = nil
+		r.leaderState.held = nil
 
 		// If we are stepping down for some reason, no known leader.
 		// We may have stepped down due to an RPC call, which would
@@ -523,6 +713,22 @@ func (r *Raft) runLeader() {
 	noop := &logFuture{log: Log{Type: LogNoop}}
 	r.dispatchLogs([]*logFuture{noop})
 
+	// A configuration read from a legacy PeerStore is only held in memory,
+	// so write it to the log now there's a leader to do so for everyone.
+	if r.hasLegacyConfiguration() {
+		configuration := r.configurations.latest.Clone()
+		future := &logFuture{}
+		log, err := r.configurationLog(configuration)
+		if err != nil {
+			r.logger.Error("failed to encode legacy configuration", "error", err)
+		} else {
+			future.log = log
+			r.dispatchLogs([]*logFuture{future})
+			r.setLatestConfiguration(configuration, future.Index())
+			r.logger.Info("appended configuration from legacy peer store", "index", future.Index())
+		}
+	}
+
 	// Sit in the leader loop until we step down
 	r.leaderLoop()
 }
@@ -535,8 +741,9 @@ func (r *Raft) startStopReplication() {
 	inConfig := make(map[ServerID]bool, len(r.configurations.latest.Servers))
 	lastIdx := r.getLastIndex()
 
-	// Start replication goroutines that need starting
-	for _, server := range r.configurations.latest.Servers {
+	// Start replication goroutines that need starting, including to outgoing
+	// servers during a joint consensus change
+	for _, server := range allServers(r.configurations.latest) {
 		if server.ID == r.localID {
 			continue
 		}
@@ -553,11 +760,14 @@ func (r *Raft) startStopReplication() {
 				triggerCh:           make(chan struct{}, 1),
 				triggerDeferErrorCh: make(chan *deferError, 1),
 				currentTerm:         r.getCurrentTerm(),
-				nextIndex:           lastIdx + 1,
+				nextIndex:           r.initialNextIndex(server.ID, lastIdx),
 				lastContact:         time.Now(),
 				notify:              make(map[*verifyFuture]struct{}),
 				notifyCh:            make(chan struct{}, 1),
 				stepDown:            r.leaderState.stepDown,
+				leadershipLostCh:    r.leaderState.leadershipLostCh,
+				stats:               newReplicationStats(),
+				startLimit:          r.leaderState.startLimit,
 			}
 
 			r.leaderState.replState[server.ID] = s
@@ -628,6 +838,26 @@ func (r *Raft) leaderLoop() {
 	// based on the current config value.
 	lease := time.After(r.config().LeaderLeaseTimeout)
 
+	var persistProgress <-chan time.Time
+	if r.config().PersistReplicationProgress {
+		persistProgress = time.After(replicationProgressInterval)
+	}
+
+	var promoteStaging <-chan time.Time
+	if r.config().StagingPromotionThreshold > 0 {
+		promoteStaging = time.After(r.config().CommitTimeout)
+	}
+
+	// releaseHeld fires while versioned commands are held, see
+	// ApplyVersioned.
+	var releaseHeld <-chan time.Time
+
+	// Entries may have been due to expire while another server was leader.
+	expiry := r.expireEntries()
+
+	// Schedules are dispatched once an entry from this term commits.
+	var scheduled scheduleTimer
+
 	for r.getState() == Leader {
 		r.mainThreadSaturation.sleeping()
 
@@ -638,8 +868,37 @@ func (r *Raft) leaderLoop() {
 
 		case <-r.leaderState.stepDown:
 			r.mainThreadSaturation.working()
+			if term := r.inflatedTerm.Swap(0); term > r.getCurrentTerm() && hasVote(r.configurations.latest, r.localID) && r.canBecomeLeader() {
+				// A follower with a stale log has a newer term, perhaps after
+				// a long partition. It can't win an election, so stand again
+				// straight away instead of waiting out an election timeout.
+				// Like a leadership transfer, this skips pre-vote and gets
+				// votes from followers that still see us as their leader.
+				r.logger.Warn("follower with a stale log has a newer term, standing for re-election", "term", term)
+				metrics.IncrCounter([]string{"raft", "termInflation", "reelect"}, 1)
+				r.setCurrentTerm(term)
+				r.candidateFromLeadershipTransfer.Store(true)
+				r.setState(Candidate)
+				continue
+			}
 			r.setState(Follower)
 
+		case future := <-r.replicationReportCh:
+			r.mainThreadSaturation.working()
+			future.report = r.replicationReport()
+			future.respond(nil)
+
+		case future := <-r.readIndexChIfReady():
+			r.mainThreadSaturation.working()
+			// Every entry up to the commit index has already been handed
+			// to the FSM by processLogs.
+			future.index = r.getCommitIndex()
+			if future.lease {
+				future.respond(r.checkReadLease())
+			} else {
+				future.respond(nil)
+			}
+
 		case future := <-r.leadershipTransferCh:
 			r.mainThreadSaturation.working()
 			if r.getLeadershipTransferInProgress() {
@@ -726,6 +985,10 @@ func (r *Raft) leaderLoop() {
 					continue
 				}
 			}
+			if err := r.peerBlocked(*address); err != nil {
+				doneCh <- fmt.Errorf("cannot transfer leadership to %v: %w", *id, err)
+				continue
+			}
 			state, ok := r.leaderState.replState[*id]
 			if !ok {
 				doneCh <- fmt.Errorf("cannot find replication state for %v", id)
@@ -739,7 +1002,12 @@ func (r *Raft) leaderLoop() {
 			// Process the newly committed entries
 			oldCommitIndex := r.getCommitIndex()
 			commitIndex := r.leaderState.commitment.getCommitIndex()
+			if commitIndex == oldCommitIndex {
+				// Already handled when an earlier notification was processed
+				continue
+			}
 			r.setCommitIndex(commitIndex)
+			r.notifyCommit()
 
 			// New configuration has been committed, set it as the committed
 			// value.
@@ -751,6 +1019,14 @@ func (r *Raft) leaderLoop() {
 				}
 			}
 
+			// Once a joint configuration is committed the outgoing servers
+			// can be dropped. This also finishes a change started by a
+			// previous leader once our first entry commits.
+			if r.configurations.latestIndex == r.configurations.committedIndex &&
+				r.configurations.latest.isJoint() {
+				r.leaveJointConfiguration()
+			}
+
 			start := time.Now()
 			var groupReady []*list.Element
 			groupFutures := make(map[uint64]*logFuture)
@@ -766,7 +1042,14 @@ func (r *Raft) leaderLoop() {
 				}
 
 				// Measure the commit time
+				commitLog.commit = start
 				metrics.MeasureSince([]string{"raft", "commitTime"}, commitLog.dispatch)
+				if r.commitLatency != nil {
+					r.commitLatency.committed(start.Sub(commitLog.dispatch))
+				}
+				if !commitLog.enqueue.IsZero() {
+					metrics.MeasureSince([]string{"raft", "apply", "commitLatency"}, commitLog.enqueue)
+				}
 				groupReady = append(groupReady, e)
 				groupFutures[idx] = commitLog
 				lastIdxInGroup = idx
@@ -779,6 +1062,14 @@ func (r *Raft) leaderLoop() {
 				for _, e := range groupReady {
 					r.leaderState.inflight.Remove(e)
 				}
+				scheduled.reset(r.dispatchScheduled())
+				if r.commitLatency != nil {
+					var oldest time.Time
+					if e := r.leaderState.inflight.Front(); e != nil {
+						oldest = e.Value.(*logFuture).dispatch
+					}
+					r.commitLatency.setOldest(oldest)
+				}
 			}
 
 			// Measure the time to enqueue batch of logs for FSM to apply
@@ -802,7 +1093,7 @@ func (r *Raft) leaderLoop() {
 			if v.quorumSize == 0 {
 				// Just dispatched, start the verification
 				r.verifyLeader(v)
-			} else if v.votes < v.quorumSize {
+			} else if !v.quorumReached() {
 				// Early return, means there must be a new leader
 				r.logger.Warn("new leader elected, stepping down")
 				r.setState(Follower)
@@ -873,6 +1164,33 @@ func (r *Raft) leaderLoop() {
 				}
 			}
 
+			// Drop the commands whose callers have given up on them, or
+			// that were meant for an earlier term
+			n := 0
+			for _, l := range ready {
+				if l.ctx != nil && l.ctx.Err() != nil {
+					l.respond(l.ctx.Err())
+					continue
+				}
+				if l.term != 0 && l.term != r.getCurrentTerm() {
+					l.respond(ErrLeadershipChanged)
+					continue
+				}
+				if l.fsmVersion != 0 && l.fsmVersion > r.clusterFSMVersion() {
+					r.leaderState.held = append(r.leaderState.held, l)
+					continue
+				}
+				ready[n] = l
+				n++
+			}
+			ready = ready[:n]
+			if len(r.leaderState.held) > 0 && releaseHeld == nil {
+				releaseHeld = time.After(r.config().CommitTimeout)
+			}
+			if len(ready) == 0 {
+				continue
+			}
+
 			// Dispatch the logs
 			if stepDown {
 				// we're in the process of stepping down as leader, don't process anything new
@@ -883,6 +1201,43 @@ func (r *Raft) leaderLoop() {
 				r.dispatchLogs(ready)
 			}
 
+		case <-persistProgress:
+			r.mainThreadSaturation.working()
+			r.persistReplicationProgress()
+			persistProgress = time.After(replicationProgressInterval)
+
+		case <-promoteStaging:
+			r.mainThreadSaturation.working()
+			r.promoteStagingServers()
+			promoteStaging = time.After(r.config().CommitTimeout)
+
+		case <-releaseHeld:
+			r.mainThreadSaturation.working()
+			releaseHeld = nil
+			if !stepDown && !r.getLeadershipTransferInProgress() {
+				r.releaseHeld()
+			}
+			if len(r.leaderState.held) > 0 {
+				releaseHeld = time.After(r.config().CommitTimeout)
+			}
+
+		case <-r.expiries.notifyCh:
+			r.mainThreadSaturation.working()
+			expiry = r.expireEntries()
+
+		case <-expiry:
+			r.mainThreadSaturation.working()
+			expiry = r.expireEntries()
+
+		case <-r.schedules.notifyCh:
+			r.mainThreadSaturation.working()
+			scheduled.reset(r.dispatchScheduled())
+
+		case <-scheduled.ch:
+			r.mainThreadSaturation.working()
+			scheduled.fired()
+			scheduled.reset(r.dispatchScheduled())
+
 		case <-lease:
 			r.mainThreadSaturation.working()
 			// Check if we've exceeded the lease, potentially stepping down
@@ -916,11 +1271,12 @@ func (r *Raft) leaderLoop() {
 // Causes the followers to attempt an immediate heartbeat.
 func (r *Raft) verifyLeader(v *verifyFuture) {
 	// Current leader always votes for self
-	v.votes = 1
+	v.configuration = r.configurations.latest.Clone()
+	v.granted = map[ServerID]bool{r.localID: true}
 
 	// Set the quorum size, hot-path for single node
 	v.quorumSize = r.quorumSize()
-	if v.quorumSize == 1 {
+	if quorumReached(v.configuration, v.granted) {
 		v.respond(nil)
 		return
 	}
@@ -987,7 +1343,7 @@ func (r *Raft) leadershipTransfer(id ServerID, address ServerAddress, repl *foll
 // contact. This must only be called from the main thread.
 func (r *Raft) checkLeaderLease() time.Duration {
 	// Track contacted nodes, we can always contact ourself
-	contacted := 0
+	contacted := make(map[ServerID]bool)
 
 	// Store lease timeout for this one check invocation as we need to refer to it
 	// in the loop and would be confusing if it ever becomes reloadable and
@@ -997,35 +1353,33 @@ func (r *Raft) checkLeaderLease() time.Duration {
 	// Check each follower
 	var maxDiff time.Duration
 	now := time.Now()
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			if server.ID == r.localID {
-				contacted++
-				continue
+	for _, server := range votingServers(r.configurations.latest) {
+		if server.ID == r.localID {
+			contacted[server.ID] = true
+			continue
+		}
+		f := r.leaderState.replState[server.ID]
+		diff := now.Sub(f.LastContact())
+		if diff <= leaseTimeout {
+			contacted[server.ID] = true
+			if diff > maxDiff {
+				maxDiff = diff
 			}
-			f := r.leaderState.replState[server.ID]
-			diff := now.Sub(f.LastContact())
-			if diff <= leaseTimeout {
-				contacted++
-				if diff > maxDiff {
-					maxDiff = diff
-				}
+		} else {
+			// Log at least once at high value, then debug. Otherwise it gets very verbose.
+			if diff <= 3*leaseTimeout {
+				r.logger.Warn("failed to contact", "server-id", server.ID, "time", diff)
 			} else {
-				// Log at least once at high value, then debug. Otherwise it gets very verbose.
-				if diff <= 3*leaseTimeout {
-					r.logger.Warn("failed to contact", "server-id", server.ID, "time", diff)
-				} else {
-					r.logger.Debug("failed to contact", "server-id", server.ID, "time", diff)
-				}
+				r.logger.Debug("failed to contact", "server-id", server.ID, "time", diff)
 			}
-			metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
 		}
+		metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
 	}
 
 	// Verify we can contact a quorum
-	quorum := r.quorumSize()
-	if contacted < quorum {
+	if !quorumReached(r.configurations.latest, contacted) {
 		r.logger.Warn("failed to contact quorum of nodes, stepping down")
+		r.recorder.recordTimer("leaderLease")
 		r.setState(Follower)
 		metrics.IncrCounter([]string{"raft", "transition", "leader_lease_timeout"}, 1)
 	}
@@ -1038,7 +1392,7 @@ func (r *Raft) checkLeaderLease() time.Duration {
 func (r *Raft) quorumSize() int {
 	voters := 0
 	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
+		if server.Suffrage.isVoting() {
 			voters++
 		}
 	}
@@ -1135,8 +1489,8 @@ func (r *Raft) restoreUserSnapshot(meta *SnapshotMeta, reader io.Reader) error {
 	// in the stable store since we created a snapshot as part of
 	// this process.
 	r.setLastLog(lastIndex, term)
-	r.setLastApplied(lastIndex)
 	r.setLastSnapshot(lastIndex, term)
+	r.setLastApplied(lastIndex)
 
 	// Remove old logs if r.logs is a MonotonicLogStore. Log any errors and continue.
 	if logs, ok := r.logs.(MonotonicLogStore); ok && logs.IsMonotonic() {
@@ -1149,10 +1503,79 @@ func (r *Raft) restoreUserSnapshot(meta *SnapshotMeta, reader io.Reader) error {
 	return nil
 }
 
+// promoteStagingServers promotes a Staging server to a Voter once its match
+// index is within Config.StagingPromotionThreshold of our last index. Only
+// one configuration change can be in flight, so nothing is done until the
+// latest configuration is committed, and servers are promoted one at a time.
+// This must only be called from the main thread.
+func (r *Raft) promoteStagingServers() {
+	if r.configurations.latestIndex != r.configurations.committedIndex || r.getLeadershipTransferInProgress() {
+		return
+	}
+	threshold := r.config().StagingPromotionThreshold
+	lastIndex := r.getLastIndex()
+	for _, server := range r.configurations.latest.Servers {
+		if server.Suffrage != Staging {
+			continue
+		}
+		s, ok := r.leaderState.replState[server.ID]
+		if !ok {
+			continue
+		}
+		matchIndex := atomic.LoadUint64(&s.matchIndex)
+		if matchIndex+threshold < lastIndex {
+			continue
+		}
+
+		r.logger.Info("promoting staging server", "server-id", server.ID,
+			"match-index", matchIndex, "last-index", lastIndex)
+		metrics.IncrCounter([]string{"raft", "leader", "promoteStaging"}, 1)
+		future := &configurationChangeFuture{
+			req: configurationChangeRequest{
+				command:   Promote,
+				serverID:  server.ID,
+				prevIndex: r.configurations.latestIndex,
+			},
+		}
+		future.init()
+		r.appendConfigurationEntry(future)
+		return
+	}
+}
+
+// leaveJointConfiguration appends the configuration that finishes a committed
+// joint consensus change. This must only be called from the main thread.
+func (r *Raft) leaveJointConfiguration() {
+	future := &configurationChangeFuture{
+		req: configurationChangeRequest{
+			command:   leaveJoint,
+			prevIndex: r.configurations.latestIndex,
+		},
+	}
+	future.init()
+	r.appendConfigurationEntry(future)
+}
+
 // appendConfigurationEntry changes the configuration and adds a new
 // configuration entry to the log. This must only be called from the
 // main thread.
 func (r *Raft) appendConfigurationEntry(future *configurationChangeFuture) {
+	// New voters start out as Staging until they've caught up, see
+	// promoteStagingServers.
+	if future.req.command == AddVoter && r.config().StagingPromotionThreshold > 0 &&
+		!hasVote(r.configurations.latest, future.req.serverID) {
+		future.req.command = addStaging
+	}
+
+	// A server that doesn't know about Outgoing would drop it from the joint
+	// configuration and count the wrong quorum. The joint entry is stamped
+	// with the cluster's version, so servers being added that are too old
+	// refuse it, but the current ones must all have reported support.
+	if future.req.command == enterJoint && r.clusterLogVersion() < 5 {
+		future.respond(ErrJointConsensusUnsupported)
+		return
+	}
+
 	configuration, err := nextConfiguration(r.configurations.latest, r.configurations.latestIndex, future.req)
 	if err != nil {
 		future.respond(err)
@@ -1163,8 +1586,24 @@ func (r *Raft) appendConfigurationEntry(future *configurationChangeFuture) {
 		"command", future.req.command,
 		"server-id", future.req.serverID,
 		"server-addr", future.req.serverAddress,
-		"servers", hclog.Fmt("%+v", configuration.Servers))
+		"servers", hclog.Fmt("%+v", configuration.Servers),
+		"outgoing", hclog.Fmt("%+v", configuration.Outgoing))
+
+	future.log, err = r.configurationLog(configuration)
+	if err != nil {
+		future.respond(err)
+		return
+	}
+
+	r.dispatchLogs([]*logFuture{&future.logFuture})
+	index := future.Index()
+	r.setLatestConfiguration(configuration, index)
+	r.leaderState.commitment.setConfiguration(configuration)
+	r.startStopReplication()
+}
 
+// configurationLog returns the log entry that sets the configuration.
+func (r *Raft) configurationLog(configuration Configuration) (Log, error) {
 	// In pre-ID compatibility mode we translate all configuration changes
 	// in to an old remove peer message, which can handle all supported
 	// cases for peer changes in the pre-ID world (adding and removing
@@ -1173,22 +1612,13 @@ func (r *Raft) appendConfigurationEntry(future *configurationChangeFuture) {
 	// see if a leader needs to step down. Since they both assert the full
 	// configuration, then we can safely call remove peer for everything.
 	if r.protocolVersion < 2 {
-		future.log = Log{
-			Type: LogRemovePeerDeprecated,
-			Data: encodePeers(configuration, r.trans),
-		}
-	} else {
-		future.log = Log{
-			Type: LogConfiguration,
-			Data: EncodeConfiguration(configuration),
+		peers, err := r.peerCodec().EncodePeers(configuration, r.trans)
+		if err != nil {
+			return Log{}, err
 		}
+		return Log{Type: LogRemovePeerDeprecated, Data: peers}, nil
 	}
-
-	r.dispatchLogs([]*logFuture{&future.logFuture})
-	index := future.Index()
-	r.setLatestConfiguration(configuration, index)
-	r.leaderState.commitment.setConfiguration(configuration)
-	r.startStopReplication()
+	return Log{Type: LogConfiguration, Data: EncodeConfiguration(configuration)}, nil
 }
 
 // dispatchLog is called on the leader to push a log to disk, mark it
@@ -1200,19 +1630,43 @@ func (r *Raft) dispatchLogs(applyLogs []*logFuture) {
 	term := r.getCurrentTerm()
 	lastIndex := r.getLastIndex()
 
-	n := len(applyLogs)
+	// Refuse entries with fields that not every server can read yet, since
+	// an older server would fail to apply them.
+	logVersion := r.clusterLogVersion()
+	n := 0
+	for _, applyLog := range applyLogs {
+		if applyLog.log.requiredVersion() > logVersion {
+			applyLog.respond(ErrLogFieldsUnsupported)
+			continue
+		}
+		applyLogs[n] = applyLog
+		n++
+	}
+	applyLogs = applyLogs[:n]
+	if n == 0 {
+		return
+	}
+
 	logs := make([]*Log, n)
 	metrics.SetGauge([]string{"raft", "leader", "dispatchNumLogs"}, float32(n))
 
 	for idx, applyLog := range applyLogs {
 		applyLog.dispatch = now
+		if !applyLog.enqueue.IsZero() {
+			metrics.MeasureSince([]string{"raft", "apply", "queueTime"}, applyLog.enqueue)
+		}
 		lastIndex++
 		applyLog.log.Index = lastIndex
 		applyLog.log.Term = term
 		applyLog.log.AppendedAt = now
+		applyLog.log.Version = logVersion
+		applyLog.log.SetChecksum()
 		logs[idx] = &applyLog.log
 		r.leaderState.inflight.PushBack(applyLog)
 	}
+	if r.commitLatency != nil {
+		r.commitLatency.dispatched(now)
+	}
 
 	// Write the log entry locally
 	if err := r.logs.StoreLogs(logs); err != nil {
@@ -1258,6 +1712,7 @@ func (r *Raft) processLogs(index uint64, futures map[uint64]*logFuture) {
 					cl.future.respond(ErrRaftShutdown)
 				}
 			}
+			releaseCommitTuples(batch)
 		}
 	}
 
@@ -1278,7 +1733,14 @@ func (r *Raft) processLogs(index uint64, futures map[uint64]*logFuture) {
 			l := new(Log)
 			if err := r.logs.GetLog(idx, l); err != nil {
 				r.logger.Error("failed to get log", "index", idx, "error", err)
-				panic(err)
+				for _, cl := range batch {
+					if cl.future != nil {
+						cl.future.respond(ErrRaftShutdown)
+					}
+				}
+				releaseCommitTuples(batch)
+				r.fatal(err)
+				return
 			}
 			preparedLog = r.prepareLog(l, nil)
 		}
@@ -1310,25 +1772,59 @@ func (r *Raft) processLogs(index uint64, futures map[uint64]*logFuture) {
 	r.setLastApplied(index)
 }
 
+// fatal handles an error that raft can't recover from according to
+// Config.FatalErrorPolicy. When it returns, raft has been shut down and the
+// caller should abandon whatever it was doing.
+func (r *Raft) fatal(err error) {
+	conf := r.config()
+	if conf.FatalErrorPolicy != FatalErrorShutdown {
+		panic(err)
+	}
+
+	r.logger.Error("shutting down due to fatal error", "error", err)
+	metrics.IncrCounter([]string{"raft", "fatal"}, 1)
+	if conf.FaultCh != nil {
+		select {
+		case conf.FaultCh <- err:
+		default:
+		}
+	}
+	r.Shutdown()
+}
+
 // processLog is invoked to process the application of a single committed log entry.
 func (r *Raft) prepareLog(l *Log, future *logFuture) *commitTuple {
+	// Witnesses don't have the commands, and can't be leader to dispatch
+	// them anyway.
+	if !isWitness(r.configurations.latest, r.localID) {
+		if err := r.schedules.track(l); err != nil {
+			r.logger.Error("failed to track schedule", "error", err)
+		}
+	}
+
 	switch l.Type {
 	case LogBarrier:
 		// Barrier is handled by the FSM
 		fallthrough
 
-	case LogCommand:
-		return &commitTuple{l, future}
+	case LogCommand, LogExpiry:
+		// Witnesses only receive entry headers so there is nothing to apply.
+		if isWitness(r.configurations.latest, r.localID) {
+			return nil
+		}
+		return newCommitTuple(l, future)
 
 	case LogConfiguration:
 		// Only support this with the v2 configuration format
 		if r.protocolVersion > 2 {
-			return &commitTuple{l, future}
+			return newCommitTuple(l, future)
 		}
 	case LogAddPeerDeprecated:
 	case LogRemovePeerDeprecated:
 	case LogNoop:
 		// Ignore the no-op
+	case LogSchedule:
+		// Tracked above, the command is applied once it's dispatched
 
 	default:
 		panic(fmt.Errorf("unrecognized log type: %#v", l))
@@ -1340,6 +1836,22 @@ func (r *Raft) prepareLog(l *Log, future *logFuture) *commitTuple {
 // processRPC is called to handle an incoming RPC request. This must only be
 // called from the main thread.
 func (r *Raft) processRPC(rpc RPC) {
+	if finish := r.recorder.interceptRPC(&rpc); finish != nil {
+		defer finish()
+	}
+
+	if r.rejectBlockedRPC(rpc) {
+		return
+	}
+
+	// Status requests may come from health checkers outside the cluster
+	// that don't speak our protocol version. They only get here from
+	// transports without a heartbeat fast-path.
+	if req, ok := rpc.Command.(*StatusRequest); ok {
+		r.status(rpc, req)
+		return
+	}
+
 	if err := r.checkRPCHeader(rpc); err != nil {
 		rpc.Respond(nil, err)
 		return
@@ -1350,10 +1862,16 @@ func (r *Raft) processRPC(rpc RPC) {
 		r.appendEntries(rpc, cmd)
 	case *RequestVoteRequest:
 		r.requestVote(rpc, cmd)
+	case *RequestPreVoteRequest:
+		r.requestPreVote(rpc, cmd)
 	case *InstallSnapshotRequest:
 		r.installSnapshot(rpc, cmd)
 	case *TimeoutNowRequest:
 		r.timeoutNow(rpc, cmd)
+	case *JoinRequest:
+		r.join(rpc, cmd)
+	case *LeaveRequest:
+		r.leave(rpc, cmd)
 	default:
 		r.logger.Error("got unexpected command",
 			"command", hclog.Fmt("%#v", rpc.Command))
@@ -1361,9 +1879,18 @@ func (r *Raft) processRPC(rpc RPC) {
 	}
 }
 
-// processHeartbeat is a special handler used just for heartbeat requests
-// so that they can be fast-pathed if a transport supports it. This must only
-// be called from the main thread.
+// status is invoked when we get a Status RPC call.
+func (r *Raft) status(rpc RPC, req *StatusRequest) {
+	defer metrics.MeasureSince([]string{"raft", "rpc", "status"}, time.Now())
+	rpc.Respond(&StatusResponse{
+		RPCHeader: r.getRPCHeader(),
+		Status:    r.Status(),
+	}, nil)
+}
+
+// processHeartbeat is a special handler used just for heartbeat and Status
+// requests so that they can be fast-pathed if a transport supports it. This
+// must only be called from the main thread.
 func (r *Raft) processHeartbeat(rpc RPC) {
 	defer metrics.MeasureSince([]string{"raft", "rpc", "processHeartbeat"}, time.Now())
 
@@ -1374,10 +1901,20 @@ func (r *Raft) processHeartbeat(rpc RPC) {
 	default:
 	}
 
+	if finish := r.recorder.interceptRPC(&rpc); finish != nil {
+		defer finish()
+	}
+
+	if r.rejectBlockedRPC(rpc) {
+		return
+	}
+
 	// Ensure we are only handling a heartbeat
 	switch cmd := rpc.Command.(type) {
 	case *AppendEntriesRequest:
 		r.appendEntries(rpc, cmd)
+	case *StatusRequest:
+		r.status(rpc, cmd)
 	default:
 		r.logger.Error("expected heartbeat, got", "command", hclog.Fmt("%#v", rpc.Command))
 		rpc.Respond(nil, fmt.Errorf("unexpected command"))
@@ -1395,6 +1932,11 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		LastLog:        r.getLastIndex(),
 		Success:        false,
 		NoRetryBackoff: false,
+		FSMVersion:     r.localFSMVersion(),
+		LogVersion:     LogVersionMax,
+	}
+	if a.Timestamp != 0 {
+		resp.Timestamp = time.Now().UnixMilli()
 	}
 	var rpcErr error
 	defer func() {
@@ -1407,8 +1949,10 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	}
 
 	// Increase the term if we see a newer one, also transition to follower
-	// if we ever get an appendEntries call
-	if a.Term > r.getCurrentTerm() || (r.getState() != Follower && !r.candidateFromLeadershipTransfer.Load()) {
+	// if we ever get an appendEntries call. A candidate seeing its own term
+	// means another server already won this election, so step down and record
+	// the leader now rather than timing out and inflating the term again.
+	if a.Term > r.getCurrentTerm() || (r.getState() != Follower && !r.awaitingTransferElection(a.Term)) {
 		// Ensure transition to follower
 		r.setState(Follower)
 		r.setCurrentTerm(a.Term)
@@ -1454,6 +1998,26 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	if len(a.Entries) > 0 {
 		start := time.Now()
 
+		// Refuse entries we can't fully decode, storing them would silently
+		// drop whatever fields were added in the newer schema, and entries
+		// corrupted on the way here.
+		for _, entry := range a.Entries {
+			if entry.Version > LogVersionMax {
+				r.logger.Error("log entry version is not supported",
+					"index", entry.Index,
+					"version", entry.Version,
+					"max-version", LogVersionMax)
+				metrics.IncrCounter([]string{"raft", "rpc", "appendEntries", "unsupportedLogVersion"}, 1)
+				rpcErr = ErrUnsupportedLogVersion
+				return
+			}
+			if err := entry.VerifyChecksum(); err != nil {
+				r.logger.Error("refusing corrupt log entry", "error", err)
+				rpcErr = err
+				return
+			}
+		}
+
 		// Delete any conflicting entries, skip any duplicates
 		lastLogIdx, _ := r.getLastLog()
 		var newEntries []*Log
@@ -1463,13 +2027,20 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 				break
 			}
 			var storeEntry Log
+			corrupt := false
 			if err := r.logs.GetLog(entry.Index, &storeEntry); err != nil {
-				r.logger.Warn("failed to get log entry",
-					"index", entry.Index,
-					"error", err)
-				return
+				if !errors.Is(err, ErrLogCorrupt) {
+					r.logger.Warn("failed to get log entry",
+						"index", entry.Index,
+						"error", err)
+					return
+				}
+				// The leader's copy replaces ours, along with everything
+				// after it, just as if it conflicted.
+				r.logger.Warn("replacing corrupt log entry", "index", entry.Index, "error", err)
+				corrupt = true
 			}
-			if entry.Term != storeEntry.Term {
+			if corrupt || entry.Term != storeEntry.Term {
 				r.logger.Warn("clearing log suffix", "from", entry.Index, "to", lastLogIdx)
 				if err := r.logs.DeleteRange(entry.Index, lastLogIdx); err != nil {
 					r.logger.Error("failed to clear log suffix", "error", err)
@@ -1516,6 +2087,7 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		start := time.Now()
 		idx := min(a.LeaderCommitIndex, r.getLastIndex())
 		r.setCommitIndex(idx)
+		r.notifyCommit()
 		if r.configurations.latestIndex <= idx {
 			r.setCommittedConfiguration(r.configurations.latest, r.configurations.latestIndex)
 		}
@@ -1539,7 +2111,7 @@ func (r *Raft) processConfigurationLogEntry(entry *Log) error {
 
 	case LogAddPeerDeprecated, LogRemovePeerDeprecated:
 		r.setCommittedConfiguration(r.configurations.latest, r.configurations.latestIndex)
-		conf, err := decodePeers(entry.Data, r.trans)
+		conf, err := r.peerCodec().DecodePeers(entry.Data, r.trans)
 		if err != nil {
 			return err
 		}
@@ -1567,7 +2139,11 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 	// Version 0 servers will panic unless the peers is present. It's only
 	// used on them to produce a warning message.
 	if r.protocolVersion < 2 {
-		resp.Peers = encodePeers(r.configurations.latest, r.trans)
+		peers, err := r.peerCodec().EncodePeers(r.configurations.latest, r.trans)
+		if err != nil {
+			r.logger.Error("failed to encode peers", "error", err)
+		}
+		resp.Peers = peers
 	}
 
 	// Check if we have an existing leader [who's not the candidate] and also
@@ -1593,6 +2169,7 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 		if len(r.configurations.latest.Servers) > 0 && !inConfiguration(r.configurations.latest, candidateID) {
 			r.logger.Warn("rejecting vote request since node is not in configuration",
 				"from", candidate)
+			resp.Reason = VoteDenialNotInConfiguration
 			return
 		}
 	}
@@ -1601,11 +2178,24 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 			"from", candidate,
 			"leader", leaderAddr,
 			"leader-id", string(leaderID))
+		resp.Reason = VoteDenialHasLeader
 		return
 	}
 
 	// Ignore an older term
 	if req.Term < r.getCurrentTerm() {
+		resp.Reason = VoteDenialOlderTerm
+		return
+	}
+
+	// Requests that will be denied whatever we've recorded are limited
+	// before they can change our term or read the StableStore. Ones that
+	// could be granted never are, so the limit can't hold up an election.
+	if limit := r.config().RequestVoteRateLimit; limit > 0 && r.voteHopeless(req) &&
+		!r.voteLimiter.allow(voteLimitSource(rpc, candidate), limit, time.Now()) {
+		metrics.IncrCounter([]string{"raft", "rpc", "requestVote", "rateLimited"}, 1)
+		r.logger.Debug("rejecting vote request since candidate exceeded rate limit", "from", candidate)
+		resp.Reason = VoteDenialRateLimited
 		return
 	}
 
@@ -1627,27 +2217,32 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 		candidateID := ServerID(req.ID)
 		if len(r.configurations.latest.Servers) > 0 && !hasVote(r.configurations.latest, candidateID) {
 			r.logger.Warn("rejecting vote request since node is not a voter", "from", candidate)
+			resp.Reason = VoteDenialNotVoter
 			return
 		}
 	}
 	// Check if we have voted yet
 	lastVoteTerm, err := r.stable.GetUint64(keyLastVoteTerm)
-	if err != nil && err.Error() != "not found" {
+	if err != nil && !isKeyNotFound(err) {
 		r.logger.Error("failed to get last vote term", "error", err)
+		resp.Reason = VoteDenialInternalError
 		return
 	}
 	lastVoteCandBytes, err := r.stable.Get(keyLastVoteCand)
-	if err != nil && err.Error() != "not found" {
+	if err != nil && !isKeyNotFound(err) {
 		r.logger.Error("failed to get last vote candidate", "error", err)
+		resp.Reason = VoteDenialInternalError
 		return
 	}
 
 	// Check if we've voted in this election before
 	if lastVoteTerm == req.Term && lastVoteCandBytes != nil {
 		r.logger.Info("duplicate requestVote for same term", "term", req.Term)
-		if bytes.Equal(lastVoteCandBytes, candidateBytes) {
+		if r.sameVoteCandidate(req, lastVoteCandBytes, candidateBytes) {
 			r.logger.Warn("duplicate requestVote from", "candidate", candidate)
 			resp.Granted = true
+		} else {
+			resp.Reason = VoteDenialAlreadyVoted
 		}
 		return
 	}
@@ -1659,6 +2254,7 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 			"candidate", candidate,
 			"last-term", lastTerm,
 			"last-candidate-term", req.LastLogTerm)
+		resp.Reason = VoteDenialStaleLogTerm
 		return
 	}
 
@@ -1667,12 +2263,14 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 			"candidate", candidate,
 			"last-index", lastIdx,
 			"last-candidate-index", req.LastLogIndex)
+		resp.Reason = VoteDenialStaleLogIndex
 		return
 	}
 
 	// Persist a vote for safety
-	if err := r.persistVote(req.Term, candidateBytes); err != nil {
+	if err := r.persistVote(req.Term, candidateBytes, ServerID(req.ID)); err != nil {
 		r.logger.Error("failed to persist vote", "error", err)
+		resp.Reason = VoteDenialInternalError
 		return
 	}
 
@@ -1680,6 +2278,84 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 	r.setLastContact()
 }
 
+// requestPreVote is invoked when we get a RequestPreVote RPC call. It reports
+// whether we would vote for the candidate in the requested term, without
+// changing our term, recording a vote or resetting our election timer. This
+// must only be called from the main thread.
+func (r *Raft) requestPreVote(rpc RPC, req *RequestPreVoteRequest) {
+	defer metrics.MeasureSince([]string{"raft", "rpc", "requestPreVote"}, time.Now())
+	r.observe(*req)
+
+	// Setup a response
+	resp := &RequestPreVoteResponse{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+		Granted:   false,
+	}
+	var rpcErr error
+	defer func() {
+		rpc.Respond(resp, rpcErr)
+	}()
+
+	candidate := r.trans.DecodePeer(req.RPCHeader.Addr)
+	candidateID := ServerID(req.ID)
+
+	// if the Servers list is empty that mean the cluster is very likely trying
+	// to bootstrap, grant the pre-vote
+	if len(r.configurations.latest.Servers) > 0 {
+		if !inConfiguration(r.configurations.latest, candidateID) {
+			r.logger.Warn("rejecting pre-vote request since node is not in configuration",
+				"from", candidate)
+			resp.Reason = VoteDenialNotInConfiguration
+			return
+		}
+		if !hasVote(r.configurations.latest, candidateID) {
+			r.logger.Warn("rejecting pre-vote request since node is not a voter", "from", candidate)
+			resp.Reason = VoteDenialNotVoter
+			return
+		}
+	}
+
+	// A pre-vote is only granted once we've stopped hearing from the leader,
+	// this is what stops a rejoining server from disrupting the cluster.
+	if leaderAddr, leaderID := r.LeaderWithID(); leaderAddr != "" && leaderAddr != candidate {
+		r.logger.Debug("rejecting pre-vote request since we have a leader",
+			"from", candidate,
+			"leader", leaderAddr,
+			"leader-id", string(leaderID))
+		resp.Reason = VoteDenialHasLeader
+		return
+	}
+
+	// Ignore an older term
+	if req.Term < r.getCurrentTerm() {
+		resp.Reason = VoteDenialOlderTerm
+		return
+	}
+
+	// Reject if their log is behind ours
+	lastIdx, lastTerm := r.getLastEntry()
+	if lastTerm > req.LastLogTerm {
+		r.logger.Debug("rejecting pre-vote request since our last term is greater",
+			"candidate", candidate,
+			"last-term", lastTerm,
+			"last-candidate-term", req.LastLogTerm)
+		resp.Reason = VoteDenialStaleLogTerm
+		return
+	}
+
+	if lastTerm == req.LastLogTerm && lastIdx > req.LastLogIndex {
+		r.logger.Debug("rejecting pre-vote request since our last index is greater",
+			"candidate", candidate,
+			"last-index", lastIdx,
+			"last-candidate-index", req.LastLogIndex)
+		resp.Reason = VoteDenialStaleLogIndex
+		return
+	}
+
+	resp.Granted = true
+}
+
 // installSnapshot is invoked when we get a InstallSnapshot RPC call.
 // We must be in the follower state for this, since it means we are
 // too far behind a leader for log replay. This must only be called
@@ -1734,14 +2410,19 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		reqConfiguration = DecodeConfiguration(req.Configuration)
 		reqConfigurationIndex = req.ConfigurationIndex
 	} else {
-		reqConfiguration, rpcErr = decodePeers(req.Peers, r.trans)
+		reqConfiguration, rpcErr = r.peerCodec().DecodePeers(req.Peers, r.trans)
 		if rpcErr != nil {
 			r.logger.Error("failed to install snapshot", "error", rpcErr)
 			return
 		}
 		reqConfigurationIndex = req.LastLogIndex
 	}
+	// Keep the version of a snapshot that has Raft's state ahead of the
+	// FSM's data, so it's read back correctly.
 	version := getSnapshotVersion(r.protocolVersion)
+	if req.SnapshotVersion >= snapshotStateVersion {
+		version = req.SnapshotVersion
+	}
 	sink, err := r.snapshots.Create(version, req.LastLogIndex, req.LastLogTerm,
 		reqConfiguration, reqConfigurationIndex, r.trans)
 	if err != nil {
@@ -1755,8 +2436,33 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	countingRPCReader := newCountingReader(rpc.Reader)
 
 	// Spill the remote snapshot to disk
+	conf := r.config()
+	receiver := &snapshotReceiver{
+		sink:       sink,
+		bufferSize: conf.SnapshotReceiveBufferSize,
+		syncBytes:  conf.SnapshotReceiveSyncBytes,
+	}
 	transferMonitor := startSnapshotRestoreMonitor(r.logger, countingRPCReader, req.Size, true)
-	n, err := io.Copy(sink, countingRPCReader)
+	// Stop reading if we are shut down part way through, or if a newer
+	// leader is seen, so the partial snapshot is cancelled rather than left
+	// behind. The main thread is busy here, so a newer leader can only be
+	// seen through a heartbeat on the transport's fast-path; on transports
+	// without one the snapshot is received in full.
+	term := r.getCurrentTerm()
+	leaderAddr, leaderID := r.LeaderWithID()
+	n, err := receiver.receive(&abortableReader{
+		r:          countingRPCReader,
+		shutdownCh: r.shutdownCh,
+		abortFn: func() error {
+			if r.getCurrentTerm() != term {
+				return ErrSnapshotInstallSuperseded
+			}
+			if addr, id := r.LeaderWithID(); addr != leaderAddr || id != leaderID {
+				return ErrSnapshotInstallSuperseded
+			}
+			return nil
+		},
+	})
 	transferMonitor.StopAndWait()
 	if err != nil {
 		sink.Cancel()
@@ -1781,6 +2487,10 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		return
 	}
 	r.logger.Info("copied to local snapshot", "bytes", n)
+	if conf.SnapshotReceiveBufferSize > 0 {
+		resp.ReceiveBytesPerSecond = receiver.rate()
+		metrics.SetGauge([]string{"raft", "snapshot", "receiveBytesPerSecond"}, float32(resp.ReceiveBytesPerSecond))
+	}
 
 	// Restore snapshot
 	future := &restoreFuture{ID: sink.ID()}
@@ -1800,12 +2510,12 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		return
 	}
 
-	// Update the lastApplied so we don't replay old logs
-	r.setLastApplied(req.LastLogIndex)
-
 	// Update the last stable snapshot info
 	r.setLastSnapshot(req.LastLogIndex, req.LastLogTerm)
 
+	// Update the lastApplied so we don't replay old logs
+	r.setLastApplied(req.LastLogIndex)
+
 	// Restore the peer set
 	r.setLatestConfiguration(reqConfiguration, reqConfigurationIndex)
 	r.setCommittedConfiguration(reqConfiguration, reqConfigurationIndex)
@@ -1835,6 +2545,55 @@ func (r *Raft) setLastContact() {
 type voteResult struct {
 	RequestVoteResponse
 	voterID ServerID
+	err     error
+}
+
+// electionVote summarizes the result for an ElectionObservation of an election
+// in the given term.
+func (v *voteResult) electionVote(term uint64) ElectionVote {
+	return newElectionVote(v.Granted, v.err, v.Term > term, v.Reason)
+}
+
+type preVoteResult struct {
+	RequestPreVoteResponse
+	voterID ServerID
+	err     error
+}
+
+// electionVote summarizes the result for an ElectionObservation of a pre-vote
+// for the given term.
+func (v *preVoteResult) electionVote(term uint64) ElectionVote {
+	return newElectionVote(v.Granted, v.err, v.Term > term, v.Reason)
+}
+
+func newElectionVote(granted bool, err error, newerTerm bool, reason VoteDenialReason) ElectionVote {
+	switch {
+	case granted:
+		return ElectionVote{Granted: true}
+	case err != nil:
+		return ElectionVote{Reason: fmt.Sprintf("rpc error: %v", err)}
+	case newerTerm:
+		return ElectionVote{Reason: "newer term"}
+	case reason != VoteDenialUnspecified:
+		return ElectionVote{Reason: reason.String()}
+	}
+	return ElectionVote{Reason: "denied"}
+}
+
+// observeElection sends an ElectionObservation for an election that has
+// finished, filling in any voters that didn't respond.
+func (r *Raft) observeElection(term uint64, result ElectionResult, votesNeeded int, votes map[ServerID]ElectionVote) {
+	for _, server := range votingServers(r.configurations.latest) {
+		if _, ok := votes[server.ID]; !ok {
+			votes[server.ID] = ElectionVote{Reason: "no response"}
+		}
+	}
+	r.observe(ElectionObservation{
+		Term:        term,
+		Result:      result,
+		VotesNeeded: votesNeeded,
+		Votes:       votes,
+	})
 }
 
 // electSelf is used to send a RequestVote RPC to all peers, and vote for
@@ -1843,7 +2602,8 @@ type voteResult struct {
 // vote for ourself). This must only be called from the main thread.
 func (r *Raft) electSelf() <-chan *voteResult {
 	// Create a response channel
-	respCh := make(chan *voteResult, len(r.configurations.latest.Servers))
+	voters := votingServers(r.configurations.latest)
+	respCh := make(chan *voteResult, len(voters))
 
 	// Increment the term
 	r.setCurrentTerm(r.getCurrentTerm() + 1)
@@ -1865,7 +2625,10 @@ func (r *Raft) electSelf() <-chan *voteResult {
 		r.goFunc(func() {
 			defer metrics.MeasureSince([]string{"raft", "candidate", "electSelf"}, time.Now())
 			resp := &voteResult{voterID: peer.ID}
-			err := r.trans.RequestVote(peer.ID, peer.Address, req, &resp.RequestVoteResponse)
+			err := r.peerBlocked(peer.Address)
+			if err == nil {
+				err = r.trans.RequestVote(peer.ID, peer.Address, req, &resp.RequestVoteResponse)
+			}
 			if err != nil {
 				r.logger.Error("failed to make requestVote RPC",
 					"target", peer,
@@ -1873,58 +2636,232 @@ func (r *Raft) electSelf() <-chan *voteResult {
 					"term", req.Term)
 				resp.Term = req.Term
 				resp.Granted = false
+				resp.err = err
 			}
 			respCh <- resp
 		})
 	}
 
 	// For each peer, request a vote
-	for _, server := range r.configurations.latest.Servers {
-		if server.Suffrage == Voter {
-			if server.ID == r.localID {
-				r.logger.Debug("voting for self", "term", req.Term, "id", r.localID)
-				// Persist a vote for ourselves
-				if err := r.persistVote(req.Term, req.RPCHeader.Addr); err != nil {
-					r.logger.Error("failed to persist vote", "error", err)
-					return nil
-				}
-				// Include our own vote
-				respCh <- &voteResult{
-					RequestVoteResponse: RequestVoteResponse{
-						RPCHeader: r.getRPCHeader(),
-						Term:      req.Term,
-						Granted:   true,
-					},
-					voterID: r.localID,
-				}
-			} else {
-				r.logger.Debug("asking for vote", "term", req.Term, "from", server.ID, "address", server.Address)
-				askPeer(server)
+	for _, server := range voters {
+		if server.ID == r.localID {
+			r.logger.Debug("voting for self", "term", req.Term, "id", r.localID)
+			// Persist a vote for ourselves
+			if err := r.persistVote(req.Term, req.RPCHeader.Addr, r.localID); err != nil {
+				r.logger.Error("failed to persist vote", "error", err)
+				return nil
+			}
+			// Include our own vote
+			respCh <- &voteResult{
+				RequestVoteResponse: RequestVoteResponse{
+					RPCHeader: r.getRPCHeader(),
+					Term:      req.Term,
+					Granted:   true,
+				},
+				voterID: r.localID,
 			}
+		} else {
+			r.logger.Debug("asking for vote", "term", req.Term, "from", server.ID, "address", server.Address)
+			askPeer(server)
 		}
 	}
 
 	return respCh
 }
 
-// persistVote is used to persist our vote for safety.
-func (r *Raft) persistVote(term uint64, candidate []byte) error {
+// preVoteEnabled returns true if candidates should run a pre-vote before
+// starting an election.
+func (r *Raft) preVoteEnabled() bool {
+	_, ok := r.trans.(WithPreVote)
+	return ok && r.config().PreVote
+}
+
+// preElectSelf is used to send a RequestPreVote RPC to all peers, and grant
+// ourself a pre-vote, for an election in the given term. Unlike electSelf this
+// doesn't change the current term or persist a vote. This must only be called
+// from the main thread.
+func (r *Raft) preElectSelf(term uint64) <-chan *preVoteResult {
+	pt := r.trans.(WithPreVote)
+
+	// Create a response channel
+	voters := votingServers(r.configurations.latest)
+	respCh := make(chan *preVoteResult, len(voters))
+
+	// Construct the request
+	lastIdx, lastTerm := r.getLastEntry()
+	req := &RequestPreVoteRequest{
+		RPCHeader:    r.getRPCHeader(),
+		Term:         term,
+		LastLogIndex: lastIdx,
+		LastLogTerm:  lastTerm,
+	}
+
+	// Construct a function to ask for a pre-vote
+	askPeer := func(peer Server) {
+		r.goFunc(func() {
+			defer metrics.MeasureSince([]string{"raft", "candidate", "preElectSelf"}, time.Now())
+			resp := &preVoteResult{voterID: peer.ID}
+			err := r.peerBlocked(peer.Address)
+			if err == nil {
+				err = pt.RequestPreVote(peer.ID, peer.Address, req, &resp.RequestPreVoteResponse)
+			}
+			if err != nil {
+				r.logger.Error("failed to make requestPreVote RPC",
+					"target", peer,
+					"error", err,
+					"term", req.Term)
+				resp.Term = req.Term
+				resp.Granted = false
+				resp.err = err
+			}
+			respCh <- resp
+		})
+	}
+
+	// For each peer, request a pre-vote
+	for _, server := range voters {
+		if server.ID == r.localID {
+			// Include our own pre-vote
+			respCh <- &preVoteResult{
+				RequestPreVoteResponse: RequestPreVoteResponse{
+					RPCHeader: r.getRPCHeader(),
+					Term:      req.Term,
+					Granted:   true,
+				},
+				voterID: r.localID,
+			}
+		} else {
+			r.logger.Debug("asking for pre-vote", "term", req.Term, "from", server.ID, "address", server.Address)
+			askPeer(server)
+		}
+	}
+
+	return respCh
+}
+
+// persistVote is used to persist our vote for safety. The term and candidate
+// bytes are kept under their original keys so older versions can still read
+// them, and a VoteRecord is written alongside for diagnostics.
+func (r *Raft) persistVote(term uint64, candidate []byte, candidateID ServerID) error {
 	if err := r.stable.SetUint64(keyLastVoteTerm, term); err != nil {
 		return err
 	}
 	if err := r.stable.Set(keyLastVoteCand, candidate); err != nil {
 		return err
 	}
-	return nil
+	record := VoteRecord{
+		Term:             term,
+		CandidateID:      candidateID,
+		CandidateAddress: r.trans.DecodePeer(candidate),
+		Time:             time.Now(),
+	}
+	buf, err := encodeMsgPack(record)
+	if err != nil {
+		return err
+	}
+	return r.stable.Set(keyLastVote, buf.Bytes())
+}
+
+// sameVoteCandidate returns true if the candidate we already voted for in this
+// term is the one making the request. When both the stored vote and the request
+// carry a server ID it is used, so that a candidate that has changed address
+// is still recognized; otherwise the encoded addresses are compared.
+func (r *Raft) sameVoteCandidate(req *RequestVoteRequest, lastVoteCandBytes, candidateBytes []byte) bool {
+	if len(req.ID) > 0 {
+		if record, err := r.lastVote(); err == nil && record.Term == req.Term && record.CandidateID != "" {
+			return record.CandidateID == ServerID(req.ID)
+		}
+	}
+	return bytes.Equal(lastVoteCandBytes, candidateBytes)
+}
+
+// lastVote returns the vote last persisted by persistVote. For votes written
+// by older versions only the term and candidate address are filled in.
+func (r *Raft) lastVote() (VoteRecord, error) {
+	var record VoteRecord
+	buf, err := r.stable.Get(keyLastVote)
+	if err != nil && !isKeyNotFound(err) {
+		return record, err
+	}
+	if len(buf) > 0 {
+		err := decodeMsgPack(buf, &record)
+		return record, err
+	}
+
+	// Fall back to the legacy keys
+	term, err := r.stable.GetUint64(keyLastVoteTerm)
+	if err != nil && !isKeyNotFound(err) {
+		return record, err
+	}
+	candidate, err := r.stable.Get(keyLastVoteCand)
+	if err != nil && !isKeyNotFound(err) {
+		return record, err
+	}
+	record.Term = term
+	if len(candidate) > 0 {
+		record.CandidateAddress = r.trans.DecodePeer(candidate)
+	}
+	return record, nil
 }
 
 // setCurrentTerm is used to set the current term in a durable manner.
+// Terms only move forward. The heartbeat fast-path can set the term from the
+// transport's goroutine while the main thread does too, so a term that's
+// already been reached or passed is left as it is rather than persisted
+// again. If the StableStore implements CompareAndSetStableStore, a stored
+// term behind the one we know about means the store lost a write, and is
+// treated as a fatal error.
 func (r *Raft) setCurrentTerm(t uint64) {
-	// Persist to disk first
-	if err := r.stable.SetUint64(keyCurrentTerm, t); err != nil {
-		panic(fmt.Errorf("failed to save current term: %v", err))
+	current := r.getCurrentTerm()
+	cas, ok := r.stable.(CompareAndSetStableStore)
+	if !ok {
+		// Without compare-and-set, concurrent writes could leave the lower
+		// term stored, so take turns.
+		r.termLock.Lock()
+		defer r.termLock.Unlock()
+		current = r.getCurrentTerm()
+		if t <= current {
+			return
+		}
+		if err := r.stable.SetUint64(keyCurrentTerm, t); err != nil {
+			panic(fmt.Errorf("failed to save current term: %v", err))
+		}
+	} else {
+		// Persist to disk first. What's stored is never behind the current
+		// term, so start from that and retry if another caller got there
+		// first.
+		stored := current
+		for stored < t {
+			swapped, err := cas.CompareAndSetUint64(keyCurrentTerm, stored, t)
+			if err != nil {
+				panic(fmt.Errorf("failed to save current term: %v", err))
+			}
+			if swapped {
+				break
+			}
+			stored, err = r.stable.GetUint64(keyCurrentTerm)
+			if err != nil {
+				panic(fmt.Errorf("failed to load current term: %v", err))
+			}
+			if stored < current {
+				r.fatal(fmt.Errorf("%w: stored term %d, current term %d", ErrTermRegression, stored, current))
+				return
+			}
+		}
+		if stored >= t {
+			// Someone else saved this term or a later one, but may not
+			// have set it in memory yet.
+			r.raftState.raiseCurrentTerm(t)
+			return
+		}
+	}
+	r.raftState.raiseCurrentTerm(t)
+
+	// Count jumps of more than one term, which elections alone don't cause
+	if t > current+1 {
+		metrics.IncrCounter([]string{"raft", "termJump"}, 1)
+		metrics.AddSample([]string{"raft", "termJump", "size"}, float32(t-current))
 	}
-	r.raftState.setCurrentTerm(t)
 }
 
 // setState is used to update the current state. Any state
@@ -1939,13 +2876,14 @@ func (r *Raft) setState(state RaftState) {
 	}
 }
 
-// pickServer returns the follower that is most up to date and participating in quorum.
+// pickServer returns the follower that is most up to date and participating in quorum,
+// other than those blocked by BlockPeer.
 // Because it accesses leaderstate, it should only be called from the leaderloop.
 func (r *Raft) pickServer() *Server {
 	var pick *Server
 	var current uint64
 	for _, server := range r.configurations.latest.Servers {
-		if server.ID == r.localID || server.Suffrage != Voter {
+		if server.ID == r.localID || server.Suffrage != Voter || r.peerBlocked(server.Address) != nil {
 			continue
 		}
 		state, ok := r.leaderState.replState[server.ID]
@@ -1968,6 +2906,12 @@ func (r *Raft) pickServer() *Server {
 func (r *Raft) initiateLeadershipTransfer(id *ServerID, address *ServerAddress) LeadershipTransferFuture {
 	future := &leadershipTransferFuture{ID: id, Address: address}
 	future.init()
+	event := AuditEvent{Operation: "LeadershipTransfer"}
+	if id != nil {
+		event.Target, event.TargetAddress = *id, *address
+	}
+	audit := r.newAuditor(event)
+	audit.watch(&future.deferError, nil)
 
 	if id != nil && *id == r.localID {
 		err := fmt.Errorf("cannot transfer leadership to itself")
@@ -1980,43 +2924,105 @@ func (r *Raft) initiateLeadershipTransfer(id *ServerID, address *ServerAddress)
 	case r.leadershipTransferCh <- future:
 		return future
 	case <-r.shutdownCh:
+		audit.record(ErrRaftShutdown, 0)
 		return errorFuture{ErrRaftShutdown}
 	default:
+		audit.record(ErrEnqueueTimeout, 0)
 		return errorFuture{ErrEnqueueTimeout}
 	}
 }
 
 // timeoutNow is what happens when a server receives a TimeoutNowRequest.
 func (r *Raft) timeoutNow(rpc RPC, req *TimeoutNowRequest) {
+	if !hasVote(r.configurations.latest, r.localID) {
+		rpc.Respond(nil, ErrNotVoter)
+		return
+	}
+	if !r.canBecomeLeader() {
+		r.logger.Warn("refusing leadership transfer, not eligible to become leader")
+		rpc.Respond(nil, ErrNotEligible)
+		return
+	}
 	r.setLeader("", "")
 	r.setState(Candidate)
+	r.leadershipTransferTerm.Store(r.getCurrentTerm())
 	r.candidateFromLeadershipTransfer.Store(true)
 	rpc.Respond(&TimeoutNowResponse{}, nil)
 }
 
+// canBecomeLeader returns false if Config.CanBecomeLeader says this server
+// mustn't start an election.
+func (r *Raft) canBecomeLeader() bool {
+	canLead := r.config().CanBecomeLeader
+	return canLead == nil || canLead()
+}
+
+// awaitingTransferElection returns true if this server was told to start an
+// election by a leadership transfer but hasn't moved past the given term yet.
+// Heartbeats are handled off the main thread, so the leader handing over may
+// still be heard from in this window.
+func (r *Raft) awaitingTransferElection(term uint64) bool {
+	return r.candidateFromLeadershipTransfer.Load() && term == r.leadershipTransferTerm.Load()
+}
+
+// indexedConfiguration is a copy of a configuration along with the index of
+// the log entry it came from, stored so it can be read off the main loop.
+type indexedConfiguration struct {
+	configuration Configuration
+	index         uint64
+}
+
 // setLatestConfiguration stores the latest configuration and updates a copy of it.
 func (r *Raft) setLatestConfiguration(c Configuration, i uint64) {
 	r.configurations.latest = c
 	r.configurations.latestIndex = i
-	r.latestConfiguration.Store(c.Clone())
+	r.latestConfiguration.Store(indexedConfiguration{c.Clone(), i})
+	if r.checkInvariants {
+		r.checkConfigurationInvariants()
+	}
 }
 
-// setCommittedConfiguration stores the committed configuration.
+// setCommittedConfiguration stores the committed configuration and updates a
+// copy of it.
 func (r *Raft) setCommittedConfiguration(c Configuration, i uint64) {
 	r.configurations.committed = c
 	r.configurations.committedIndex = i
+	r.committedConfiguration.Store(indexedConfiguration{c.Clone(), i})
+	r.applyClusterParameters(c.Parameters)
+	if r.checkInvariants {
+		r.checkConfigurationInvariants()
+	}
 }
 
 // getLatestConfiguration reads the configuration from a copy of the main
 // configuration, which means it can be accessed independently from the main
 // loop.
 func (r *Raft) getLatestConfiguration() Configuration {
+	c, _ := r.getLatestConfigurationWithIndex()
+	return c
+}
+
+// getLatestConfigurationWithIndex is like getLatestConfiguration but also
+// returns the index of the latest configuration.
+func (r *Raft) getLatestConfigurationWithIndex() (Configuration, uint64) {
 	// this switch catches the case where this is called without having set
 	// a configuration previously.
 	switch c := r.latestConfiguration.Load().(type) {
-	case Configuration:
-		return c
+	case indexedConfiguration:
+		return c.configuration, c.index
+	default:
+		return Configuration{}, 0
+	}
+}
+
+// getCommittedConfigurationWithIndex reads the committed configuration and
+// its index from a copy, which means it can be accessed independently from
+// the main loop.
+func (r *Raft) getCommittedConfigurationWithIndex() (Configuration, uint64) {
+	switch c := r.committedConfiguration.Load().(type) {
+	case indexedConfiguration:
+		return c.configuration, c.index
 	default:
-		return Configuration{}
+		return Configuration{}, 0
 	}
 }
@@ -5,12 +5,15 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,6 +65,64 @@ func TestRaft_AfterShutdown(t *testing.T) {
 	}
 }
 
+func TestRaft_ShutdownGracefully(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	// A follower finishes applying what's been committed.
+	follower := c.Followers()[0]
+	c.Disconnect(follower.localAddr)
+	require.NoError(t, follower.ShutdownGracefully(time.Second).Error())
+
+	// The leader finishes the commands already submitted, and refuses new
+	// ones.
+	var futures []ApplyFuture
+	for i := 0; i < 100; i++ {
+		futures = append(futures, leader.Apply([]byte("test"), 0))
+	}
+	shutdown := leader.ShutdownGracefully(5 * time.Second)
+	require.ErrorIs(t, leader.Apply([]byte("late"), 0).Error(), ErrRaftShutdown)
+	require.NoError(t, shutdown.Error())
+	for _, future := range futures {
+		require.NoError(t, future.Error())
+	}
+	require.Len(t, getMockFSM(c.fsms[c.IndexOf(leader)]).Logs(), 100)
+}
+
+func TestRaft_ShutdownGracefully_Concurrent(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Commands submitted while draining starts are either refused straight
+	// away or finished, never accepted and then abandoned.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var accepted []ApplyFuture
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				future := leader.Apply([]byte("test"), 0)
+				if _, ok := future.(errorFuture); ok {
+					return
+				}
+				lock.Lock()
+				accepted = append(accepted, future)
+				lock.Unlock()
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, leader.ShutdownGracefully(5*time.Second).Error())
+	wg.Wait()
+	for _, future := range accepted {
+		require.NoError(t, future.Error())
+	}
+}
+
 func TestRaft_LiveBootstrap(t *testing.T) {
 	// Make the cluster.
 	c := MakeClusterNoBootstrap(3, t, nil)
@@ -499,6 +560,63 @@ func TestRaft_ApplyNonLeader(t *testing.T) {
 	}
 }
 
+func TestRaft_ApplyCtx(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	require.NoError(t, leader.ApplyCtx(context.Background(), []byte("test")).Error())
+
+	// A command whose context is already done isn't appended.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	last := leader.LastIndex()
+	require.ErrorIs(t, leader.ApplyCtx(ctx, []byte("test")).Error(), context.Canceled)
+	require.Equal(t, last, leader.LastIndex())
+
+	// Cancelling a command that can't commit completes its future. It's
+	// cancelled straight away, before the leader steps down for lack of
+	// contact with the followers.
+	for _, f := range c.Followers() {
+		c.Disconnect(f.localAddr)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	future := leader.ApplyCtx(ctx, []byte("test"))
+	cancel()
+	require.ErrorIs(t, future.Error(), context.Canceled)
+}
+
+func TestRaft_ApplyCtx_Appended(t *testing.T) {
+	fsm := &blockingFSM{MockFSM: &MockFSM{}, unblock: make(chan struct{})}
+	c := MakeClusterCustom(t, &MakeClusterOpts{
+		Peers:     1,
+		Bootstrap: true,
+		Conf:      inmemConfig(t),
+		MakeFSMFunc: func() FSM {
+			return fsm
+		},
+	})
+	defer c.Close()
+	leader := c.Leader()
+
+	// With the FSM stuck on an earlier command, the command is appended and
+	// committed but can't be applied.
+	last := leader.LastIndex()
+	first := leader.Apply([]byte("first"), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	future := leader.ApplyCtx(ctx, []byte("test"))
+	retry(t, func() bool { return leader.getCommitIndex() == last+2 })
+
+	// Cancelling it completes the future without waiting for the FSM.
+	cancel()
+	require.ErrorIs(t, future.Error(), context.Canceled)
+
+	// The command is still applied once the FSM gets to it.
+	close(fsm.unblock)
+	require.NoError(t, first.Error())
+	retry(t, func() bool { return countCommand(fsm.MockFSM, []byte("test")) == 1 })
+}
+
 func TestRaft_ApplyConcurrent(t *testing.T) {
 	// Make the cluster
 	conf := inmemConfig(t)
@@ -618,6 +736,90 @@ func TestRaft_JoinNode(t *testing.T) {
 	c.EnsureSamePeers(t)
 }
 
+func TestRaft_JoinNode_StagingPromotion(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.StagingPromotionThreshold = 5
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error())
+	}
+
+	// Join a new node that can't be reached yet, it should be added as
+	// Staging so the leader can keep committing on its own.
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	joined := c1.rafts[0]
+	require.NoError(t, leader.AddVoter(joined.localID, joined.localAddr, 0, 0).Error())
+
+	suffrage := func() ServerSuffrage {
+		future := leader.GetConfiguration()
+		require.NoError(t, future.Error())
+		for _, server := range future.Configuration().Servers {
+			if server.ID == joined.localID {
+				return server.Suffrage
+			}
+		}
+		t.Fatalf("server %v missing from configuration", joined.localID)
+		return Nonvoter
+	}
+	require.Equal(t, Staging, suffrage())
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	time.Sleep(c.propagateTimeout)
+	require.Equal(t, Staging, suffrage())
+
+	// Once it's reachable it catches up and gets promoted.
+	c.FullyConnect()
+	require.Eventually(t, func() bool {
+		return suffrage() == Voter
+	}, 10*c.propagateTimeout, 10*time.Millisecond)
+	c.EnsureSame(t)
+}
+
+func TestRaft_ChangeConfiguration(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+
+	// Swap both followers for two new servers in a single change.
+	removed := c.Followers()
+	c1 := MakeClusterNoBootstrap(2, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+	servers := []Server{{Suffrage: Voter, ID: leader.localID, Address: leader.localAddr}}
+	for _, r := range c1.rafts {
+		servers = append(servers, Server{Suffrage: Voter, ID: r.localID, Address: r.localAddr})
+	}
+	var err error
+	retry(t, func() bool {
+		err = leader.ChangeConfiguration(servers, 0, 0).Error()
+		return err != ErrJointConsensusUnsupported
+	})
+	require.NoError(t, err)
+
+	// The leader leaves the joint configuration on its own.
+	require.Eventually(t, func() bool {
+		future := leader.GetConfiguration()
+		require.NoError(t, future.Error())
+		configuration := future.Configuration()
+		return !configuration.isJoint() && reflect.DeepEqual(configuration.Servers, servers)
+	}, c.propagateTimeout*10, 10*time.Millisecond)
+
+	// The new servers can carry on without the old ones.
+	for _, r := range removed {
+		c.Disconnect(r.localAddr)
+	}
+	future := leader.Apply([]byte("test2"), c.propagateTimeout)
+	require.NoError(t, future.Error())
+	for _, r := range c1.rafts {
+		require.Eventually(t, func() bool {
+			return r.AppliedIndex() >= future.Index()
+		}, c.propagateTimeout*10, 10*time.Millisecond)
+	}
+}
+
 func TestRaft_JoinNode_ConfigStore(t *testing.T) {
 	// Make a cluster
 	conf := inmemConfig(t)
@@ -838,6 +1040,48 @@ func TestRaft_RemoveLeader_NoShutdown(t *testing.T) {
 	c.EnsureSame(t)
 }
 
+func TestRaft_AddWitness(t *testing.T) {
+	c := MakeCluster(2, t, nil)
+	defer c.Close()
+
+	c1 := MakeClusterNoBootstrap(1, t, nil)
+	c.Merge(c1)
+	c.FullyConnect()
+
+	leader := c.Leader()
+	witness := c1.rafts[0]
+	future := leader.AddWitness(witness.localID, witness.localAddr, 0, 0)
+	require.NoError(t, future.Error())
+
+	applyFuture := leader.Apply([]byte("test"), c.conf.CommitTimeout)
+	require.NoError(t, applyFuture.Error())
+	require.NoError(t, leader.Barrier(c.conf.CommitTimeout).Error())
+
+	// Wait for the witness to catch up on the log.
+	limit := time.Now().Add(c.longstopTimeout)
+	for time.Now().Before(limit) && witness.getLastIndex() < leader.getLastIndex() {
+		time.Sleep(c.propagateTimeout)
+	}
+	require.Equal(t, leader.getLastIndex(), witness.getLastIndex())
+
+	// The witness should know its own suffrage and should only have the
+	// headers of command entries.
+	configuration := c.getConfiguration(witness)
+	require.True(t, isWitness(configuration, witness.localID))
+	var log Log
+	require.NoError(t, witness.logs.GetLog(applyFuture.Index(), &log))
+	require.Equal(t, LogCommand, log.Type)
+	require.Nil(t, log.Data)
+
+	// Nothing should have been applied to the witness's FSM.
+	require.Empty(t, getMockFSM(c1.fsms[0]).logs)
+	require.Equal(t, Follower, witness.getState())
+
+	// A witness must be removed before it can become a voter.
+	future = leader.AddVoter(witness.localID, witness.localAddr, 0, 0)
+	require.Error(t, future.Error())
+}
+
 func TestRaft_RemoveFollower_SplitCluster(t *testing.T) {
 	// Make a cluster.
 	conf := inmemConfig(t)
@@ -1637,6 +1881,53 @@ func TestRaft_SendSnapshotFollower(t *testing.T) {
 	c.EnsureSame(t)
 }
 
+func TestRaft_SendSnapshotFollower_CatchupGap(t *testing.T) {
+	// Make the cluster, keeping enough trailing logs that the behind follower
+	// could be caught up from the log alone.
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 1000
+	conf.SnapshotCatchupGap = 50
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Disconnect one follower
+	followers := c.Followers()
+	leader := c.Leader()
+	behind := followers[0]
+	c.Disconnect(behind.localAddr)
+
+	decisionCh := make(chan Observation, 10)
+	leader.RegisterObserver(NewObserver(decisionCh, false, func(o *Observation) bool {
+		_, ok := o.Data.(SnapshotDecisionObservation)
+		return ok
+	}))
+
+	// Commit a lot of things
+	var future Future
+	for i := 0; i < 100; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	require.NoError(t, future.Error())
+
+	// Snapshot on the leader, the logs will be retained.
+	require.NoError(t, leader.Snapshot().Error())
+
+	// Reconnect the behind node
+	c.FullyConnect()
+
+	select {
+	case o := <-decisionCh:
+		decision := o.Data.(SnapshotDecisionObservation)
+		require.Equal(t, SnapshotCatchupGap, decision.Reason)
+		require.Equal(t, behind.localID, decision.Peer.ID)
+	case <-time.After(c.longstopTimeout):
+		t.Fatalf("timed out waiting for snapshot decision")
+	}
+
+	// Ensure all the logs are the same
+	c.EnsureSame(t)
+}
+
 func TestRaft_SendSnapshotAndLogsFollower(t *testing.T) {
 	// Make the cluster
 	conf := inmemConfig(t)
@@ -1863,6 +2154,31 @@ func TestRaft_Barrier(t *testing.T) {
 	}
 }
 
+func TestRaft_BarrierAtTerm(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	_, _, term := leader.LeaderWithTerm()
+	require.NoError(t, leader.BarrierAtTerm(term, 0).Error())
+
+	// Hand leadership away and back again, so the leader is the same but the
+	// term isn't.
+	other := c.Followers()[0]
+	require.NoError(t, leader.LeadershipTransferToServer(other.localID, other.localAddr).Error())
+	require.Eventually(t, func() bool { return other.State() == Leader }, c.longstopTimeout, 10*time.Millisecond)
+	require.NoError(t, other.LeadershipTransferToServer(leader.localID, leader.localAddr).Error())
+	require.Eventually(t, func() bool { return leader.State() == Leader }, c.longstopTimeout, 10*time.Millisecond)
+
+	require.ErrorIs(t, leader.BarrierAtTerm(term, 0).Error(), ErrLeadershipChanged)
+	_, _, newTerm := leader.LeaderWithTerm()
+	require.Greater(t, newTerm, term)
+	require.NoError(t, leader.BarrierAtTerm(newTerm, 0).Error())
+
+	// Followers aren't the leader for any term.
+	require.ErrorIs(t, other.BarrierAtTerm(newTerm, 0).Error(), ErrNotLeader)
+}
+
 func TestRaft_VerifyLeader(t *testing.T) {
 	// Make the cluster
 	c := MakeCluster(3, t, nil)
@@ -2003,7 +2319,10 @@ func TestRaft_NotifyCh(t *testing.T) {
 }
 
 func TestRaft_AppendEntry(t *testing.T) {
-	c := MakeCluster(3, t, nil)
+	// The test overwrites committed entries, which breaks the invariants.
+	conf := inmemConfig(t)
+	conf.CheckInvariants = false
+	c := MakeCluster(3, t, conf)
 	defer c.Close()
 	followers := c.Followers()
 	ldr := c.Leader()
@@ -2140,6 +2459,49 @@ func TestRaft_ProtocolVersion_RejectRPC(t *testing.T) {
 	}
 }
 
+func TestRaft_ProtocolVersion_SupportedRange(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	check := func(version ProtocolVersion) error {
+		return r.checkRPCHeader(RPC{Command: &AppendEntriesRequest{
+			RPCHeader: RPCHeader{ProtocolVersion: version},
+		}})
+	}
+
+	// By default one version back is accepted.
+	require.ErrorIs(t, check(ProtocolVersionMax-2), ErrUnsupportedProtocol)
+	require.NoError(t, check(ProtocolVersionMax-1))
+	require.NoError(t, check(ProtocolVersionMax))
+	require.ErrorIs(t, check(ProtocolVersionMax+1), ErrUnsupportedProtocol)
+
+	// Only the configured range is accepted.
+	newConf := r.config()
+	newConf.MinProtocolVersion = ProtocolVersionMax
+	r.conf.Store(newConf)
+	require.ErrorIs(t, check(ProtocolVersionMax-1), ErrUnsupportedProtocol)
+	require.NoError(t, check(ProtocolVersionMax))
+
+	newConf.MinProtocolVersion = ProtocolVersionMax - 2
+	r.conf.Store(newConf)
+	require.NoError(t, check(ProtocolVersionMax-2))
+
+	// The range must include the version we speak, and be one we understand.
+	conf = inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.MinProtocolVersion = ProtocolVersionMax
+	conf.ProtocolVersion = ProtocolVersionMax - 1
+	require.Error(t, ValidateConfig(conf))
+	conf.ProtocolVersion = ProtocolVersionMax
+	require.NoError(t, ValidateConfig(conf))
+	conf.MaxProtocolVersion = ProtocolVersionMax + 1
+	require.Error(t, ValidateConfig(conf))
+}
+
 func TestRaft_ProtocolVersion_Upgrade_1_2(t *testing.T) {
 	// Make a cluster back on protocol version 1.
 	conf := inmemConfig(t)
@@ -2321,6 +2683,55 @@ func TestRaft_LeadershipTransfer(t *testing.T) {
 	}
 }
 
+func TestRaft_PersistReplicationProgress(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.PersistReplicationProgress = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	var future Future
+	for i := 0; i < 10; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	require.NoError(t, future.Error())
+	c.WaitForReplication(10)
+	lastIndex := leader.getLastIndex()
+
+	// Stepping down saves the progress of each follower.
+	require.NoError(t, leader.LeadershipTransfer().Error())
+
+	buf, err := leader.stable.Get(keyReplicationProgress)
+	require.NoError(t, err)
+	var progress map[ServerID]uint64
+	require.NoError(t, decodeMsgPack(buf, &progress))
+	require.Len(t, progress, 2)
+	for _, r := range c.rafts {
+		if r == leader {
+			continue
+		}
+		require.Equal(t, lastIndex, progress[r.localID])
+	}
+
+	// The saved progress is used as hints next time we're leader.
+	hinted := &Raft{}
+	hinted.leaderState.progressHints = leader.loadReplicationProgress()
+	for id, idx := range progress {
+		require.Equal(t, idx+1, hinted.initialNextIndex(id, lastIndex+5))
+	}
+	require.Equal(t, lastIndex+6, hinted.initialNextIndex("unknown", lastIndex+5))
+
+	// Only what followers have acknowledged is saved, not what's been sent
+	// to them.
+	r := &Raft{stable: NewInmemStore()}
+	r.leaderState.replState = map[ServerID]*followerReplication{
+		"pipelined": {nextIndex: 10, matchIndex: 5},
+		"new":       {nextIndex: 3},
+	}
+	r.persistReplicationProgress()
+	require.Equal(t, map[ServerID]uint64{"pipelined": 5}, r.loadReplicationProgress())
+}
+
 func TestRaft_LeadershipTransferWithOneNode(t *testing.T) {
 	c := MakeCluster(1, t, nil)
 	defer c.Close()
@@ -2563,6 +2974,38 @@ func TestRaft_LeadershipTransferIgnoresNonvoters(t *testing.T) {
 	}
 }
 
+func TestRaft_CanBecomeLeader(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	followers := c.Followers()
+
+	eligible := make([]atomic.Bool, len(followers))
+	for i, f := range followers {
+		eligible := &eligible[i]
+		conf := f.config()
+		conf.CanBecomeLeader = eligible.Load
+		f.conf.Store(conf)
+	}
+
+	// An ineligible server refuses a leadership transfer.
+	future := leader.LeadershipTransferToServer(followers[0].localID, followers[0].localAddr)
+	require.ErrorContains(t, future.Error(), ErrNotEligible.Error())
+	require.Equal(t, leader.localID, c.Leader().localID)
+
+	// Without the leader, neither stands for election.
+	c.Disconnect(leader.localAddr)
+	time.Sleep(c.propagateTimeout)
+	for _, f := range followers {
+		require.Equal(t, Follower, f.State())
+	}
+
+	// Once one is eligible again it takes over.
+	eligible[1].Store(true)
+	retry(t, func() bool { return followers[1].State() == Leader })
+	require.Equal(t, Follower, followers[0].State())
+}
+
 func TestRaft_LeadershipTransferStopRightAway(t *testing.T) {
 	r := Raft{leaderState: leaderState{}, logger: hclog.New(nil)}
 	r.setupLeaderState()
@@ -2750,6 +3193,11 @@ func TestRaft_ReloadConfigValidates(t *testing.T) {
 
 	require.Error(t, raft.ReloadConfig(newCfg))
 
+	// A zero threshold would snapshot after every entry.
+	newCfg.SnapshotInterval = 120 * time.Second
+	newCfg.SnapshotThreshold = 0
+	require.Error(t, raft.ReloadConfig(newCfg))
+
 	// Now we should have same values
 	require.Equal(t, uint64(10240), raft.config().TrailingLogs)
 	require.Equal(t, 120*time.Second, raft.config().SnapshotInterval)
@@ -2806,6 +3254,56 @@ func TestRaft_InstallSnapshot_InvalidPeers(t *testing.T) {
 	require.Contains(t, resp.Error.Error(), "failed to decode peers")
 }
 
+func TestRaft_InstallSnapshot_NewLeaderAborts(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("follower")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	// The leader in term 2 starts streaming a snapshot.
+	data, stream := io.Pipe()
+	chResp := make(chan RPCResponse, 1)
+	go r.installSnapshot(RPC{Reader: data, RespChan: chResp}, &InstallSnapshotRequest{
+		RPCHeader:       RPCHeader{ID: []byte("first"), Addr: r.trans.EncodePeer("first", "first-addr")},
+		SnapshotVersion: 1,
+		Term:            2,
+		LastLogIndex:    10,
+		LastLogTerm:     2,
+		Size:            1 << 20,
+		Configuration: EncodeConfiguration(Configuration{Servers: []Server{
+			{Suffrage: Voter, ID: "first", Address: "first-addr"},
+			{Suffrage: Voter, ID: "second", Address: "second-addr"},
+			{Suffrage: Voter, ID: "follower", Address: r.localAddr},
+		}}),
+	})
+	_, err := stream.Write(make([]byte, 1024))
+	require.NoError(t, err)
+
+	// A heartbeat from a new leader in term 3 arrives on the fast-path part
+	// way through.
+	r.processHeartbeat(RPC{RespChan: make(chan RPCResponse, 1), Command: &AppendEntriesRequest{
+		RPCHeader: RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")},
+		Term:      3,
+	}})
+
+	// The follower stops receiving the snapshot and discards what it has.
+	_, err = stream.Write(make([]byte, 1024))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	select {
+	case resp := <-chResp:
+		require.ErrorIs(t, resp.Error, ErrSnapshotInstallSuperseded)
+		require.False(t, resp.Response.(*InstallSnapshotResponse).Success)
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshot install didn't finish")
+	}
+	snapshots, err := env.snapshot.List()
+	require.NoError(t, err)
+	require.Empty(t, snapshots)
+}
+
 func TestRaft_VoteNotGranted_WhenNodeNotInCluster(t *testing.T) {
 	// Make a cluster
 	c := MakeCluster(3, t, nil)
@@ -3180,3 +3678,848 @@ func TestRaft_runFollower_ReloadTimeoutConfigs(t *testing.T) {
 	// Check the follower loop set the right state
 	require.Equal(t, Candidate, env.raft.getState())
 }
+
+func TestRaft_releaseCommitTuples(t *testing.T) {
+	l := &Log{Index: 1, Type: LogCommand}
+	future := &logFuture{log: *l}
+	ct := newCommitTuple(l, future)
+	require.Same(t, l, ct.log)
+	require.Same(t, future, ct.future)
+
+	// Released tuples must not keep the log or future alive.
+	releaseCommitTuples([]*commitTuple{ct})
+	require.Nil(t, ct.log)
+	require.Nil(t, ct.future)
+}
+
+func TestRaft_processLogs_FatalErrorPolicy(t *testing.T) {
+	t.Run("panic", func(t *testing.T) {
+		conf := inmemConfig(t)
+		conf.LocalID = ServerID("first")
+		conf.skipStartup = true
+		env := MakeRaft(t, conf, false)
+		defer env.Release()
+
+		// Nothing has been written to the log store so getting the log fails.
+		require.Panics(t, func() { env.raft.processLogs(1, nil) })
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		faultCh := make(chan error, 1)
+		conf := inmemConfig(t)
+		conf.LocalID = ServerID("first")
+		conf.skipStartup = true
+		conf.FatalErrorPolicy = FatalErrorShutdown
+		conf.FaultCh = faultCh
+		env := MakeRaft(t, conf, false)
+		defer env.Release()
+
+		require.NotPanics(t, func() { env.raft.processLogs(1, nil) })
+		require.Equal(t, Shutdown, env.raft.getState())
+		require.Equal(t, uint64(0), env.raft.getLastApplied())
+		select {
+		case err := <-faultCh:
+			require.ErrorIs(t, err, ErrLogNotFound)
+		default:
+			t.Fatalf("expected fault to be reported")
+		}
+	})
+}
+
+func TestRaft_setCurrentTerm_Regression(t *testing.T) {
+	faultCh := make(chan error, 1)
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	conf.FatalErrorPolicy = FatalErrorShutdown
+	conf.FaultCh = faultCh
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+
+	env.raft.setCurrentTerm(5)
+	stored, err := env.store.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), stored)
+
+	// A lower term than we have is left alone.
+	env.raft.setCurrentTerm(4)
+	require.Equal(t, uint64(5), env.raft.getCurrentTerm())
+
+	// A later term already stored, as another caller would leave it, is
+	// taken as saved.
+	require.NoError(t, env.store.SetUint64(keyCurrentTerm, 10))
+	env.raft.setCurrentTerm(7)
+	require.Equal(t, uint64(7), env.raft.getCurrentTerm())
+	stored, err = env.store.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), stored)
+	require.Empty(t, faultCh)
+
+	// Simulate the store losing the terms we saved.
+	require.NoError(t, env.store.SetUint64(keyCurrentTerm, 3))
+	env.raft.setCurrentTerm(8)
+	require.Equal(t, uint64(7), env.raft.getCurrentTerm())
+	require.Equal(t, Shutdown, env.raft.getState())
+	select {
+	case err := <-faultCh:
+		require.ErrorIs(t, err, ErrTermRegression)
+	default:
+		t.Fatalf("expected fault to be reported")
+	}
+	stored, err = env.store.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stored)
+}
+
+func TestRaft_setCurrentTerm_Concurrent(t *testing.T) {
+	for name, wrap := range map[string]func(*InmemStore) StableStore{
+		"compare and set": func(s *InmemStore) StableStore { return s },
+		"plain":           func(s *InmemStore) StableStore { return struct{ StableStore }{s} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			faultCh := make(chan error, 1)
+			conf := inmemConfig(t)
+			conf.LocalID = ServerID("first")
+			conf.skipStartup = true
+			conf.FatalErrorPolicy = FatalErrorShutdown
+			conf.FaultCh = faultCh
+			env := MakeRaft(t, conf, false)
+			defer env.Release()
+			env.raft.stable = wrap(env.store)
+
+			// Every goroutine moves through the same terms, so they keep
+			// racing each other to save each one.
+			const terms = 1000
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for term := uint64(1); term <= terms; term++ {
+						env.raft.setCurrentTerm(term)
+						if current := env.raft.getCurrentTerm(); current < term {
+							t.Errorf("current term %d is behind term %d just set", current, term)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			require.Empty(t, faultCh)
+			require.NotEqual(t, Shutdown, env.raft.getState())
+			require.Equal(t, uint64(terms), env.raft.getCurrentTerm())
+			stored, err := env.store.GetUint64(keyCurrentTerm)
+			require.NoError(t, err)
+			require.Equal(t, uint64(terms), stored)
+		})
+	}
+}
+
+// notFoundStableStore is a StableStore that returns "not found" for keys that
+// haven't been set, as raft-boltdb does.
+type notFoundStableStore struct {
+	*InmemStore
+}
+
+func (s notFoundStableStore) GetUint64(key []byte) (uint64, error) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	val, ok := s.kvInt[string(key)]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	return val, nil
+}
+
+func TestRaft_setCurrentTerm_NotFound(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+
+	env.raft.stable = notFoundStableStore{env.store}
+	env.raft.setCurrentTerm(1)
+	require.Equal(t, uint64(1), env.raft.getCurrentTerm())
+	stored, err := env.store.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stored)
+}
+
+func TestRaft_LastVote(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	vote, err := leader.LastVote()
+	require.NoError(t, err)
+	require.Equal(t, leader.getCurrentTerm(), vote.Term)
+	require.Equal(t, leader.localID, vote.CandidateID)
+	require.Equal(t, leader.localAddr, vote.CandidateAddress)
+	require.False(t, vote.Time.IsZero())
+}
+
+func TestRaft_LastVote_Legacy(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+
+	vote, err := env.raft.LastVote()
+	require.NoError(t, err)
+	require.Equal(t, VoteRecord{}, vote)
+
+	// Votes persisted by older versions only have the term and address.
+	require.NoError(t, env.store.SetUint64(keyLastVoteTerm, 3))
+	require.NoError(t, env.store.Set(keyLastVoteCand, env.raft.trans.EncodePeer("other", "127.0.0.1:1234")))
+	vote, err = env.raft.LastVote()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), vote.Term)
+	require.Equal(t, ServerAddress("127.0.0.1:1234"), vote.CandidateAddress)
+	require.Empty(t, vote.CandidateID)
+}
+
+func TestRaft_ElectionObservation(t *testing.T) {
+	c := MakeClusterNoBootstrap(3, t, nil)
+	defer c.Close()
+
+	electionCh := make(chan Observation, 32)
+	configuration := Configuration{}
+	for _, r := range c.rafts {
+		r.RegisterObserver(NewObserver(electionCh, false, func(o *Observation) bool {
+			_, ok := o.Data.(ElectionObservation)
+			return ok
+		}))
+		configuration.Servers = append(configuration.Servers, Server{
+			ID:      r.localID,
+			Address: r.localAddr,
+		})
+	}
+	require.NoError(t, c.rafts[0].BootstrapCluster(configuration).Error())
+	leader := c.Leader()
+
+	timeout := time.After(c.longstopTimeout)
+	for {
+		select {
+		case o := <-electionCh:
+			election := o.Data.(ElectionObservation)
+			if o.Raft != leader || election.Result != ElectionWon {
+				continue
+			}
+			require.Equal(t, leader.getCurrentTerm(), election.Term)
+			require.Equal(t, 2, election.VotesNeeded)
+			require.Len(t, election.Votes, 3)
+			require.True(t, election.Votes[leader.localID].Granted)
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for election observation")
+		}
+	}
+}
+
+func TestRaft_appendEntries_CandidateStepsDownOnEqualTerm(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	send := func(term uint64) {
+		respCh := make(chan RPCResponse, 1)
+		r.appendEntries(RPC{RespChan: respCh}, &AppendEntriesRequest{
+			RPCHeader: RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")},
+			Term:      term,
+		})
+		<-respCh
+	}
+
+	// Two servers became candidates for the same term and the other one won.
+	r.setCurrentTerm(5)
+	r.setState(Candidate)
+	send(5)
+	require.Equal(t, Follower, r.getState())
+	require.Equal(t, uint64(5), r.getCurrentTerm())
+	addr, id := r.LeaderWithID()
+	require.Equal(t, ServerAddress("second-addr"), addr)
+	require.Equal(t, ServerID("second"), id)
+
+	// A leadership transfer target keeps campaigning while it still hears
+	// from the leader handing over in the old term...
+	r.setState(Candidate)
+	r.leadershipTransferTerm.Store(5)
+	r.candidateFromLeadershipTransfer.Store(true)
+	send(5)
+	require.Equal(t, Candidate, r.getState())
+
+	// ...but steps down once a leader is elected in its election's term.
+	r.setCurrentTerm(6)
+	send(6)
+	require.Equal(t, Follower, r.getState())
+}
+
+func TestRaft_VotingDenialReasons(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.ProtocolVersion = 3
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	followers := c.Followers()
+	ldr := c.Leader()
+	ldrT := c.trans[c.IndexOf(ldr)]
+	voter := followers[0]
+
+	requestVote := func(req RequestVoteRequest) RequestVoteResponse {
+		var resp RequestVoteResponse
+		require.NoError(t, ldrT.RequestVote(voter.localID, voter.localAddr, &req, &resp))
+		return resp
+	}
+
+	reqVote := RequestVoteRequest{
+		RPCHeader:    ldr.getRPCHeader(),
+		Term:         ldr.getCurrentTerm() + 10,
+		LastLogIndex: ldr.LastIndex(),
+		LastLogTerm:  ldr.getCurrentTerm(),
+	}
+
+	// The follower still hears from the leader, so only the leader gets a vote.
+	other := reqVote
+	other.RPCHeader = followers[1].getRPCHeader()
+	resp := requestVote(other)
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialHasLeader, resp.Reason)
+
+	// Leadership transfers are allowed through, but a stale log isn't.
+	other.LeadershipTransfer = true
+	other.LastLogTerm = 0
+	resp = requestVote(other)
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialStaleLogTerm, resp.Reason)
+
+	// Once it has voted for the leader it won't vote for anyone else.
+	resp = requestVote(reqVote)
+	require.True(t, resp.Granted)
+	require.Equal(t, VoteDenialUnspecified, resp.Reason)
+	other.LastLogTerm = reqVote.LastLogTerm
+	resp = requestVote(other)
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialAlreadyVoted, resp.Reason)
+
+	// Older terms are ignored.
+	other.Term = reqVote.Term - 1
+	resp = requestVote(other)
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialOlderTerm, resp.Reason)
+}
+
+func TestRaft_RequestVoteRateLimit(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.RequestVoteRateLimit = 2
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	followers := c.Followers()
+	voter := followers[0]
+	candidate := followers[1]
+	trans := c.trans[c.IndexOf(candidate)]
+
+	// A candidate whose log is behind is denied anyway, so it's limited.
+	// Claiming to be someone else doesn't get it a fresh allowance.
+	term := voter.getCurrentTerm() + 10
+	stale := RequestVoteRequest{
+		RPCHeader:          candidate.getRPCHeader(),
+		Term:               term,
+		LeadershipTransfer: true,
+	}
+	var reasons []VoteDenialReason
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			stale.RPCHeader.Addr = []byte("forged")
+		}
+		var resp RequestVoteResponse
+		require.NoError(t, trans.RequestVote(voter.localID, voter.localAddr, &stale, &resp))
+		require.False(t, resp.Granted)
+		reasons = append(reasons, resp.Reason)
+	}
+	require.Equal(t, []VoteDenialReason{VoteDenialStaleLogTerm, VoteDenialStaleLogTerm, VoteDenialRateLimited}, reasons)
+
+	// A request that could be granted isn't limited.
+	lastIndex, lastTerm := voter.getLastEntry()
+	req := RequestVoteRequest{
+		RPCHeader:          candidate.getRPCHeader(),
+		Term:               term,
+		LastLogIndex:       lastIndex,
+		LastLogTerm:        lastTerm,
+		LeadershipTransfer: true,
+	}
+	var resp RequestVoteResponse
+	require.NoError(t, trans.RequestVote(voter.localID, voter.localAddr, &req, &resp))
+	require.True(t, resp.Granted)
+}
+
+func TestRaft_Stats_Configuration(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	require.NoError(t, leader.Barrier(0).Error())
+
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.NotZero(t, future.Index())
+
+	stats := leader.Stats()
+	require.Equal(t, strconv.FormatUint(future.Index(), 10), stats["latest_configuration_index"])
+	require.Equal(t, stats["latest_configuration_index"], stats["committed_configuration_index"])
+	require.Equal(t, stats["latest_configuration"], stats["committed_configuration"])
+	require.Equal(t, "2", stats["num_peers"])
+}
+
+func TestRaft_appendEntries_LogVersion(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+	r.setCurrentTerm(1)
+
+	send := func(entry *Log) RPCResponse {
+		entry.SetChecksum()
+		respCh := make(chan RPCResponse, 1)
+		r.appendEntries(RPC{RespChan: respCh}, &AppendEntriesRequest{
+			RPCHeader:    RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")},
+			Term:         1,
+			PrevLogEntry: entry.Index - 1,
+			PrevLogTerm:  1,
+			Entries:      []*Log{entry},
+		})
+		return <-respCh
+	}
+
+	// Entries from before versioning, and from the current version, are
+	// both stored.
+	for i, version := range []LogVersion{LogVersionMin, LogVersionMax} {
+		index := uint64(i + 1)
+		resp := send(&Log{Version: version, Index: index, Term: 1, Type: LogNoop})
+		require.NoError(t, resp.Error)
+		require.True(t, resp.Response.(*AppendEntriesResponse).Success)
+
+		var stored Log
+		require.NoError(t, env.store.GetLog(index, &stored))
+		require.Equal(t, version, stored.Version)
+	}
+
+	// An entry with a schema we don't know is refused, not stored.
+	resp := send(&Log{Version: LogVersionMax + 1, Index: 3, Term: 1, Type: LogNoop})
+	require.ErrorIs(t, resp.Error, ErrUnsupportedLogVersion)
+	require.False(t, resp.Response.(*AppendEntriesResponse).Success)
+	require.Equal(t, uint64(2), r.getLastIndex())
+}
+
+func TestRaft_ApplyLatencyMetrics(t *testing.T) {
+	sink := testSetupMetrics(t)
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	require.NoError(t, c.Leader().Apply([]byte("test"), c.propagateTimeout).Error())
+	require.NoError(t, c.Leader().Barrier(c.propagateTimeout).Error())
+
+	hasSample := func(name string) bool {
+		for _, interval := range sink.Data() {
+			interval.RLock()
+			s, ok := interval.Samples[name]
+			interval.RUnlock()
+			if ok && s.Count > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range []string{
+		"raft.test.raft.apply.queueTime",
+		"raft.test.raft.apply.commitLatency",
+		"raft.test.raft.fsm.commitToApply",
+		"raft.test.raft.apply.latency",
+	} {
+		require.True(t, hasSample(name), "missing sample %q", name)
+	}
+}
+
+func TestRaft_PreVote_RejoiningFollowerDoesNotDisrupt(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.PreVote = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	term := leader.getCurrentTerm()
+	follower := c.Followers()[0]
+
+	// Partition a follower for several election timeouts. Its pre-votes go
+	// unanswered so it never increments its term.
+	c.Disconnect(follower.localAddr)
+	time.Sleep(5 * conf.ElectionTimeout)
+	require.Equal(t, Candidate, follower.getState())
+	require.Equal(t, term, follower.getCurrentTerm())
+
+	// When it rejoins, its pre-votes are denied while the leader is healthy
+	// and it follows the leader again without an election.
+	c.FullyConnect()
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	c.WaitForReplication(1)
+	require.Equal(t, leader, c.Leader())
+	require.Equal(t, term, leader.getCurrentTerm())
+	require.Equal(t, term, follower.getCurrentTerm())
+}
+
+func TestRaft_TermInflationGuard(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TermInflationGuard = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	follower := c.Followers()[0]
+
+	// Partition a follower until it has campaigned its way to a higher term,
+	// while the others move on without it.
+	c.Disconnect(follower.localAddr)
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	require.Eventually(t, func() bool {
+		return follower.getCurrentTerm() > leader.getCurrentTerm()+2
+	}, c.longstopTimeout, 10*time.Millisecond)
+
+	stateCh := make(chan Observation, 16)
+	leader.RegisterObserver(NewObserver(stateCh, false, func(o *Observation) bool {
+		_, ok := o.Data.(RaftState)
+		return ok
+	}))
+
+	// When it rejoins, the leader stands again in its term rather than
+	// stepping down to follower, and wins.
+	c.FullyConnect()
+	select {
+	case o := <-stateCh:
+		require.Equal(t, Candidate, o.Data)
+	case <-time.After(c.longstopTimeout):
+		t.Fatal("leader didn't stand for re-election")
+	}
+	require.Equal(t, leader, c.Leader())
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	c.WaitForReplication(2)
+}
+
+// slowCASStableStore is an InmemStore that takes a moment to save a value
+// with CompareAndSetUint64, to widen the window for concurrent callers.
+type slowCASStableStore struct {
+	*InmemStore
+}
+
+func (s slowCASStableStore) CompareAndSetUint64(key []byte, old, val uint64) (bool, error) {
+	time.Sleep(100 * time.Microsecond)
+	return s.InmemStore.CompareAndSetUint64(key, old, val)
+}
+
+func TestRaft_TermInflationGuard_ConcurrentTerm(t *testing.T) {
+	faultCh := make(chan error, 1)
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	conf.TermInflationGuard = true
+	conf.FatalErrorPolicy = FatalErrorShutdown
+	conf.FaultCh = faultCh
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+	r.stable = slowCASStableStore{env.store}
+
+	// The leader takes on a follower's inflated term from the main thread
+	// just as a heartbeat from a new leader in the same term arrives on the
+	// fast-path.
+	const terms = 500
+	for term := uint64(1); term <= terms; term++ {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			r.processHeartbeat(RPC{RespChan: make(chan RPCResponse, 1), Command: &AppendEntriesRequest{
+				RPCHeader: RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")},
+				Term:      term,
+			}})
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			r.setCurrentTerm(term)
+		}()
+		close(start)
+		wg.Wait()
+		require.Equal(t, term, r.getCurrentTerm())
+	}
+
+	require.Empty(t, faultCh)
+	require.NotEqual(t, Shutdown, r.getState())
+	stored, err := env.store.GetUint64(keyCurrentTerm)
+	require.NoError(t, err)
+	require.Equal(t, uint64(terms), stored)
+}
+
+func TestRaft_PreVote_LeaderFailure(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.PreVote = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	term := leader.getCurrentTerm()
+
+	// Once the followers stop hearing from the leader they grant pre-votes
+	// and a new leader is elected in the next term.
+	c.Disconnect(leader.localAddr)
+	var newLeader *Raft
+	require.Eventually(t, func() bool {
+		for _, r := range c.GetInState(Leader) {
+			if r != leader {
+				newLeader = r
+				return true
+			}
+		}
+		return false
+	}, 10*conf.ElectionTimeout, 10*time.Millisecond)
+	require.Greater(t, newLeader.getCurrentTerm(), term)
+}
+
+func TestRaft_requestPreVote(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+	r.setCurrentTerm(5)
+
+	preVote := func(req RequestPreVoteRequest) *RequestPreVoteResponse {
+		req.RPCHeader = RPCHeader{ID: []byte("second"), Addr: r.trans.EncodePeer("second", "second-addr")}
+		respCh := make(chan RPCResponse, 1)
+		r.requestPreVote(RPC{RespChan: respCh}, &req)
+		resp := <-respCh
+		require.NoError(t, resp.Error)
+		return resp.Response.(*RequestPreVoteResponse)
+	}
+
+	// Granting a pre-vote doesn't change our term or record a vote.
+	resp := preVote(RequestPreVoteRequest{Term: 6})
+	require.True(t, resp.Granted)
+	require.Equal(t, uint64(5), resp.Term)
+	require.Equal(t, uint64(5), r.getCurrentTerm())
+	_, err := env.store.Get(keyLastVoteCand)
+	require.EqualError(t, err, "not found")
+
+	resp = preVote(RequestPreVoteRequest{Term: 4})
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialOlderTerm, resp.Reason)
+
+	// Denied while we're still hearing from a leader.
+	r.setLeader("third-addr", "third")
+	resp = preVote(RequestPreVoteRequest{Term: 6})
+	require.False(t, resp.Granted)
+	require.Equal(t, VoteDenialHasLeader, resp.Reason)
+}
+
+func TestRaft_checkClockSkew(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = ServerID("first")
+	conf.ClockSkewThreshold = time.Second
+	conf.skipStartup = true
+	env := MakeRaft(t, conf, false)
+	defer env.Release()
+	r := env.raft
+
+	skewCh := make(chan Observation, 8)
+	r.RegisterObserver(NewObserver(skewCh, false, func(o *Observation) bool {
+		_, ok := o.Data.(ClockSkewObservation)
+		return ok
+	}))
+
+	start := time.UnixMilli(time.Now().UnixMilli())
+	end := start.Add(100 * time.Millisecond)
+	remote := func(offset time.Duration) int64 {
+		return start.Add(50 * time.Millisecond).Add(offset).UnixMilli()
+	}
+
+	// Followers that don't report their time are ignored.
+	require.False(t, r.checkClockSkew("second", start, end, 0, false))
+
+	// Skew within the threshold.
+	require.False(t, r.checkClockSkew("second", start, end, remote(500*time.Millisecond), false))
+	require.Empty(t, skewCh)
+
+	// The follower's clock is behind; only crossing the threshold is observed.
+	require.True(t, r.checkClockSkew("second", start, end, remote(-2*time.Second), false))
+	require.True(t, r.checkClockSkew("second", start, end, remote(-3*time.Second), true))
+	require.Len(t, skewCh, 1)
+	o := (<-skewCh).Data.(ClockSkewObservation)
+	require.Equal(t, ClockSkewObservation{PeerID: "second", Skew: -2 * time.Second, Exceeded: true}, o)
+
+	// Back within the threshold.
+	require.False(t, r.checkClockSkew("second", start, end, remote(0), true))
+	o = (<-skewCh).Data.(ClockSkewObservation)
+	require.Equal(t, ClockSkewObservation{PeerID: "second", Skew: 0, Exceeded: false}, o)
+}
+
+func TestRaft_Status(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	c.WaitForReplication(1)
+
+	s := leader.Status()
+	require.Equal(t, Leader, s.State)
+	require.Equal(t, leader.localID, s.LeaderID)
+	require.Zero(t, s.LastContact)
+	require.True(t, s.IsFresh(0))
+
+	// Ask a follower over the transport, without a valid protocol version as
+	// a health checker wouldn't have one.
+	follower := c.Followers()[0]
+	trans := c.trans[c.IndexOf(leader)].(WithStatus)
+	var resp StatusResponse
+	require.NoError(t, trans.Status(follower.localID, follower.localAddr, &StatusRequest{}, &resp))
+	require.Equal(t, Follower, resp.State)
+	require.Equal(t, leader.localAddr, resp.LeaderAddr)
+	require.Equal(t, leader.localID, resp.LeaderID)
+	require.Equal(t, leader.getCurrentTerm(), resp.Term)
+	require.Equal(t, follower.AppliedIndex(), resp.AppliedIndex)
+	require.True(t, resp.IsFresh(c.propagateTimeout))
+
+	// A follower that hasn't heard from the leader recently isn't fresh.
+	require.False(t, Status{State: Follower, LeaderID: "leader", LastContact: time.Minute}.IsFresh(time.Second))
+	require.False(t, Status{State: Follower, LastContact: 0}.IsFresh(time.Second))
+	require.False(t, Status{State: Candidate}.IsFresh(time.Second))
+}
+
+func TestRaft_ConfigurationAppliedObservation(t *testing.T) {
+	c := MakeClusterNoBootstrap(3, t, nil)
+	defer c.Close()
+
+	appliedCh := make(chan Observation, 32)
+	configuration := Configuration{}
+	for _, r := range c.rafts {
+		r.RegisterObserver(NewObserver(appliedCh, false, func(o *Observation) bool {
+			_, ok := o.Data.(ConfigurationAppliedObservation)
+			return ok
+		}))
+		configuration.Servers = append(configuration.Servers, Server{
+			ID:      r.localID,
+			Address: r.localAddr,
+		})
+	}
+	require.NoError(t, c.rafts[0].BootstrapCluster(configuration).Error())
+	leader := c.Leader()
+
+	// Every server applies the bootstrap configuration.
+	seen := make(map[*Raft]bool)
+	timeout := time.After(c.longstopTimeout)
+	for len(seen) < 3 {
+		select {
+		case o := <-appliedCh:
+			applied := o.Data.(ConfigurationAppliedObservation)
+			require.Equal(t, uint64(1), applied.Index)
+			require.Equal(t, configuration, applied.Configuration)
+			seen[o.Raft] = true
+		case <-timeout:
+			t.Fatalf("timed out waiting for observations, got %d", len(seen))
+		}
+	}
+
+	// Removing a server is observed once the change is applied.
+	follower := c.Followers()[0]
+	future := leader.RemoveServer(follower.localID, 0, 0)
+	require.NoError(t, future.Error())
+	timeout = time.After(c.longstopTimeout)
+	for {
+		select {
+		case o := <-appliedCh:
+			if o.Raft != leader {
+				continue
+			}
+			applied := o.Data.(ConfigurationAppliedObservation)
+			require.Equal(t, future.Index(), applied.Index)
+			require.Len(t, applied.Configuration.Servers, 2)
+			require.False(t, inConfiguration(applied.Configuration, follower.localID))
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for observation")
+		}
+	}
+}
+
+func TestRaft_LastConfiguration(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	configuration, index := leader.LastConfiguration()
+	require.Equal(t, uint64(1), index)
+	require.Len(t, configuration.Servers, 3)
+
+	// It follows changes made by the main loop.
+	follower := c.Followers()[0]
+	future := leader.RemoveServer(follower.localID, 0, 0)
+	require.NoError(t, future.Error())
+	configuration, index = leader.LastConfiguration()
+	require.Equal(t, future.Index(), index)
+	require.Len(t, configuration.Servers, 2)
+	require.False(t, inConfiguration(configuration, follower.localID))
+}
+
+func TestRaft_LeaderWithTerm(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	addr, id, term := leader.LeaderWithTerm()
+	require.Equal(t, leader.localAddr, addr)
+	require.Equal(t, leader.localID, id)
+	require.Equal(t, leader.getCurrentTerm(), term)
+
+	follower := c.Followers()[0]
+	addr, id, term = follower.LeaderWithTerm()
+	require.Equal(t, leader.localAddr, addr)
+	require.Equal(t, leader.localID, id)
+	require.Equal(t, leader.getCurrentTerm(), term)
+
+	// Once a new leader is elected the followers report it, with its term.
+	c.Disconnect(leader.localAddr)
+	require.Eventually(t, func() bool {
+		addr, _, _ := follower.LeaderWithTerm()
+		return addr != "" && addr != leader.localAddr
+	}, c.longstopTimeout, 10*time.Millisecond)
+	_, _, newTerm := follower.LeaderWithTerm()
+	require.Greater(t, newTerm, term)
+
+	// A leader learned in an earlier term isn't returned.
+	follower.setCurrentTerm(newTerm + 1)
+	addr, id, term = follower.LeaderWithTerm()
+	require.Empty(t, addr)
+	require.Empty(t, id)
+	require.Equal(t, newTerm+1, term)
+}
+
+func TestRaft_Chaos(t *testing.T) {
+	for _, seed := range []int64{1, 2} {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			conf := inmemConfig(t)
+			conf.SnapshotThreshold = 20
+			conf.TrailingLogs = 10
+			c := MakeCluster(3, t, conf)
+			defer c.Close()
+			c.RunChaos(ChaosOpts{Seed: seed, Steps: 6})
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// readIndexFuture is used to get the commit index from the main thread.
+type readIndexFuture struct {
+	deferError
+	index uint64
+
+	// lease asks the leader to check its read lease, in which case no
+	// heartbeat round is needed.
+	lease bool
+}
+
+// fsmBarrierFuture is queued to the FSM goroutine and responds once every
+// entry queued before it has been applied.
+type fsmBarrierFuture struct {
+	deferError
+}
+
+// ReadIndex returns an index that the FSM must have applied before a read
+// from it is linearizable, using the ReadIndex algorithm from the Raft
+// dissertation: the leader records its commit index and then confirms it's
+// still the leader with a round of heartbeats. Unlike Barrier nothing is
+// written to the log. This must be run on the leader or it will fail. A new
+// leader waits until it has committed an entry in its own term, since only
+// then is its commit index known to be current.
+//
+// FSMs that track the last index they applied can compare against the
+// returned index. Otherwise use LinearizableRead.
+func (r *Raft) ReadIndex() (uint64, error) {
+	return r.readIndex(nil)
+}
+
+// LinearizableRead blocks until the FSM reflects every write that was
+// committed before it was called, so a read from the FSM that follows won't
+// be stale. It uses ReadIndex and then waits for the FSM to catch up. An
+// optional timeout limits how long it waits. This must be run on the leader
+// or it will fail.
+func (r *Raft) LinearizableRead(timeout time.Duration) error {
+	defer metrics.MeasureSince([]string{"raft", "linearizableRead"}, time.Now())
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	if _, err := r.readIndex(timer); err != nil {
+		return err
+	}
+	return r.waitForFSM(timer)
+}
+
+// LeaseRead blocks until the FSM reflects every write that was committed
+// before it was called, like LinearizableRead, but relies on the leader's
+// lease instead of a round of heartbeats, so it needs no network round trip.
+// After a quorum accepts a heartbeat, none of them will vote for another
+// server until their heartbeat timeout passes, and so the leader can't have
+// been replaced before then. This is only safe if clocks can't drift apart
+// by more than Config.LeaseReadMaxClockSkew in that time, which must be set
+// to enable lease reads. ErrLeaseExpired is returned when the lease has
+// lapsed, in which case LinearizableRead can still be used. This must be run
+// on the leader or it will fail.
+func (r *Raft) LeaseRead() error {
+	defer metrics.MeasureSince([]string{"raft", "leaseRead"}, time.Now())
+	future := &readIndexFuture{lease: true}
+	future.init()
+	select {
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case r.readIndexCh <- future:
+	}
+	if err := future.Error(); err != nil {
+		return err
+	}
+	return r.waitForFSM(nil)
+}
+
+// waitForFSM blocks until everything queued to the FSM so far has been
+// applied, giving up with ErrEnqueueTimeout when the timer fires.
+func (r *Raft) waitForFSM(timer <-chan time.Time) error {
+	// Everything up to the read index was queued to the FSM before we got
+	// it, so once this reaches the front of the queue it has all been
+	// applied.
+	future := &fsmBarrierFuture{}
+	future.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case r.fsmMutateCh <- future:
+	}
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case err := <-future.errCh:
+		return err
+	}
+}
+
+// readIndex implements ReadIndex, giving up with ErrEnqueueTimeout when the
+// timer fires.
+func (r *Raft) readIndex(timer <-chan time.Time) (uint64, error) {
+	metrics.IncrCounter([]string{"raft", "readIndex"}, 1)
+	future := &readIndexFuture{}
+	future.init()
+	select {
+	case <-timer:
+		return 0, ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return 0, ErrRaftShutdown
+	case r.readIndexCh <- future:
+	}
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+
+	verify := &verifyFuture{}
+	verify.init()
+	select {
+	case <-timer:
+		return 0, ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return 0, ErrRaftShutdown
+	case r.verifyCh <- verify:
+	}
+	if err := verify.Error(); err != nil {
+		return 0, err
+	}
+	return future.index, nil
+}
+
+// readIndexChIfReady returns r.readIndexCh once this leader has committed an
+// entry in its term, and nil before then.
+func (r *Raft) readIndexChIfReady() chan *readIndexFuture {
+	if r.getCommitIndex() >= r.leaderState.commitment.startIndex {
+		return r.readIndexCh
+	}
+	return nil
+}
+
+// checkReadLease returns nil if this leader's read lease is current. The lease
+// runs from the time the heartbeats a quorum accepted were sent, since a
+// follower's heartbeat timeout starts no earlier than that. This must only be
+// called from the main thread.
+func (r *Raft) checkReadLease() error {
+	conf := r.config()
+	if conf.LeaseReadMaxClockSkew <= 0 {
+		return fmt.Errorf("lease reads are disabled: LeaseReadMaxClockSkew is not set")
+	}
+	// A follower may vote for the target of a leadership transfer without
+	// waiting for its heartbeat timeout.
+	if r.getLeadershipTransferInProgress() {
+		return ErrLeadershipTransferInProgress
+	}
+
+	lease := conf.HeartbeatTimeout
+	if conf.ElectionTimeout < lease {
+		lease = conf.ElectionTimeout
+	}
+	lease -= conf.LeaseReadMaxClockSkew
+
+	acked := make(map[ServerID]bool)
+	now := time.Now()
+	for _, server := range votingServers(r.configurations.latest) {
+		if server.ID == r.localID {
+			acked[server.ID] = true
+			continue
+		}
+		if f, ok := r.leaderState.replState[server.ID]; ok && now.Sub(f.LastAckSent()) < lease {
+			acked[server.ID] = true
+		}
+	}
+	if !quorumReached(r.configurations.latest, acked) {
+		metrics.IncrCounter([]string{"raft", "leaseRead", "expired"}, 1)
+		return ErrLeaseExpired
+	}
+	return nil
+}
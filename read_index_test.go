@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_LinearizableRead(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last ApplyFuture
+	for i := 0; i < 10; i++ {
+		last = leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, last.Error())
+
+	index, err := leader.ReadIndex()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, index, last.Index())
+
+	// Once the read returns the leader's FSM has every committed write.
+	require.NoError(t, leader.LinearizableRead(c.propagateTimeout))
+	fsm := getMockFSM(c.fsms[c.IndexOf(leader)])
+	require.Len(t, fsm.Logs(), 10)
+
+	// Only the leader can serve reads.
+	follower := c.Followers()[0]
+	_, err = follower.ReadIndex()
+	require.ErrorIs(t, err, ErrNotLeader)
+	require.ErrorIs(t, follower.LinearizableRead(0), ErrNotLeader)
+
+	// A leader that has been partitioned away can't confirm its leadership,
+	// once any heartbeats that were already in flight have been answered.
+	c.Partition([]ServerAddress{leader.localAddr})
+	require.Eventually(t, func() bool {
+		_, err := leader.ReadIndex()
+		return err != nil
+	}, c.propagateTimeout, 10*time.Millisecond)
+}
+
+func TestRaft_LeaseRead(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LeaseReadMaxClockSkew = conf.HeartbeatTimeout / 10
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last ApplyFuture
+	for i := 0; i < 10; i++ {
+		last = leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, last.Error())
+
+	// Once the read returns the leader's FSM has every committed write.
+	require.NoError(t, leader.LeaseRead())
+	fsm := getMockFSM(c.fsms[c.IndexOf(leader)])
+	require.Len(t, fsm.Logs(), 10)
+
+	require.ErrorIs(t, c.Followers()[0].LeaseRead(), ErrNotLeader)
+
+	// Once the leader is partitioned away its lease lapses, if it hasn't
+	// already stepped down.
+	c.Partition([]ServerAddress{leader.localAddr})
+	time.Sleep(conf.HeartbeatTimeout)
+	err := leader.LeaseRead()
+	if !errors.Is(err, ErrNotLeader) {
+		require.ErrorIs(t, err, ErrLeaseExpired)
+	}
+}
+
+func TestRaft_LeaseRead_Disabled(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	err := c.Leader().LeaseRead()
+	require.ErrorContains(t, err, "lease reads are disabled")
+}
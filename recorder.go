@@ -0,0 +1,403 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// TraceEventKind is the kind of a TraceEvent.
+type TraceEventKind uint8
+
+const (
+	// TraceStart records the server's ID and address, and the state it
+	// started from: its log, the values it keeps in the stable store, and
+	// its latest snapshot.
+	TraceStart TraceEventKind = iota
+	// TraceRPC records an RPC the server handled and how it responded.
+	TraceRPC
+	// TraceTimer records a timer firing that moved the server to another
+	// state.
+	TraceTimer
+	// TraceStore records a write to the log or stable store.
+	TraceStore
+)
+
+// String returns a human readable form of the TraceEventKind.
+func (k TraceEventKind) String() string {
+	switch k {
+	case TraceStart:
+		return "Start"
+	case TraceRPC:
+		return "RPC"
+	case TraceTimer:
+		return "Timer"
+	case TraceStore:
+		return "Store"
+	default:
+		return fmt.Sprintf("TraceEventKind(%d)", k)
+	}
+}
+
+// TraceEvent is a single event written by a Recorder. Which fields are set
+// depends on Kind.
+type TraceEvent struct {
+	// Seq orders the events. RPCs are numbered when the server starts
+	// handling them, and everything else when it happens.
+	Seq      uint64
+	UnixNano int64
+	Kind     TraceEventKind
+
+	// LocalID and LocalAddr are set for TraceStart.
+	LocalID   ServerID
+	LocalAddr ServerAddress
+
+	// Logs holds the log for TraceStart, and the entries stored for a
+	// StoreLogs TraceStore.
+	Logs []*Log
+
+	// StableUint64 and StableBytes hold the values in the stable store for
+	// TraceStart.
+	StableUint64 map[string]uint64
+	StableBytes  map[string][]byte
+
+	// Snapshot and SnapshotData hold the latest snapshot, if any, for
+	// TraceStart.
+	Snapshot     *SnapshotMeta
+	SnapshotData []byte
+
+	// RPC names the type of RPC for TraceRPC. Command and Response are its
+	// request and response, encoded with msgpack, Error is the error it
+	// was answered with, if any, and Data is the snapshot sent with an
+	// InstallSnapshot.
+	RPC      string
+	Command  []byte
+	Response []byte
+	Error    string
+	Data     []byte
+
+	// Timer names the timer for TraceTimer, one of "heartbeat", "election"
+	// or "leaderLease".
+	Timer string
+
+	// Op names the store method called for TraceStore. Key, Value and
+	// Uint64 hold its arguments, with Min and Max holding the range for
+	// DeleteRange, and Min the old value for CompareAndSetUint64.
+	Op     string
+	Key    []byte
+	Value  []byte
+	Uint64 uint64
+	Min    uint64
+	Max    uint64
+}
+
+// Recorder writes a trace of everything a server does that affects its
+// state, so that a hard to reproduce bug can be reported along with the
+// trace and replayed with Replay. It's enabled by setting Config.Recorder. A
+// trace holds the server's whole log and latest snapshot as of when it
+// started, along with every entry written since, so recording is meant for
+// debugging rather than production use.
+type Recorder struct {
+	lock sync.Mutex
+	enc  *codec.Encoder
+	seq  uint64
+	err  error
+}
+
+// NewRecorder returns a Recorder that writes its trace to w. The caller is
+// responsible for flushing and closing w once the server is shut down.
+func NewRecorder(w io.Writer) *Recorder {
+	hd := codec.MsgpackHandle{
+		BasicHandle: codec.BasicHandle{
+			TimeNotBuiltin: true,
+		},
+	}
+	return &Recorder{enc: codec.NewEncoder(w, &hd)}
+}
+
+// Err returns the first error writing the trace, after which nothing more is
+// written.
+func (rec *Recorder) Err() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.err
+}
+
+// nextSeq reserves a sequence number for an event written later.
+func (rec *Recorder) nextSeq() uint64 {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.seq++
+	return rec.seq
+}
+
+// write writes an event, numbering it unless it already has been.
+func (rec *Recorder) write(event *TraceEvent) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.err != nil {
+		return
+	}
+	if event.Seq == 0 {
+		rec.seq++
+		event.Seq = rec.seq
+	}
+	event.UnixNano = time.Now().UnixNano()
+	rec.err = rec.enc.Encode(event)
+}
+
+// recordStart records the state a server starts from.
+func (rec *Recorder) recordStart(id ServerID, addr ServerAddress, logs LogStore, stable StableStore, snaps SnapshotStore) error {
+	event := &TraceEvent{
+		Kind:         TraceStart,
+		LocalID:      id,
+		LocalAddr:    addr,
+		StableUint64: make(map[string]uint64),
+		StableBytes:  make(map[string][]byte),
+	}
+
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return fmt.Errorf("failed to record log: %v", err)
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to record log: %v", err)
+	}
+	for index := first; first > 0 && index <= last; index++ {
+		entry := new(Log)
+		if err := logs.GetLog(index, entry); err != nil {
+			return fmt.Errorf("failed to record log: %v", err)
+		}
+		event.Logs = append(event.Logs, entry)
+	}
+
+	// Missing keys are left out.
+	for _, key := range [][]byte{keyCurrentTerm, keyLastVoteTerm} {
+		if val, err := stable.GetUint64(key); err == nil {
+			event.StableUint64[string(key)] = val
+		}
+	}
+	for _, key := range [][]byte{keyLastVoteCand, keyReplicationProgress} {
+		if val, err := stable.Get(key); err == nil && len(val) > 0 {
+			event.StableBytes[string(key)] = val
+		}
+	}
+
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot: %v", err)
+	}
+	if len(snapshots) > 0 {
+		meta, source, err := snaps.Open(snapshots[0].ID)
+		if err != nil {
+			return fmt.Errorf("failed to record snapshot: %v", err)
+		}
+		data, err := io.ReadAll(source)
+		source.Close()
+		if err != nil {
+			return fmt.Errorf("failed to record snapshot: %v", err)
+		}
+		event.Snapshot = meta
+		event.SnapshotData = data
+	}
+
+	rec.write(event)
+	return rec.Err()
+}
+
+// traceRPCTypes returns new request and response values for each type of
+// RPC that's recorded, by name.
+var traceRPCTypes = map[string]func() (interface{}, interface{}){
+	"AppendEntries": func() (interface{}, interface{}) {
+		return &AppendEntriesRequest{}, &AppendEntriesResponse{}
+	},
+	"RequestVote": func() (interface{}, interface{}) {
+		return &RequestVoteRequest{}, &RequestVoteResponse{}
+	},
+	"RequestPreVote": func() (interface{}, interface{}) {
+		return &RequestPreVoteRequest{}, &RequestPreVoteResponse{}
+	},
+	"InstallSnapshot": func() (interface{}, interface{}) {
+		return &InstallSnapshotRequest{}, &InstallSnapshotResponse{}
+	},
+	"TimeoutNow": func() (interface{}, interface{}) {
+		return &TimeoutNowRequest{}, &TimeoutNowResponse{}
+	},
+}
+
+// traceRPCName returns the name an RPC is recorded under, or "" if it isn't
+// recorded. Only the RPCs that drive consensus are; the rest are answered
+// asynchronously or don't change the server's state.
+func traceRPCName(command interface{}) string {
+	switch command.(type) {
+	case *AppendEntriesRequest:
+		return "AppendEntries"
+	case *RequestVoteRequest:
+		return "RequestVote"
+	case *RequestPreVoteRequest:
+		return "RequestPreVote"
+	case *InstallSnapshotRequest:
+		return "InstallSnapshot"
+	case *TimeoutNowRequest:
+		return "TimeoutNow"
+	default:
+		return ""
+	}
+}
+
+// interceptRPC arranges for an RPC to be recorded once it's been answered,
+// returning a func to call after it has been, or nil if it isn't recorded.
+// The RPC must be answered before the func is called. It's safe to call on
+// nil, which records nothing.
+func (rec *Recorder) interceptRPC(rpc *RPC) func() {
+	if rec == nil {
+		return nil
+	}
+	name := traceRPCName(rpc.Command)
+	if name == "" {
+		return nil
+	}
+	event := &TraceEvent{Seq: rec.nextSeq(), Kind: TraceRPC, RPC: name}
+	if buf, err := encodeMsgPack(rpc.Command); err == nil {
+		event.Command = buf.Bytes()
+	}
+
+	var data *bytes.Buffer
+	if rpc.Reader != nil {
+		data = new(bytes.Buffer)
+		rpc.Reader = io.TeeReader(rpc.Reader, data)
+	}
+	respCh := make(chan RPCResponse, 1)
+	origCh := rpc.RespChan
+	rpc.RespChan = respCh
+
+	return func() {
+		resp := <-respCh
+		if resp.Response != nil {
+			if buf, err := encodeMsgPack(resp.Response); err == nil {
+				event.Response = buf.Bytes()
+			}
+		}
+		if resp.Error != nil {
+			event.Error = resp.Error.Error()
+		}
+		if data != nil {
+			event.Data = data.Bytes()
+		}
+		rec.write(event)
+		origCh <- resp
+	}
+}
+
+// recordTimer records a timer firing. It's safe to call on nil.
+func (rec *Recorder) recordTimer(timer string) {
+	if rec == nil {
+		return
+	}
+	rec.write(&TraceEvent{Kind: TraceTimer, Timer: timer})
+}
+
+// wrapLogStore returns a LogStore that records writes to store.
+func (rec *Recorder) wrapLogStore(store LogStore) LogStore {
+	return &recordingLogStore{LogStore: store, rec: rec}
+}
+
+// wrapStableStore returns a StableStore that records writes to store.
+func (rec *Recorder) wrapStableStore(store StableStore) StableStore {
+	s := &recordingStableStore{StableStore: store, rec: rec}
+	if _, ok := store.(CompareAndSetStableStore); ok {
+		return &recordingCASStableStore{s}
+	}
+	return s
+}
+
+// recordingLogStore records the writes to a LogStore.
+type recordingLogStore struct {
+	LogStore
+	rec *Recorder
+}
+
+// IsMonotonic implements the MonotonicLogStore interface. This is a shim to
+// expose the underlying store as monotonically indexed or not.
+func (s *recordingLogStore) IsMonotonic() bool {
+	if store, ok := s.LogStore.(MonotonicLogStore); ok {
+		return store.IsMonotonic()
+	}
+	return false
+}
+
+// StoreLog implements the LogStore interface.
+func (s *recordingLogStore) StoreLog(log *Log) error {
+	return s.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface.
+func (s *recordingLogStore) StoreLogs(logs []*Log) error {
+	s.rec.write(&TraceEvent{Kind: TraceStore, Op: "StoreLogs", Logs: logs})
+	return s.LogStore.StoreLogs(logs)
+}
+
+// DeleteRange implements the LogStore interface.
+func (s *recordingLogStore) DeleteRange(min, max uint64) error {
+	s.rec.write(&TraceEvent{Kind: TraceStore, Op: "DeleteRange", Min: min, Max: max})
+	return s.LogStore.DeleteRange(min, max)
+}
+
+// recordingStableStore records the writes to a StableStore.
+type recordingStableStore struct {
+	StableStore
+	rec *Recorder
+}
+
+// Set implements the StableStore interface.
+func (s *recordingStableStore) Set(key []byte, val []byte) error {
+	s.rec.write(&TraceEvent{Kind: TraceStore, Op: "Set", Key: key, Value: val})
+	return s.StableStore.Set(key, val)
+}
+
+// SetUint64 implements the StableStore interface.
+func (s *recordingStableStore) SetUint64(key []byte, val uint64) error {
+	s.rec.write(&TraceEvent{Kind: TraceStore, Op: "SetUint64", Key: key, Uint64: val})
+	return s.StableStore.SetUint64(key, val)
+}
+
+// recordingCASStableStore is a recordingStableStore for a store that
+// implements CompareAndSetStableStore.
+type recordingCASStableStore struct {
+	*recordingStableStore
+}
+
+// CompareAndSetUint64 implements the CompareAndSetStableStore interface.
+func (s *recordingCASStableStore) CompareAndSetUint64(key []byte, old, val uint64) (bool, error) {
+	s.rec.write(&TraceEvent{Kind: TraceStore, Op: "CompareAndSetUint64", Key: key, Min: old, Uint64: val})
+	return s.StableStore.(CompareAndSetStableStore).CompareAndSetUint64(key, old, val)
+}
+
+// ReadTrace reads the events written by a Recorder, in order.
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	dec := codec.NewDecoder(r, &codec.MsgpackHandle{})
+	var events []TraceEvent
+	for {
+		var event TraceEvent
+		if err := dec.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode trace event %d: %v", len(events), err)
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, nil
+}
@@ -0,0 +1,207 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// replayTimeout is how long Replay waits for the server to answer an RPC.
+const replayTimeout = 10 * time.Second
+
+// ReplayReport is the outcome of Replay.
+type ReplayReport struct {
+	// RPCs is how many RPCs were replayed.
+	RPCs int
+
+	// Divergences lists the RPCs the server answered differently to how it
+	// did when the trace was recorded.
+	Divergences []ReplayDivergence
+
+	// StoppedAt is the sequence number of the timer firing the replay
+	// stopped at, or zero if it reached the end of the trace. StoppedBy
+	// names the timer.
+	StoppedAt uint64
+	StoppedBy string
+}
+
+// ReplayDivergence describes an RPC that was answered differently when it
+// was replayed.
+type ReplayDivergence struct {
+	Seq      uint64
+	RPC      string
+	Recorded string
+	Replayed string
+}
+
+// Replay re-executes a trace written by a Recorder in process. A server is
+// started from the state the trace starts with, using in-memory stores and
+// the given FSM, and sent each recorded RPC in turn, and the answers it gives
+// are compared with the recorded ones. Fields that depend on the clock, such
+// as timestamps, aren't compared. Replay returns once the FSM has applied
+// everything the server committed, after which the server is shut down.
+//
+// The server's own timers are held off so that it only acts on what it's
+// sent, so the replay stops at the first recorded timer firing, after which
+// the recorded server went on to act on its own, such as by standing for
+// election. The parts of conf that decide how RPCs are handled, such as
+// ProtocolVersion, should match the recorded server's; its ID and timeouts
+// are overridden.
+func Replay(conf *Config, fsm FSM, events []TraceEvent) (*ReplayReport, error) {
+	if len(events) == 0 || events[0].Kind != TraceStart {
+		return nil, fmt.Errorf("trace doesn't start with a %s event", TraceStart)
+	}
+	start := events[0]
+
+	logs := NewInmemStore()
+	if err := logs.StoreLogs(start.Logs); err != nil {
+		return nil, err
+	}
+	for key, val := range start.StableUint64 {
+		if err := logs.SetUint64([]byte(key), val); err != nil {
+			return nil, err
+		}
+	}
+	for key, val := range start.StableBytes {
+		if err := logs.Set([]byte(key), val); err != nil {
+			return nil, err
+		}
+	}
+	_, trans := NewInmemTransport(start.LocalAddr)
+	defer trans.Close()
+	snaps := NewInmemSnapshotStore()
+	if meta := start.Snapshot; meta != nil {
+		sink, err := snaps.Create(meta.Version, meta.Index, meta.Term, meta.Configuration, meta.ConfigurationIndex, trans)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := sink.Write(start.SnapshotData); err != nil {
+			sink.Cancel()
+			return nil, err
+		}
+		if err := sink.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	replayConf := *conf
+	replayConf.LocalID = start.LocalID
+	replayConf.HeartbeatTimeout = time.Hour
+	replayConf.ElectionTimeout = time.Hour
+	replayConf.LeaderLeaseTimeout = time.Hour
+	replayConf.Recorder = nil
+	r, err := NewRaft(&replayConf, fsm, logs, logs, snaps, trans)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { r.Shutdown().Error() }()
+
+	report := &ReplayReport{}
+	for _, event := range events[1:] {
+		if event.Kind == TraceTimer {
+			report.StoppedAt = event.Seq
+			report.StoppedBy = event.Timer
+			break
+		}
+		if event.Kind == TraceRPC {
+			divergence, err := replayRPC(trans, event)
+			if err != nil {
+				return report, err
+			}
+			report.RPCs++
+			if divergence != nil {
+				report.Divergences = append(report.Divergences, *divergence)
+			}
+		}
+	}
+
+	// Everything committed has been queued to the FSM by the time the RPC
+	// that committed it is answered, so let the FSM catch up.
+	return report, r.waitForFSM(time.After(replayTimeout))
+}
+
+// replayRPC sends a recorded RPC to the server listening on trans, returning
+// how its answer differs from the recorded one, if it does.
+func replayRPC(trans *InmemTransport, event TraceEvent) (*ReplayDivergence, error) {
+	newTypes, ok := traceRPCTypes[event.RPC]
+	if !ok {
+		return nil, fmt.Errorf("unknown RPC %q at %d", event.RPC, event.Seq)
+	}
+	command, recorded := newTypes()
+	if err := decodeMsgPack(event.Command, command); err != nil {
+		return nil, fmt.Errorf("failed to decode %s request at %d: %v", event.RPC, event.Seq, err)
+	}
+	if len(event.Response) > 0 {
+		if err := decodeMsgPack(event.Response, recorded); err != nil {
+			return nil, fmt.Errorf("failed to decode %s response at %d: %v", event.RPC, event.Seq, err)
+		}
+	} else {
+		recorded = nil
+	}
+
+	respCh := make(chan RPCResponse, 1)
+	rpc := RPC{Command: command, RespChan: respCh}
+	if event.RPC == "InstallSnapshot" {
+		rpc.Reader = bytes.NewReader(event.Data)
+	}
+	timeout := time.After(replayTimeout)
+	select {
+	case trans.consumerCh <- rpc:
+	case <-timeout:
+		return nil, fmt.Errorf("timed out sending %s at %d", event.RPC, event.Seq)
+	}
+	var resp RPCResponse
+	select {
+	case resp = <-respCh:
+	case <-timeout:
+		return nil, fmt.Errorf("timed out waiting for %s response at %d", event.RPC, event.Seq)
+	}
+
+	var replayedErr string
+	if resp.Error != nil {
+		replayedErr = resp.Error.Error()
+	}
+	want := describeReplayResponse(recorded, event.Error)
+	got := describeReplayResponse(resp.Response, replayedErr)
+	if want == got {
+		return nil, nil
+	}
+	return &ReplayDivergence{Seq: event.Seq, RPC: event.RPC, Recorded: want, Replayed: got}, nil
+}
+
+// describeReplayResponse returns a comparable description of an RPC's
+// answer, leaving out the fields that depend on the clock or the sender.
+func describeReplayResponse(resp interface{}, err string) string {
+	switch r := resp.(type) {
+	case *AppendEntriesResponse:
+		c := *r
+		c.RPCHeader, c.Timestamp = RPCHeader{}, 0
+		resp = c
+	case *RequestVoteResponse:
+		c := *r
+		c.RPCHeader = RPCHeader{}
+		resp = c
+	case *RequestPreVoteResponse:
+		c := *r
+		c.RPCHeader = RPCHeader{}
+		resp = c
+	case *InstallSnapshotResponse:
+		c := *r
+		c.RPCHeader, c.ReceiveBytesPerSecond = RPCHeader{}, 0
+		resp = c
+	case *TimeoutNowResponse:
+		c := *r
+		c.RPCHeader = RPCHeader{}
+		resp = c
+	}
+	if err != "" {
+		return fmt.Sprintf("%+v error=%q", resp, err)
+	}
+	return fmt.Sprintf("%+v", resp)
+}
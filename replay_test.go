@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_RecordAndReplay(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// The recorded server joins after a snapshot, so it's sent one.
+	for i := 0; i < 50; i++ {
+		leader.Apply([]byte("before"), 0)
+	}
+	require.NoError(t, leader.Barrier(0).Error())
+	require.NoError(t, leader.Snapshot().Error())
+
+	var trace bytes.Buffer
+	recConf := *conf
+	recConf.Recorder = NewRecorder(&trace)
+	c1 := MakeClusterNoBootstrap(1, t, &recConf)
+	c.Merge(c1)
+	c.FullyConnect()
+	recorded := c1.rafts[0]
+	require.NoError(t, leader.AddVoter(recorded.localID, recorded.localAddr, 0, 0).Error())
+	for i := 0; i < 20; i++ {
+		leader.Apply([]byte("after"), 0)
+	}
+	require.NoError(t, leader.Barrier(0).Error())
+	recordedFSM := getMockFSM(c1.fsms[0])
+	retry(t, func() bool { return len(recordedFSM.Logs()) == 70 })
+
+	c.Disconnect(recorded.localAddr)
+	require.NoError(t, recorded.Shutdown().Error())
+	require.NoError(t, recConf.Recorder.Err())
+
+	events, err := ReadTrace(&trace)
+	require.NoError(t, err)
+	require.Equal(t, TraceStart, events[0].Kind)
+	kinds := make(map[TraceEventKind]int)
+	rpcs := make(map[string]int)
+	for i, event := range events {
+		kinds[event.Kind]++
+		rpcs[event.RPC]++
+		if i > 0 {
+			require.Greater(t, event.Seq, events[i-1].Seq)
+		}
+	}
+	require.NotZero(t, kinds[TraceStore])
+	require.NotZero(t, rpcs["AppendEntries"])
+	require.Equal(t, 1, rpcs["InstallSnapshot"])
+
+	// Replaying the trace reproduces what the server did.
+	replayConf := *conf
+	replayFSM := &MockFSM{}
+	report, err := Replay(&replayConf, replayFSM, events)
+	require.NoError(t, err)
+	require.Empty(t, report.Divergences)
+	require.Equal(t, kinds[TraceRPC], report.RPCs)
+	require.Zero(t, report.StoppedAt)
+	require.Len(t, replayFSM.Logs(), 70)
+	require.Equal(t, recordedFSM.Logs(), replayFSM.Logs())
+
+	// An answer that doesn't match the recording is reported.
+	var tampered uint64
+	for i, event := range events {
+		if event.RPC != "AppendEntries" || len(event.Response) == 0 {
+			continue
+		}
+		var resp AppendEntriesResponse
+		require.NoError(t, decodeMsgPack(event.Response, &resp))
+		resp.Success = !resp.Success
+		buf, err := encodeMsgPack(&resp)
+		require.NoError(t, err)
+		events[i].Response = buf.Bytes()
+		tampered = event.Seq
+		break
+	}
+	report, err = Replay(&replayConf, &MockFSM{}, events)
+	require.NoError(t, err)
+	require.Len(t, report.Divergences, 1)
+	require.Equal(t, tampered, report.Divergences[0].Seq)
+	require.Equal(t, "AppendEntries", report.Divergences[0].RPC)
+
+	// The replay stops at a timer firing.
+	events = append(events[:2:2], TraceEvent{Seq: events[1].Seq + 1, Kind: TraceTimer, Timer: "heartbeat"})
+	report, err = Replay(&replayConf, &MockFSM{}, events)
+	require.NoError(t, err)
+	require.Equal(t, "heartbeat", report.StoppedBy)
+	require.Equal(t, events[2].Seq, report.StoppedAt)
+}
@@ -16,6 +16,10 @@ import (
 const (
 	maxFailureScale = 12
 	failureWait     = 10 * time.Millisecond
+
+	// maxFailureWait is the longest wait between retries to a follower, when
+	// the wait has been doubled up to maxFailureScale.
+	maxFailureWait = failureWait << (maxFailureScale - 2)
 )
 
 var (
@@ -43,6 +47,10 @@ type followerReplication struct {
 	// which may fall past the end of the log.
 	nextIndex uint64
 
+	// matchIndex is the last index the follower has acknowledged. Unlike
+	// nextIndex - 1, it is never an optimistic guess.
+	matchIndex uint64
+
 	// peer contains the network address and ID of the remote follower.
 	peer Server
 	// peerLock protects 'peer'
@@ -70,7 +78,12 @@ type followerReplication struct {
 	// received from the follower (successful or not). This is used to check
 	// whether the leader should step down (Raft.checkLeaderLease()).
 	lastContact time.Time
-	// lastContactLock protects 'lastContact'.
+	// lastAckSent is when the latest AppendEntries RPC that the follower
+	// accepted was sent. The follower can't have campaigned for a new term
+	// until at least HeartbeatTimeout after this, which is what lease reads
+	// rely on (Raft.checkReadLease()).
+	lastAckSent time.Time
+	// lastContactLock protects 'lastContact' and 'lastAckSent'.
 	lastContactLock sync.RWMutex
 
 	// failures counts the number of failed RPCs since the last success, which is
@@ -90,9 +103,79 @@ type followerReplication struct {
 	// should step down based on information from a follower.
 	stepDown chan struct{}
 
+	// leadershipLostCh is closed when this leader steps down. It is used to
+	// abort long running transfers, such as streaming a snapshot, that
+	// wouldn't otherwise notice until they completed.
+	leadershipLostCh chan struct{}
+
 	// allowPipeline is used to determine when to pipeline the AppendEntries RPCs.
 	// It is private to this replication goroutine.
 	allowPipeline bool
+
+	// stats accumulates the figures reported by ReplicationReport.
+	stats *replicationStats
+
+	// startLimit, if not nil, is shared by this leader's replication
+	// goroutines to bound how many make their initial catch-up at once.
+	startLimit chan struct{}
+
+	// snapshotRate is the rate the follower last reported writing a
+	// snapshot at, which later snapshots sent to it are paced to. It is
+	// private to this replication goroutine.
+	snapshotRate uint64
+
+	// fsmVersion is the FSM version the follower last reported.
+	fsmVersion atomic.Uint64
+
+	// logVersion is the newest log entry version the follower last reported
+	// accepting.
+	logVersion atomic.Uint32
+}
+
+// initialNextIndex returns the index replication to a newly tracked follower
+// should start from. Without a persisted hint this is just past our last log.
+func (r *Raft) initialNextIndex(id ServerID, lastIdx uint64) uint64 {
+	if hint, ok := r.leaderState.progressHints[id]; ok && hint < lastIdx {
+		return hint + 1
+	}
+	return lastIdx + 1
+}
+
+// persistReplicationProgress saves the last index each follower is known to
+// have replicated to the stable store. This must only be called from the main
+// thread.
+func (r *Raft) persistReplicationProgress() {
+	progress := make(map[ServerID]uint64, len(r.leaderState.replState))
+	for id, s := range r.leaderState.replState {
+		// nextIndex runs ahead of what's acknowledged while pipelining, so
+		// only matchIndex is known to be replicated.
+		if match := atomic.LoadUint64(&s.matchIndex); match > 0 {
+			progress[id] = match
+		}
+	}
+	buf, err := encodeMsgPack(progress)
+	if err != nil {
+		r.logger.Error("failed to encode replication progress", "error", err)
+		return
+	}
+	if err := r.stable.Set(keyReplicationProgress, buf.Bytes()); err != nil {
+		r.logger.Error("failed to persist replication progress", "error", err)
+	}
+}
+
+// loadReplicationProgress returns the follower replication progress saved by
+// persistReplicationProgress, or nil if there is none.
+func (r *Raft) loadReplicationProgress() map[ServerID]uint64 {
+	buf, err := r.stable.Get(keyReplicationProgress)
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	var progress map[ServerID]uint64
+	if err := decodeMsgPack(buf, &progress); err != nil {
+		r.logger.Warn("failed to decode replication progress, ignoring", "error", err)
+		return nil
+	}
+	return progress
 }
 
 // notifyAll is used to notify all the waiting verify futures
@@ -105,8 +188,11 @@ func (s *followerReplication) notifyAll(leader bool) {
 	s.notifyLock.Unlock()
 
 	// Submit our votes
+	s.peerLock.RLock()
+	id := s.peer.ID
+	s.peerLock.RUnlock()
 	for v := range n {
-		v.vote(leader)
+		v.vote(id, leader)
 	}
 }
 
@@ -132,6 +218,24 @@ func (s *followerReplication) setLastContact() {
 	s.lastContactLock.Unlock()
 }
 
+// LastAckSent returns when the latest accepted AppendEntries RPC was sent.
+func (s *followerReplication) LastAckSent() time.Time {
+	s.lastContactLock.RLock()
+	sent := s.lastAckSent
+	s.lastContactLock.RUnlock()
+	return sent
+}
+
+// setLastAckSent records that an AppendEntries RPC sent at start was
+// accepted. Responses can arrive out of order, so only later times are kept.
+func (s *followerReplication) setLastAckSent(start time.Time) {
+	s.lastContactLock.Lock()
+	if start.After(s.lastAckSent) {
+		s.lastAckSent = start
+	}
+	s.lastContactLock.Unlock()
+}
+
 // replicate is a long running routine that replicates log entries to a single
 // follower.
 func (r *Raft) replicate(s *followerReplication) {
@@ -140,9 +244,28 @@ func (r *Raft) replicate(s *followerReplication) {
 	defer close(stopHeartbeat)
 	r.goFunc(func() { r.heartbeat(s, stopHeartbeat) })
 
+	// Wait for our turn to make the initial catch-up, if that's limited
+	if s.startLimit != nil {
+		select {
+		case s.startLimit <- struct{}{}:
+		case maxIndex := <-s.stopCh:
+			if maxIndex > 0 {
+				r.replicateTo(s, maxIndex)
+			}
+			return
+		}
+		lastLogIdx, _ := r.getLastLog()
+		shouldStop := r.replicateTo(s, lastLogIdx)
+		<-s.startLimit
+		if shouldStop {
+			return
+		}
+	}
+
 RPC:
 	shouldStop := false
 	for !shouldStop {
+		var woke time.Time
 		select {
 		case maxIndex := <-s.stopCh:
 			// Make a best effort to replicate up to this index
@@ -151,6 +274,7 @@ RPC:
 			}
 			return
 		case deferErr := <-s.triggerDeferErrorCh:
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.replicateTo(s, lastLogIdx)
 			if !shouldStop {
@@ -159,6 +283,7 @@ RPC:
 				deferErr.respond(fmt.Errorf("replication failed"))
 			}
 		case <-s.triggerCh:
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.replicateTo(s, lastLogIdx)
 		// This is _not_ our heartbeat mechanism but is to ensure
@@ -167,9 +292,11 @@ RPC:
 		// can't do this to keep them unblocked by disk IO on the
 		// follower. See https://github.com/hashicorp/raft/issues/282.
 		case <-randomTimeout(r.config().CommitTimeout):
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.replicateTo(s, lastLogIdx)
 		}
+		r.profileLoop(HotLoopReplicate, time.Since(woke))
 
 		// If things looks healthy, switch to pipeline mode
 		if !shouldStop && s.allowPipeline {
@@ -205,12 +332,16 @@ func (r *Raft) replicateTo(s *followerReplication, lastIndex uint64) (shouldStop
 	var resp AppendEntriesResponse
 	var start time.Time
 	var peer Server
+	var rejections uint64
+	var reason SnapshotDecisionReason
+	var matched bool
+	var conf Config
 
 START:
 	// Prevent an excessive retry rate on errors
 	if s.failures > 0 {
 		select {
-		case <-time.After(backoff(failureWait, s.failures, maxFailureScale)):
+		case <-time.After(r.backoffWait(BackoffReplication, s.failures, failureWait, maxFailureWait)):
 		case <-r.shutdownCh:
 		}
 	}
@@ -219,8 +350,21 @@ START:
 	peer = s.peer
 	s.peerLock.RUnlock()
 
+	// Don't send anything to a blocked peer, see BlockPeer
+	if err := r.peerBlocked(peer.Address); err != nil {
+		s.failures++
+		return
+	}
+
+	// Check if the follower is far enough behind that a snapshot is cheaper
+	if r.snapshotCatchupGapExceeded(atomic.LoadUint64(&s.nextIndex)) {
+		reason = SnapshotCatchupGap
+		goto SEND_SNAP
+	}
+
 	// Setup the request
 	if err := r.setupAppendEntries(s, &req, atomic.LoadUint64(&s.nextIndex), lastIndex); err == ErrLogNotFound {
+		reason = SnapshotLogNotFound
 		goto SEND_SNAP
 	} else if err != nil {
 		return
@@ -234,25 +378,32 @@ START:
 		return
 	}
 	appendStats(string(peer.ID), start, float32(len(req.Entries)))
+	s.stats.recordAppend(start, &req)
 
 	// Check for a newer term, stop running
 	if resp.Term > req.Term {
+		r.checkTermInflation(&resp)
 		r.handleStaleTerm(s)
 		return true
 	}
 
 	// Update the last contact
 	s.setLastContact()
+	s.fsmVersion.Store(resp.FSMVersion)
+	s.logVersion.Store(uint32(resp.LogVersion))
 
 	// Update s based on success
 	if resp.Success {
 		// Update our replication state
+		s.setLastAckSent(start)
 		updateLastAppended(s, &req)
 
 		// Clear any failures, allow pipelining
 		s.failures = 0
 		s.allowPipeline = true
+		matched = true
 	} else {
+		matched = false
 		atomic.StoreUint64(&s.nextIndex, max(min(s.nextIndex-1, resp.LastLog+1), 1))
 		if resp.NoRetryBackoff {
 			s.failures = 0
@@ -260,6 +411,12 @@ START:
 			s.failures++
 		}
 		r.logger.Warn("appendEntries rejected, sending older logs", "peer", peer, "next", atomic.LoadUint64(&s.nextIndex))
+
+		rejections++
+		if limit := r.config().SnapshotCatchupRejections; limit > 0 && rejections >= limit {
+			reason = SnapshotCatchupRejections
+			goto SEND_SNAP
+		}
 	}
 
 CHECK_MORE:
@@ -275,14 +432,43 @@ CHECK_MORE:
 	}
 
 	// Check if there are more logs to replicate
-	if atomic.LoadUint64(&s.nextIndex) <= lastIndex {
+	if next := atomic.LoadUint64(&s.nextIndex); next <= lastIndex {
+		conf = r.config()
+		if matched && conf.CatchUpStreams > 1 && next+uint64(conf.MaxAppendEntries) <= lastIndex {
+			goto CATCH_UP
+		}
 		goto START
 	}
 	return
 
+	// CATCH_UP is used when the follower's log matches ours but it's still
+	// more than a batch behind, see catchUpSend
+CATCH_UP:
+	if r.peerBlocked(peer.Address) != nil {
+		s.failures++
+		return
+	}
+	conf = r.config()
+	if stop, ok := r.catchUpSend(s, peer, lastIndex, conf.CatchUpStreams, uint64(conf.MaxAppendEntries)); stop {
+		return true
+	} else if !ok {
+		matched = false
+	}
+	goto CHECK_MORE
+
 	// SEND_SNAP is used when we fail to get a log, usually because the follower
 	// is too far behind, and we must ship a snapshot down instead
 SEND_SNAP:
+	r.logger.Info("sending snapshot to follower", "peer", peer, "reason", reason,
+		"next", atomic.LoadUint64(&s.nextIndex), "last-index", r.getLastIndex())
+	metrics.IncrCounter([]string{"raft", "replication", "snapshotDecision", string(reason)}, 1)
+	r.observe(SnapshotDecisionObservation{
+		Peer:      peer,
+		Reason:    reason,
+		NextIndex: atomic.LoadUint64(&s.nextIndex),
+		LastIndex: r.getLastIndex(),
+	})
+	rejections = 0
 	if stop, err := r.sendLatestSnapshot(s); stop {
 		return true
 	} else if err != nil {
@@ -294,6 +480,19 @@ SEND_SNAP:
 	goto CHECK_MORE
 }
 
+// snapshotCatchupGapExceeded returns true if a follower that needs logs starting
+// at nextIndex is further behind our last log than Config.SnapshotCatchupGap
+// and the latest snapshot would move it forward.
+func (r *Raft) snapshotCatchupGapExceeded(nextIndex uint64) bool {
+	gap := r.config().SnapshotCatchupGap
+	lastIndex := r.getLastIndex()
+	if gap == 0 || lastIndex < nextIndex || lastIndex-nextIndex < gap {
+		return false
+	}
+	snapIndex, _ := r.getLastSnapshot()
+	return snapIndex >= nextIndex
+}
+
 // sendLatestSnapshot is used to send the latest snapshot we have
 // down to our follower.
 func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
@@ -340,7 +539,22 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 	// Make the call
 	start := time.Now()
 	var resp InstallSnapshotResponse
-	if err := r.trans.InstallSnapshot(peer.ID, peer.Address, &req, &resp, snapshot); err != nil {
+	data := &abortableReader{
+		r:          snapshot,
+		abortCh:    s.leadershipLostCh,
+		abortErr:   ErrLeadershipLost,
+		shutdownCh: r.shutdownCh,
+	}
+	if s.snapshotRate > 0 {
+		r.logger.Debug("pacing snapshot to follower's receive rate", "peer", peer, "bytes-per-second", s.snapshotRate)
+		data.limiter = newSnapshotIOLimiter(float64(s.snapshotRate), start)
+	}
+	if err := r.trans.InstallSnapshot(peer.ID, peer.Address, &req, &resp, data); err != nil {
+		if errors.Is(err, ErrLeadershipLost) || errors.Is(err, ErrRaftShutdown) {
+			r.logger.Warn("aborted installing snapshot", "id", snapID, "peer", peer, "error", err)
+			metrics.IncrCounter([]string{"raft", "replication", "installSnapshot", "aborted"}, 1)
+			return true, nil
+		}
 		r.logger.Error("failed to install snapshot", "id", snapID, "error", err)
 		s.failures++
 		return false, err
@@ -358,12 +572,15 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 
 	// Update the last contact
 	s.setLastContact()
+	s.snapshotRate = resp.ReceiveBytesPerSecond
 
 	// Check for success
 	if resp.Success {
 		// Update the indexes
 		atomic.StoreUint64(&s.nextIndex, meta.Index+1)
+		atomic.StoreUint64(&s.matchIndex, meta.Index)
 		s.commitment.match(peer.ID, meta.Index)
+		s.stats.recordSnapshot(meta.Size)
 
 		// Clear any failures
 		s.failures = 0
@@ -382,6 +599,7 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 // since that routine could potentially be blocked on disk IO.
 func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 	var failures uint64
+	var skewed bool
 	req := AppendEntriesRequest{
 		RPCHeader: r.getRPCHeader(),
 		Term:      s.currentTerm,
@@ -404,12 +622,22 @@ func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 		s.peerLock.RUnlock()
 
 		start := time.Now()
-		if err := r.trans.AppendEntries(peer.ID, peer.Address, &req, &resp); err != nil {
-			nextBackoffTime := cappedExponentialBackoff(failureWait, failures, maxFailureScale, r.config().HeartbeatTimeout/2)
+		req.Timestamp = start.UnixMilli()
+		resp.Timestamp = 0
+		err := r.peerBlocked(peer.Address)
+		if err == nil {
+			err = r.trans.AppendEntries(peer.ID, peer.Address, &req, &resp)
+		}
+		if err != nil {
+			failures++
+			maxWait := r.config().HeartbeatTimeout / 2
+			if maxWait > maxFailureWait {
+				maxWait = maxFailureWait
+			}
+			nextBackoffTime := r.backoffWait(BackoffHeartbeat, failures, failureWait, maxWait)
 			r.logger.Error("failed to heartbeat to", "peer", peer.Address, "backoff time",
 				nextBackoffTime, "error", err)
 			r.observe(FailedHeartbeatObservation{PeerID: peer.ID, LastContact: s.LastContact()})
-			failures++
 			select {
 			case <-time.After(nextBackoffTime):
 			case <-stopCh:
@@ -420,16 +648,53 @@ func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 				r.observe(ResumedHeartbeatObservation{PeerID: peer.ID})
 			}
 			s.setLastContact()
+			s.fsmVersion.Store(resp.FSMVersion)
+			s.logVersion.Store(uint32(resp.LogVersion))
 			failures = 0
 			labels := []metrics.Label{{Name: "peer_id", Value: string(peer.ID)}}
 			metrics.MeasureSinceWithLabels([]string{"raft", "replication", "heartbeat"}, start, labels)
 			// Duplicated information. Kept for backward compatibility.
 			metrics.MeasureSince([]string{"raft", "replication", "heartbeat", string(peer.ID)}, start)
+			if resp.Success {
+				s.setLastAckSent(start)
+			}
 			s.notifyAll(resp.Success)
+			skewed = r.checkClockSkew(peer.ID, start, time.Now(), resp.Timestamp, skewed)
 		}
 	}
 }
 
+// checkClockSkew estimates the skew between our clock and a follower's from
+// a heartbeat sent at start and answered at end with the follower's time in
+// Unix milliseconds. The follower's time is assumed to have been taken half
+// way through the round trip. It returns whether the skew exceeds
+// Config.ClockSkewThreshold, given whether it did for the previous heartbeat,
+// warning when that changes.
+func (r *Raft) checkClockSkew(peer ServerID, start, end time.Time, remoteMillis int64, skewed bool) bool {
+	// Older followers don't report their time
+	if remoteMillis == 0 {
+		return skewed
+	}
+	midpoint := start.Add(end.Sub(start) / 2)
+	skew := time.UnixMilli(remoteMillis).Sub(midpoint).Round(time.Millisecond)
+
+	labels := []metrics.Label{{Name: "peer_id", Value: string(peer)}}
+	metrics.SetGaugeWithLabels([]string{"raft", "replication", "clockSkew"}, float32(skew.Milliseconds()), labels)
+
+	threshold := r.config().ClockSkewThreshold
+	exceeded := threshold > 0 && (skew > threshold || skew < -threshold)
+	if exceeded == skewed {
+		return exceeded
+	}
+	if exceeded {
+		r.logger.Warn("clock skew with peer exceeds threshold", "peer", peer, "skew", skew, "threshold", threshold)
+	} else {
+		r.logger.Info("clock skew with peer back within threshold", "peer", peer, "skew", skew)
+	}
+	r.observe(ClockSkewObservation{PeerID: peer, Skew: skew, Exceeded: exceeded})
+	return exceeded
+}
+
 // pipelineReplicate is used when we have synchronized our state with the follower,
 // and want to switch to a higher performance pipeline mode of replication.
 // We only pipeline AppendEntries commands, and if we ever hit an error, we fall
@@ -463,6 +728,7 @@ func (r *Raft) pipelineReplicate(s *followerReplication) error {
 	shouldStop := false
 SEND:
 	for !shouldStop {
+		var woke time.Time
 		select {
 		case <-finishCh:
 			break SEND
@@ -473,6 +739,7 @@ SEND:
 			}
 			break SEND
 		case deferErr := <-s.triggerDeferErrorCh:
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.pipelineSend(s, pipeline, &nextIndex, lastLogIdx)
 			if !shouldStop {
@@ -481,12 +748,15 @@ SEND:
 				deferErr.respond(fmt.Errorf("replication failed"))
 			}
 		case <-s.triggerCh:
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.pipelineSend(s, pipeline, &nextIndex, lastLogIdx)
 		case <-randomTimeout(r.config().CommitTimeout):
+			woke = time.Now()
 			lastLogIdx, _ := r.getLastLog()
 			shouldStop = r.pipelineSend(s, pipeline, &nextIndex, lastLogIdx)
 		}
+		r.profileLoop(HotLoopReplicate, time.Since(woke))
 	}
 
 	// Stop our decoder, and wait for it to finish
@@ -501,6 +771,14 @@ SEND:
 // pipelineSend is used to send data over a pipeline. It is a helper to
 // pipelineReplicate.
 func (r *Raft) pipelineSend(s *followerReplication, p AppendPipeline, nextIdx *uint64, lastIndex uint64) (shouldStop bool) {
+	// Fall back to replicateTo, which backs off, if the peer is blocked
+	s.peerLock.RLock()
+	addr := s.peer.Address
+	s.peerLock.RUnlock()
+	if r.peerBlocked(addr) != nil {
+		return true
+	}
+
 	// Create a new append request
 	req := new(AppendEntriesRequest)
 	if err := r.setupAppendEntries(s, req, *nextIdx, lastIndex); err != nil {
@@ -534,15 +812,19 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 
 			req, resp := ready.Request(), ready.Response()
 			appendStats(string(peer.ID), ready.Start(), float32(len(req.Entries)))
+			s.stats.recordAppend(ready.Start(), req)
 
 			// Check for a newer term, stop running
 			if resp.Term > req.Term {
+				r.checkTermInflation(resp)
 				r.handleStaleTerm(s)
 				return
 			}
 
 			// Update the last contact
 			s.setLastContact()
+			s.fsmVersion.Store(resp.FSMVersion)
+			s.logVersion.Store(uint32(resp.LogVersion))
 
 			// Abort pipeline if not successful
 			if !resp.Success {
@@ -550,6 +832,7 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 			}
 
 			// Update our replication state
+			s.setLastAckSent(ready.Start())
 			updateLastAppended(s, req)
 		case <-stopCh:
 			return
@@ -570,9 +853,31 @@ func (r *Raft) setupAppendEntries(s *followerReplication, req *AppendEntriesRequ
 	if err := r.setNewLogs(req, nextIndex, lastIndex); err != nil {
 		return err
 	}
+	s.peerLock.RLock()
+	witness := s.peer.Suffrage == Witness
+	s.peerLock.RUnlock()
+	if witness {
+		stripLogData(req.Entries)
+	}
 	return nil
 }
 
+// stripLogData removes the payload from command entries so only their headers
+// are replicated to a witness. Configuration entries are kept intact since the
+// witness needs them to track membership. The checksums of stripped entries
+// are recomputed to match. The entries must be owned by the caller since they
+// are modified in place.
+func stripLogData(entries []*Log) {
+	for _, entry := range entries {
+		switch entry.Type {
+		case LogCommand, LogBarrier, LogExpiry, LogSchedule:
+			entry.Data = nil
+			entry.Extensions = nil
+			entry.SetChecksum()
+		}
+	}
+}
+
 // setPreviousLog is used to setup the PrevLogEntry and PrevLogTerm for an
 // AppendEntriesRequest given the next index to replicate.
 func (r *Raft) setPreviousLog(req *AppendEntriesRequest, nextIndex uint64) error {
@@ -637,6 +942,22 @@ func (r *Raft) handleStaleTerm(s *followerReplication) {
 	asyncNotifyCh(s.stepDown)
 }
 
+// checkTermInflation is used when a follower responds with a newer term. If
+// Config.TermInflationGuard is set and the follower's log is behind ours, so
+// it can't win an election, it arranges for the leader loop to stand for
+// re-election in the follower's term rather than just stepping down.
+func (r *Raft) checkTermInflation(resp *AppendEntriesResponse) {
+	if !r.config().TermInflationGuard || resp.LastLog >= r.getLastIndex() {
+		return
+	}
+	for {
+		term := r.inflatedTerm.Load()
+		if resp.Term <= term || r.inflatedTerm.CompareAndSwap(term, resp.Term) {
+			return
+		}
+	}
+}
+
 // updateLastAppended is used to update follower replication state after a
 // successful AppendEntries RPC.
 // TODO: This isn't used during InstallSnapshot, but the code there is similar.
@@ -645,6 +966,7 @@ func updateLastAppended(s *followerReplication, req *AppendEntriesRequest) {
 	if logs := req.Entries; len(logs) > 0 {
 		last := logs[len(logs)-1]
 		atomic.StoreUint64(&s.nextIndex, last.Index+1)
+		atomic.StoreUint64(&s.matchIndex, last.Index)
 		s.commitment.match(s.peer.ID, last.Index)
 	}
 
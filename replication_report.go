@@ -0,0 +1,209 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+const (
+	// replicationReportWindow is how far back snapshot installs are counted
+	// in a ReplicationReport.
+	replicationReportWindow = 10 * time.Minute
+
+	// ackLatencyWeight is the weight given to each new sample in the moving
+	// average of a follower's ack latency.
+	ackLatencyWeight = 0.1
+)
+
+// ReplicationReport describes how well the leader is replicating to each of
+// its followers, so that slow followers can be identified. It can be
+// marshalled to JSON for machines, and String formats it as a table for
+// humans.
+type ReplicationReport struct {
+	// LastIndex is the leader's last log index when the report was built.
+	LastIndex uint64 `json:"last_index"`
+
+	// SnapshotWindow is how far back PeerReplicationReport.SnapshotInstalls
+	// counts.
+	SnapshotWindow time.Duration `json:"snapshot_window"`
+
+	// Peers has an entry for every server the leader replicates to, sorted
+	// in configuration order.
+	Peers []PeerReplicationReport `json:"peers"`
+}
+
+// PeerReplicationReport describes replication to a single follower. All
+// figures cover the current leadership term only.
+type PeerReplicationReport struct {
+	ID       ServerID       `json:"id"`
+	Address  ServerAddress  `json:"address"`
+	Suffrage ServerSuffrage `json:"suffrage"`
+
+	// AckLatency is a moving average of the time taken for the follower to
+	// respond to AppendEntries RPCs carrying log entries. Heartbeats are not
+	// included since they don't wait for the follower's disk.
+	AckLatency time.Duration `json:"ack_latency"`
+
+	// BytesPerSecond is the average rate of log entry and snapshot data sent
+	// to the follower since this server became leader.
+	BytesPerSecond float64 `json:"bytes_per_second"`
+
+	// SnapshotInstalls is the number of snapshots installed on the follower
+	// within the report's SnapshotWindow.
+	SnapshotInstalls int `json:"snapshot_installs"`
+
+	// MatchIndex is the last index the follower is known to have replicated
+	// and Lag is how many entries it is behind the leader's last index.
+	MatchIndex uint64 `json:"match_index"`
+	Lag        uint64 `json:"lag"`
+
+	// LastContact is how long ago the follower last responded to any RPC.
+	LastContact time.Duration `json:"last_contact"`
+}
+
+// String formats the report as a table.
+func (r ReplicationReport) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAddress\tSuffrage\tAck Latency\tBytes/sec\tSnapshots\tMatch Index\tLag\tLast Contact")
+	for _, p := range r.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.0f\t%d\t%d\t%d\t%s\n",
+			p.ID, p.Address, p.Suffrage, p.AckLatency, p.BytesPerSecond,
+			p.SnapshotInstalls, p.MatchIndex, p.Lag, p.LastContact)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// replicationReportFuture is used to build a ReplicationReport on the main
+// thread.
+type replicationReportFuture struct {
+	deferError
+	report ReplicationReport
+}
+
+// ReplicationReport returns statistics about replication to each follower.
+// Must be run on the leader, or it will fail.
+func (r *Raft) ReplicationReport() (ReplicationReport, error) {
+	future := &replicationReportFuture{}
+	future.init()
+	select {
+	case <-r.shutdownCh:
+		return ReplicationReport{}, ErrRaftShutdown
+	case r.replicationReportCh <- future:
+	}
+	if err := future.Error(); err != nil {
+		return ReplicationReport{}, err
+	}
+	return future.report, nil
+}
+
+// replicationReport builds a ReplicationReport from the leader state. This
+// must only be called from the main thread while leader.
+func (r *Raft) replicationReport() ReplicationReport {
+	now := time.Now()
+	lastIndex := r.getLastIndex()
+	report := ReplicationReport{
+		LastIndex:      lastIndex,
+		SnapshotWindow: replicationReportWindow,
+	}
+	for _, server := range allServers(r.configurations.latest) {
+		s, ok := r.leaderState.replState[server.ID]
+		if !ok {
+			continue
+		}
+		match := atomic.LoadUint64(&s.matchIndex)
+		peer := PeerReplicationReport{
+			ID:         server.ID,
+			Address:    server.Address,
+			Suffrage:   server.Suffrage,
+			MatchIndex: match,
+		}
+		if match < lastIndex {
+			peer.Lag = lastIndex - match
+		}
+		if last := s.LastContact(); !last.IsZero() {
+			peer.LastContact = now.Sub(last)
+		}
+		peer.AckLatency, peer.BytesPerSecond, peer.SnapshotInstalls = s.stats.summary(now)
+		report.Peers = append(report.Peers, peer)
+	}
+	return report
+}
+
+// replicationStats accumulates the figures for a follower reported by
+// ReplicationReport. It is updated by the replication goroutines and read from
+// the main thread.
+type replicationStats struct {
+	lock       sync.Mutex
+	started    time.Time
+	ackLatency time.Duration
+	bytes      uint64
+	snapshots  []time.Time
+}
+
+func newReplicationStats() *replicationStats {
+	return &replicationStats{started: time.Now()}
+}
+
+// recordAppend records an AppendEntries RPC that was started at the given
+// time and has now been answered.
+func (s *replicationStats) recordAppend(start time.Time, req *AppendEntriesRequest) {
+	if len(req.Entries) == 0 {
+		return
+	}
+	latency := time.Since(start)
+	var n uint64
+	for _, entry := range req.Entries {
+		n += uint64(len(entry.Data) + len(entry.Extensions))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ackLatency == 0 {
+		s.ackLatency = latency
+	} else {
+		s.ackLatency += time.Duration(ackLatencyWeight * float64(latency-s.ackLatency))
+	}
+	s.bytes += n
+}
+
+// recordSnapshot records a snapshot of the given size that was installed on
+// the follower.
+func (s *replicationStats) recordSnapshot(size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bytes += uint64(size)
+	s.snapshots = append(s.snapshots, time.Now())
+}
+
+// summary returns the average ack latency, the bytes sent per second and the
+// number of snapshots installed within replicationReportWindow.
+func (s *replicationStats) summary(now time.Time) (time.Duration, float64, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Forget snapshots that have fallen out of the window
+	cutoff := now.Add(-replicationReportWindow)
+	i := 0
+	for i < len(s.snapshots) && s.snapshots[i].Before(cutoff) {
+		i++
+	}
+	s.snapshots = s.snapshots[i:]
+
+	var rate float64
+	if elapsed := now.Sub(s.started).Seconds(); elapsed > 0 {
+		rate = float64(s.bytes) / elapsed
+	}
+	return s.ackLatency, rate, len(s.snapshots)
+}
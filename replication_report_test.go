@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_ReplicationReport(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	}
+	c.WaitForReplication(10)
+
+	report, err := leader.ReplicationReport()
+	require.NoError(t, err)
+	require.Equal(t, leader.LastIndex(), report.LastIndex)
+	require.Equal(t, replicationReportWindow, report.SnapshotWindow)
+	require.Len(t, report.Peers, 2)
+	for _, peer := range report.Peers {
+		require.NotEqual(t, leader.localID, peer.ID)
+		require.Equal(t, Voter, peer.Suffrage)
+		require.Greater(t, peer.AckLatency, time.Duration(0))
+		require.Greater(t, peer.BytesPerSecond, float64(0))
+		require.Zero(t, peer.SnapshotInstalls)
+		require.Equal(t, report.LastIndex-peer.MatchIndex, peer.Lag)
+	}
+
+	// Human and machine readable.
+	table := report.String()
+	require.True(t, strings.HasPrefix(table, "ID "))
+	for _, peer := range report.Peers {
+		require.Contains(t, table, string(peer.ID))
+	}
+	buf, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"ack_latency"`)
+
+	// Only the leader can report.
+	_, err = c.Followers()[0].ReplicationReport()
+	require.ErrorIs(t, err, ErrNotLeader)
+}
+
+func TestReplicationStats_summary(t *testing.T) {
+	now := time.Now()
+	s := &replicationStats{started: now.Add(-10 * time.Second)}
+
+	s.recordAppend(now.Add(-time.Second), &AppendEntriesRequest{})
+	latency, rate, snapshots := s.summary(now)
+	require.Zero(t, latency, "heartbeats shouldn't count towards ack latency")
+	require.Zero(t, rate)
+	require.Zero(t, snapshots)
+
+	s.recordAppend(time.Now(), &AppendEntriesRequest{Entries: []*Log{{Data: make([]byte, 100)}}})
+	s.recordSnapshot(900)
+	s.snapshots = append([]time.Time{now.Add(-2 * replicationReportWindow)}, s.snapshots...)
+	_, rate, snapshots = s.summary(now)
+	require.InDelta(t, 100, rate, 1)
+	require.Equal(t, 1, snapshots, "snapshots outside the window shouldn't be counted")
+}
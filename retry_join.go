@@ -0,0 +1,177 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+const (
+	// defaultRetryJoinInterval is used when Config.RetryJoinInterval is zero.
+	defaultRetryJoinInterval = time.Second
+
+	// maxRetryJoinScale caps the RetryJoin backoff at this many times
+	// Config.RetryJoinInterval.
+	maxRetryJoinScale = 16
+)
+
+// runRetryJoin is a long running goroutine that asks the servers in
+// Config.RetryJoin to add this server to the cluster, until one of them does
+// or it runs out of attempts.
+func (r *Raft) runRetryJoin() {
+	trans, ok := r.trans.(WithJoin)
+	if !ok {
+		r.logger.Error("retry join is configured but the transport doesn't support joining")
+		return
+	}
+
+	conf := r.config()
+	interval := conf.RetryJoinInterval
+	if interval == 0 {
+		interval = defaultRetryJoinInterval
+	}
+	for attempt := 1; ; attempt++ {
+		// Stop once we're part of a configuration, however we got there.
+		if inConfiguration(r.getLatestConfiguration(), r.localID) {
+			return
+		}
+
+		err := r.retryJoinOnce(trans, conf.RetryJoin)
+		if err == nil {
+			r.logger.Info("joined cluster", "attempts", attempt)
+			return
+		}
+		metrics.IncrCounter([]string{"raft", "retryJoin", "failed"}, 1)
+		if conf.RetryJoinMaxAttempts > 0 && attempt >= conf.RetryJoinMaxAttempts {
+			r.logger.Error("giving up joining cluster", "attempts", attempt, "error", err)
+			return
+		}
+
+		wait := r.backoffWait(BackoffRetryJoin, uint64(attempt), interval, maxRetryJoinScale*interval)
+		r.logger.Warn("failed to join cluster, will retry", "attempt", attempt, "backoff time", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-r.shutdownCh:
+			return
+		}
+	}
+}
+
+// retryJoinOnce asks each of the seeds in turn to add this server, following
+// a redirect to the leader if a seed isn't the leader itself.
+func (r *Raft) retryJoinOnce(trans WithJoin, seeds []string) error {
+	var errs []error
+	for _, seed := range seeds {
+		target := ServerAddress(seed)
+		if target == r.localAddr {
+			continue
+		}
+		err := r.sendJoin(trans, target)
+		var redirect *joinRedirectError
+		if errors.As(err, &redirect) && redirect.leader != "" && redirect.leader != r.localAddr {
+			err = r.sendJoin(trans, redirect.leader)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no servers to join other than this one")
+	}
+	return errors.Join(errs...)
+}
+
+// joinRedirectError is returned by sendJoin when the target isn't the leader.
+type joinRedirectError struct {
+	target ServerAddress
+	leader ServerAddress
+}
+
+func (e *joinRedirectError) Error() string {
+	if e.leader == "" {
+		return fmt.Sprintf("%s is not the leader and doesn't know of one", e.target)
+	}
+	return fmt.Sprintf("%s is not the leader, the leader is %s", e.target, e.leader)
+}
+
+// sendJoin sends a single JoinRequest to target.
+func (r *Raft) sendJoin(trans WithJoin, target ServerAddress) error {
+	req := &JoinRequest{
+		RPCHeader: r.getRPCHeader(),
+		ID:        r.localID,
+		Address:   r.localAddr,
+	}
+	var resp JoinResponse
+	if err := trans.Join("", target, req, &resp); err != nil {
+		return fmt.Errorf("failed to join via %s: %w", target, err)
+	}
+	if !resp.Success {
+		return &joinRedirectError{target: target, leader: resp.Leader}
+	}
+	return nil
+}
+
+// join is invoked when we get a Join RPC call. This must only be called from
+// the main thread.
+func (r *Raft) join(rpc RPC, req *JoinRequest) {
+	defer metrics.MeasureSince([]string{"raft", "rpc", "join"}, time.Now())
+	resp := &JoinResponse{RPCHeader: r.getRPCHeader()}
+	if r.getState() != Leader {
+		resp.Leader, _ = r.LeaderWithID()
+		rpc.Respond(resp, nil)
+		return
+	}
+
+	authorize := r.config().AuthorizeJoin
+	if authorize == nil {
+		rpc.Respond(resp, fmt.Errorf("%w: joining isn't enabled on the leader", ErrJoinRefused))
+		return
+	}
+	if string(req.RPCHeader.ID) != string(req.ID) || r.trans.DecodePeer(req.RPCHeader.Addr) != req.Address {
+		rpc.Respond(resp, fmt.Errorf("%w: servers can only ask to add themselves", ErrJoinRefused))
+		return
+	}
+
+	// A server that's already known may only join under the same ID and
+	// address, so one can't take over another's identity.
+	for _, server := range r.configurations.latest.Servers {
+		if server.ID != req.ID && server.Address != req.Address {
+			continue
+		}
+		if server.ID != req.ID || server.Address != req.Address {
+			rpc.Respond(resp, fmt.Errorf("%w: %s at %s conflicts with server %s at %s",
+				ErrJoinRefused, req.ID, req.Address, server.ID, server.Address))
+			return
+		}
+		if server.Suffrage != Nonvoter {
+			resp.Success = true
+			rpc.Respond(resp, nil)
+			return
+		}
+	}
+
+	// The change is made by the main thread, which is busy handling this RPC,
+	// so wait for it elsewhere.
+	r.goFunc(func() {
+		if err := authorize(req.ID, req.Address); err != nil {
+			r.logger.Warn("refused server that asked to join", "id", req.ID, "address", req.Address, "error", err)
+			rpc.Respond(resp, fmt.Errorf("%w: %v", ErrJoinRefused, err))
+			return
+		}
+		r.logger.Info("adding server that asked to join", "id", req.ID, "address", req.Address)
+		err := r.requestConfigChange(configurationChangeRequest{
+			command:       AddVoter,
+			serverID:      req.ID,
+			serverAddress: req.Address,
+			requester:     req.ID,
+		}, 0).Error()
+		resp.Success = err == nil
+		rpc.Respond(resp, err)
+	})
+}
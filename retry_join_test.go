@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaft_RetryJoin(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.AuthorizeJoin = func(id ServerID, address ServerAddress) error { return nil }
+	c := MakeCluster(2, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Seed the new server with an unreachable address and a follower, which
+	// redirects it to the leader.
+	joinConf := inmemConfig(t)
+	joinConf.RetryJoin = []string{"unreachable", string(c.Followers()[0].localAddr)}
+	joinConf.RetryJoinInterval = 10 * time.Millisecond
+	c1 := MakeClusterNoBootstrap(1, t, joinConf)
+	joiner := c1.rafts[0]
+	c.Merge(c1)
+	c.FullyConnect()
+
+	require.Eventually(t, func() bool {
+		future := leader.GetConfiguration()
+		return future.Error() == nil && hasVote(future.Configuration(), joiner.localID)
+	}, c.propagateTimeout*5, 10*time.Millisecond)
+	require.NoError(t, leader.Apply([]byte("test"), c.propagateTimeout).Error())
+	c.WaitForReplication(1)
+}
+
+func TestRaft_JoinRefused(t *testing.T) {
+	var authorized ServerID
+	conf := inmemConfig(t)
+	conf.AuthorizeJoin = func(id ServerID, address ServerAddress) error {
+		if id != authorized {
+			return errors.New("not expected")
+		}
+		return nil
+	}
+	c := MakeCluster(2, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+
+	c1 := MakeClusterNoBootstrap(1, t, inmemConfig(t))
+	joiner := c1.rafts[0]
+	c.Merge(c1)
+	c.FullyConnect()
+	trans := c.trans[c.IndexOf(joiner)]
+	join := func(req *JoinRequest) error {
+		var resp JoinResponse
+		return trans.(WithJoin).Join(leader.localID, leader.localAddr, req, &resp)
+	}
+	req := func(id ServerID, addr ServerAddress) *JoinRequest {
+		return &JoinRequest{
+			RPCHeader: RPCHeader{
+				ProtocolVersion: ProtocolVersionMax,
+				ID:              []byte(id),
+				Addr:            trans.EncodePeer(id, addr),
+			},
+			ID:      id,
+			Address: addr,
+		}
+	}
+
+	// A server the hook doesn't expect isn't added.
+	err := join(req(joiner.localID, joiner.localAddr))
+	require.ErrorContains(t, err, ErrJoinRefused.Error())
+
+	// Nor is one claiming to be another server.
+	impostor := req(joiner.localID, joiner.localAddr)
+	impostor.ID, impostor.Address = "other", "other-addr"
+	require.ErrorContains(t, join(impostor), ErrJoinRefused.Error())
+
+	// Nor one taking over an existing server's ID, whatever the hook says.
+	authorized = follower.localID
+	require.ErrorContains(t, join(req(follower.localID, joiner.localAddr)), ErrJoinRefused.Error())
+
+	authorized = joiner.localID
+	require.NoError(t, join(req(joiner.localID, joiner.localAddr)))
+	future := leader.GetConfiguration()
+	require.NoError(t, future.Error())
+	require.Len(t, future.Configuration().Servers, 3)
+	for _, server := range future.Configuration().Servers {
+		if server.ID == follower.localID {
+			require.Equal(t, follower.localAddr, server.Address)
+		}
+	}
+}
@@ -33,6 +33,10 @@ type saturationMetric struct {
 
 	lastReport, sleepBegan, workBegan time.Time
 
+	// iterationFn, if set, is called with the time spent working each time
+	// the loop goes back to sleep.
+	iterationFn func(worked time.Duration)
+
 	// These are overwritten in tests.
 	nowFn    func() time.Time
 	reportFn func(float32)
@@ -61,6 +65,9 @@ func (s *saturationMetric) sleeping() {
 		// measuring nonsense.
 		s.lost += now.Sub(s.sleepBegan)
 	}
+	if s.iterationFn != nil && !s.workBegan.IsZero() {
+		s.iterationFn(now.Sub(s.workBegan))
+	}
 
 	s.sleepBegan = now
 	s.workBegan = time.Time{}
@@ -145,3 +145,24 @@ func TestSaturationMetric_IncorrectUsage(t *testing.T) {
 		require.Equal(t, float32(0.5), reported)
 	})
 }
+
+func TestSaturationMetric_Iterations(t *testing.T) {
+	sat := newSaturationMetric([]string{"metric"}, time.Second)
+	now := sat.lastReport
+	sat.nowFn = func() time.Time { return now }
+	var iterations []time.Duration
+	sat.iterationFn = func(d time.Duration) { iterations = append(iterations, d) }
+
+	sat.sleeping()
+	now = now.Add(50 * time.Millisecond)
+	sat.working()
+	now = now.Add(20 * time.Millisecond)
+	sat.sleeping()
+	now = now.Add(10 * time.Millisecond)
+	sat.working()
+	now = now.Add(30 * time.Millisecond)
+	sat.sleeping()
+
+	// Only the time spent working is reported.
+	require.Equal(t, []time.Duration{20 * time.Millisecond, 30 * time.Millisecond}, iterations)
+}
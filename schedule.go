@@ -0,0 +1,291 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// Schedule says when a command given to ApplyAt should be applied. If both
+// Index and Time are set, it waits for both. If neither is, it's applied as
+// soon as the LogSchedule entry holding it commits.
+type Schedule struct {
+	// Index holds the command back until the commit index reaches it.
+	Index uint64
+
+	// Time holds the command back until the leader's clock reaches it.
+	Time time.Time
+}
+
+// scheduledCommand is the Data of a LogSchedule entry.
+type scheduledCommand struct {
+	Index      uint64
+	UnixNano   int64
+	Data       []byte
+	Extensions []byte
+	TTL        time.Duration
+}
+
+// ready returns whether the command is due, and when it will be if it's only
+// waiting on the clock.
+func (c *scheduledCommand) ready(now time.Time, commitIndex uint64) (bool, time.Time) {
+	if c.Index > commitIndex {
+		return false, time.Time{}
+	}
+	if c.UnixNano != 0 {
+		if at := time.Unix(0, c.UnixNano); at.After(now) {
+			return false, at
+		}
+	}
+	return true, time.Time{}
+}
+
+// ApplyAt is like Apply, but the command is only applied once the cluster
+// reaches the given Schedule, so a change can be made on every server at the
+// same point, such as a schema cutover. The command is first committed in a
+// LogSchedule entry, whose index the returned future holds. Every server
+// tracks the committed LogSchedule entries, so whichever is leader when the
+// schedule is reached appends the command as a LogCommand entry with
+// ScheduledIndex set to that index, which FSMs can use to tell it apart.
+// Schedules that haven't been reached are kept in snapshots, so they aren't
+// forgotten by a server that restores one. This must be run on the leader or
+// it will fail, and fails with ErrLogFieldsUnsupported until every server in
+// the configuration supports schedules. A schedule reached while a server
+// that doesn't is in the configuration waits until it's upgraded or removed.
+func (r *Raft) ApplyAt(cmd []byte, at Schedule, timeout time.Duration) ApplyFuture {
+	return r.ApplyLogAt(Log{Data: cmd}, at, timeout)
+}
+
+// ApplyLogAt is like ApplyAt, but takes a Log in the same way as ApplyLog.
+func (r *Raft) ApplyLogAt(log Log, at Schedule, timeout time.Duration) ApplyFuture {
+	metrics.IncrCounter([]string{"raft", "apply", "scheduled"}, 1)
+	// Raised before draining is checked, as in applyLog.
+	r.applyWaiting.Add(1)
+	defer r.applyWaiting.Add(-1)
+	if r.draining.Load() {
+		return errorFuture{ErrRaftShutdown}
+	}
+
+	cmd := scheduledCommand{
+		Index:      at.Index,
+		Data:       log.Data,
+		Extensions: log.Extensions,
+		TTL:        log.TTL,
+	}
+	if !at.Time.IsZero() {
+		cmd.UnixNano = at.Time.UnixNano()
+	}
+	buf, err := encodeMsgPack(cmd)
+	if err != nil {
+		return errorFuture{fmt.Errorf("failed to encode scheduled command: %v", err)}
+	}
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	logFuture := &logFuture{
+		log: Log{
+			Type: LogSchedule,
+			Data: buf.Bytes(),
+		},
+		enqueue: time.Now(),
+	}
+	logFuture.init()
+
+	select {
+	case <-timer:
+		return errorFuture{ErrEnqueueTimeout}
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.applyCh <- logFuture:
+		return logFuture
+	}
+}
+
+// scheduleTracker records the committed LogSchedule entries whose command
+// hasn't been committed yet. It is updated by the main thread as entries are
+// committed, so every server tracks the same schedules and any of them can
+// take over dispatching them when it becomes leader. The pending schedules
+// are kept in snapshots, see snapshotState. As commits run ahead of the FSM,
+// a snapshot may hold schedules from after its index, or miss ones whose
+// command committed after it, but either way the entries after the snapshot
+// are committed again on top of it, which puts the tracker right.
+type scheduleTracker struct {
+	lock    sync.Mutex
+	pending map[uint64]scheduledCommand
+
+	// notifyCh is notified when a schedule is added, so the leader can
+	// arrange for it.
+	notifyCh chan struct{}
+}
+
+func newScheduleTracker() *scheduleTracker {
+	return &scheduleTracker{
+		pending:  make(map[uint64]scheduledCommand),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// track updates the tracker for an entry that has been committed.
+func (t *scheduleTracker) track(l *Log) error {
+	switch {
+	case l.Type == LogSchedule:
+		var cmd scheduledCommand
+		if err := decodeMsgPack(l.Data, &cmd); err != nil {
+			return fmt.Errorf("failed to decode scheduled command at index %d: %v", l.Index, err)
+		}
+		t.lock.Lock()
+		t.pending[l.Index] = cmd
+		t.lock.Unlock()
+		asyncNotifyCh(t.notifyCh)
+	case l.Type == LogCommand && l.ScheduledIndex > 0:
+		t.lock.Lock()
+		delete(t.pending, l.ScheduledIndex)
+		t.lock.Unlock()
+	}
+	return nil
+}
+
+// scheduleState is a pending schedule as it's kept in a snapshot.
+type scheduleState struct {
+	Index   uint64
+	Command scheduledCommand
+}
+
+// snapshot returns the pending schedules, in index order, to be kept in a
+// snapshot.
+func (t *scheduleTracker) snapshot() []scheduleState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	states := make([]scheduleState, 0, len(t.pending))
+	for index, cmd := range t.pending {
+		states = append(states, scheduleState{Index: index, Command: cmd})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Index < states[j].Index })
+	return states
+}
+
+// restore replaces the pending schedules with those kept in a snapshot.
+func (t *scheduleTracker) restore(states []scheduleState) {
+	t.lock.Lock()
+	t.pending = make(map[uint64]scheduledCommand, len(states))
+	for _, s := range states {
+		t.pending[s.Index] = s.Command
+	}
+	t.lock.Unlock()
+	asyncNotifyCh(t.notifyCh)
+}
+
+// due returns the indexes of the schedules that have been reached at now and
+// commitIndex, other than those in skip, and the earliest time one of the rest
+// that is only waiting on the clock will be, which is zero if there are none.
+// Indexes in skip that are no longer pending are removed from it.
+func (t *scheduleTracker) due(now time.Time, commitIndex uint64, skip map[uint64]struct{}) ([]uint64, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for index := range skip {
+		if _, ok := t.pending[index]; !ok {
+			delete(skip, index)
+		}
+	}
+
+	var due []uint64
+	var next time.Time
+	for index, cmd := range t.pending {
+		if _, ok := skip[index]; ok {
+			continue
+		}
+		ready, at := cmd.ready(now, commitIndex)
+		if ready {
+			due = append(due, index)
+		} else if !at.IsZero() && (next.IsZero() || at.Before(next)) {
+			next = at
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	return due, next
+}
+
+// command returns the command of a pending schedule.
+func (t *scheduleTracker) command(index uint64) scheduledCommand {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.pending[index]
+}
+
+// scheduleTimer fires when the next schedule waiting on the clock is due.
+type scheduleTimer struct {
+	ch   <-chan time.Time
+	next time.Time
+}
+
+// reset arms the timer for next, or disarms it if next is zero. It's left
+// alone if it's already armed for next, so that frequent calls don't pile up
+// timers.
+func (s *scheduleTimer) reset(next time.Time) {
+	if s.ch != nil && next.Equal(s.next) {
+		return
+	}
+	s.next = next
+	s.ch = nil
+	if !next.IsZero() {
+		s.ch = time.After(time.Until(next))
+	}
+}
+
+// fired must be called when the timer fires, before it's reset.
+func (s *scheduleTimer) fired() {
+	s.ch = nil
+}
+
+// dispatchScheduled appends a LogCommand entry for each schedule that has been
+// reached, returning when the next one waiting on the clock is due, or zero if
+// there are none. This must only be called from the main thread while leader.
+func (r *Raft) dispatchScheduled() time.Time {
+	// Wait for an entry from this term to commit first. By then every command
+	// dispatched by an earlier leader that will ever commit has been, and so
+	// isn't dispatched again.
+	commitIndex := r.getCommitIndex()
+	if commitIndex < r.leaderState.commitment.startIndex {
+		return time.Time{}
+	}
+
+	now := time.Now()
+	due, next := r.schedules.due(now, commitIndex, r.leaderState.scheduling)
+	if len(due) > 0 && r.clusterLogVersion() < (&Log{ScheduledIndex: due[0]}).requiredVersion() {
+		// A server has joined that can't apply scheduled commands, so hold
+		// them until it's upgraded or removed.
+		return now.Add(r.config().CommitTimeout)
+	}
+	if len(due) > 0 {
+		futures := make([]*logFuture, 0, len(due))
+		for _, index := range due {
+			cmd := r.schedules.command(index)
+			// Nobody waits on these, they're applied like any other entry.
+			future := &logFuture{log: Log{
+				Type:           LogCommand,
+				Data:           cmd.Data,
+				Extensions:     cmd.Extensions,
+				TTL:            cmd.TTL,
+				ScheduledIndex: index,
+			}}
+			future.init()
+			futures = append(futures, future)
+			r.leaderState.scheduling[index] = struct{}{}
+		}
+		metrics.IncrCounter([]string{"raft", "leader", "scheduled"}, float32(len(futures)))
+		r.dispatchLogs(futures)
+	}
+	return next
+}
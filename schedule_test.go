@@ -0,0 +1,200 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func scheduleEntry(t *testing.T, index uint64, cmd scheduledCommand) *Log {
+	buf, err := encodeMsgPack(cmd)
+	require.NoError(t, err)
+	return &Log{Index: index, Type: LogSchedule, Data: buf.Bytes()}
+}
+
+func TestScheduleTracker(t *testing.T) {
+	tr := newScheduleTracker()
+	now := time.Now()
+
+	require.NoError(t, tr.track(scheduleEntry(t, 1, scheduledCommand{Index: 10, Data: []byte("index")})))
+	require.NoError(t, tr.track(scheduleEntry(t, 2, scheduledCommand{UnixNano: now.Add(time.Second).UnixNano(), Data: []byte("time")})))
+	require.NoError(t, tr.track(scheduleEntry(t, 3, scheduledCommand{Index: 10, UnixNano: now.Add(2 * time.Second).UnixNano()})))
+	require.NoError(t, tr.track(scheduleEntry(t, 4, scheduledCommand{})))
+	require.Error(t, tr.track(&Log{Index: 5, Type: LogSchedule, Data: []byte("junk")}))
+	select {
+	case <-tr.notifyCh:
+	default:
+		t.Fatalf("expected a notification")
+	}
+
+	// Only the one without a target is due.
+	skip := make(map[uint64]struct{})
+	due, next := tr.due(now, 5, skip)
+	require.Equal(t, []uint64{4}, due)
+	require.Equal(t, time.Unix(0, now.Add(time.Second).UnixNano()), next)
+
+	// The index target is reached, but entry 3 is still waiting on the
+	// clock.
+	skip[4] = struct{}{}
+	due, next = tr.due(now, 10, skip)
+	require.Equal(t, []uint64{1}, due)
+	require.Equal(t, time.Unix(0, now.Add(time.Second).UnixNano()), next)
+
+	due, next = tr.due(now.Add(3*time.Second), 10, skip)
+	require.Equal(t, []uint64{1, 2, 3}, due)
+	require.True(t, next.IsZero())
+	require.Equal(t, []byte("time"), tr.command(2).Data)
+
+	// Committing the command removes the schedule, and it's dropped from
+	// skip.
+	require.NoError(t, tr.track(&Log{Index: 6, Type: LogCommand, ScheduledIndex: 4}))
+	due, _ = tr.due(now, 10, skip)
+	require.Equal(t, []uint64{1}, due)
+	require.Empty(t, skip)
+
+	// The pending schedules survive a round trip through a snapshot, and
+	// restoring one replaces what was there.
+	restored := newScheduleTracker()
+	require.NoError(t, restored.track(scheduleEntry(t, 7, scheduledCommand{})))
+	restored.restore(tr.snapshot())
+	require.Equal(t, tr.snapshot(), restored.snapshot())
+	require.Equal(t, []byte("time"), restored.command(2).Data)
+}
+
+func TestScheduleTimer(t *testing.T) {
+	var s scheduleTimer
+	s.reset(time.Time{})
+	require.Nil(t, s.ch)
+
+	next := time.Now().Add(10 * time.Millisecond)
+	s.reset(next)
+	ch := s.ch
+	require.NotNil(t, ch)
+
+	// Resetting for the same time keeps the timer.
+	s.reset(next)
+	require.True(t, ch == s.ch)
+	<-s.ch
+	s.fired()
+	s.reset(next)
+	require.False(t, ch == s.ch)
+
+	s.reset(time.Time{})
+	require.Nil(t, s.ch)
+}
+
+// countCommand returns how many times cmd was applied to the FSM.
+func countCommand(fsm FSM, cmd []byte) int {
+	var n int
+	for _, l := range getMockFSM(fsm).Logs() {
+		if bytes.Equal(l, cmd) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRaft_ApplyAt_Index(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	target := leader.LastIndex() + 20
+	future := leader.ApplyAt([]byte("cutover"), Schedule{Index: target}, 0)
+	require.NoError(t, future.Error())
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	for _, fsm := range c.fsms {
+		require.Zero(t, countCommand(fsm, []byte("cutover")))
+	}
+
+	for leader.LastIndex() < target {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	retry(t, func() bool {
+		for _, fsm := range c.fsms {
+			if countCommand(fsm, []byte("cutover")) != 1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The command is marked with the schedule it came from.
+	require.NoError(t, leader.Barrier(0).Error())
+	var found bool
+	for i := future.Index() + 1; i <= leader.LastIndex(); i++ {
+		var entry Log
+		require.NoError(t, leader.logs.GetLog(i, &entry))
+		if bytes.Equal(entry.Data, []byte("cutover")) {
+			require.Equal(t, LogCommand, entry.Type)
+			require.Equal(t, future.Index(), entry.ScheduledIndex)
+			require.Greater(t, entry.Index, target)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestRaft_ApplyAt_TimeAcrossLeaderChange(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	at := time.Now().Add(500 * time.Millisecond)
+	require.NoError(t, leader.ApplyAt([]byte("cutover"), Schedule{Time: at}, 0).Error())
+	require.NoError(t, leader.Barrier(0).Error())
+
+	// Whoever is leader when the time comes applies it, just once.
+	require.NoError(t, leader.LeadershipTransfer().Error())
+	newLeader := c.Leader()
+	require.NotEqual(t, leader.localID, newLeader.localID)
+
+	retry(t, func() bool {
+		for _, fsm := range c.fsms {
+			if countCommand(fsm, []byte("cutover")) != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	require.False(t, time.Now().Before(at))
+	require.NoError(t, newLeader.Barrier(0).Error())
+	time.Sleep(50 * time.Millisecond)
+	for _, fsm := range c.fsms {
+		require.Equal(t, 1, countCommand(fsm, []byte("cutover")))
+	}
+}
+
+func TestRaft_ApplyAt_Snapshot(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 0
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	// A schedule that's compacted into a snapshot before it's reached is
+	// kept in the snapshot.
+	leader := c.Leader()
+	target := leader.LastIndex() + 1000
+	future := leader.ApplyAt([]byte("cutover"), Schedule{Index: target}, 0)
+	require.NoError(t, future.Error())
+	require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	require.NoError(t, leader.Snapshot().Error())
+
+	// A server that joins and is sent the snapshot tracks it too, so it
+	// can dispatch it if it becomes leader.
+	c1 := MakeClusterNoBootstrap(1, t, inmemConfig(t))
+	c.Merge(c1)
+	c.FullyConnect()
+	joined := c1.rafts[0]
+	require.NoError(t, leader.AddNonvoter(joined.localID, joined.localAddr, 0, 0).Error())
+	retry(t, func() bool { return joined.schedules.command(future.Index()).Index == target })
+	require.Equal(t, []byte("cutover"), joined.schedules.command(future.Index()).Data)
+}
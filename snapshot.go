@@ -36,6 +36,11 @@ type SnapshotMeta struct {
 
 	// Size is the size of the snapshot in bytes.
 	Size int64
+
+	// CreatedAt is when the snapshot was created in the store, which for a
+	// snapshot received from the leader is when this server started
+	// receiving it. It's zero if the store doesn't record it.
+	CreatedAt time.Time
 }
 
 // SnapshotStore interface is used to allow for flexible implementations
@@ -74,14 +79,16 @@ func (r *Raft) runSnapshots() {
 		select {
 		case <-randomTimeout(r.config().SnapshotInterval):
 			// Check if we should snapshot
-			if !r.shouldSnapshot() {
+			if !r.shouldSnapshot() || r.snapshotSuppressed() {
 				continue
 			}
 
 			// Trigger a snapshot
-			if _, err := r.takeSnapshot(); err != nil {
+			_, err := r.takeSnapshot()
+			if err != nil {
 				r.logger.Error("failed to take snapshot", "error", err)
 			}
+			r.snapshotDone(err)
 
 		case future := <-r.userSnapshotCh:
 			// User-triggered, run immediately
@@ -93,6 +100,7 @@ func (r *Raft) runSnapshots() {
 					return r.snapshots.Open(id)
 				}
 			}
+			r.snapshotDone(err)
 			future.respond(err)
 
 		case <-r.shutdownCh:
@@ -178,31 +186,34 @@ func (r *Raft) takeSnapshot() (string, error) {
 	// Create a new snapshot.
 	r.logger.Info("starting snapshot up to", "index", snapReq.index)
 	start := time.Now()
-	version := getSnapshotVersion(r.protocolVersion)
+	version := snapshotVersion(r.protocolVersion, snapReq.snapshot)
 	sink, err := r.snapshots.Create(version, snapReq.index, snapReq.term, committed, committedIndex, r.trans)
 	if err != nil {
-		return "", fmt.Errorf("failed to create snapshot: %v", err)
+		return "", snapshotStoreError{fmt.Errorf("failed to create snapshot: %v", err)}
 	}
 	metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
+	if r.snapshotIO != nil {
+		sink = r.snapshotIO.wrapSink(sink)
+	}
 
 	// Try to persist the snapshot.
 	start = time.Now()
 	if err := snapReq.snapshot.Persist(sink); err != nil {
 		sink.Cancel()
-		return "", fmt.Errorf("failed to persist snapshot: %v", err)
+		return "", snapshotStoreError{fmt.Errorf("failed to persist snapshot: %v", err)}
 	}
 	metrics.MeasureSince([]string{"raft", "snapshot", "persist"}, start)
 
 	// Close and check for error.
 	if err := sink.Close(); err != nil {
-		return "", fmt.Errorf("failed to close snapshot: %v", err)
+		return "", snapshotStoreError{fmt.Errorf("failed to close snapshot: %v", err)}
 	}
 
 	// Update the last stable snapshot info.
 	r.setLastSnapshot(snapReq.index, snapReq.term)
 
 	// Compact the logs.
-	if err := r.compactLogs(snapReq.index); err != nil {
+	if err := r.compactSnapshotLogs(snapReq.index); err != nil {
 		return "", err
 	}
 
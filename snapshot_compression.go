@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// SnapshotCompressor compresses snapshots as they're written to a
+// FileSnapshotStore, set with FileSnapshotStore.SetCompressor. The name of the
+// compressor is recorded in each snapshot's metadata, and snapshots are
+// decompressed when opened. Encrypted data doesn't compress, so there's no
+// gain from compressing the snapshots of an EncryptedSnapshotStore this way.
+type SnapshotCompressor interface {
+	// Name identifies the algorithm in snapshot metadata, so it mustn't
+	// change while there are snapshots using it.
+	Name() string
+
+	// NewWriter returns a writer compressing what's written to it into w.
+	// Closing it must flush all the data to w, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader decompressing what's read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// NewGzipSnapshotCompressor returns a SnapshotCompressor using gzip from the
+// standard library at the given level, such as gzip.BestSpeed. Algorithms like
+// zstd can be used by implementing SnapshotCompressor with a library providing
+// them.
+func NewGzipSnapshotCompressor(level int) (SnapshotCompressor, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return gzipSnapshotCompressor{level: level}, nil
+}
+
+type gzipSnapshotCompressor struct {
+	level int
+}
+
+// Name implements the SnapshotCompressor interface.
+func (c gzipSnapshotCompressor) Name() string {
+	return "gzip"
+}
+
+// NewWriter implements the SnapshotCompressor interface.
+func (c gzipSnapshotCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+// NewReader implements the SnapshotCompressor interface.
+func (c gzipSnapshotCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// snapshotCompressor returns the compressor recorded for a snapshot: the
+// store's own if the name matches, or the built in gzip compressor, which can
+// read snapshots written at any level.
+func (f *FileSnapshotStore) snapshotCompressor(name string) (SnapshotCompressor, bool) {
+	if f.compressor != nil && f.compressor.Name() == name {
+		return f.compressor, true
+	}
+	if name == "gzip" {
+		return gzipSnapshotCompressor{level: gzip.DefaultCompression}, true
+	}
+	return nil, false
+}
+
+// compressedFile is returned when opening a compressed snapshot, so that both
+// the decompressor and the file get closed.
+type compressedFile struct {
+	io.ReadCloser
+	fh *os.File
+}
+
+// Close implements the io.Closer interface.
+func (c *compressedFile) Close() error {
+	c.ReadCloser.Close()
+	return c.fh.Close()
+}
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// renamedCompressor is gzip under another name.
+type renamedCompressor struct {
+	SnapshotCompressor
+}
+
+func (renamedCompressor) Name() string {
+	return "renamed"
+}
+
+func TestFileSS_Compression(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSnapshotStoreWithLogger(dir, 3, newTestLogger(t))
+	require.NoError(t, err)
+	c, err := NewGzipSnapshotCompressor(gzip.BestSpeed)
+	require.NoError(t, err)
+	store.SetCompressor(c)
+
+	data := bytes.Repeat([]byte("compressible "), 10000)
+	_, trans := NewInmemTransport(NewInmemAddr())
+	sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = sink.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	// The state file is compressed, but the metadata has the full size.
+	stat, err := os.Stat(filepath.Join(store.path, sink.ID(), stateFilePath))
+	require.NoError(t, err)
+	require.Less(t, stat.Size(), int64(len(data)/10))
+	snaps, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, int64(len(data)), snaps[0].Size)
+
+	read := func(store *FileSnapshotStore) ([]byte, error) {
+		meta, rc, err := store.Open(sink.ID())
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		require.Equal(t, int64(len(data)), meta.Size)
+		return io.ReadAll(rc)
+	}
+	got, err := read(store)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// A store without a compressor can still open gzip snapshots.
+	plain, err := NewFileSnapshotStoreWithLogger(dir, 3, newTestLogger(t))
+	require.NoError(t, err)
+	got, err = read(plain)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// But not those using a compressor it doesn't have.
+	store.SetCompressor(renamedCompressor{c})
+	sink, err = store.Create(SnapshotVersionMax, 11, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = sink.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	got, err = read(store)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	_, err = read(plain)
+	require.ErrorContains(t, err, "unknown snapshot compression")
+}
@@ -0,0 +1,347 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+const (
+	// encryptedSnapshotChunkSize is how much plaintext is sealed at a time.
+	encryptedSnapshotChunkSize = 64 * 1024
+
+	// encryptedSnapshotVersion is the version of the encrypted format. Version
+	// 2 added the key ID to the header; version 1 snapshots can still be read.
+	encryptedSnapshotVersion = 2
+)
+
+// encryptedSnapshotMagic starts every encrypted snapshot.
+var encryptedSnapshotMagic = []byte("RSNE")
+
+// ErrSnapshotNotEncrypted is returned when opening a snapshot through an
+// EncryptedSnapshotStore that wasn't written by one.
+var ErrSnapshotNotEncrypted = errors.New("snapshot is not encrypted")
+
+// SnapshotKeyProvider supplies the keys used to encrypt snapshots, typically
+// backed by a key management service holding a key encryption key that never
+// leaves it.
+type SnapshotKeyProvider interface {
+	// GenerateDataKey returns a new AES key of 16, 24 or 32 bytes for
+	// encrypting a single snapshot, along with the same key wrapped
+	// (encrypted) by the provider. Only the wrapped key is stored.
+	GenerateDataKey() (key, wrapped []byte, err error)
+
+	// UnwrapDataKey returns the key wrapped by GenerateDataKey.
+	UnwrapDataKey(wrapped []byte) ([]byte, error)
+
+	// KeyID identifies the key the provider wraps data keys with. It's
+	// recorded in each snapshot's header, so RotateFileSnapshotKeys can tell
+	// which snapshots already use it. It must be at most 255 bytes.
+	KeyID() string
+}
+
+// EncryptedSnapshotStore wraps a SnapshotStore so the snapshots it stores are
+// encrypted, protecting backups kept off the server. Each snapshot is
+// encrypted with AES-GCM under its own data key from a SnapshotKeyProvider,
+// and the wrapped data key is recorded in a header ahead of the encrypted
+// data. Snapshots are decrypted when opened, so what's restored or sent to
+// other servers is unchanged.
+//
+// The sizes returned by List are those of the encrypted snapshots, while Open
+// returns the size of the decrypted data.
+type EncryptedSnapshotStore struct {
+	store SnapshotStore
+	keys  SnapshotKeyProvider
+}
+
+// NewEncryptedSnapshotStore returns an EncryptedSnapshotStore storing
+// snapshots in store, encrypted with keys from keys.
+func NewEncryptedSnapshotStore(store SnapshotStore, keys SnapshotKeyProvider) *EncryptedSnapshotStore {
+	return &EncryptedSnapshotStore{store: store, keys: keys}
+}
+
+// Create implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) Create(version SnapshotVersion, index, term uint64,
+	configuration Configuration, configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	sink, err := e.store.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := newEncryptedSnapshotSink(sink, e.keys)
+	if err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// List implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) List() ([]*SnapshotMeta, error) {
+	return e.store.List()
+}
+
+// Open implements the SnapshotStore interface.
+func (e *EncryptedSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := e.store.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, size, err := newEncryptedSnapshotReader(rc, meta.Size, e.keys)
+	if err != nil {
+		rc.Close()
+		return nil, nil, fmt.Errorf("failed to open snapshot %s: %w", id, err)
+	}
+
+	// Report the size of the plaintext, which is what gets restored and sent
+	// to other servers.
+	decrypted := *meta
+	decrypted.Size = size
+	return &decrypted, r, nil
+}
+
+// newEncryptedSnapshotSink writes the header for a new data key from keys to
+// sink, and returns a sink encrypting what's written to it under that key.
+func newEncryptedSnapshotSink(sink SnapshotSink, keys SnapshotKeyProvider) (*encryptedSnapshotSink, error) {
+	key, wrapped, err := keys.GenerateDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate snapshot data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("wrapped snapshot data key too long (%d bytes)", len(wrapped))
+	}
+	keyID := keys.KeyID()
+	if len(keyID) > 0xff {
+		return nil, fmt.Errorf("snapshot key ID too long (%d bytes)", len(keyID))
+	}
+	aead, err := newSnapshotAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptedSnapshotMagic)+4+len(keyID)+len(wrapped))
+	header = append(header, encryptedSnapshotMagic...)
+	header = append(header, encryptedSnapshotVersion)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, wrapped...)
+	if _, err := sink.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot header: %w", err)
+	}
+	return &encryptedSnapshotSink{
+		SnapshotSink: sink,
+		aead:         aead,
+		buf:          make([]byte, 0, encryptedSnapshotChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// newEncryptedSnapshotReader reads the header of the encrypted snapshot in
+// rc, of size bytes, and returns a reader decrypting it along with the size
+// of the plaintext.
+func newEncryptedSnapshotReader(rc io.ReadCloser, size int64, keys SnapshotKeyProvider) (*encryptedSnapshotReader, int64, error) {
+	r := bufio.NewReaderSize(rc, encryptedSnapshotChunkSize)
+	_, wrapped, headerLen, err := readEncryptedSnapshotHeader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := keys.UnwrapDataKey(wrapped)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newSnapshotAEAD(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := size - headerLen
+	sealed := int64(encryptedSnapshotChunkSize + aead.Overhead())
+	chunks := (body + sealed - 1) / sealed
+	plain := body - chunks*int64(aead.Overhead())
+	if plain < 0 {
+		return nil, 0, fmt.Errorf("encrypted data truncated")
+	}
+	return &encryptedSnapshotReader{
+		r:      r,
+		closer: rc,
+		aead:   aead,
+		chunk:  make([]byte, sealed),
+	}, plain, nil
+}
+
+// readEncryptedSnapshotHeader reads the header of an encrypted snapshot,
+// returning the key ID, the wrapped data key and the length of the header.
+// The key ID is empty for snapshots written before it was recorded.
+func readEncryptedSnapshotHeader(r io.Reader) (string, []byte, int64, error) {
+	fixed := make([]byte, len(encryptedSnapshotMagic)+3)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return "", nil, 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	if !bytes.Equal(fixed[:len(encryptedSnapshotMagic)], encryptedSnapshotMagic) {
+		return "", nil, 0, ErrSnapshotNotEncrypted
+	}
+	version := fixed[len(encryptedSnapshotMagic)]
+	if version != 1 && version != encryptedSnapshotVersion {
+		return "", nil, 0, fmt.Errorf("unsupported encrypted snapshot version %d", version)
+	}
+	headerLen := int64(len(fixed))
+	var keyID []byte
+	if version >= 2 {
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", nil, 0, fmt.Errorf("failed to read header: %w", err)
+		}
+		keyID = make([]byte, n[0])
+		if _, err := io.ReadFull(r, keyID); err != nil {
+			return "", nil, 0, fmt.Errorf("failed to read header: %w", err)
+		}
+		headerLen += 1 + int64(len(keyID))
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(fixed[len(encryptedSnapshotMagic)+1:]))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return "", nil, 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	return string(keyID), wrapped, headerLen + int64(len(wrapped)), nil
+}
+
+// newSnapshotAEAD returns the AES-GCM cipher for a snapshot's data key.
+func newSnapshotAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// snapshotChunkNonce returns the nonce for the chunk at the given position.
+// Data keys are never reused, so a counter is enough to keep nonces unique.
+// The final chunk is marked so a truncated snapshot fails to decrypt.
+func snapshotChunkNonce(aead cipher.AEAD, seq uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, seq)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptedSnapshotSink encrypts what's written to it in chunks.
+type encryptedSnapshotSink struct {
+	SnapshotSink
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+
+	// closed is set once the last chunk is sealed, since both the FSM and
+	// Raft may close the sink.
+	closed bool
+}
+
+// Write implements the io.Writer interface. A full chunk is only sealed once
+// more data follows it, so the last chunk is always sealed by Close.
+func (s *encryptedSnapshotSink) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("snapshot sink is closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == encryptedSnapshotChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):encryptedSnapshotChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close implements the io.Closer interface.
+func (s *encryptedSnapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.seal(true); err != nil {
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	return s.SnapshotSink.Close()
+}
+
+// seal encrypts the buffered chunk and writes it to the underlying sink.
+func (s *encryptedSnapshotSink) seal(last bool) error {
+	sealed := s.aead.Seal(s.buf[:0], snapshotChunkNonce(s.aead, s.seq, last), s.buf, nil)
+	s.seq++
+	s.buf = s.buf[:0]
+	if _, err := s.SnapshotSink.Write(sealed); err != nil {
+		return fmt.Errorf("failed to write encrypted snapshot: %w", err)
+	}
+	return nil
+}
+
+// encryptedSnapshotReader decrypts a snapshot written by an
+// encryptedSnapshotSink.
+type encryptedSnapshotReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	chunk  []byte
+	plain  []byte
+	seq    uint64
+	done   bool
+}
+
+// Read implements the io.Reader interface.
+func (e *encryptedSnapshotReader) Read(p []byte) (int, error) {
+	for len(e.plain) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.plain)
+	e.plain = e.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (e *encryptedSnapshotReader) open() error {
+	n, err := io.ReadFull(e.r, e.chunk)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		e.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := e.r.Peek(1); err == io.EOF {
+			e.done = true
+		}
+	}
+	plain, err := e.aead.Open(e.chunk[:0], snapshotChunkNonce(e.aead, e.seq, e.done), e.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt snapshot: %w", err)
+	}
+	e.seq++
+	e.plain = plain
+	return nil
+}
+
+// Close implements the io.Closer interface.
+func (e *encryptedSnapshotReader) Close() error {
+	return e.closer.Close()
+}
@@ -0,0 +1,204 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyProvider wraps data keys with a fixed key encryption key.
+type testKeyProvider struct {
+	id  string
+	kek cipher.AEAD
+}
+
+func newTestKeyProvider(t *testing.T) *testKeyProvider {
+	t.Helper()
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	aead, err := newSnapshotAEAD(kek)
+	require.NoError(t, err)
+	return &testKeyProvider{id: hex.EncodeToString(kek[:8]), kek: aead}
+}
+
+func (p *testKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, p.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, p.kek.Seal(nonce, nonce, key, nil), nil
+}
+
+func (p *testKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	n := p.kek.NonceSize()
+	return p.kek.Open(nil, wrapped[:n], wrapped[n:], nil)
+}
+
+func (p *testKeyProvider) KeyID() string {
+	return p.id
+}
+
+func TestEncryptedSnapshotStore(t *testing.T) {
+	for _, size := range []int{0, 10, encryptedSnapshotChunkSize, 3*encryptedSnapshotChunkSize + 100} {
+		inner := NewInmemSnapshotStore()
+		store := NewEncryptedSnapshotStore(inner, newTestKeyProvider(t))
+
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		_, trans := NewInmemTransport(NewInmemAddr())
+		sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+		require.NoError(t, err)
+		// Write in odd sized pieces to cross chunk boundaries.
+		for rest := data; len(rest) > 0; {
+			n := 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err := sink.Write(rest[:n])
+			require.NoError(t, err)
+			rest = rest[n:]
+		}
+		require.NoError(t, sink.Close())
+		// Closing again, as Raft does after the FSM closes the sink, has no
+		// effect.
+		require.NoError(t, sink.Close())
+
+		// The stored snapshot doesn't hold the data.
+		_, rc, err := inner.Open(sink.ID())
+		require.NoError(t, err)
+		stored, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		if size > 0 {
+			require.False(t, bytes.Contains(stored, data))
+		}
+
+		meta, rc, err := store.Open(sink.ID())
+		require.NoError(t, err)
+		require.Equal(t, int64(size), meta.Size)
+		require.Equal(t, uint64(10), meta.Index)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, data, got)
+	}
+}
+
+func TestEncryptedSnapshotStore_Tampering(t *testing.T) {
+	inner := NewInmemSnapshotStore()
+	store := NewEncryptedSnapshotStore(inner, newTestKeyProvider(t))
+	_, trans := NewInmemTransport(NewInmemAddr())
+	sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = sink.Write(make([]byte, 2*encryptedSnapshotChunkSize))
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	read := func() error {
+		_, rc, err := store.Open(sink.ID())
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}
+	require.NoError(t, read())
+
+	// Dropping the final chunk is detected.
+	contents := inner.latest.contents
+	full := append([]byte(nil), contents.Bytes()...)
+	contents.Truncate(len(full) - 100)
+	require.Error(t, read())
+
+	// As is modifying the data.
+	contents.Reset()
+	contents.Write(full)
+	contents.Bytes()[len(full)/2] ^= 1
+	require.Error(t, read())
+
+	// Snapshots that aren't encrypted can't be opened.
+	plain := NewInmemSnapshotStore()
+	plainSink, err := plain.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, trans)
+	require.NoError(t, err)
+	_, err = plainSink.Write([]byte("plaintext snapshot"))
+	require.NoError(t, err)
+	require.NoError(t, plainSink.Close())
+	_, _, err = NewEncryptedSnapshotStore(plain, newTestKeyProvider(t)).Open(plainSink.ID())
+	require.ErrorIs(t, err, ErrSnapshotNotEncrypted)
+}
+
+func TestReadEncryptedSnapshotHeader(t *testing.T) {
+	// Version 1 headers have no key ID.
+	header := append([]byte("RSNE"), 1, 0, 3, 'k', 'e', 'y')
+	keyID, wrapped, n, err := readEncryptedSnapshotHeader(bytes.NewReader(header))
+	require.NoError(t, err)
+	require.Empty(t, keyID)
+	require.Equal(t, []byte("key"), wrapped)
+	require.Equal(t, int64(len(header)), n)
+
+	header = append([]byte("RSNE"), 2, 0, 3, 2, 'i', 'd', 'k', 'e', 'y')
+	keyID, wrapped, n, err = readEncryptedSnapshotHeader(bytes.NewReader(header))
+	require.NoError(t, err)
+	require.Equal(t, "id", keyID)
+	require.Equal(t, []byte("key"), wrapped)
+	require.Equal(t, int64(len(header)), n)
+}
+
+func TestRaft_EncryptedSnapshotStore(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	keys := newTestKeyProvider(t)
+
+	// Restart the server with its snapshots encrypted.
+	restart := func() *Raft {
+		r := c.rafts[0]
+		require.NoError(t, r.Shutdown().Error())
+		_, trans := NewInmemTransport(r.trans.LocalAddr())
+		cfg := r.config()
+		store := r.snapshots
+		if _, ok := store.(*EncryptedSnapshotStore); !ok {
+			store = NewEncryptedSnapshotStore(store, keys)
+		}
+		r, err := NewRaft(&cfg, r.fsm, r.logs, r.stable, store, trans)
+		require.NoError(t, err)
+		c.rafts[0] = r
+		return r
+	}
+	restart()
+	leader := c.Leader()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Apply([]byte("test"), 0).Error())
+	}
+	snap := leader.Snapshot()
+	require.NoError(t, snap.Error())
+	meta, rc, err := snap.Open()
+	require.NoError(t, err)
+	rc.Close()
+
+	// The server restores from the encrypted snapshot on startup.
+	r := restart()
+	require.Equal(t, meta.Index, r.getLastApplied())
+}
+
+func TestNewSnapshotAEAD_BadKey(t *testing.T) {
+	_, err := newSnapshotAEAD([]byte("short"))
+	require.ErrorAs(t, err, new(aes.KeySizeError))
+}
@@ -0,0 +1,193 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// snapshotIOBufferSize is how much a snapshot sink buffers before handing the
+// write to the snapshot I/O pool, so FSMs writing in small pieces don't pay
+// for a hand off each time.
+const snapshotIOBufferSize = 64 * 1024
+
+// snapshotIOPool runs the I/O of persisting snapshots on a bounded set of
+// goroutines, each locked to its own OS thread with its I/O priority lowered
+// where the platform supports it, so that background snapshots compete less
+// with the log for the disk. Where the priority can't be lowered, the I/O is
+// throttled to a number of bytes per second instead, if one is configured.
+//
+// Restores aren't run on the pool, since the server can't make progress until
+// they're done.
+type snapshotIOPool struct {
+	reqCh      chan *snapshotIOReq
+	limiter    *snapshotIOLimiter
+	shutdownCh <-chan struct{}
+	logger     hclog.Logger
+}
+
+// snapshotIOReq is a piece of I/O for the pool to run.
+type snapshotIOReq struct {
+	fn     func() (int, error)
+	n      int
+	err    error
+	doneCh chan struct{}
+}
+
+// newSnapshotIOPool returns a pool for the given configuration, or nil if
+// snapshot I/O should be done inline. Its workers must be started with run.
+func newSnapshotIOPool(conf *Config, shutdownCh <-chan struct{}, logger hclog.Logger) *snapshotIOPool {
+	if conf.SnapshotIOWorkers <= 0 && conf.SnapshotIOBytesPerSecond <= 0 {
+		return nil
+	}
+	p := &snapshotIOPool{
+		reqCh:      make(chan *snapshotIOReq),
+		shutdownCh: shutdownCh,
+		logger:     logger,
+	}
+	if conf.SnapshotIOBytesPerSecond > 0 {
+		p.limiter = newSnapshotIOLimiter(float64(conf.SnapshotIOBytesPerSecond), time.Now())
+	}
+	return p
+}
+
+// workers returns how many workers the pool should run.
+func (p *snapshotIOPool) workers(conf *Config) int {
+	if conf.SnapshotIOWorkers > 0 {
+		return conf.SnapshotIOWorkers
+	}
+	return 1
+}
+
+// run is a long running goroutine that does the pool's I/O until shutdown.
+func (p *snapshotIOPool) run() {
+	// The thread is never unlocked, so it exits with the goroutine rather
+	// than going back to the scheduler with a lowered priority.
+	runtime.LockOSThread()
+	limiter := p.limiter
+	if err := lowerIOPriority(); err != nil {
+		p.logger.Debug("unable to lower snapshot I/O priority", "error", err, "throttled", limiter != nil)
+	} else {
+		limiter = nil
+	}
+
+	for {
+		select {
+		case req := <-p.reqCh:
+			req.n, req.err = req.fn()
+			if limiter != nil {
+				select {
+				case <-time.After(limiter.reserve(req.n, time.Now())):
+				case <-p.shutdownCh:
+				}
+			}
+			close(req.doneCh)
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+// do runs fn, which returns how many bytes it read or wrote, on the pool.
+func (p *snapshotIOPool) do(fn func() (int, error)) (int, error) {
+	req := &snapshotIOReq{fn: fn, doneCh: make(chan struct{})}
+	select {
+	case p.reqCh <- req:
+	case <-p.shutdownCh:
+		return 0, ErrRaftShutdown
+	}
+	// Workers always finish the requests they take.
+	<-req.doneCh
+	return req.n, req.err
+}
+
+// wrapSink returns a sink whose writes and close are run on the pool.
+func (p *snapshotIOPool) wrapSink(sink SnapshotSink) SnapshotSink {
+	s := &snapshotIOSink{SnapshotSink: sink, pool: p}
+	s.buffered = bufio.NewWriterSize(snapshotIOWriter{s}, snapshotIOBufferSize)
+	return s
+}
+
+// snapshotIOSink is a SnapshotSink whose I/O is run on a snapshotIOPool.
+type snapshotIOSink struct {
+	SnapshotSink
+	pool     *snapshotIOPool
+	buffered *bufio.Writer
+	closed   bool
+}
+
+// snapshotIOWriter writes to the underlying sink on the pool.
+type snapshotIOWriter struct {
+	s *snapshotIOSink
+}
+
+// Write implements the io.Writer interface.
+func (w snapshotIOWriter) Write(b []byte) (int, error) {
+	return w.s.pool.do(func() (int, error) {
+		return w.s.SnapshotSink.Write(b)
+	})
+}
+
+// Write implements the io.Writer interface.
+func (s *snapshotIOSink) Write(b []byte) (int, error) {
+	return s.buffered.Write(b)
+}
+
+// Close implements the io.Closer interface. It's safe to call more than once,
+// as FSMs usually close the sink themselves before Raft does.
+func (s *snapshotIOSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.buffered.Flush(); err != nil {
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	_, err := s.pool.do(func() (int, error) {
+		return 0, s.SnapshotSink.Close()
+	})
+	return err
+}
+
+// Cancel implements the SnapshotSink interface.
+func (s *snapshotIOSink) Cancel() error {
+	s.closed = true
+	return s.SnapshotSink.Cancel()
+}
+
+// snapshotIOLimiter is a token bucket limiting snapshot I/O to a number of
+// bytes per second, in bursts of up to a second's worth.
+type snapshotIOLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newSnapshotIOLimiter(rate float64, now time.Time) *snapshotIOLimiter {
+	return &snapshotIOLimiter{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait before
+// the I/O that used them is within the limit.
+func (l *snapshotIOLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
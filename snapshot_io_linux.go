@@ -0,0 +1,34 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+// +build linux
+
+package raft
+
+import "syscall"
+
+const (
+	// ioprioWhoProcess makes ioprio_set apply to a single thread when given
+	// a thread ID, or the calling thread when given zero.
+	ioprioWhoProcess = 1
+
+	// ioprioClassBestEffort is the default scheduling class, within which
+	// level 7 is the lowest priority. The idle class isn't used since it can
+	// starve snapshots completely on a busy disk.
+	ioprioClassBestEffort = 2
+	ioprioClassShift      = 13
+	ioprioLowestLevel     = 7
+)
+
+// lowerIOPriority lowers the I/O priority of the calling thread, like
+// ionice -c2 -n7. It only takes effect with I/O schedulers that honor
+// priorities, such as BFQ.
+func lowerIOPriority() error {
+	prio := ioprioClassBestEffort<<ioprioClassShift | ioprioLowestLevel
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+// +build !linux
+
+package raft
+
+import "errors"
+
+// lowerIOPriority isn't supported on this platform.
+func lowerIOPriority() error {
+	return errors.New("I/O priorities are not supported on this platform")
+}
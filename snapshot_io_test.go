@@ -0,0 +1,103 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIOLimiter(t *testing.T) {
+	now := time.Now()
+	l := newSnapshotIOLimiter(1000, now)
+
+	// A second's worth is allowed straight away.
+	require.Zero(t, l.reserve(600, now))
+	require.Zero(t, l.reserve(400, now))
+
+	// Then it has to wait for the bucket to refill.
+	require.Equal(t, 500*time.Millisecond, l.reserve(500, now))
+	require.Equal(t, 250*time.Millisecond, l.reserve(0, now.Add(250*time.Millisecond)))
+
+	// The bucket doesn't fill past a second's worth.
+	require.Zero(t, l.reserve(1000, now.Add(time.Hour)))
+	require.Equal(t, time.Second, l.reserve(1000, now.Add(time.Hour)))
+}
+
+func TestSnapshotIOPool(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.SnapshotIOWorkers = 2
+	shutdownCh := make(chan struct{})
+	p := newSnapshotIOPool(conf, shutdownCh, newTestLogger(t))
+	require.NotNil(t, p)
+	for i := 0; i < p.workers(conf); i++ {
+		go p.run()
+	}
+
+	store := NewInmemSnapshotStore()
+	sink, err := store.Create(SnapshotVersionMax, 10, 3, Configuration{}, 2, nil)
+	require.NoError(t, err)
+	sink = p.wrapSink(sink)
+
+	// Write more than the buffer in small pieces.
+	var expected bytes.Buffer
+	for i := 0; expected.Len() < 3*snapshotIOBufferSize; i++ {
+		chunk := []byte(fmt.Sprintf("chunk %d\n", i))
+		expected.Write(chunk)
+		_, err := sink.Write(chunk)
+		require.NoError(t, err)
+	}
+	require.NoError(t, sink.Close())
+	require.NoError(t, sink.Close())
+
+	_, rc, err := store.Open(sink.ID())
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes(), data)
+
+	// Nothing more is done after shutdown.
+	close(shutdownCh)
+	_, err = p.do(func() (int, error) { return 0, nil })
+	require.ErrorIs(t, err, ErrRaftShutdown)
+
+	// Without any options I/O is done inline.
+	require.Nil(t, newSnapshotIOPool(inmemConfig(t), shutdownCh, newTestLogger(t)))
+}
+
+func TestRaft_SnapshotIO(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.SnapshotIOWorkers = 1
+	conf.SnapshotIOBytesPerSecond = 1 << 20
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	var future ApplyFuture
+	for i := 0; i < 100; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	require.NoError(t, future.Error())
+	require.NoError(t, leader.Snapshot().Error())
+
+	snaps, err := leader.snapshots.List()
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+	require.Equal(t, future.Index(), snaps[0].Index)
+
+	// The snapshot is complete enough to restore.
+	meta, rc, err := leader.snapshots.Open(snaps[0].ID)
+	require.NoError(t, err)
+	defer rc.Close()
+	fsm := &MockFSM{}
+	require.NoError(t, fsm.Restore(rc))
+	require.Len(t, fsm.logs, 100)
+	require.Equal(t, snaps[0].Size, meta.Size)
+}
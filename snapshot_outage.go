@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// snapshotStoreBackoffFactor is how many times SnapshotInterval the wait
+// between snapshot attempts grows to while the snapshot store is failing.
+const snapshotStoreBackoffFactor = 32
+
+// SnapshotStoreObservation is sent each time a snapshot fails because the
+// snapshot store couldn't create, write or close it, and once the store
+// works again. While it's failing, consensus carries on as usual, but
+// snapshots are attempted less often, and the log isn't compacted so it
+// grows.
+type SnapshotStoreObservation struct {
+	// Available is false when a snapshot has failed, and true once one
+	// succeeds again.
+	Available bool
+	// Failures is how many snapshots in a row have failed.
+	Failures uint64
+	// Error is the error the snapshot failed with.
+	Error error
+	// Since is when the first of the failures happened.
+	Since time.Time
+	// RetryAt is when the next snapshot will be attempted, unless one is
+	// asked for with Snapshot.
+	RetryAt time.Time
+}
+
+// snapshotStoreError marks an error from the snapshot store, as opposed to
+// one from the FSM or from there being nothing to snapshot.
+type snapshotStoreError struct {
+	err error
+}
+
+func (e snapshotStoreError) Error() string {
+	return e.err.Error()
+}
+
+func (e snapshotStoreError) Unwrap() error {
+	return e.err
+}
+
+// snapshotOutage tracks failures of the snapshot store. It's only used from
+// the snapshot goroutine.
+type snapshotOutage struct {
+	failures uint64
+	since    time.Time
+	retryAt  time.Time
+
+	// retainFrom is the first entry that wasn't covered by a snapshot when
+	// the store started failing. Entries from it onwards are kept, within
+	// Config.SnapshotOutageLogBudget, by the first compaction after the store
+	// recovers. It's zero if there's nothing to keep.
+	retainFrom uint64
+}
+
+// snapshotSuppressed returns true if automatic snapshots are being held off
+// because the snapshot store has been failing.
+func (r *Raft) snapshotSuppressed() bool {
+	o := &r.snapshotOutage
+	return o.failures > 0 && time.Now().Before(o.retryAt)
+}
+
+// snapshotDone records the outcome of an attempt to take a snapshot, backing
+// off further attempts while the snapshot store is failing.
+func (r *Raft) snapshotDone(err error) {
+	o := &r.snapshotOutage
+	var storeErr snapshotStoreError
+	if err != nil && !errors.As(err, &storeErr) {
+		return
+	}
+
+	if err == nil {
+		if o.failures == 0 {
+			return
+		}
+		r.logger.Info("snapshot store has recovered", "failures", o.failures, "since", o.since)
+		metrics.SetGauge([]string{"raft", "snapshot", "storeUnavailable"}, 0)
+		r.observe(SnapshotStoreObservation{Available: true, Failures: o.failures, Since: o.since})
+		o.failures = 0
+		o.since = time.Time{}
+		o.retryAt = time.Time{}
+		return
+	}
+
+	now := time.Now()
+	if o.failures == 0 {
+		o.since = now
+		lastSnap, _ := r.getLastSnapshot()
+		o.retainFrom = lastSnap + 1
+		metrics.SetGauge([]string{"raft", "snapshot", "storeUnavailable"}, 1)
+	}
+	o.failures++
+	interval := r.config().SnapshotInterval
+	o.retryAt = now.Add(r.backoffWait(BackoffSnapshot, o.failures, interval, snapshotStoreBackoffFactor*interval))
+	metrics.IncrCounter([]string{"raft", "snapshot", "storeFailed"}, 1)
+	r.logger.Warn("snapshot store is failing, backing off snapshots",
+		"failures", o.failures, "retry-at", o.retryAt, "error", err)
+	r.observe(SnapshotStoreObservation{
+		Failures: o.failures,
+		Error:    err,
+		Since:    o.since,
+		RetryAt:  o.retryAt,
+	})
+}
+
+// compactSnapshotLogs compacts the logs after a snapshot up to snapIdx has
+// been taken. The first compaction after the snapshot store recovers keeps
+// the entries written while it was failing, within
+// Config.SnapshotOutageLogBudget, since followers that fell behind in that
+// time couldn't be sent a snapshot and may still need them.
+func (r *Raft) compactSnapshotLogs(snapIdx uint64) error {
+	o := &r.snapshotOutage
+	if o.retainFrom == 0 {
+		return r.compactLogs(snapIdx)
+	}
+	defer metrics.MeasureSince([]string{"raft", "compactLogs"}, time.Now())
+
+	retainFrom := o.retainFrom
+	o.retainFrom = 0
+	lastLogIdx, _ := r.getLastLog()
+	trailingLogs := r.config().TrailingLogs
+	if kept := r.outageLogsWithinBudget(retainFrom, lastLogIdx); kept > trailingLogs {
+		r.logger.Info("keeping logs written while the snapshot store was failing", "logs", kept)
+		trailingLogs = kept
+	}
+	return r.compactLogsWithTrailing(snapIdx, lastLogIdx, trailingLogs)
+}
+
+// outageLogsWithinBudget returns how many of the most recent entries from
+// from to lastLogIdx fit in Config.SnapshotOutageLogBudget.
+func (r *Raft) outageLogsWithinBudget(from, lastLogIdx uint64) uint64 {
+	budget := r.config().SnapshotOutageLogBudget
+	if budget == 0 || from > lastLogIdx {
+		return 0
+	}
+	var size uint64
+	index := lastLogIdx
+	for ; index >= from; index-- {
+		var entry Log
+		if err := r.logs.GetLog(index, &entry); err != nil {
+			break
+		}
+		size += uint64(len(entry.Data) + len(entry.Extensions))
+		if size > budget {
+			break
+		}
+	}
+	return lastLogIdx - index
+}
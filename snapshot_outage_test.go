@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingSnapshotStore is a SnapshotStore that can't create snapshots while
+// fail is set.
+type failingSnapshotStore struct {
+	SnapshotStore
+	fail atomic.Bool
+}
+
+func (f *failingSnapshotStore) Create(version SnapshotVersion, index, term uint64, configuration Configuration,
+	configurationIndex uint64, trans Transport) (SnapshotSink, error) {
+	if f.fail.Load() {
+		return nil, errors.New("store unavailable")
+	}
+	return f.SnapshotStore.Create(version, index, term, configuration, configurationIndex, trans)
+}
+
+func TestRaft_SnapshotStoreOutage(t *testing.T) {
+	b := &recordingBackoff{}
+	conf := inmemConfig(t)
+	conf.LocalID = "outage"
+	conf.Backoff = b
+	conf.SnapshotInterval = 10 * time.Millisecond
+	conf.SnapshotThreshold = 10
+	conf.TrailingLogs = 5
+	conf.SnapshotOutageLogBudget = 1 << 20
+	store := NewInmemStore()
+	snaps := &failingSnapshotStore{SnapshotStore: NewInmemSnapshotStore()}
+	addr, trans := NewInmemTransport("")
+	configuration := Configuration{Servers: []Server{{Suffrage: Voter, ID: conf.LocalID, Address: addr}}}
+	require.NoError(t, BootstrapCluster(conf, store, store, snaps, trans, configuration))
+
+	r, err := NewRaft(conf, &MockFSM{}, store, store, snaps, trans)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, r.Shutdown().Error()) }()
+	retry(t, func() bool { return r.State() == Leader })
+
+	obsCh := make(chan Observation, 100)
+	r.RegisterObserver(NewObserver(obsCh, false, func(o *Observation) bool {
+		_, ok := o.Data.(SnapshotStoreObservation)
+		return ok
+	}))
+	nextObservation := func() SnapshotStoreObservation {
+		select {
+		case o := <-obsCh:
+			return o.Data.(SnapshotStoreObservation)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for observation")
+			return SnapshotStoreObservation{}
+		}
+	}
+
+	// Consensus carries on while snapshots fail, and the log isn't
+	// compacted.
+	snaps.fail.Store(true)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, r.Apply([]byte("test"), 0).Error())
+	}
+	obs := nextObservation()
+	require.False(t, obs.Available)
+	require.Equal(t, uint64(1), obs.Failures)
+	require.ErrorContains(t, obs.Error, "store unavailable")
+	require.ErrorContains(t, r.Snapshot().Error(), "failed to create snapshot")
+	retry(t, func() bool { return b.failures(BackoffSnapshot) >= 2 })
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+
+	// Once the store recovers, the first compaction keeps the entries
+	// written while it was failing.
+	snaps.fail.Store(false)
+	for {
+		if obs = nextObservation(); obs.Available {
+			break
+		}
+	}
+	require.GreaterOrEqual(t, obs.Failures, uint64(2))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+
+	// Later ones compact to TrailingLogs as usual.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, r.Apply([]byte("test"), 0).Error())
+	}
+	require.NoError(t, r.Snapshot().Error())
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, conf.TrailingLogs, last-first+1)
+}
+
+func TestRaft_SnapshotStoreOutageBudget(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.SnapshotOutageLogBudget = 10
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	r := c.Leader()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, r.Apply([]byte("ab"), 0).Error())
+	}
+	last, err := r.logs.LastIndex()
+	require.NoError(t, err)
+
+	// Five of the two byte entries fit in the budget.
+	require.Equal(t, uint64(5), r.outageLogsWithinBudget(1, last))
+	require.Equal(t, uint64(1), r.outageLogsWithinBudget(last, last))
+	require.Zero(t, r.outageLogsWithinBudget(last+1, last))
+}
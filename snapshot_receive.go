@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"io"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// snapshotReceiveChunkSize is how much of a snapshot being received is read
+// from the network at a time when it's received through a bounded buffer.
+const snapshotReceiveChunkSize = 64 * 1024
+
+// SyncableSnapshotSink is an optional interface for a SnapshotSink that can
+// make what has been written to it durable before it's closed. When
+// Config.SnapshotReceiveSyncBytes is set, a snapshot received from the leader
+// is synced as it's written to such a sink, so a disk slower than the network
+// doesn't pile up unwritten data in memory. Sinks that wrap another sink
+// don't pass this through unless they implement it themselves.
+type SyncableSnapshotSink interface {
+	SnapshotSink
+
+	// Sync makes everything written so far durable.
+	Sync() error
+}
+
+// snapshotReceiver copies a snapshot being received from the leader to a
+// sink, timing how long the sink takes to write it so the rate the follower
+// can take snapshots at can be reported back to the leader.
+type snapshotReceiver struct {
+	sink SnapshotSink
+
+	// bufferSize, if positive, bounds how much is read ahead of the sink.
+	bufferSize int
+
+	// syncBytes, if positive and the sink is a SyncableSnapshotSink, is how
+	// many bytes are written between syncs.
+	syncBytes int64
+
+	written  int64
+	unsynced int64
+	busy     time.Duration
+}
+
+// receive copies src to the sink, returning how many bytes were copied.
+func (s *snapshotReceiver) receive(src io.Reader) (int64, error) {
+	if s.bufferSize <= 0 {
+		_, err := io.Copy(snapshotReceiverWriter{s}, src)
+		return s.written, err
+	}
+
+	// Chunks are handed from the reader to the writer and back again, so
+	// no more than bufferSize is ever held.
+	chunks := s.bufferSize / snapshotReceiveChunkSize
+	if chunks < 1 {
+		chunks = 1
+	}
+	freeCh := make(chan []byte, chunks)
+	for i := 0; i < chunks; i++ {
+		freeCh <- make([]byte, snapshotReceiveChunkSize)
+	}
+	fullCh := make(chan snapshotChunk, chunks)
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		s.readChunks(src, freeCh, fullCh, stopCh)
+	}()
+	// The reader must be finished with src before it's handed back.
+	defer func() {
+		close(stopCh)
+		<-doneCh
+	}()
+
+	for chunk := range fullCh {
+		if len(chunk.data) > 0 {
+			if err := s.write(chunk.data); err != nil {
+				return s.written, err
+			}
+		}
+		if chunk.err == io.EOF {
+			return s.written, nil
+		} else if chunk.err != nil {
+			return s.written, chunk.err
+		}
+		freeCh <- chunk.data[:cap(chunk.data)]
+	}
+	return s.written, nil
+}
+
+// snapshotChunk is a piece of a snapshot read ahead of the sink, along with
+// the error that ended the read, if any.
+type snapshotChunk struct {
+	data []byte
+	err  error
+}
+
+// readChunks reads src into free chunks until it ends or stopCh is closed.
+func (s *snapshotReceiver) readChunks(src io.Reader, freeCh chan []byte, fullCh chan<- snapshotChunk, stopCh <-chan struct{}) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-freeCh:
+		case <-stopCh:
+			return
+		}
+		n, err := io.ReadFull(src, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case fullCh <- snapshotChunk{data: buf[:n], err: err}:
+		case <-stopCh:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write writes b to the sink, syncing it if enough has been written since
+// the last sync.
+func (s *snapshotReceiver) write(b []byte) error {
+	start := time.Now()
+	defer func() { s.busy += time.Since(start) }()
+
+	n, err := s.sink.Write(b)
+	s.written += int64(n)
+	s.unsynced += int64(n)
+	if err != nil {
+		return err
+	}
+	if syncer, ok := s.sink.(SyncableSnapshotSink); ok && s.syncBytes > 0 && s.unsynced >= s.syncBytes {
+		s.unsynced = 0
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// rate returns the bytes per second the sink has taken the snapshot at,
+// counting only the time spent writing it, or zero if that's not known.
+func (s *snapshotReceiver) rate() uint64 {
+	if s.busy <= 0 {
+		return 0
+	}
+	return uint64(float64(s.written) / s.busy.Seconds())
+}
+
+// snapshotReceiverWriter writes straight through a snapshotReceiver.
+type snapshotReceiverWriter struct {
+	s *snapshotReceiver
+}
+
+// Write implements the io.Writer interface.
+func (w snapshotReceiverWriter) Write(b []byte) (int, error) {
+	before := w.s.written
+	err := w.s.write(b)
+	return int(w.s.written - before), err
+}
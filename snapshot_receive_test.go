@@ -0,0 +1,149 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncRecordingSink is a SyncableSnapshotSink that keeps what's written in
+// memory, counting syncs, and fails writes past failAfter bytes if it's set.
+type syncRecordingSink struct {
+	bytes.Buffer
+	syncs     int
+	failAfter int
+}
+
+func (s *syncRecordingSink) Write(b []byte) (int, error) {
+	if s.failAfter > 0 && s.Len()+len(b) > s.failAfter {
+		return 0, errors.New("disk full")
+	}
+	return s.Buffer.Write(b)
+}
+
+func (s *syncRecordingSink) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func (s *syncRecordingSink) ID() string    { return "sync-recording" }
+func (s *syncRecordingSink) Cancel() error { return nil }
+func (s *syncRecordingSink) Close() error  { return nil }
+
+func TestSnapshotReceiver(t *testing.T) {
+	data := make([]byte, 5*snapshotReceiveChunkSize+123)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		bufferSize int
+	}{
+		{"unbuffered", 0},
+		{"less than a chunk", 1},
+		{"several chunks", 4 * snapshotReceiveChunkSize},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := &syncRecordingSink{}
+			receiver := &snapshotReceiver{
+				sink:       sink,
+				bufferSize: tc.bufferSize,
+				syncBytes:  2 * snapshotReceiveChunkSize,
+			}
+			n, err := receiver.receive(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, data, sink.Bytes())
+			require.NotZero(t, sink.syncs)
+			require.NotZero(t, receiver.rate())
+		})
+	}
+
+	t.Run("sink error", func(t *testing.T) {
+		sink := &syncRecordingSink{failAfter: 2 * snapshotReceiveChunkSize}
+		receiver := &snapshotReceiver{sink: sink, bufferSize: snapshotReceiveChunkSize}
+		n, err := receiver.receive(bytes.NewReader(data))
+		require.EqualError(t, err, "disk full")
+		require.Equal(t, int64(2*snapshotReceiveChunkSize), n)
+	})
+
+	t.Run("source error", func(t *testing.T) {
+		sink := &syncRecordingSink{}
+		receiver := &snapshotReceiver{sink: sink, bufferSize: snapshotReceiveChunkSize}
+		src := io.MultiReader(bytes.NewReader(data[:100]), &abortableReader{abortCh: closedCh(), abortErr: ErrLeadershipLost})
+		_, err := receiver.receive(src)
+		require.ErrorIs(t, err, ErrLeadershipLost)
+		require.Equal(t, data[:100], sink.Bytes())
+	})
+}
+
+// closedCh returns a closed channel.
+func closedCh() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func TestAbortableReader_Limiter(t *testing.T) {
+	const rate = 64 * 1024
+	data := make([]byte, rate+rate/2)
+
+	// A second's worth goes straight through, the rest waits for the rate.
+	start := time.Now()
+	r := &abortableReader{r: bytes.NewReader(data), limiter: newSnapshotIOLimiter(rate, start)}
+	n, err := io.Copy(io.Discard, r)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// Aborting stops the wait.
+	abortCh := make(chan struct{})
+	r = &abortableReader{
+		r:        bytes.NewReader(data),
+		abortCh:  abortCh,
+		abortErr: ErrLeadershipLost,
+		limiter:  newSnapshotIOLimiter(1, time.Now()),
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(abortCh) })
+	start = time.Now()
+	_, err = io.Copy(io.Discard, r)
+	require.ErrorIs(t, err, ErrLeadershipLost)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestRaft_SnapshotReceiveBuffer(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 10
+	conf.SnapshotReceiveBufferSize = 2 * snapshotReceiveChunkSize
+	conf.SnapshotReceiveSyncBytes = snapshotReceiveChunkSize
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	for i := 0; i < 100; i++ {
+		leader.Apply([]byte("test"), 0)
+	}
+	require.NoError(t, leader.Barrier(0).Error())
+	require.NoError(t, leader.Snapshot().Error())
+
+	// A new server is sent the snapshot, which it receives through the
+	// buffer.
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	joiner := c1.rafts[0]
+	require.NoError(t, leader.AddVoter(joiner.localID, joiner.localAddr, 0, 0).Error())
+	retry(t, func() bool {
+		lastSnap, _ := joiner.getLastSnapshot()
+		return lastSnap > 0 && len(getMockFSM(c1.fsms[0]).Logs()) == 100
+	})
+}
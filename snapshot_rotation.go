@@ -0,0 +1,269 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+const (
+	// rotateSuffix marks a snapshot being rewritten under a new key.
+	rotateSuffix = ".rotate" + tmpSuffix
+
+	// rotateOldSuffix marks a snapshot that's been rewritten under a new key,
+	// moved aside until the rewritten copy is in place.
+	rotateOldSuffix = ".rotate-old" + tmpSuffix
+)
+
+// KeyRotationProgress reports the progress of RotateFileSnapshotKeys after
+// each snapshot.
+type KeyRotationProgress struct {
+	// ID is the snapshot just handled.
+	ID string
+
+	// Rotated is false if the snapshot was skipped because it was already
+	// encrypted under the new key, such as when resuming a rotation.
+	Rotated bool
+
+	// Done is how many of the Total snapshots have been handled.
+	Done  int
+	Total int
+}
+
+// RotateFileSnapshotKeys rewrites the encrypted snapshots in a
+// FileSnapshotStore at base, written through an EncryptedSnapshotStore with
+// keys from from, so they're encrypted with new data keys from to. It must
+// only be called while the server using the store isn't running.
+//
+// Each snapshot is rewritten alongside the original, compressed the same way,
+// and then swapped into place, so an interrupted rotation can be resumed by
+// calling this again: snapshots whose header records the KeyID of to are
+// skipped. progress, if not nil, is called after each snapshot.
+func RotateFileSnapshotKeys(base string, from, to SnapshotKeyProvider, progress func(KeyRotationProgress)) error {
+	store, err := NewFileSnapshotStoreWithLogger(base, 1, hclog.NewNullLogger())
+	if err != nil {
+		return err
+	}
+	if err := store.recoverRotation(); err != nil {
+		return err
+	}
+	snapshots, err := store.getSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for i, meta := range snapshots {
+		keyID, err := store.snapshotKeyID(meta.ID)
+		if err != nil {
+			return err
+		}
+		rotated := keyID == to.KeyID()
+		if !rotated {
+			if err := store.rotateKeys(meta, from, to); err != nil {
+				return fmt.Errorf("failed to rotate snapshot %s: %w", meta.ID, err)
+			}
+		}
+		if progress != nil {
+			progress(KeyRotationProgress{
+				ID:      meta.ID,
+				Rotated: !rotated,
+				Done:    i + 1,
+				Total:   len(snapshots),
+			})
+		}
+	}
+	return nil
+}
+
+// recoverRotation tidies up after an interrupted key rotation, putting back
+// any snapshot that was moved aside before its rewritten copy was in place.
+func (f *FileSnapshotStore) recoverRotation() error {
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(f.path, name)
+		switch {
+		case strings.HasSuffix(name, rotateOldSuffix):
+			original := filepath.Join(f.path, strings.TrimSuffix(name, rotateOldSuffix))
+			if _, err := os.Stat(original); err == nil {
+				err = os.RemoveAll(path)
+			} else if os.IsNotExist(err) {
+				err = os.Rename(path, original)
+			}
+			if err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, rotateSuffix):
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotKeyID returns the ID of the key recorded in an encrypted snapshot's
+// header.
+func (f *FileSnapshotStore) snapshotKeyID(id string) (string, error) {
+	_, rc, err := f.Open(id)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	keyID, _, _, err := readEncryptedSnapshotHeader(rc)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot %s: %w", id, err)
+	}
+	return keyID, nil
+}
+
+// rotateKeys rewrites a snapshot encrypted with keys from from so it's
+// encrypted with keys from to.
+func (f *FileSnapshotStore) rotateKeys(meta *fileSnapshotMeta, from, to SnapshotKeyProvider) error {
+	_, rc, err := f.Open(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r, _, err := newEncryptedSnapshotReader(rc, meta.Size, from)
+	if err != nil {
+		return err
+	}
+
+	// Write the new copy next to the original.
+	dir := filepath.Join(f.path, meta.ID)
+	tmpDir := dir + rotateSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return err
+	}
+	fh, err := os.Create(filepath.Join(tmpDir, stateFilePath))
+	if err != nil {
+		return err
+	}
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	state := &rotationFileSink{
+		fh:       fh,
+		buffered: bufio.NewWriter(io.MultiWriter(fh, hash)),
+		noSync:   f.noSync,
+	}
+	if meta.Compression != "" {
+		c, ok := f.snapshotCompressor(meta.Compression)
+		if !ok {
+			fh.Close()
+			return fmt.Errorf("unknown snapshot compression %q", meta.Compression)
+		}
+		if state.compressed, err = c.NewWriter(state.buffered); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	sink, err := newEncryptedSnapshotSink(state, to)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	if _, err := io.Copy(sink, r); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+
+	rotated := &FileSnapshotSink{dir: tmpDir, meta: *meta, noSync: f.noSync}
+	rotated.meta.Size = state.written
+	rotated.meta.CRC = hash.Sum(nil)
+	if err := rotated.writeMeta(); err != nil {
+		return err
+	}
+
+	// Swap it into place.
+	oldDir := dir + rotateOldSuffix
+	if err := os.Rename(dir, oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+	if !f.noSync && runtime.GOOS != "windows" {
+		parent, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer parent.Close()
+		if err := parent.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// rotationFileSink writes a rewritten snapshot's state file, compressing it
+// if compressed is set, and counting the bytes written before compression
+// for the metadata.
+type rotationFileSink struct {
+	fh         *os.File
+	buffered   *bufio.Writer
+	compressed io.WriteCloser
+	written    int64
+	noSync     bool
+}
+
+// Write implements the io.Writer interface.
+func (s *rotationFileSink) Write(b []byte) (int, error) {
+	s.written += int64(len(b))
+	if s.compressed != nil {
+		return s.compressed.Write(b)
+	}
+	return s.buffered.Write(b)
+}
+
+// Close implements the io.Closer interface.
+func (s *rotationFileSink) Close() error {
+	if s.compressed != nil {
+		if err := s.compressed.Close(); err != nil {
+			s.fh.Close()
+			return err
+		}
+	}
+	if err := s.buffered.Flush(); err != nil {
+		s.fh.Close()
+		return err
+	}
+	if !s.noSync {
+		if err := s.fh.Sync(); err != nil {
+			s.fh.Close()
+			return err
+		}
+	}
+	return s.fh.Close()
+}
+
+// ID implements the SnapshotSink interface.
+func (s *rotationFileSink) ID() string {
+	return ""
+}
+
+// Cancel implements the SnapshotSink interface.
+func (s *rotationFileSink) Cancel() error {
+	return s.fh.Close()
+}
@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateFileSnapshotKeys(t *testing.T) {
+	dir := t.TempDir()
+	files, err := NewFileSnapshotStoreWithLogger(dir, 3, newTestLogger(t))
+	require.NoError(t, err)
+	c, err := NewGzipSnapshotCompressor(gzip.BestSpeed)
+	require.NoError(t, err)
+	files.SetCompressor(c)
+	oldKeys, newKeys := newTestKeyProvider(t), newTestKeyProvider(t)
+	store := NewEncryptedSnapshotStore(files, oldKeys)
+
+	_, trans := NewInmemTransport(NewInmemAddr())
+	contents := make(map[string][]byte)
+	for i := uint64(1); i <= 3; i++ {
+		data := make([]byte, 100*1024)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		sink, err := store.Create(SnapshotVersionMax, i*10, 1, Configuration{}, 1, trans)
+		require.NoError(t, err)
+		_, err = sink.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, sink.Close())
+		contents[sink.ID()] = data
+	}
+	ids := make([]string, 0, len(contents))
+	for id := range contents {
+		ids = append(ids, id)
+	}
+
+	// Simulate an interrupted rotation, with one snapshot moved aside and a
+	// partial copy of another.
+	moved := filepath.Join(files.path, ids[0])
+	require.NoError(t, os.Rename(moved, moved+rotateOldSuffix))
+	require.NoError(t, os.MkdirAll(filepath.Join(files.path, ids[1]+rotateSuffix), 0o755))
+
+	var progress []KeyRotationProgress
+	require.NoError(t, RotateFileSnapshotKeys(dir, oldKeys, newKeys, func(p KeyRotationProgress) {
+		progress = append(progress, p)
+	}))
+	require.Len(t, progress, 3)
+	for i, p := range progress {
+		require.True(t, p.Rotated)
+		require.Equal(t, i+1, p.Done)
+		require.Equal(t, 3, p.Total)
+	}
+
+	// Nothing is left behind, and the snapshots can only be read with the
+	// new keys. They're still compressed.
+	entries, err := os.ReadDir(files.path)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	rotated := NewEncryptedSnapshotStore(files, newKeys)
+	snapshots, err := files.getSnapshots()
+	require.NoError(t, err)
+	for _, meta := range snapshots {
+		require.Equal(t, "gzip", meta.Compression)
+	}
+	for id, data := range contents {
+		meta, rc, err := rotated.Open(id)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), meta.Size)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, data, got)
+
+		_, _, err = store.Open(id)
+		require.Error(t, err)
+	}
+
+	// Running it again skips the rotated snapshots.
+	progress = nil
+	require.NoError(t, RotateFileSnapshotKeys(dir, oldKeys, newKeys, func(p KeyRotationProgress) {
+		progress = append(progress, p)
+	}))
+	require.Len(t, progress, 3)
+	for _, p := range progress {
+		require.False(t, p.Rotated)
+	}
+}
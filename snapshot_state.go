@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// snapshotStateMagic prefixes the state Raft writes ahead of the FSM's own
+// data in a snapshot. See snapshotState.
+var snapshotStateMagic = []byte{0x00, 0xff, 'r', 'a', 'f', 't', 's', 't', 'a', 't', 'e', 0x01}
+
+// snapshotStateVersion is the snapshot version from which the state may be
+// written ahead of the FSM's data.
+const snapshotStateVersion SnapshotVersion = 2
+
+// snapshotState is the state Raft keeps for entries that were applied but
+// whose effect isn't finished yet, such as commands with a TTL that hasn't run
+// out or schedules that haven't been reached. It isn't part of the FSM, so it's written ahead of the FSM's data when
+// a snapshot is taken and taken back off when one is restored, which lets a
+// server that restores the snapshot carry on where the others are. It's only
+// written if there's something in it, so snapshots of clusters that don't use
+// these features hold nothing but the FSM's data. Snapshots it's written in
+// are created with snapshotStateVersion, which older servers refuse.
+type snapshotState struct {
+	// Expiries are the entries with a TTL that hadn't expired.
+	Expiries []expiryState
+
+	// Schedules are the LogSchedule entries whose command hadn't been
+	// committed.
+	Schedules []scheduleState
+}
+
+func (s *snapshotState) empty() bool {
+	return len(s.Expiries) == 0 && len(s.Schedules) == 0
+}
+
+// snapshotState returns the state to write into a snapshot of everything
+// applied so far. This must only be called from the FSM goroutine.
+func (r *Raft) snapshotState() snapshotState {
+	return snapshotState{
+		Expiries:  r.expiries.snapshot(),
+		Schedules: r.schedules.snapshot(),
+	}
+}
+
+// restoreSnapshotState replaces the state with what was kept in a restored
+// snapshot. This must only be called from the FSM goroutine, or before Raft
+// has started.
+func (r *Raft) restoreSnapshotState(state snapshotState) {
+	r.expiries.restore(state.Expiries)
+	r.schedules.restore(state.Schedules)
+}
+
+// restoreFSM restores the FSM, and the state Raft keeps with it, from a
+// snapshot. The caller is still responsible for calling Close on the source.
+func (r *Raft) restoreFSM(logger hclog.Logger, source io.ReadCloser, meta *SnapshotMeta) error {
+	state, rest, err := readSnapshotState(source, meta.Version)
+	if err != nil {
+		return err
+	}
+	if err := fsmRestoreAndMeasure(logger, r.fsm, rest, meta.Size); err != nil {
+		return err
+	}
+	r.restoreSnapshotState(state)
+	return nil
+}
+
+// readSnapshotState takes the state Raft keeps off the front of a snapshot
+// with the given version, and returns it with the rest, which is the FSM's
+// data. A snapshot without the state yields an empty one.
+func readSnapshotState(source io.ReadCloser, version SnapshotVersion) (snapshotState, io.ReadCloser, error) {
+	var state snapshotState
+	if version < snapshotStateVersion {
+		return state, source, nil
+	}
+	r := bufio.NewReader(source)
+	rest := struct {
+		io.Reader
+		io.Closer
+	}{r, source}
+
+	// A snapshot shorter than the magic can't hold the state, so a short
+	// Peek just means there isn't any.
+	prefix, _ := r.Peek(len(snapshotStateMagic))
+	if !bytes.Equal(prefix, snapshotStateMagic) {
+		return state, rest, nil
+	}
+	if _, err := r.Discard(len(snapshotStateMagic)); err != nil {
+		return state, nil, fmt.Errorf("failed to read snapshot state: %v", err)
+	}
+	buf, err := readPrefixed(r)
+	if err != nil {
+		return state, nil, fmt.Errorf("failed to read snapshot state: %v", err)
+	}
+	if err := decodeMsgPack(buf, &state); err != nil {
+		return state, nil, fmt.Errorf("failed to decode snapshot state: %v", err)
+	}
+	return state, rest, nil
+}
+
+// writeSnapshotState writes the state ahead of the FSM's data.
+func writeSnapshotState(w io.Writer, state snapshotState) error {
+	buf, err := encodeMsgPack(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot state: %v", err)
+	}
+	if _, err := w.Write(appendPrefixed(nil, snapshotStateMagic, buf.Bytes())); err != nil {
+		return fmt.Errorf("failed to write snapshot state: %v", err)
+	}
+	return nil
+}
+
+// withSnapshotState returns snap wrapped so that state is written ahead of
+// it, or snap itself if there's no state to write. Use snapshotVersion for
+// the version to create the snapshot with.
+func withSnapshotState(snap FSMSnapshot, state snapshotState) FSMSnapshot {
+	if snap == nil || state.empty() {
+		return snap
+	}
+	return &stateSnapshot{state: state, snap: snap}
+}
+
+// snapshotVersion returns the version to create a snapshot of snap with,
+// given the protocol version in use.
+func snapshotVersion(protocolVersion ProtocolVersion, snap FSMSnapshot) SnapshotVersion {
+	if _, ok := snap.(*stateSnapshot); ok {
+		return snapshotStateVersion
+	}
+	return getSnapshotVersion(protocolVersion)
+}
+
+// stateSnapshot writes the state Raft keeps ahead of the FSM's snapshot.
+type stateSnapshot struct {
+	state snapshotState
+	snap  FSMSnapshot
+}
+
+// Persist implements the FSMSnapshot interface.
+func (s *stateSnapshot) Persist(sink SnapshotSink) error {
+	if err := writeSnapshotState(sink, s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return s.snap.Persist(sink)
+}
+
+// Release implements the FSMSnapshot interface.
+func (s *stateSnapshot) Release() {
+	s.snap.Release()
+}
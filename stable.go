@@ -3,6 +3,19 @@
 
 package raft
 
+import "errors"
+
+// ErrKeyNotFound is returned by InmemStore when a key hasn't been set. Stores
+// can return it, or an error wrapping it, to tell raft a key is missing.
+var ErrKeyNotFound = errors.New("not found")
+
+// isKeyNotFound returns true if err means the key hasn't been set. Stores
+// written before ErrKeyNotFound, such as raft-boltdb, return their own error
+// with the same message, so that's accepted too.
+func isKeyNotFound(err error) bool {
+	return errors.Is(err, ErrKeyNotFound) || err.Error() == ErrKeyNotFound.Error()
+}
+
 // StableStore is used to provide stable storage
 // of key configurations to ensure safety.
 type StableStore interface {
@@ -16,3 +29,16 @@ type StableStore interface {
 	// GetUint64 returns the uint64 value for key, or 0 if key was not found.
 	GetUint64(key []byte) (uint64, error)
 }
+
+// CompareAndSetStableStore is an optional interface for StableStore
+// implementations that can atomically update a uint64 value. If implemented,
+// raft uses it when persisting the current term so that a store that has lost
+// or reordered writes can't silently move the term backwards.
+type CompareAndSetStableStore interface {
+	StableStore
+
+	// CompareAndSetUint64 sets key to val only if its current value is old,
+	// where a missing key has the value 0. It returns false without an error
+	// if the current value didn't match.
+	CompareAndSetUint64(key []byte, old, val uint64) (bool, error)
+}
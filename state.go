@@ -94,6 +94,16 @@ func (r *raftState) setCurrentTerm(term uint64) {
 	atomic.StoreUint64(&r.currentTerm, term)
 }
 
+// raiseCurrentTerm sets the current term unless it's already at least term.
+func (r *raftState) raiseCurrentTerm(term uint64) {
+	for {
+		current := atomic.LoadUint64(&r.currentTerm)
+		if term <= current || atomic.CompareAndSwapUint64(&r.currentTerm, current, term) {
+			return
+		}
+	}
+}
+
 func (r *raftState) getLastLog() (index, term uint64) {
 	r.lastLock.Lock()
 	index = r.lastLogIndex
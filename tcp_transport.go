@@ -67,6 +67,19 @@ func NewTCPTransportWithConfig(
 func newTCPTransport(bindAddr string,
 	advertise net.Addr,
 	transportCreator func(stream StreamLayer) *NetworkTransport) (*NetworkTransport, error) {
+	stream, err := newTCPStreamLayer(bindAddr, advertise)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the network transport
+	trans := transportCreator(stream)
+	return trans, nil
+}
+
+// newTCPStreamLayer binds to bindAddr and checks that the layer has an
+// address other servers can reach it on.
+func newTCPStreamLayer(bindAddr string, advertise net.Addr) (*TCPStreamLayer, error) {
 	// Try to bind
 	list, err := net.Listen("tcp", bindAddr)
 	if err != nil {
@@ -89,10 +102,7 @@ func newTCPTransport(bindAddr string,
 		list.Close()
 		return nil, errNotAdvertisable
 	}
-
-	// Create the network transport
-	trans := transportCreator(stream)
-	return trans, nil
+	return stream, nil
 }
 
 // Dial implements the StreamLayer interface.
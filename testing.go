@@ -27,6 +27,7 @@ func inmemConfig(tb testing.TB) *Config {
 	conf.ElectionTimeout = 50 * time.Millisecond
 	conf.LeaderLeaseTimeout = 50 * time.Millisecond
 	conf.CommitTimeout = 5 * time.Millisecond
+	conf.CheckInvariants = true
 	conf.Logger = newTestLogger(tb)
 	return conf
 }
@@ -95,8 +96,12 @@ func (m *MockFSM) Restore(inp io.ReadCloser) error {
 	hd := codec.MsgpackHandle{}
 	dec := codec.NewDecoder(inp, &hd)
 
+	// An empty snapshot holds no logs.
 	m.logs = nil
-	return dec.Decode(&m.logs)
+	if err := dec.Decode(&m.logs); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
 }
 
 // NOTE: This is exposed for middleware testing purposes and is not a stable API
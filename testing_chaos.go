@@ -0,0 +1,300 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChaosOpts configures RunChaos.
+//
+// NOTE: This is exposed for middleware testing purposes and is not a stable API
+type ChaosOpts struct {
+	// Seed picks the faults, so a failing run can be repeated.
+	Seed int64
+
+	// Steps is how many faults to inject.
+	Steps int
+
+	// StepDuration is how long each fault is held for while commands are
+	// applied. If zero, ten heartbeat timeouts are used.
+	StepDuration time.Duration
+}
+
+// chaosFault is a fault injected by RunChaos.
+type chaosFault int
+
+const (
+	// chaosKill shuts a server down, restarting it from its stores at the
+	// next step.
+	chaosKill chaosFault = iota
+
+	// chaosPartition splits the servers into two random groups.
+	chaosPartition
+
+	// chaosPause cuts a single server off without stopping it, as if its
+	// process had stalled. Raft reads the real clock, so this is as close as
+	// the in-memory cluster gets to pausing a server's clock.
+	chaosPause
+
+	// chaosNone leaves the cluster healthy for a step.
+	chaosNone
+
+	numChaosFaults
+)
+
+// String returns a human readable name for the fault.
+func (f chaosFault) String() string {
+	switch f {
+	case chaosKill:
+		return "kill"
+	case chaosPartition:
+		return "partition"
+	case chaosPause:
+		return "pause"
+	case chaosNone:
+		return "none"
+	default:
+		return fmt.Sprintf("%d", int(f))
+	}
+}
+
+// chaosRun holds the state of a RunChaos call.
+type chaosRun struct {
+	c   *cluster
+	rng *rand.Rand
+
+	// rafts mirrors c.rafts so the checker can read it while servers are
+	// restarted.
+	raftsLock sync.Mutex
+	rafts     []*Raft
+	dead      map[int]bool
+
+	// leaders records the leader seen in each term.
+	leadersLock sync.Mutex
+	leaders     map[uint64]ServerID
+
+	// history is the longest sequence of commands seen applied, which every
+	// FSM must agree with, and applied is what each FSM last had applied.
+	history [][]byte
+	applied map[*MockFSM][][]byte
+}
+
+// RunChaos injects faults into the cluster chosen at random from the seed:
+// killing and restarting servers, partitioning the network and stalling
+// servers, while applying commands to whichever server is leader. After each
+// step it checks that no term has had two leaders and that the commands
+// applied by every FSM are a prefix of the same history, which only grows.
+// Finally it heals the cluster and waits for every FSM to catch up. The
+// cluster's FSMs must be MockFSMs or MockFSMConfigStores.
+//
+// NOTE: This is exposed for middleware testing purposes and is not a stable API
+func (c *cluster) RunChaos(opts ChaosOpts) {
+	c.t.Helper()
+	if opts.StepDuration == 0 {
+		opts.StepDuration = 10 * c.conf.HeartbeatTimeout
+	}
+	for _, fsm := range c.fsms {
+		switch fsm.(type) {
+		case *MockFSM, *MockFSMConfigStore:
+		default:
+			c.t.Fatalf("chaos needs MockFSMs, got %T", fsm)
+		}
+	}
+	c.logger.Info("running chaos", "seed", opts.Seed, "steps", opts.Steps)
+
+	run := &chaosRun{
+		c:       c,
+		rng:     rand.New(rand.NewSource(opts.Seed)),
+		rafts:   append([]*Raft(nil), c.rafts...),
+		dead:    make(map[int]bool),
+		leaders: make(map[uint64]ServerID),
+		applied: make(map[*MockFSM][][]byte),
+	}
+
+	// Watch for leaders continuously, since they can come and go within a
+	// step.
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(time.Millisecond):
+				run.checkLeaders()
+			}
+		}
+	}()
+	defer func() {
+		close(stopCh)
+		wg.Wait()
+	}()
+
+	var commands int
+	for step := 0; step < opts.Steps; step++ {
+		run.heal()
+		fault := chaosFault(run.rng.Intn(int(numChaosFaults)))
+		c.logger.Info("chaos step", "seed", opts.Seed, "step", step, "fault", fault)
+		run.inject(fault)
+
+		deadline := time.Now().Add(opts.StepDuration)
+		for time.Now().Before(deadline) {
+			if leader := run.leader(); leader != nil {
+				commands++
+				cmd := []byte(fmt.Sprintf("chaos-%d-%d", opts.Seed, commands))
+				leader.Apply(cmd, c.conf.CommitTimeout)
+			}
+			time.Sleep(c.conf.CommitTimeout)
+		}
+		run.checkApplied(fmt.Sprintf("seed %d step %d (%s)", opts.Seed, step, fault))
+		if c.t.Failed() {
+			return
+		}
+	}
+
+	// Let everything converge.
+	run.heal()
+	leader := c.Leader()
+	if err := leader.Barrier(c.longstopTimeout).Error(); err != nil {
+		c.t.Fatalf("chaos seed %d: barrier failed: %v", opts.Seed, err)
+	}
+	c.EnsureSame(c.t)
+	run.checkApplied(fmt.Sprintf("seed %d after healing", opts.Seed))
+}
+
+// inject applies a fault to the cluster.
+func (run *chaosRun) inject(fault chaosFault) {
+	c := run.c
+	n := len(c.rafts)
+	switch fault {
+	case chaosKill:
+		i := run.rng.Intn(n)
+		if err := c.rafts[i].Shutdown().Error(); err != nil {
+			c.t.Fatalf("shutdown failed: %v", err)
+		}
+		run.raftsLock.Lock()
+		run.dead[i] = true
+		run.raftsLock.Unlock()
+	case chaosPartition:
+		var far []ServerAddress
+		for _, t := range c.trans {
+			if run.rng.Intn(2) == 0 {
+				far = append(far, t.LocalAddr())
+			}
+		}
+		c.Partition(far)
+	case chaosPause:
+		c.Disconnect(c.trans[run.rng.Intn(n)].LocalAddr())
+	}
+}
+
+// heal restarts any dead servers and reconnects everything.
+func (run *chaosRun) heal() {
+	c := run.c
+	run.raftsLock.Lock()
+	dead := run.dead
+	run.dead = make(map[int]bool)
+	run.raftsLock.Unlock()
+
+	for i := range dead {
+		old := c.rafts[i]
+		conf := old.config()
+		_, trans := NewInmemTransport(old.localAddr)
+
+		// The FSM starts again from scratch, as a real one would, and is
+		// rebuilt from the snapshot and the log.
+		var fsm FSM = &MockFSM{}
+		if _, ok := c.fsms[i].(*MockFSMConfigStore); ok {
+			fsm = &MockFSMConfigStore{FSM: fsm}
+		}
+		r, err := NewRaft(&conf, fsm, old.logs, old.stable, old.snapshots, trans)
+		if err != nil {
+			c.t.Fatalf("restart failed: %v", err)
+		}
+		r.RegisterObserver(NewObserver(c.observationCh, false, nil))
+		c.trans[i] = trans
+		c.fsms[i] = fsm
+		c.rafts[i] = r
+
+		run.raftsLock.Lock()
+		run.rafts[i] = r
+		run.raftsLock.Unlock()
+	}
+	c.FullyConnect()
+}
+
+// leader returns a server that currently thinks it's the leader, if any.
+func (run *chaosRun) leader() *Raft {
+	run.raftsLock.Lock()
+	defer run.raftsLock.Unlock()
+	for i, r := range run.rafts {
+		if !run.dead[i] && r.getState() == Leader {
+			return r
+		}
+	}
+	return nil
+}
+
+// checkLeaders fails the test if two servers have been leader in the same
+// term.
+func (run *chaosRun) checkLeaders() {
+	run.raftsLock.Lock()
+	rafts := append([]*Raft(nil), run.rafts...)
+	run.raftsLock.Unlock()
+
+	for _, r := range rafts {
+		// Only trust the state if the term didn't change while reading it.
+		term := r.getCurrentTerm()
+		if r.getState() != Leader || r.getCurrentTerm() != term {
+			continue
+		}
+		run.leadersLock.Lock()
+		if other, ok := run.leaders[term]; ok && other != r.localID {
+			run.c.Failf("two leaders in term %d: %s and %s", term, other, r.localID)
+		}
+		run.leaders[term] = r.localID
+		run.leadersLock.Unlock()
+	}
+}
+
+// checkApplied fails the test if any FSM has applied commands that disagree
+// with the history, or with what it had applied before.
+func (run *chaosRun) checkApplied(when string) {
+	for i, raw := range run.c.fsms {
+		fsm := getMockFSM(raw)
+		logs := fsm.Logs()
+		if prev := run.applied[fsm]; !isCommandPrefix(prev, logs) {
+			run.c.Failf("%s: server %d went back on applied commands: had %d, now %d", when, i, len(prev), len(logs))
+		}
+		run.applied[fsm] = logs
+
+		switch {
+		case isCommandPrefix(logs, run.history):
+		case isCommandPrefix(run.history, logs):
+			run.history = logs
+		default:
+			run.c.Failf("%s: server %d applied commands that diverge from the history", when, i)
+		}
+	}
+}
+
+// isCommandPrefix reports whether a is a prefix of b.
+func isCommandPrefix(a, b [][]byte) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// tieredSpillBatch is the most entries moved from the hot store to the cold
+// store in one write.
+const tieredSpillBatch = 1024
+
+// TieredLogStore is a LogStore that keeps the most recent entries in a hot
+// store, such as an InmemStore, and moves older ones to a cold store, such as
+// one on disk, in the background. Reads look in the hot store first and fall
+// back to the cold one, so replication to followers that are keeping up is
+// served from the hot store while a large TrailingLogs is kept in the cold
+// one.
+//
+// Raft relies on an entry being durable once it has been stored, and entries
+// are only as durable as the hot store keeps them until they're moved. An
+// InmemStore hot store loses the entries it holds if the process crashes, so
+// it's only suitable where that's acceptable, and a small, fast durable store
+// should be used otherwise.
+type TieredLogStore struct {
+	hot        LogStore
+	cold       LogStore
+	hotEntries uint64
+
+	// spillLock is held while entries are moved to the cold store, and by
+	// DeleteRange so an entry being moved can't be deleted from under it.
+	spillLock sync.Mutex
+
+	// lock protects spilling and spillErr.
+	lock     sync.Mutex
+	spilling bool
+	spillErr error
+}
+
+// NewTieredLogStore returns a TieredLogStore that keeps the hotEntries most
+// recent entries in hot, moving older ones to cold.
+func NewTieredLogStore(hot, cold LogStore, hotEntries int) (*TieredLogStore, error) {
+	if hotEntries <= 0 {
+		return nil, fmt.Errorf("hotEntries must be positive")
+	}
+	return &TieredLogStore{
+		hot:        hot,
+		cold:       cold,
+		hotEntries: uint64(hotEntries),
+	}, nil
+}
+
+// IsMonotonic implements the MonotonicLogStore interface. The store is only
+// monotonic if both of its tiers are.
+func (t *TieredLogStore) IsMonotonic() bool {
+	hot, ok := t.hot.(MonotonicLogStore)
+	if !ok || !hot.IsMonotonic() {
+		return false
+	}
+	cold, ok := t.cold.(MonotonicLogStore)
+	return ok && cold.IsMonotonic()
+}
+
+// FirstIndex implements the LogStore interface.
+func (t *TieredLogStore) FirstIndex() (uint64, error) {
+	first, err := t.cold.FirstIndex()
+	if err != nil || first != 0 {
+		return first, err
+	}
+	return t.hot.FirstIndex()
+}
+
+// LastIndex implements the LogStore interface.
+func (t *TieredLogStore) LastIndex() (uint64, error) {
+	last, err := t.hot.LastIndex()
+	if err != nil || last != 0 {
+		return last, err
+	}
+	return t.cold.LastIndex()
+}
+
+// GetLog implements the LogStore interface.
+func (t *TieredLogStore) GetLog(index uint64, log *Log) error {
+	err := t.hot.GetLog(index, log)
+	if !errors.Is(err, ErrLogNotFound) {
+		return err
+	}
+	return t.cold.GetLog(index, log)
+}
+
+// StoreLog implements the LogStore interface.
+func (t *TieredLogStore) StoreLog(log *Log) error {
+	return t.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. If moving entries to the cold
+// store has failed since the last call, the error is returned here instead.
+func (t *TieredLogStore) StoreLogs(logs []*Log) error {
+	t.lock.Lock()
+	err := t.spillErr
+	t.spillErr = nil
+	t.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to move entries to the cold store: %w", err)
+	}
+
+	if err := t.hot.StoreLogs(logs); err != nil {
+		return err
+	}
+	if t.hotFull() {
+		t.startSpill()
+	}
+	return nil
+}
+
+// DeleteRange implements the LogStore interface.
+func (t *TieredLogStore) DeleteRange(min, max uint64) error {
+	t.spillLock.Lock()
+	defer t.spillLock.Unlock()
+	if err := deleteOverlap(t.cold, min, max); err != nil {
+		return err
+	}
+	return deleteOverlap(t.hot, min, max)
+}
+
+// deleteOverlap deletes the part of the range that store holds, so a store
+// isn't asked to delete a range entirely outside its entries, which some
+// stores, such as InmemStore, don't expect.
+func deleteOverlap(store LogStore, min, max uint64) error {
+	first, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+	if first == 0 || max < first || min > last {
+		return nil
+	}
+	if min < first {
+		min = first
+	}
+	if max > last {
+		max = last
+	}
+	return store.DeleteRange(min, max)
+}
+
+// hotFull returns true if the hot store holds more than hotEntries.
+func (t *TieredLogStore) hotFull() bool {
+	first, err := t.hot.FirstIndex()
+	if err != nil {
+		return false
+	}
+	last, err := t.hot.LastIndex()
+	if err != nil {
+		return false
+	}
+	return first != 0 && last-first+1 > t.hotEntries
+}
+
+// startSpill starts moving entries to the cold store, unless they're already
+// being moved.
+func (t *TieredLogStore) startSpill() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.spilling {
+		return
+	}
+	t.spilling = true
+	go t.spill()
+}
+
+// spill moves entries to the cold store until the hot store holds no more
+// than hotEntries.
+func (t *TieredLogStore) spill() {
+	var err error
+	defer func() {
+		t.lock.Lock()
+		t.spilling = false
+		if err != nil {
+			t.spillErr = err
+		}
+		t.lock.Unlock()
+	}()
+
+	for {
+		var done bool
+		if done, err = t.spillBatch(); done || err != nil {
+			return
+		}
+	}
+}
+
+// spillBatch moves up to tieredSpillBatch of the oldest entries in the hot
+// store to the cold store, returning true once there are none to move.
+func (t *TieredLogStore) spillBatch() (bool, error) {
+	t.spillLock.Lock()
+	defer t.spillLock.Unlock()
+
+	first, err := t.hot.FirstIndex()
+	if err != nil {
+		return false, err
+	}
+	last, err := t.hot.LastIndex()
+	if err != nil {
+		return false, err
+	}
+	if first == 0 || last-first+1 <= t.hotEntries {
+		return true, nil
+	}
+	upTo := last - t.hotEntries
+	if upTo-first+1 > tieredSpillBatch {
+		upTo = first + tieredSpillBatch - 1
+	}
+
+	logs := make([]*Log, 0, upTo-first+1)
+	for index := first; index <= upTo; index++ {
+		log := new(Log)
+		if err := t.hot.GetLog(index, log); err != nil {
+			return false, err
+		}
+		logs = append(logs, log)
+	}
+	// The entries are in the cold store before they leave the hot one, so
+	// reads always find them in one or the other.
+	if err := t.cold.StoreLogs(logs); err != nil {
+		return false, err
+	}
+	if err := t.hot.DeleteRange(first, upTo); err != nil {
+		return false, err
+	}
+	metrics.IncrCounter([]string{"raft", "tieredLogStore", "spilled"}, float32(len(logs)))
+	return false, nil
+}
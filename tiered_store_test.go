@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingLogStore is a LogStore whose writes fail once fail is set.
+type failingLogStore struct {
+	*InmemStore
+	fail bool
+}
+
+func (f *failingLogStore) StoreLogs(logs []*Log) error {
+	if f.fail {
+		return errors.New("disk failed")
+	}
+	return f.InmemStore.StoreLogs(logs)
+}
+
+// hotCount returns how many entries a store holds.
+func hotCount(t *testing.T, store LogStore) uint64 {
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	if first == 0 {
+		return 0
+	}
+	return last - first + 1
+}
+
+func TestTieredLogStore(t *testing.T) {
+	_, err := NewTieredLogStore(NewInmemStore(), NewInmemStore(), 0)
+	require.Error(t, err)
+
+	hot, cold := NewInmemStore(), NewInmemStore()
+	store, err := NewTieredLogStore(hot, cold, 10)
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= 100; i++ {
+		require.NoError(t, store.StoreLog(&Log{Index: i, Term: 1, Data: []byte{byte(i)}}))
+	}
+	retry(t, func() bool { return hotCount(t, hot) == 10 })
+
+	// Reads span both tiers.
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), last)
+	coldLast, err := cold.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), coldLast)
+	for i := uint64(1); i <= 100; i++ {
+		var entry Log
+		require.NoError(t, store.GetLog(i, &entry))
+		require.Equal(t, []byte{byte(i)}, entry.Data)
+	}
+	var entry Log
+	require.ErrorIs(t, store.GetLog(101, &entry), ErrLogNotFound)
+
+	// Compacting the prefix and truncating the suffix cover both tiers.
+	require.NoError(t, store.DeleteRange(1, 50))
+	require.NoError(t, store.DeleteRange(85, 100))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(51), first)
+	last, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(84), last)
+	require.Zero(t, hotCount(t, hot))
+
+	// New entries after a truncation go to the hot store again.
+	require.NoError(t, store.StoreLog(&Log{Index: 85, Term: 2}))
+	require.NoError(t, store.GetLog(85, &entry))
+	require.Equal(t, uint64(2), entry.Term)
+}
+
+func TestTieredLogStore_SpillError(t *testing.T) {
+	cold := &failingLogStore{InmemStore: NewInmemStore(), fail: true}
+	store, err := NewTieredLogStore(NewInmemStore(), cold, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, store.StoreLogs([]*Log{{Index: 1}, {Index: 2}}))
+	retry(t, func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return store.spillErr != nil
+	})
+
+	// The failure is returned by the next write, and then cleared.
+	require.ErrorContains(t, store.StoreLog(&Log{Index: 3}), "disk failed")
+	cold.fail = false
+	require.NoError(t, store.StoreLog(&Log{Index: 3}))
+}
+
+func TestRaft_TieredLogStore(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LocalID = "tiered"
+	hot, cold := NewInmemStore(), NewInmemStore()
+	store, err := NewTieredLogStore(hot, cold, 16)
+	require.NoError(t, err)
+	stable := NewInmemStore()
+	snaps := NewInmemSnapshotStore()
+	addr, trans := NewInmemTransport("")
+	configuration := Configuration{Servers: []Server{{Suffrage: Voter, ID: conf.LocalID, Address: addr}}}
+	require.NoError(t, BootstrapCluster(conf, store, stable, snaps, trans, configuration))
+
+	fsm := &MockFSM{}
+	r, err := NewRaft(conf, fsm, store, stable, snaps, trans)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, r.Shutdown().Error()) }()
+	retry(t, func() bool { return r.State() == Leader })
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, r.Apply([]byte("test"), 0).Error())
+	}
+	require.Len(t, fsm.Logs(), 100)
+	retry(t, func() bool { return hotCount(t, hot) == 16 })
+	require.NotZero(t, hotCount(t, cold))
+}
@@ -0,0 +1,113 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// ErrPeerIdentityMismatch is returned when a peer's TLS certificate doesn't
+// match the identity pinned for it.
+var ErrPeerIdentityMismatch = errors.New("peer certificate doesn't match pinned identity")
+
+// PeerIdentity is the identity a peer's TLS certificate is expected to carry.
+// A certificate matches if it has any of the fingerprints or SPIFFE IDs.
+type PeerIdentity struct {
+	// Fingerprints are hex encoded SHA-256 digests of the peer's DER encoded
+	// certificate. Case and colons are ignored.
+	Fingerprints []string
+
+	// SPIFFEIDs are URIs, such as spiffe://example.org/raft/node1, expected
+	// among the certificate's URI subject alternative names. Anyone can
+	// issue themselves a certificate claiming one, so they only match
+	// certificates whose chain the TLS handshake verified, which requires
+	// tls.RequireAndVerifyClientCert on servers and rules out
+	// InsecureSkipVerify on clients.
+	SPIFFEIDs []string
+}
+
+// PeerPins pins the identities that peers must present over TLS, keyed by
+// their address. Its methods can be used as tls.Config.VerifyConnection, so
+// that a connection to or from a host presenting any other identity is
+// rejected even if its certificate is otherwise valid.
+type PeerPins map[ServerAddress]PeerIdentity
+
+// VerifyPeer returns a function for tls.Config.VerifyConnection that rejects
+// a connection to addr unless the peer's certificate matches the identity
+// pinned for addr. Peers that have no pin are rejected.
+func (p PeerPins) VerifyPeer(addr ServerAddress) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		id, ok := p[addr]
+		if !ok {
+			return fmt.Errorf("%w: no identity pinned for %s", ErrPeerIdentityMismatch, addr)
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: %s presented no certificate", ErrPeerIdentityMismatch, addr)
+		}
+		if !id.matches(cs.PeerCertificates[0], len(cs.VerifiedChains) > 0) {
+			return fmt.Errorf("%w: %s", ErrPeerIdentityMismatch, addr)
+		}
+		return nil
+	}
+}
+
+// VerifyAnyPeer can be used as tls.Config.VerifyConnection where the peer's
+// address isn't known, such as for connections accepted from other servers.
+// It rejects a connection unless the peer's certificate matches one of the
+// pinned identities, so the server should also require client certificates,
+// and verify them if any SPIFFE IDs are pinned.
+func (p PeerPins) VerifyAnyPeer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: peer presented no certificate", ErrPeerIdentityMismatch)
+	}
+	cert := cs.PeerCertificates[0]
+	for _, id := range p {
+		if id.matches(cert, len(cs.VerifiedChains) > 0) {
+			return nil
+		}
+	}
+	return ErrPeerIdentityMismatch
+}
+
+// matches reports whether cert carries this identity. SPIFFE IDs are only
+// matched if verified is set, meaning the certificate's chain was verified.
+func (id PeerIdentity) matches(cert *x509.Certificate, verified bool) bool {
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	for _, f := range id.Fingerprints {
+		if strings.EqualFold(strings.ReplaceAll(f, ":", ""), fingerprint) {
+			return true
+		}
+	}
+	if !verified {
+		return false
+	}
+	for _, spiffeID := range id.SPIFFEIDs {
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" && uri.String() == spiffeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasSPIFFEIDs reports whether any of the pinned identities are SPIFFE IDs.
+func (p PeerPins) hasSPIFFEIDs() bool {
+	for _, id := range p {
+		if len(id.SPIFFEIDs) > 0 {
+			return true
+		}
+	}
+	return false
+}
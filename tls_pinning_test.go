@@ -0,0 +1,169 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, with the
+// given SPIFFE ID if it isn't empty.
+func testCertificate(t *testing.T, spiffeID string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if spiffeID != "" {
+		u, err := url.Parse(spiffeID)
+		require.NoError(t, err)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func fingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// pinnedHandshake connects a client to a server over loopback, with each
+// verifying the other using pins, and returns the client's and server's
+// errors. Certificate chains are verified against roots, unless it's nil.
+func pinnedHandshake(t *testing.T, pins PeerPins, addr ServerAddress, client, server tls.Certificate,
+	roots *x509.CertPool) (error, error) {
+	t.Helper()
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer list.Close()
+
+	serverConfig := &tls.Config{
+		Certificates:     []tls.Certificate{server},
+		ClientAuth:       tls.RequireAnyClientCert,
+		VerifyConnection: pins.VerifyAnyPeer,
+	}
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{client},
+		InsecureSkipVerify: true,
+		VerifyConnection:   pins.VerifyPeer(addr),
+	}
+	if roots != nil {
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		serverConfig.ClientCAs = roots
+		clientConfig.InsecureSkipVerify = false
+		clientConfig.RootCAs = roots
+		clientConfig.ServerName = "127.0.0.1"
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- tls.Server(conn, serverConfig).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", list.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	clientErr := tls.Client(conn, clientConfig).Handshake()
+	if clientErr != nil {
+		conn.Close()
+	}
+	return clientErr, <-errCh
+}
+
+func TestPeerPins(t *testing.T) {
+	node1 := testCertificate(t, "spiffe://example.org/raft/node1")
+	node2 := testCertificate(t, "")
+	rogue := testCertificate(t, "spiffe://example.org/raft/rogue")
+	roots := x509.NewCertPool()
+	for _, cert := range []tls.Certificate{node1, node2, rogue} {
+		roots.AddCert(cert.Leaf)
+	}
+
+	pins := PeerPins{
+		"node1:8300": {SPIFFEIDs: []string{"spiffe://example.org/raft/node1"}},
+		"node2:8300": {Fingerprints: []string{fingerprint(node2)}},
+	}
+
+	// Pinned identities are accepted both ways.
+	clientErr, serverErr := pinnedHandshake(t, pins, "node1:8300", node2, node1, roots)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+	clientErr, serverErr = pinnedHandshake(t, pins, "node2:8300", node1, node2, roots)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	// The client rejects a server presenting another peer's identity.
+	clientErr, _ = pinnedHandshake(t, pins, "node2:8300", node1, node1, roots)
+	require.ErrorIs(t, clientErr, ErrPeerIdentityMismatch)
+
+	// And a server with no pin.
+	clientErr, _ = pinnedHandshake(t, pins, "node3:8300", node1, node2, roots)
+	require.ErrorIs(t, clientErr, ErrPeerIdentityMismatch)
+
+	// The server rejects a client that isn't pinned.
+	_, serverErr = pinnedHandshake(t, pins, "node1:8300", rogue, node1, roots)
+	require.ErrorIs(t, serverErr, ErrPeerIdentityMismatch)
+
+	// Without verifying chains, a fingerprint is still enough, but a
+	// certificate merely claiming a pinned SPIFFE ID isn't.
+	impostor := testCertificate(t, "spiffe://example.org/raft/node1")
+	clientErr, serverErr = pinnedHandshake(t, pins, "node2:8300", node2, node2, nil)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+	clientErr, _ = pinnedHandshake(t, pins, "node1:8300", node2, impostor, nil)
+	require.ErrorIs(t, clientErr, ErrPeerIdentityMismatch)
+	_, serverErr = pinnedHandshake(t, pins, "node2:8300", impostor, node2, nil)
+	require.ErrorIs(t, serverErr, ErrPeerIdentityMismatch)
+}
+
+func TestPeerIdentity_Fingerprint(t *testing.T) {
+	cert := testCertificate(t, "")
+	f := fingerprint(cert)
+
+	// Colon separated, upper case fingerprints match too.
+	var colons string
+	for i := 0; i < len(f); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += f[i : i+2]
+	}
+	id := PeerIdentity{Fingerprints: []string{strings.ToUpper(colons)}}
+	require.True(t, id.matches(cert.Leaf, false))
+	require.False(t, PeerIdentity{Fingerprints: []string{fingerprint(testCertificate(t, ""))}}.matches(cert.Leaf, false))
+}
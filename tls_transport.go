@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// TLSStreamLayer implements the StreamLayer interface over TCP connections
+// secured with TLS. The RPC framing used by NetworkTransport is unchanged.
+type TLSStreamLayer struct {
+	tcp          *TCPStreamLayer
+	serverConfig *tls.Config
+	clientConfig *tls.Config
+	pins         PeerPins
+}
+
+// NewTLSStreamLayer returns a TLSStreamLayer listening on bindAddr, for use
+// with NewNetworkTransport and friends. config is used both for accepting
+// connections, so it must include a certificate, and for dialing other
+// servers. Set its ClientAuth to have other servers' client certificates
+// verified too. Unless config sets a ServerName, the host of the address
+// being dialed is used to verify the server's certificate.
+//
+// If pins isn't nil, connections are also checked against the pinned
+// identities: a dialed server must present the identity pinned for its
+// address and an accepted client must present one of the pinned identities,
+// which implies requiring client certificates, and verifying them against
+// config's ClientCAs if any SPIFFE IDs are pinned.
+func NewTLSStreamLayer(bindAddr string, advertise net.Addr, config *tls.Config, pins PeerPins) (*TLSStreamLayer, error) {
+	if config == nil {
+		return nil, errors.New("TLS config is required")
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, errors.New("TLS config must include a certificate")
+	}
+	tcp, err := newTCPStreamLayer(bindAddr, advertise)
+	if err != nil {
+		return nil, err
+	}
+
+	serverConfig := config.Clone()
+	if pins != nil {
+		// SPIFFE IDs can only be trusted on verified certificates, while
+		// fingerprints pin the certificate itself.
+		clientAuth := tls.RequireAnyClientCert
+		if pins.hasSPIFFEIDs() {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+		if serverConfig.ClientAuth < clientAuth {
+			serverConfig.ClientAuth = clientAuth
+		}
+		serverConfig.VerifyConnection = chainVerifyConnection(config.VerifyConnection, pins.VerifyAnyPeer)
+	}
+	return &TLSStreamLayer{
+		tcp:          tcp,
+		serverConfig: serverConfig,
+		clientConfig: config.Clone(),
+		pins:         pins,
+	}, nil
+}
+
+// chainVerifyConnection returns a VerifyConnection callback that runs first,
+// if it's set, and then second.
+func chainVerifyConnection(first, second func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	if first == nil {
+		return second
+	}
+	return func(cs tls.ConnectionState) error {
+		if err := first(cs); err != nil {
+			return err
+		}
+		return second(cs)
+	}
+}
+
+// Dial implements the StreamLayer interface. The TLS handshake is completed
+// before returning, within the same timeout as the connection.
+func (t *TLSStreamLayer) Dial(address ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.tcp.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	config := t.clientConfig
+	if config.ServerName == "" || t.pins != nil {
+		config = config.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(string(address)); err == nil {
+				config.ServerName = host
+			}
+		}
+		if t.pins != nil {
+			config.VerifyConnection = chainVerifyConnection(config.VerifyConnection, t.pins.VerifyPeer(address))
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Accept implements the net.Listener interface. The TLS handshake happens on
+// the first read or write, so a slow client doesn't hold up other
+// connections.
+func (t *TLSStreamLayer) Accept() (net.Conn, error) {
+	conn, err := t.tcp.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, t.serverConfig), nil
+}
+
+// Close implements the net.Listener interface.
+func (t *TLSStreamLayer) Close() error {
+	return t.tcp.Close()
+}
+
+// Addr implements the net.Listener interface.
+func (t *TLSStreamLayer) Addr() net.Addr {
+	return t.tcp.Addr()
+}
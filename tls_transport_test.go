@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTLSTransport returns a NetworkTransport using a TLSStreamLayer with
+// cert, trusting the certificates in roots.
+func makeTLSTransport(t *testing.T, cert tls.Certificate, roots *x509.CertPool, pins PeerPins) *NetworkTransport {
+	t.Helper()
+	stream, err := NewTLSStreamLayer("127.0.0.1:0", nil, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, pins)
+	require.NoError(t, err)
+	// Rejected handshakes are logged by the accepting side, possibly after
+	// the test has finished.
+	trans := NewNetworkTransportWithLogger(stream, 2, time.Second, hclog.NewNullLogger())
+	t.Cleanup(func() { trans.Close() })
+	return trans
+}
+
+func TestTLSStreamLayer_AppendEntries(t *testing.T) {
+	cert1 := testCertificate(t, "")
+	cert2 := testCertificate(t, "")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert1.Leaf)
+	roots.AddCert(cert2.Leaf)
+
+	trans1 := makeTLSTransport(t, cert1, roots, nil)
+	trans2 := makeTLSTransport(t, cert2, roots, nil)
+
+	args := makeAppendRPC()
+	resp := makeAppendRPCResponse()
+	go func() {
+		select {
+		case rpc := <-trans1.Consumer():
+			rpc.Respond(&resp, nil)
+		case <-time.After(time.Second):
+			t.Errorf("timeout")
+		}
+	}()
+
+	var out AppendEntriesResponse
+	require.NoError(t, trans2.AppendEntries("id1", trans1.LocalAddr(), &args, &out))
+	require.Equal(t, resp, out)
+
+	// A server with an untrusted certificate is rejected.
+	untrusted := makeTLSTransport(t, testCertificate(t, ""), roots, nil)
+	require.Error(t, trans2.AppendEntries("id3", untrusted.LocalAddr(), &args, &out))
+}
+
+func TestTLSStreamLayer_Pinning(t *testing.T) {
+	cert1 := testCertificate(t, "spiffe://example.org/raft/node1")
+	cert2 := testCertificate(t, "spiffe://example.org/raft/node2")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert1.Leaf)
+	roots.AddCert(cert2.Leaf)
+
+	// The second server only accepts clients pinned by the first, and the
+	// first only dials servers it has pinned.
+	trans2 := makeTLSTransport(t, cert2, roots, PeerPins{
+		"127.0.0.1:1": {SPIFFEIDs: []string{"spiffe://example.org/raft/node1"}},
+	})
+	trans1 := makeTLSTransport(t, cert1, roots, PeerPins{
+		trans2.LocalAddr(): {SPIFFEIDs: []string{"spiffe://example.org/raft/node2"}},
+	})
+	go func() {
+		select {
+		case rpc := <-trans2.Consumer():
+			rpc.Respond(&AppendEntriesResponse{}, nil)
+		case <-time.After(time.Second):
+			t.Errorf("timeout")
+		}
+	}()
+	args := makeAppendRPC()
+	var out AppendEntriesResponse
+	require.NoError(t, trans1.AppendEntries("id2", trans2.LocalAddr(), &args, &out))
+
+	// A server presenting another identity than the one pinned for its
+	// address is rejected.
+	trans3 := makeTLSTransport(t, cert2, roots, nil)
+	err := trans1.AppendEntries("id3", trans3.LocalAddr(), &args, &out)
+	require.ErrorIs(t, err, ErrPeerIdentityMismatch)
+}
+
+func TestNewTLSStreamLayer_NoCertificate(t *testing.T) {
+	_, err := NewTLSStreamLayer("127.0.0.1:0", nil, &tls.Config{}, nil)
+	require.Error(t, err)
+}
+
+func TestNewTLSStreamLayer_PinsRequireClientCerts(t *testing.T) {
+	cert := testCertificate(t, "")
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// Fingerprints pin the certificate itself, but SPIFFE IDs can only be
+	// trusted on verified certificates.
+	stream, err := NewTLSStreamLayer("127.0.0.1:0", nil, config, PeerPins{
+		"node1:8300": {Fingerprints: []string{fingerprint(cert)}},
+	})
+	require.NoError(t, err)
+	defer stream.Close()
+	require.Equal(t, tls.RequireAnyClientCert, stream.serverConfig.ClientAuth)
+
+	stream, err = NewTLSStreamLayer("127.0.0.1:0", nil, config, PeerPins{
+		"node1:8300": {SPIFFEIDs: []string{"spiffe://example.org/raft/node1"}},
+	})
+	require.NoError(t, err)
+	defer stream.Close()
+	require.Equal(t, tls.RequireAndVerifyClientCert, stream.serverConfig.ClientAuth)
+}
@@ -19,6 +19,12 @@ type RPC struct {
 	Command  interface{}
 	Reader   io.Reader // Set only for InstallSnapshot
 	RespChan chan<- RPCResponse
+
+	// From is where the transport received the RPC from, such as the remote
+	// address of the connection it arrived on, or empty if the transport
+	// doesn't know. Unlike the addresses in the RPC's header, it isn't
+	// chosen by the sender.
+	From ServerAddress
 }
 
 // Respond is used to respond with a response, error or both
@@ -28,6 +34,9 @@ func (r *RPC) Respond(resp interface{}, err error) {
 
 // Transport provides an interface for network transports
 // to allow Raft to communicate with other nodes.
+//
+// TransportV2 is the shape this is expected to take in the next major
+// version. NewTransportV2 and TransportFromV2 convert between the two.
 type Transport interface {
 	// Consumer returns a channel that can be used to
 	// consume and respond to RPC requests.
@@ -60,6 +69,7 @@ type Transport interface {
 	// as a fast-pass. This is to avoid head-of-line blocking from
 	// disk IO. If a Transport does not support this, it can simply
 	// ignore the call, and push the heartbeat onto the Consumer channel.
+	// StatusRequests may be passed to the handler as well.
 	SetHeartbeatHandler(cb func(rpc RPC))
 
 	// TimeoutNow is used to start a leadership transfer to the target node.
@@ -78,6 +88,43 @@ type WithClose interface {
 	Close() error
 }
 
+// WithPreVote is an interface that a transport may provide which allows
+// candidates to run a pre-vote before starting an election. Raft only uses
+// pre-vote when Config.PreVote is set and the transport implements this.
+//
+// Experimental: see docs/api_stability.md.
+type WithPreVote interface {
+	// RequestPreVote sends the appropriate RPC to the target node.
+	RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error
+}
+
+// WithStatus is an interface that a transport may provide which allows
+// health checkers to ask a server for its Status.
+//
+// Experimental: see docs/api_stability.md.
+type WithStatus interface {
+	// Status sends the appropriate RPC to the target node.
+	Status(id ServerID, target ServerAddress, args *StatusRequest, resp *StatusResponse) error
+}
+
+// WithJoin is an interface that a transport may provide which allows a server
+// to ask to be added to the cluster, see Config.RetryJoin.
+//
+// Experimental: see docs/api_stability.md.
+type WithJoin interface {
+	// Join sends the appropriate RPC to the target node.
+	Join(id ServerID, target ServerAddress, args *JoinRequest, resp *JoinResponse) error
+}
+
+// WithLeave is an interface that a transport may provide which allows a server
+// to ask the leader to remove it from the cluster, see Raft.Leave.
+//
+// Experimental: see docs/api_stability.md.
+type WithLeave interface {
+	// Leave sends the appropriate RPC to the target node.
+	Leave(id ServerID, target ServerAddress, args *LeaveRequest, resp *LeaveResponse) error
+}
+
 // LoopbackTransport is an interface that provides a loopback transport suitable for testing
 // e.g. InmemTransport. It's there so we don't have to rewrite tests.
 type LoopbackTransport interface {
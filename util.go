@@ -4,9 +4,12 @@
 package raft
 
 import (
+	"bufio"
 	"bytes"
 	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"math/rand"
@@ -139,6 +142,55 @@ func encodeMsgPack(in interface{}) (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// maxPrefixedSize bounds the length readPrefixed accepts, so a corrupt
+// snapshot can't force a huge allocation.
+const maxPrefixedSize = 256 << 20
+
+// appendPrefixed appends magic, then field prefixed by its length, to buf.
+// This is how commands and snapshots are framed when Raft or one of its FSM
+// wrappers adds its own data to them; magic tells them apart from data
+// framed some other way, and may be empty where that can't happen.
+func appendPrefixed(buf, magic, field []byte) []byte {
+	buf = append(buf, magic...)
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	return append(buf, field...)
+}
+
+// splitPrefixed splits data framed by appendPrefixed into the field and
+// whatever follows it. It returns false if data doesn't start with magic or
+// is cut short.
+func splitPrefixed(data, magic []byte) ([]byte, []byte, bool) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, nil, false
+	}
+	rest := data[len(magic):]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n {
+		return nil, nil, false
+	}
+	rest = rest[size:]
+	return rest[:n], rest[n:], true
+}
+
+// readPrefixed reads a field framed by appendPrefixed, after the magic, from
+// r. It returns io.EOF only if r is already at its end.
+func readPrefixed(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxPrefixedSize {
+		return nil, fmt.Errorf("length of %d bytes is over the limit of %d", n, maxPrefixedSize)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 // backoff is used to compute an exponential backoff
 // duration. Base time is scaled by the current round,
 // up to some maximum scale factor.
@@ -171,6 +223,53 @@ func cappedExponentialBackoff(base time.Duration, round, limit uint64, cap time.
 // Needed for sorting []uint64, used to determine commitment
 type uint64Slice []uint64
 
+// abortableReader wraps a reader so that a long running stream, such as a
+// snapshot being sent or received, stops as soon as one of the abort channels
+// is closed instead of running to completion.
+type abortableReader struct {
+	r io.Reader
+
+	// abortCh and shutdownCh may be nil, in which case they're never ready.
+	abortCh    <-chan struct{}
+	abortErr   error
+	shutdownCh <-chan struct{}
+
+	// abortFn, if not nil, is called before each read and stops the stream
+	// with the error it returns, if any.
+	abortFn func() error
+
+	// limiter, if not nil, paces reads to its rate.
+	limiter *snapshotIOLimiter
+}
+
+func (a *abortableReader) Read(p []byte) (int, error) {
+	select {
+	case <-a.abortCh:
+		return 0, a.abortErr
+	case <-a.shutdownCh:
+		return 0, ErrRaftShutdown
+	default:
+	}
+	if a.abortFn != nil {
+		if err := a.abortFn(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := a.r.Read(p)
+	if a.limiter != nil && n > 0 {
+		if wait := a.limiter.reserve(n, time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-a.abortCh:
+				return n, a.abortErr
+			case <-a.shutdownCh:
+				return n, ErrRaftShutdown
+			}
+		}
+	}
+	return n, err
+}
+
 func (p uint64Slice) Len() int           { return len(p) }
 func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -4,7 +4,10 @@
 package raft
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"io"
 	"regexp"
 	"testing"
 	"time"
@@ -166,3 +169,67 @@ func TestOverrideNotifyBool(t *testing.T) {
 	default:
 	}
 }
+
+func TestAbortableReader(t *testing.T) {
+	abortCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	r := &abortableReader{
+		r:          bytes.NewReader([]byte("hello world")),
+		abortCh:    abortCh,
+		abortErr:   ErrLeadershipLost,
+		shutdownCh: shutdownCh,
+	}
+
+	buf := make([]byte, 5)
+	if n, err := r.Read(buf); err != nil || n != 5 {
+		t.Fatalf("unexpected read: %d %v", n, err)
+	}
+
+	close(abortCh)
+	if _, err := r.Read(buf); err != ErrLeadershipLost {
+		t.Fatalf("expected ErrLeadershipLost, got %v", err)
+	}
+
+	// A nil abort channel is never ready, so only shutdown stops the read.
+	r = &abortableReader{r: bytes.NewReader([]byte("hello")), shutdownCh: shutdownCh}
+	if n, err := r.Read(buf); err != nil || n != 5 {
+		t.Fatalf("unexpected read: %d %v", n, err)
+	}
+	close(shutdownCh)
+	if _, err := r.Read(buf); err != ErrRaftShutdown {
+		t.Fatalf("expected ErrRaftShutdown, got %v", err)
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	magic := []byte{0xff, 'x'}
+	data := append(appendPrefixed(nil, magic, []byte("field")), "rest"...)
+	field, rest, ok := splitPrefixed(data, magic)
+	if !ok || string(field) != "field" || string(rest) != "rest" {
+		t.Fatalf("unexpected split: %q %q %v", field, rest, ok)
+	}
+	if _, _, ok := splitPrefixed(data, []byte{0xff, 'y'}); ok {
+		t.Fatalf("expected other magic not to match")
+	}
+	if _, _, ok := splitPrefixed(data[:5], magic); ok {
+		t.Fatalf("expected short data not to split")
+	}
+
+	r := bufio.NewReader(bytes.NewReader(appendPrefixed(nil, nil, []byte("field"))))
+	if field, err := readPrefixed(r); err != nil || string(field) != "field" {
+		t.Fatalf("unexpected read: %q %v", field, err)
+	}
+	if _, err := readPrefixed(r); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// A corrupt length fails instead of being allocated.
+	r = bufio.NewReader(bytes.NewReader(binary.AppendUvarint(nil, 1<<62)))
+	if _, err := readPrefixed(r); err == nil {
+		t.Fatalf("expected error for oversized length")
+	}
+	r = bufio.NewReader(bytes.NewReader(binary.AppendUvarint(nil, 10)))
+	if _, err := readPrefixed(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"io"
+)
+
+// This file holds the shapes Transport, LogStore and FSM are expected to take
+// in the next major version of this module, with shims converting between
+// them and the current interfaces so implementations can be migrated ahead of
+// it. Everything exported from this file is experimental: it may change or be
+// removed in a future release. See docs/api_stability.md.
+
+// LogStoreV2 is the expected next shape of LogStore. Every method takes a
+// context, and entries are read in batches as well as written in them.
+type LogStoreV2 interface {
+	// FirstIndex returns the first index written. 0 for no entries.
+	FirstIndex(ctx context.Context) (uint64, error)
+
+	// LastIndex returns the last index written. 0 for no entries.
+	LastIndex(ctx context.Context) (uint64, error)
+
+	// GetLogs returns the entries from min to max inclusive, in order. It
+	// returns ErrLogNotFound if any of them is missing.
+	GetLogs(ctx context.Context, min, max uint64) ([]*Log, error)
+
+	// StoreLogs stores multiple log entries, see LogStore.StoreLogs.
+	StoreLogs(ctx context.Context, logs []*Log) error
+
+	// DeleteRange deletes a range of log entries. The range is inclusive.
+	DeleteRange(ctx context.Context, min, max uint64) error
+}
+
+// NewLogStoreV2 returns store as a LogStoreV2. The context is checked before
+// each call to store, but can't interrupt one in progress.
+func NewLogStoreV2(store LogStore) LogStoreV2 {
+	if s, ok := store.(*logStoreFromV2); ok {
+		return s.store
+	}
+	return &logStoreV2{store: store}
+}
+
+// LogStoreFromV2 returns store as a LogStore, so it can be passed to NewRaft.
+// Calls are made with context.Background. If store implements
+// MonotonicLogStore, so does the result.
+func LogStoreFromV2(store LogStoreV2) LogStore {
+	if s, ok := store.(*logStoreV2); ok {
+		return s.store
+	}
+	return &logStoreFromV2{store: store}
+}
+
+type logStoreV2 struct {
+	store LogStore
+}
+
+func (s *logStoreV2) FirstIndex(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.store.FirstIndex()
+}
+
+func (s *logStoreV2) LastIndex(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.store.LastIndex()
+}
+
+func (s *logStoreV2) GetLogs(ctx context.Context, min, max uint64) ([]*Log, error) {
+	var logs []*Log
+	for index := min; index <= max && index >= min; index++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		l := new(Log)
+		if err := s.store.GetLog(index, l); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, nil
+}
+
+func (s *logStoreV2) StoreLogs(ctx context.Context, logs []*Log) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.StoreLogs(logs)
+}
+
+func (s *logStoreV2) DeleteRange(ctx context.Context, min, max uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.DeleteRange(min, max)
+}
+
+func (s *logStoreV2) IsMonotonic() bool {
+	return isMonotonic(s.store)
+}
+
+type logStoreFromV2 struct {
+	store LogStoreV2
+}
+
+func (s *logStoreFromV2) FirstIndex() (uint64, error) {
+	return s.store.FirstIndex(context.Background())
+}
+
+func (s *logStoreFromV2) LastIndex() (uint64, error) {
+	return s.store.LastIndex(context.Background())
+}
+
+func (s *logStoreFromV2) GetLog(index uint64, log *Log) error {
+	logs, err := s.store.GetLogs(context.Background(), index, index)
+	if err != nil {
+		return err
+	}
+	if len(logs) != 1 {
+		return ErrLogNotFound
+	}
+	*log = *logs[0]
+	return nil
+}
+
+func (s *logStoreFromV2) StoreLog(log *Log) error {
+	return s.store.StoreLogs(context.Background(), []*Log{log})
+}
+
+func (s *logStoreFromV2) StoreLogs(logs []*Log) error {
+	return s.store.StoreLogs(context.Background(), logs)
+}
+
+func (s *logStoreFromV2) DeleteRange(min, max uint64) error {
+	return s.store.DeleteRange(context.Background(), min, max)
+}
+
+func (s *logStoreFromV2) IsMonotonic() bool {
+	return isMonotonic(s.store)
+}
+
+func isMonotonic(store interface{}) bool {
+	m, ok := store.(MonotonicLogStore)
+	return ok && m.IsMonotonic()
+}
+
+// TransportV2 is the expected next shape of Transport. Every RPC takes a
+// context and the Server it's sent to, and WithClose and WithPreVote are
+// folded in. The other optional interfaces, such as WithStatus, remain
+// optional.
+type TransportV2 interface {
+	// Consumer returns a channel that can be used to
+	// consume and respond to RPC requests.
+	Consumer() <-chan RPC
+
+	// LocalAddr is used to return our local address to distinguish from our peers.
+	LocalAddr() ServerAddress
+
+	// AppendEntriesPipeline returns an interface that can be used to pipeline
+	// AppendEntries requests.
+	AppendEntriesPipeline(ctx context.Context, peer Server) (AppendPipeline, error)
+
+	// AppendEntries sends the appropriate RPC to peer.
+	AppendEntries(ctx context.Context, peer Server, args *AppendEntriesRequest, resp *AppendEntriesResponse) error
+
+	// RequestVote sends the appropriate RPC to peer.
+	RequestVote(ctx context.Context, peer Server, args *RequestVoteRequest, resp *RequestVoteResponse) error
+
+	// RequestPreVote sends the appropriate RPC to peer.
+	RequestPreVote(ctx context.Context, peer Server, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error
+
+	// InstallSnapshot is used to push a snapshot down to peer. The data is
+	// read from the Reader and streamed to it.
+	InstallSnapshot(ctx context.Context, peer Server, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error
+
+	// TimeoutNow is used to start a leadership transfer to peer.
+	TimeoutNow(ctx context.Context, peer Server, args *TimeoutNowRequest, resp *TimeoutNowResponse) error
+
+	// EncodePeer is used to serialize a peer's address.
+	EncodePeer(id ServerID, addr ServerAddress) []byte
+
+	// DecodePeer is used to deserialize a peer's address.
+	DecodePeer([]byte) ServerAddress
+
+	// SetHeartbeatHandler is used to setup a heartbeat handler, see
+	// Transport.SetHeartbeatHandler.
+	SetHeartbeatHandler(cb func(rpc RPC))
+
+	// Close permanently closes the transport, stopping
+	// any associated goroutines and freeing other resources.
+	Close() error
+}
+
+// NewTransportV2 returns trans as a TransportV2. The context is checked
+// before each call to trans, but can't interrupt one in progress.
+// RequestPreVote returns ErrUnsupportedProtocol if trans doesn't implement
+// WithPreVote, and Close does nothing if it doesn't implement WithClose.
+func NewTransportV2(trans Transport) TransportV2 {
+	if t, ok := trans.(*transportFromV2); ok {
+		return t.trans
+	}
+	return &transportV2{trans: trans}
+}
+
+// TransportFromV2 returns trans as a Transport, so it can be passed to
+// NewRaft. Calls are made with context.Background and a Server holding just
+// the ID and address raft passes. The result implements WithClose and
+// WithPreVote, so raft uses pre-vote if Config.PreVote is set.
+func TransportFromV2(trans TransportV2) Transport {
+	if t, ok := trans.(*transportV2); ok {
+		return t.trans
+	}
+	return &transportFromV2{trans: trans}
+}
+
+type transportV2 struct {
+	trans Transport
+}
+
+func (t *transportV2) Consumer() <-chan RPC {
+	return t.trans.Consumer()
+}
+
+func (t *transportV2) LocalAddr() ServerAddress {
+	return t.trans.LocalAddr()
+}
+
+func (t *transportV2) AppendEntriesPipeline(ctx context.Context, peer Server) (AppendPipeline, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.trans.AppendEntriesPipeline(peer.ID, peer.Address)
+}
+
+func (t *transportV2) AppendEntries(ctx context.Context, peer Server, args *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.trans.AppendEntries(peer.ID, peer.Address, args, resp)
+}
+
+func (t *transportV2) RequestVote(ctx context.Context, peer Server, args *RequestVoteRequest, resp *RequestVoteResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.trans.RequestVote(peer.ID, peer.Address, args, resp)
+}
+
+func (t *transportV2) RequestPreVote(ctx context.Context, peer Server, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pt, ok := t.trans.(WithPreVote)
+	if !ok {
+		return ErrUnsupportedProtocol
+	}
+	return pt.RequestPreVote(peer.ID, peer.Address, args, resp)
+}
+
+func (t *transportV2) InstallSnapshot(ctx context.Context, peer Server, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.trans.InstallSnapshot(peer.ID, peer.Address, args, resp, data)
+}
+
+func (t *transportV2) TimeoutNow(ctx context.Context, peer Server, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.trans.TimeoutNow(peer.ID, peer.Address, args, resp)
+}
+
+func (t *transportV2) EncodePeer(id ServerID, addr ServerAddress) []byte {
+	return t.trans.EncodePeer(id, addr)
+}
+
+func (t *transportV2) DecodePeer(buf []byte) ServerAddress {
+	return t.trans.DecodePeer(buf)
+}
+
+func (t *transportV2) SetHeartbeatHandler(cb func(rpc RPC)) {
+	t.trans.SetHeartbeatHandler(cb)
+}
+
+func (t *transportV2) Close() error {
+	if closer, ok := t.trans.(WithClose); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type transportFromV2 struct {
+	trans TransportV2
+}
+
+func (t *transportFromV2) Consumer() <-chan RPC {
+	return t.trans.Consumer()
+}
+
+func (t *transportFromV2) LocalAddr() ServerAddress {
+	return t.trans.LocalAddr()
+}
+
+func (t *transportFromV2) AppendEntriesPipeline(id ServerID, target ServerAddress) (AppendPipeline, error) {
+	return t.trans.AppendEntriesPipeline(context.Background(), Server{ID: id, Address: target})
+}
+
+func (t *transportFromV2) AppendEntries(id ServerID, target ServerAddress, args *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	return t.trans.AppendEntries(context.Background(), Server{ID: id, Address: target}, args, resp)
+}
+
+func (t *transportFromV2) RequestVote(id ServerID, target ServerAddress, args *RequestVoteRequest, resp *RequestVoteResponse) error {
+	return t.trans.RequestVote(context.Background(), Server{ID: id, Address: target}, args, resp)
+}
+
+func (t *transportFromV2) RequestPreVote(id ServerID, target ServerAddress, args *RequestPreVoteRequest, resp *RequestPreVoteResponse) error {
+	return t.trans.RequestPreVote(context.Background(), Server{ID: id, Address: target}, args, resp)
+}
+
+func (t *transportFromV2) InstallSnapshot(id ServerID, target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error {
+	return t.trans.InstallSnapshot(context.Background(), Server{ID: id, Address: target}, args, resp, data)
+}
+
+func (t *transportFromV2) TimeoutNow(id ServerID, target ServerAddress, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	return t.trans.TimeoutNow(context.Background(), Server{ID: id, Address: target}, args, resp)
+}
+
+func (t *transportFromV2) EncodePeer(id ServerID, addr ServerAddress) []byte {
+	return t.trans.EncodePeer(id, addr)
+}
+
+func (t *transportFromV2) DecodePeer(buf []byte) ServerAddress {
+	return t.trans.DecodePeer(buf)
+}
+
+func (t *transportFromV2) SetHeartbeatHandler(cb func(rpc RPC)) {
+	t.trans.SetHeartbeatHandler(cb)
+}
+
+func (t *transportFromV2) Close() error {
+	return t.trans.Close()
+}
+
+// FSMV2 is the expected next shape of FSM, which is only given entries in
+// batches. It has the same methods as BatchingFSM, apart from Apply.
+type FSMV2 interface {
+	// ApplyBatch is invoked once a batch of log entries has been committed
+	// and is ready to be applied, see BatchingFSM.ApplyBatch.
+	ApplyBatch([]*Log) []interface{}
+
+	// Snapshot returns an FSMSnapshot, see FSM.Snapshot.
+	Snapshot() (FSMSnapshot, error)
+
+	// Restore is used to restore the FSM from a snapshot, see FSM.Restore.
+	Restore(snapshot io.ReadCloser) error
+}
+
+// NewFSMV2 returns fsm as an FSMV2. A BatchingFSM is returned as it is;
+// otherwise ApplyBatch calls Apply for each LogCommand entry and returns nil
+// for the others.
+func NewFSMV2(fsm FSM) FSMV2 {
+	if f, ok := fsm.(*fsmFromV2); ok {
+		return f.fsm
+	}
+	if batcher, ok := fsm.(BatchingFSM); ok {
+		return batcher
+	}
+	return &fsmV2{fsm: fsm}
+}
+
+// FSMFromV2 returns fsm as an FSM, so it can be passed to NewRaft. The result
+// implements BatchingFSM, so fsm is still given entries in batches. Optional
+// interfaces fsm implements, such as ExpiringFSM, aren't carried over; an FSM
+// needing them should implement FSM directly.
+func FSMFromV2(fsm FSMV2) FSM {
+	if f, ok := fsm.(*fsmV2); ok {
+		return f.fsm
+	}
+	if f, ok := fsm.(FSM); ok {
+		return f
+	}
+	return &fsmFromV2{fsm: fsm}
+}
+
+type fsmV2 struct {
+	fsm FSM
+}
+
+func (f *fsmV2) ApplyBatch(logs []*Log) []interface{} {
+	responses := make([]interface{}, len(logs))
+	for i, l := range logs {
+		if l.Type == LogCommand {
+			responses[i] = f.fsm.Apply(l)
+		}
+	}
+	return responses
+}
+
+func (f *fsmV2) Snapshot() (FSMSnapshot, error) {
+	return f.fsm.Snapshot()
+}
+
+func (f *fsmV2) Restore(snapshot io.ReadCloser) error {
+	return f.fsm.Restore(snapshot)
+}
+
+type fsmFromV2 struct {
+	fsm FSMV2
+}
+
+func (f *fsmFromV2) Apply(l *Log) interface{} {
+	return f.fsm.ApplyBatch([]*Log{l})[0]
+}
+
+func (f *fsmFromV2) ApplyBatch(logs []*Log) []interface{} {
+	return f.fsm.ApplyBatch(logs)
+}
+
+func (f *fsmFromV2) Snapshot() (FSMSnapshot, error) {
+	return f.fsm.Snapshot()
+}
+
+func (f *fsmFromV2) Restore(snapshot io.ReadCloser) error {
+	return f.fsm.Restore(snapshot)
+}
+
+// NewRaftV2 is NewRaft for implementations of the V2 interfaces. It converts
+// them with FSMFromV2, LogStoreFromV2 and TransportFromV2.
+func NewRaftV2(conf *Config, fsm FSMV2, logs LogStoreV2, stable StableStore, snaps SnapshotStore, trans TransportV2) (*Raft, error) {
+	return NewRaft(conf, FSMFromV2(fsm), LogStoreFromV2(logs), stable, snaps, TransportFromV2(trans))
+}
@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// batchOnlyFSM is an FSMV2 that doesn't also implement FSM, so FSMFromV2 has
+// to wrap it.
+type batchOnlyFSM struct {
+	fsm *MockFSM
+}
+
+func (f *batchOnlyFSM) ApplyBatch(logs []*Log) []interface{} {
+	responses := make([]interface{}, len(logs))
+	for i, l := range logs {
+		if l.Type == LogCommand {
+			responses[i] = f.fsm.Apply(l)
+		}
+	}
+	return responses
+}
+
+func (f *batchOnlyFSM) Snapshot() (FSMSnapshot, error) {
+	return f.fsm.Snapshot()
+}
+
+func (f *batchOnlyFSM) Restore(snapshot io.ReadCloser) error {
+	return f.fsm.Restore(snapshot)
+}
+
+func TestLogStoreV2(t *testing.T) {
+	store := NewInmemStore()
+	v2 := NewLogStoreV2(store)
+	ctx := context.Background()
+
+	require.NoError(t, v2.StoreLogs(ctx, []*Log{
+		{Index: 1, Term: 1, Data: []byte("a")},
+		{Index: 2, Term: 1, Data: []byte("b")},
+		{Index: 3, Term: 2, Data: []byte("c")},
+	}))
+	first, err := v2.FirstIndex(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	last, err := v2.LastIndex(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), last)
+
+	logs, err := v2.GetLogs(ctx, 2, 3)
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	require.Equal(t, []byte("b"), logs[0].Data)
+	require.Equal(t, []byte("c"), logs[1].Data)
+
+	_, err = v2.GetLogs(ctx, 3, 4)
+	require.ErrorIs(t, err, ErrLogNotFound)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = v2.GetLogs(cancelled, 1, 3)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, v2.DeleteRange(cancelled, 1, 3), context.Canceled)
+
+	// Converting back returns the original store, while a LogStoreV2
+	// implemented elsewhere is wrapped.
+	require.Same(t, store, LogStoreFromV2(v2))
+	wrapped := LogStoreFromV2(struct{ LogStoreV2 }{v2})
+	var l Log
+	require.NoError(t, wrapped.GetLog(1, &l))
+	require.Equal(t, []byte("a"), l.Data)
+	require.ErrorIs(t, wrapped.GetLog(4, &l), ErrLogNotFound)
+	require.NoError(t, wrapped.StoreLog(&Log{Index: 4, Term: 2}))
+	require.NoError(t, wrapped.DeleteRange(1, 2))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+	last, err = wrapped.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), last)
+}
+
+func TestTransportV2_Unsupported(t *testing.T) {
+	_, trans := NewInmemTransport("")
+	v2 := NewTransportV2(struct{ Transport }{trans})
+
+	// A Transport without the optional interfaces can't pre-vote, and
+	// closing it does nothing.
+	err := v2.RequestPreVote(context.Background(), Server{ID: "a", Address: "a"}, &RequestPreVoteRequest{}, &RequestPreVoteResponse{})
+	require.ErrorIs(t, err, ErrUnsupportedProtocol)
+	require.NoError(t, v2.Close())
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = v2.AppendEntries(cancelled, Server{ID: "a", Address: "a"}, &AppendEntriesRequest{}, &AppendEntriesResponse{})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRaft_NewRaftV2(t *testing.T) {
+	var rafts []*Raft
+	var fsms []*MockFSM
+	var transports []*InmemTransport
+	var servers []Server
+	for i := 0; i < 3; i++ {
+		addr, trans := NewInmemTransport("")
+		transports = append(transports, trans)
+		servers = append(servers, Server{Suffrage: Voter, ID: ServerID(fmt.Sprintf("server-%d", i)), Address: addr})
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	for i, trans := range transports {
+		conf := inmemConfig(t)
+		conf.LocalID = servers[i].ID
+		conf.PreVote = true
+		store := NewInmemStore()
+		fsm := &MockFSM{}
+
+		// Hide the V1 implementations behind the V2 interfaces so the
+		// servers run through the shims in both directions.
+		r, err := NewRaftV2(conf, &batchOnlyFSM{fsm},
+			struct{ LogStoreV2 }{NewLogStoreV2(store)}, store, NewInmemSnapshotStore(),
+			struct{ TransportV2 }{NewTransportV2(trans)})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Shutdown().Error()) }()
+		rafts = append(rafts, r)
+		fsms = append(fsms, fsm)
+	}
+	require.NoError(t, rafts[0].BootstrapCluster(Configuration{Servers: servers}).Error())
+
+	var leader *Raft
+	retry(t, func() bool {
+		for _, r := range rafts {
+			if r.State() == Leader {
+				leader = r
+				return true
+			}
+		}
+		return false
+	})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Apply([]byte(fmt.Sprintf("test%d", i)), time.Second).Error())
+	}
+	retry(t, func() bool {
+		for _, fsm := range fsms {
+			if len(fsm.Logs()) != 10 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A snapshot is taken through the wrapped FSM.
+	require.NoError(t, leader.Snapshot().Error())
+}
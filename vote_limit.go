@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// maxVoteLimitSources is how many sources the vote rate limiter tracks
+// before it forgets those that have been quiet long enough to be back at
+// their full allowance.
+const maxVoteLimitSources = 256
+
+// voteRateLimiter limits how often RequestVote RPCs are processed from each
+// source, using a token bucket per source. It's only used from the main
+// thread.
+type voteRateLimiter struct {
+	buckets map[string]*voteBucket
+}
+
+// voteBucket holds the requests a candidate may still make, as of last.
+type voteBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// voteLimitSource returns the source a RequestVote RPC is limited by. That's
+// the host the transport received it from, where the transport says, since
+// unlike the candidate's address in the request it isn't chosen by the
+// sender. The port is dropped so that opening new connections doesn't get a
+// sender a fresh allowance.
+func voteLimitSource(rpc RPC, candidate ServerAddress) string {
+	if rpc.From == "" {
+		return string(candidate)
+	}
+	if host, _, err := net.SplitHostPort(string(rpc.From)); err == nil {
+		return host
+	}
+	return string(rpc.From)
+}
+
+// voteBurst is how many requests a source may make at once for a given rate.
+// It's at least one, so that a rate below one per second still lets requests
+// through.
+func voteBurst(rate float64) float64 {
+	return math.Max(1, rate)
+}
+
+// allow reports whether a request from source may be processed, given a
+// limit of rate requests per second, in bursts of up to voteBurst(rate)
+// requests.
+func (l *voteRateLimiter) allow(source string, rate float64, now time.Time) bool {
+	if l.buckets == nil {
+		l.buckets = make(map[string]*voteBucket)
+	}
+	burst := voteBurst(rate)
+	b, ok := l.buckets[source]
+	if !ok {
+		if len(l.buckets) >= maxVoteLimitSources {
+			l.prune(rate, now)
+		}
+		b = &voteBucket{tokens: burst, last: now}
+		l.buckets[source] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the sources whose buckets have refilled, which makes no
+// difference to what's allowed.
+func (l *voteRateLimiter) prune(rate float64, now time.Time) {
+	burst := voteBurst(rate)
+	for source, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, source)
+		}
+	}
+}
+
+// voteHopeless reports whether a RequestVote would be denied because the
+// candidate doesn't have a vote or its log is behind ours, which are the
+// denials that don't depend on the vote we've recorded. This must only be
+// called from the main thread.
+func (r *Raft) voteHopeless(req *RequestVoteRequest) bool {
+	if len(req.ID) > 0 && len(r.configurations.latest.Servers) > 0 &&
+		!hasVote(r.configurations.latest, ServerID(req.ID)) {
+		return true
+	}
+	lastIdx, lastTerm := r.getLastEntry()
+	return lastTerm > req.LastLogTerm ||
+		(lastTerm == req.LastLogTerm && lastIdx > req.LastLogIndex)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVoteRateLimiter(t *testing.T) {
+	var l voteRateLimiter
+	now := time.Now()
+
+	// A burst of up to the rate is allowed, per source.
+	require.True(t, l.allow("a", 2, now))
+	require.True(t, l.allow("a", 2, now))
+	require.False(t, l.allow("a", 2, now))
+	require.True(t, l.allow("b", 2, now))
+
+	// The allowance refills over time.
+	require.False(t, l.allow("a", 2, now.Add(100*time.Millisecond)))
+	require.True(t, l.allow("a", 2, now.Add(600*time.Millisecond)))
+	require.False(t, l.allow("a", 2, now.Add(600*time.Millisecond)))
+
+	// Quiet sources are forgotten once there are too many.
+	later := now.Add(time.Hour)
+	for i := 0; i < maxVoteLimitSources; i++ {
+		l.allow(string(rune('c'+i)), 2, later)
+	}
+	require.LessOrEqual(t, len(l.buckets), maxVoteLimitSources)
+	require.NotContains(t, l.buckets, "a")
+
+	// A rate below one still allows one request at a time.
+	require.True(t, l.allow("slow", 0.5, now))
+	require.False(t, l.allow("slow", 0.5, now.Add(time.Second)))
+	require.True(t, l.allow("slow", 0.5, now.Add(2*time.Second)))
+}
+
+func TestVoteLimitSource(t *testing.T) {
+	require.Equal(t, "candidate", voteLimitSource(RPC{}, "candidate"))
+	require.Equal(t, "10.0.0.1", voteLimitSource(RPC{From: "10.0.0.1:51234"}, "candidate"))
+	require.Equal(t, "inmem", voteLimitSource(RPC{From: "inmem"}, "candidate"))
+}